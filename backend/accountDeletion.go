@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DeleteAccountRequest struct {
+	// ConfirmEmail must match the account email to confirm the deletion
+	ConfirmEmail string `json:"confirmEmail"`
+}
+
+// Schedule deletion of the authenticated user's account after a grace period
+func (us *UserService) DeleteAccount(c *gin.Context) {
+	user := currentUser(c)
+
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.ConfirmEmail), user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Confirmation email does not match"})
+		return
+	}
+
+	if user.DeletionScheduledAt != nil {
+		c.JSON(http.StatusAccepted, gin.H{"deletionScheduledAt": user.DeletionScheduledAt})
+		return
+	}
+
+	scheduledAt := time.Now().Add(us.deletionGracePeriod)
+	if _, err := us.db.Exec("UPDATE users SET deletion_scheduled_at = ? WHERE id = ?", scheduledAt, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule deletion"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"deletionScheduledAt": scheduledAt})
+}
+
+// Cancel a scheduled account deletion during the grace period
+func (us *UserService) CancelAccountDeletion(c *gin.Context) {
+	user := currentUser(c)
+
+	result, err := us.db.Exec("UPDATE users SET deletion_scheduled_at = NULL WHERE id = ? AND deletion_scheduled_at IS NOT NULL", user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel deletion"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No deletion is scheduled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deletion cancelled"})
+}
+
+// purgeScheduledDeletions deletes accounts whose grace period has ended.
+func (us *UserService) purgeScheduledDeletions() error {
+	rows, err := us.db.Query("SELECT id FROM users WHERE deletion_scheduled_at IS NOT NULL AND deletion_scheduled_at <= NOW()")
+	if err != nil {
+		return err
+	}
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		if err := us.purgeUser(userID); err != nil {
+			return err
+		}
+		log.Printf("Deleted account %s after grace period", userID)
+	}
+	return nil
+}
+
+// purgeUser removes every row and file tied to a user. Rows are deleted
+// explicitly instead of relying on foreign key cascades so nothing is left
+// behind when a table is added without one.
+func (us *UserService) purgeUser(userID string) error {
+	var avatar *string
+	if err := us.db.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&avatar); err != nil {
+		return err
+	}
+
+	exportIDs := []string{}
+	rows, err := us.db.Query("SELECT id FROM data_exports WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		exportIDs = append(exportIDs, id)
+	}
+	rows.Close()
+
+	// Workspaces without another owner go away with their last owner
+	orphaned, err := us.soleOwnerWorkspaces(userID)
+	if err != nil {
+		return err
+	}
+	for _, workspaceID := range orphaned {
+		if err := deleteWorkspace(us.db, workspaceID); err != nil {
+			return err
+		}
+	}
+
+	tx, err := us.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Chats in shared workspaces stay with the team under another owner
+	_, err = tx.Exec(`
+		UPDATE chats ch
+		JOIN workspace_members m ON m.workspace_id = ch.workspace_id AND m.role = ? AND m.user_id <> ?
+		SET ch.user_id = m.user_id
+		WHERE ch.user_id = ?
+	`, WorkspaceOwner, userID, userID)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		"DELETE m FROM messages m JOIN chats ch ON m.chat_id = ch.id WHERE ch.user_id = ?",
+		"DELETE FROM chats WHERE user_id = ?",
+		"UPDATE messages SET user_id = NULL WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM data_exports WHERE user_id = ?",
+		"UPDATE invite_codes SET created_by = NULL WHERE created_by = ?",
+		"UPDATE waitlist SET reviewed_by = NULL WHERE reviewed_by = ?",
+		"DELETE w FROM waitlist w JOIN users u ON w.email = u.email WHERE u.id = ?",
+		"DELETE FROM workspace_members WHERE user_id = ?",
+		"UPDATE workspaces SET created_by = NULL WHERE created_by = ?",
+		"UPDATE workspace_invitations SET invited_by = NULL WHERE invited_by = ?",
+		"DELETE i FROM workspace_invitations i JOIN users u ON i.email = u.email WHERE u.id = ?",
+		"DELETE FROM provider_keys WHERE user_id = ?",
+		"DELETE FROM mcp_servers WHERE user_id = ?",
+		"UPDATE model_policies SET updated_by = NULL WHERE updated_by = ?",
+		"DELETE FROM user_settings WHERE user_id = ?",
+		"DELETE FROM personas WHERE user_id = ?",
+		"UPDATE personas SET created_by = NULL WHERE created_by = ?",
+		"DELETE FROM prompt_templates WHERE user_id = ?",
+		"UPDATE prompt_templates SET created_by = NULL WHERE created_by = ?",
+		"DELETE FROM memories WHERE user_id = ?",
+		"DELETE FROM knowledge_bases WHERE user_id = ?",
+		"UPDATE knowledge_bases SET created_by = NULL WHERE created_by = ?",
+		"UPDATE knowledge_documents SET created_by = NULL WHERE created_by = ?",
+		// Attachments without a user are removed with their files by the cleanup job
+		"UPDATE attachments SET user_id = NULL WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Files go last so a failed transaction never leaves dangling rows
+	us.removeAvatarFile(avatar)
+	for _, id := range exportIDs {
+		os.Remove(us.exportPath(id))
+	}
+	return nil
+}
+
+// soleOwnerWorkspaces lists workspaces the user owns without a co-owner.
+func (us *UserService) soleOwnerWorkspaces(userID string) ([]int, error) {
+	rows, err := us.db.Query(`
+		SELECT m.workspace_id FROM workspace_members m
+		WHERE m.user_id = ? AND m.role = ? AND NOT EXISTS (
+			SELECT 1 FROM workspace_members o
+			WHERE o.workspace_id = m.workspace_id AND o.role = ? AND o.user_id <> m.user_id
+		)
+	`, userID, WorkspaceOwner, WorkspaceOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var workspaceIDs []int
+	for rows.Next() {
+		var workspaceID int
+		if err := rows.Scan(&workspaceID); err != nil {
+			return nil, err
+		}
+		workspaceIDs = append(workspaceIDs, workspaceID)
+	}
+	return workspaceIDs, rows.Err()
+}
+
+func deletionGracePeriod() time.Duration {
+	days, err := strconv.Atoi(getEnv("ACCOUNT_DELETION_GRACE_DAYS", "14"))
+	if err != nil || days < 0 {
+		days = 14
+	}
+	return time.Hour * 24 * time.Duration(days)
+}
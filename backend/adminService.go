@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminService struct {
+	db          *sql.DB
+	userService *UserService
+}
+
+type UserUsage struct {
+	UserID           string     `json:"userId"`
+	ChatCount        int        `json:"chatCount"`
+	MessageCount     int        `json:"messageCount"`
+	UserMessageCount int        `json:"userMessageCount"`
+	ActiveSessions   int        `json:"activeSessions"`
+	LastMessageAt    *time.Time `json:"lastMessageAt"`
+}
+
+func NewAdminService(db *sql.DB, userService *UserService) *AdminService {
+	return &AdminService{db: db, userService: userService}
+}
+
+// List users, optionally filtered by a search on email or name
+func (as *AdminService) ListUsers(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	query := `SELECT ` + userColumns + ` FROM users u`
+	countQuery := `SELECT COUNT(*) FROM users u`
+	args := []interface{}{}
+
+	if search := c.Query("q"); search != "" {
+		filter := ` WHERE u.email LIKE ? OR u.name LIKE ? OR u.display_name LIKE ?`
+		pattern := "%" + escapeLike(search) + "%"
+		query += filter
+		countQuery += filter
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	var total int
+	if err := as.db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count users"})
+		return
+	}
+
+	query += ` ORDER BY u.created_at DESC LIMIT ? OFFSET ?`
+	rows, err := as.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan user"})
+			return
+		}
+		users = append(users, *user)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "total": total})
+}
+
+// Get a single user
+func (as *AdminService) GetUser(c *gin.Context) {
+	user, err := scanUser(as.db.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.id = ?`, c.Param("id")))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// Get chat and session statistics for a user
+func (as *AdminService) GetUserUsage(c *gin.Context) {
+	userID := c.Param("id")
+
+	var exists bool
+	if err := as.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, userID).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	usage := UserUsage{UserID: userID}
+	err := as.db.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM chats WHERE user_id = ?),
+			(SELECT COUNT(*) FROM messages m JOIN chats ch ON m.chat_id = ch.id WHERE ch.user_id = ?),
+			(SELECT COUNT(*) FROM messages m JOIN chats ch ON m.chat_id = ch.id WHERE ch.user_id = ? AND m.role = 'user'),
+			(SELECT COUNT(*) FROM sessions WHERE user_id = ? AND expires_at > NOW()),
+			(SELECT MAX(m.created_at) FROM messages m JOIN chats ch ON m.chat_id = ch.id WHERE ch.user_id = ?)
+	`, userID, userID, userID, userID, userID).Scan(
+		&usage.ChatCount, &usage.MessageCount, &usage.UserMessageCount, &usage.ActiveSessions, &usage.LastMessageAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// Disable a user account and end all of its sessions
+func (as *AdminService) DisableUser(c *gin.Context) {
+	userID := c.Param("id")
+	if userID == currentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot disable your own account"})
+		return
+	}
+
+	tx, err := as.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET disabled_at = ? WHERE id = ? AND disabled_at IS NULL", time.Now(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable user"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or already disabled"})
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sessions"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled successfully"})
+}
+
+// Re-enable a disabled user account
+func (as *AdminService) EnableUser(c *gin.Context) {
+	result, err := as.db.Exec("UPDATE users SET disabled_at = NULL WHERE id = ? AND disabled_at IS NOT NULL", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable user"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found or not disabled"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled successfully"})
+}
+
+// Change a user's role
+func (as *AdminService) UpdateUserRole(c *gin.Context) {
+	userID := c.Param("id")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Role != RoleUser && req.Role != RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	if userID == currentUser(c).ID && req.Role != RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot remove your own admin role"})
+		return
+	}
+
+	result, err := as.db.Exec("UPDATE users SET role = ?, role_assigned_at = ? WHERE id = ?", req.Role, time.Now(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var exists bool
+		as.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, userID).Scan(&exists)
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated successfully"})
+}
+
+// Delete a user account immediately, along with all of its data
+func (as *AdminService) DeleteUser(c *gin.Context) {
+	userID := c.Param("id")
+	if userID == currentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+
+	if err := as.userService.purgeUser(userID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, so user input only
+// matches literally.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"alice":      "alice",
+		"100%":       `100\%`,
+		"first_last": `first\_last`,
+		`back\slash`: `back\\slash`,
+		`\%_`:        `\\\%\_`,
+	}
+	for input, want := range tests {
+		if got := escapeLike(input); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	maxAttachmentNameLength  = 255
+	// unlinkedAttachmentTTL is how long an upload may wait for a message
+	unlinkedAttachmentTTL = 24 * time.Hour
+)
+
+// defaultAttachmentTypes are accepted unless ATTACHMENT_ALLOWED_TYPES
+// overrides them. Code files are stored as text/plain.
+var defaultAttachmentTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp",
+	"application/pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"text/plain", "text/markdown", "text/csv", "application/json",
+}
+
+var (
+	errAttachmentNotFound = errors.New("attachment not found")
+	errAttachmentLimit    = errors.New("too many attachments")
+)
+
+// Attachment is an uploaded file, linked to a message once it is sent.
+type Attachment struct {
+	ID          string `json:"id"`
+	MessageID   *int   `json:"messageId"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	// DownloadURL is signed and expires at DownloadExpiresAt
+	DownloadURL       string     `json:"downloadUrl,omitempty"`
+	DownloadExpiresAt *time.Time `json:"downloadExpiresAt,omitempty"`
+	// ExtractionStatus is set for documents whose text is extracted for prompts
+	ExtractionStatus *string   `json:"extractionStatus"`
+	ExtractionError  *string   `json:"extractionError,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+
+	userID     *string
+	storageKey string
+}
+
+// attachmentColumns lists the attachments columns scanned by scanAttachment.
+const attachmentColumns = "id, message_id, user_id, filename, content_type, size, sha256, storage_key, " +
+	"extraction_status, extraction_error, created_at"
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var attachment Attachment
+	err := row.Scan(
+		&attachment.ID, &attachment.MessageID, &attachment.userID, &attachment.Filename, &attachment.ContentType,
+		&attachment.Size, &attachment.SHA256, &attachment.storageKey, &attachment.ExtractionStatus,
+		&attachment.ExtractionError, &attachment.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// AttachmentSigner creates and checks download URLs, so files can be fetched
+// by browsers and image tags that don't send the session.
+type AttachmentSigner struct {
+	key     []byte
+	ttl     time.Duration
+	baseURL string
+}
+
+// NewAttachmentSigner reads the signing key from ATTACHMENT_SIGNING_KEY. A
+// random key is used without it, URLs then stop working after a restart.
+func NewAttachmentSigner() *AttachmentSigner {
+	key := []byte(os.Getenv("ATTACHMENT_SIGNING_KEY"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("Failed to generate attachment signing key:", err)
+		}
+		log.Println("ATTACHMENT_SIGNING_KEY is not set, download URLs won't survive a restart")
+	}
+	return &AttachmentSigner{
+		key:     key,
+		ttl:     time.Duration(getEnvInt64("ATTACHMENT_URL_TTL_MINUTES", 15)) * time.Minute,
+		baseURL: os.Getenv("BACKEND_URL"),
+	}
+}
+
+func (s *AttachmentSigner) signature(attachmentID string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(attachmentID + "." + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign fills in a fresh download URL.
+func (s *AttachmentSigner) sign(attachment *Attachment) {
+	expiresAt := time.Now().Add(s.ttl).Truncate(time.Second)
+	expires := expiresAt.Unix()
+	attachment.DownloadURL = s.baseURL + "/api/files/" + attachment.ID +
+		"?expires=" + strconv.FormatInt(expires, 10) + "&signature=" + s.signature(attachment.ID, expires)
+	attachment.DownloadExpiresAt = &expiresAt
+}
+
+// signMessages fills in the download URLs of every attachment of messages.
+func (s *AttachmentSigner) signMessages(messages []Message) {
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			s.sign(&messages[i].Attachments[j])
+		}
+	}
+}
+
+func (s *AttachmentSigner) verify(attachmentID, expiresValue, signature string) bool {
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.signature(attachmentID, expires)))
+}
+
+type AttachmentService struct {
+	db           *sql.DB
+	chats        *ChatService
+	store        BlobStore
+	signer       *AttachmentSigner
+	jobs         *JobQueue
+	maxSize      int64
+	allowedTypes []string
+}
+
+func NewAttachmentService(db *sql.DB, chats *ChatService, store BlobStore, signer *AttachmentSigner, jobs *JobQueue) *AttachmentService {
+	allowedTypes := getEnvList("ATTACHMENT_ALLOWED_TYPES")
+	if len(allowedTypes) == 0 {
+		allowedTypes = defaultAttachmentTypes
+	}
+	return &AttachmentService{
+		db:           db,
+		chats:        chats,
+		store:        store,
+		signer:       signer,
+		jobs:         jobs,
+		maxSize:      getEnvInt64("ATTACHMENT_MAX_BYTES", 20<<20),
+		allowedTypes: allowedTypes,
+	}
+}
+
+// Upload a file, to be linked to a message with attachmentIds
+func (as *AttachmentService) UploadAttachment(c *gin.Context) {
+	user := currentUser(c)
+
+	// Leave room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, as.maxSize+64<<10)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		}
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, as.maxSize+1))
+	if err != nil || int64(len(data)) > as.maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+		return
+	}
+	if len(data) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return
+	}
+
+	filename := filepath.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	if filename == "." || filename == "/" || len([]rune(filename)) > maxAttachmentNameLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+		return
+	}
+
+	contentType := detectAttachmentType(filename, data)
+	if !slices.Contains(as.allowedTypes, contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "File type " + contentType + " is not allowed"})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	attachment := Attachment{
+		ID:          uuid.New().String(),
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		CreatedAt:   time.Now(),
+	}
+	attachment.storageKey = "attachments/" + attachment.ID
+	if isDocumentType(contentType) {
+		status := ExtractionPending
+		attachment.ExtractionStatus = &status
+	}
+
+	if err := as.store.Put(c.Request.Context(), attachment.storageKey, bytes.NewReader(data), attachment.Size, contentType); err != nil {
+		log.Printf("Failed to store attachment: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	_, err = as.db.Exec(`
+		INSERT INTO attachments (id, user_id, filename, content_type, size, sha256, storage_key, extraction_status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, attachment.ID, user.ID, attachment.Filename, attachment.ContentType, attachment.Size, attachment.SHA256,
+		attachment.storageKey, attachment.ExtractionStatus, attachment.CreatedAt)
+	if err != nil {
+		as.store.Delete(context.Background(), attachment.storageKey)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create attachment"})
+		return
+	}
+	if attachment.ExtractionStatus != nil {
+		as.scheduleExtraction(attachment)
+	}
+
+	as.signer.sign(&attachment)
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// Get an attachment with a fresh download URL
+func (as *AttachmentService) GetAttachment(c *gin.Context) {
+	attachment, ok := as.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	as.signer.sign(attachment)
+	c.JSON(http.StatusOK, attachment)
+}
+
+// Delete an attachment and its file
+func (as *AttachmentService) DeleteAttachment(c *gin.Context) {
+	attachment, ok := as.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if _, err := as.db.Exec("DELETE FROM attachments WHERE id = ?", attachment.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+	if err := as.deleteBlobs(c.Request.Context(), attachment.ID, attachment.storageKey); err != nil {
+		log.Printf("Failed to delete blob of attachment %s: %v", attachment.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Attachment deleted successfully"})
+}
+
+// Serve an attachment through a signed download URL
+func (as *AttachmentService) DownloadAttachment(c *gin.Context) {
+	attachmentID := c.Param("id")
+	if !as.signer.verify(attachmentID, c.Query("expires"), c.Query("signature")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired download link"})
+		return
+	}
+
+	attachment, err := scanAttachment(as.db.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, attachmentID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment"})
+		}
+		return
+	}
+
+	blob, err := as.store.Get(c.Request.Context(), attachment.storageKey)
+	if err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		} else {
+			log.Printf("Failed to read blob of attachment %s: %v", attachment.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		}
+		return
+	}
+	defer blob.Close()
+
+	// Only images are shown inline, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=300")
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, blob, nil)
+}
+
+// authorize loads the attachment named in the path. Unlinked uploads are
+// only visible to their uploader, linked ones follow the chat's permissions.
+func (as *AttachmentService) authorize(c *gin.Context, minRole string) (*Attachment, bool) {
+	user := currentUser(c)
+
+	attachment, err := scanAttachment(as.db.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, c.Param("id")))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment"})
+		}
+		return nil, false
+	}
+
+	if attachment.MessageID == nil {
+		if attachment.userID == nil || *attachment.userID != user.ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+			return nil, false
+		}
+		return attachment, true
+	}
+
+	var chatID int
+	if err := as.db.QueryRow("SELECT chat_id FROM messages WHERE id = ?", *attachment.MessageID).Scan(&chatID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment"})
+		return nil, false
+	}
+	if _, ok := as.chats.authorizeChat(c, chatID, minRole); !ok {
+		return nil, false
+	}
+	return attachment, true
+}
+
+// cleanupAttachments deletes uploads that were never sent, and attachments
+// whose message was deleted.
+func (as *AttachmentService) cleanupAttachments() error {
+	if err := as.failInterruptedExtractions(); err != nil {
+		return err
+	}
+
+	rows, err := as.db.Query(
+		"SELECT id, storage_key FROM attachments WHERE message_id IS NULL AND (user_id IS NULL OR created_at < ?)",
+		time.Now().Add(-unlinkedAttachmentTTL),
+	)
+	if err != nil {
+		return err
+	}
+
+	type orphan struct{ id, storageKey string }
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		if err := rows.Scan(&o.id, &o.storageKey); err != nil {
+			rows.Close()
+			return err
+		}
+		orphans = append(orphans, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range orphans {
+		if err := as.deleteBlobs(context.Background(), o.id, o.storageKey); err != nil {
+			log.Printf("Failed to delete blob of attachment %s: %v", o.id, err)
+			continue
+		}
+		if _, err := as.db.Exec("DELETE FROM attachments WHERE id = ? AND message_id IS NULL", o.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteBlobs removes an attachment's file and the copy prepared for vision
+// models.
+func (as *AttachmentService) deleteBlobs(ctx context.Context, attachmentID, storageKey string) error {
+	if err := as.store.Delete(ctx, "vision/"+attachmentID); err != nil {
+		return err
+	}
+	return as.store.Delete(ctx, storageKey)
+}
+
+// linkAttachments attaches the user's unsent uploads to a message. Either
+// all of them are linked or none.
+func linkAttachments(db *sql.DB, messageID int, userID string, attachmentIDs []string) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+	if len(attachmentIDs) > maxAttachmentsPerMessage {
+		return errAttachmentLimit
+	}
+	slices.Sort(attachmentIDs)
+	attachmentIDs = slices.Compact(attachmentIDs)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{messageID, userID}
+	for _, id := range attachmentIDs {
+		args = append(args, id)
+	}
+	result, err := tx.Exec(
+		`UPDATE attachments SET message_id = ? WHERE user_id = ? AND message_id IS NULL AND id IN (?`+
+			strings.Repeat(", ?", len(attachmentIDs)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); int(affected) != len(attachmentIDs) {
+		return errAttachmentNotFound
+	}
+	return tx.Commit()
+}
+
+// respondLinkError writes the response for a failed linkAttachments.
+func respondLinkError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errAttachmentLimit):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A message can have at most 10 attachments"})
+	case errors.Is(err, errAttachmentNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or already sent attachment"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link attachments"})
+	}
+}
+
+// queryChatAttachments loads the attachments of a chat's messages, keyed by
+// message ID.
+func queryChatAttachments(db *sql.DB, chatID int) (map[int][]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT a.id, a.message_id, a.user_id, a.filename, a.content_type, a.size, a.sha256, a.storage_key,
+			a.extraction_status, a.extraction_error, a.created_at
+		FROM attachments a JOIN messages m ON a.message_id = m.id
+		WHERE m.chat_id = ?
+		ORDER BY a.created_at ASC
+	`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := map[int][]Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments[*attachment.MessageID] = append(attachments[*attachment.MessageID], *attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// detectAttachmentType sniffs the content of an upload. The type the client
+// declares is ignored, the extension only refines text and zip containers.
+func detectAttachmentType(filename string, data []byte) string {
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	switch detected {
+	case "text/plain":
+		switch ext {
+		case ".md", ".markdown":
+			return "text/markdown"
+		case ".csv":
+			return "text/csv"
+		case ".json":
+			return "application/json"
+		}
+	case "application/zip":
+		if ext == ".docx" {
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		}
+	}
+	return detected
+}
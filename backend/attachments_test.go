@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(key string) *AttachmentSigner {
+	return &AttachmentSigner{key: []byte(key), ttl: time.Minute, baseURL: "https://chat.example.com"}
+}
+
+func TestAttachmentSignerSignVerify(t *testing.T) {
+	signer := newTestSigner("test-key")
+	attachment := &Attachment{ID: "attachment-1"}
+	signer.sign(attachment)
+
+	if !strings.HasPrefix(attachment.DownloadURL, "https://chat.example.com/api/files/attachment-1?") {
+		t.Fatalf("DownloadURL = %q", attachment.DownloadURL)
+	}
+	if attachment.DownloadExpiresAt == nil || time.Until(*attachment.DownloadExpiresAt) > time.Minute {
+		t.Fatalf("DownloadExpiresAt = %v, want within a minute", attachment.DownloadExpiresAt)
+	}
+
+	parsed, err := url.Parse(attachment.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := parsed.Query().Get("expires")
+	signature := parsed.Query().Get("signature")
+
+	tests := []struct {
+		name         string
+		signer       *AttachmentSigner
+		attachmentID string
+		expires      string
+		signature    string
+		want         bool
+	}{
+		{"valid", signer, "attachment-1", expires, signature, true},
+		{"other attachment", signer, "attachment-2", expires, signature, false},
+		{"extended expiry", signer, "attachment-1", strconv.FormatInt(attachment.DownloadExpiresAt.Unix()+3600, 10), signature, false},
+		{"tampered signature", signer, "attachment-1", expires, strings.Repeat("0", len(signature)), false},
+		{"malformed expiry", signer, "attachment-1", "soon", signature, false},
+		{"other key", newTestSigner("other-key"), "attachment-1", expires, signature, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.signer.verify(tt.attachmentID, tt.expires, tt.signature); got != tt.want {
+				t.Errorf("verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentSignerRejectsExpiredURLs(t *testing.T) {
+	signer := newTestSigner("test-key")
+	expires := time.Now().Add(-time.Second).Unix()
+	if signer.verify("attachment-1", strconv.FormatInt(expires, 10), signer.signature("attachment-1", expires)) {
+		t.Error("verify accepted an expired URL")
+	}
+}
+
+func TestAttachmentSignerSignMessages(t *testing.T) {
+	signer := newTestSigner("test-key")
+	messages := []Message{{Attachments: []Attachment{{ID: "a"}, {ID: "b"}}}, {}}
+	signer.signMessages(messages)
+	for _, attachment := range messages[0].Attachments {
+		if !strings.Contains(attachment.DownloadURL, "/api/files/"+attachment.ID+"?") {
+			t.Errorf("attachment %s has DownloadURL %q", attachment.ID, attachment.DownloadURL)
+		}
+	}
+}
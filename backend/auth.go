@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,7 +17,10 @@ import (
 
 type AuthService struct {
 	db           *sql.DB
+	box          *SecretBox
 	googleConfig *oauth2.Config
+	adminEmails  map[string]bool
+	signupPolicy *SignupPolicy
 }
 
 type User struct {
@@ -28,6 +32,41 @@ type User struct {
 	Avatar      *string   `json:"avatar"`
 	CreatedAt   time.Time `json:"createdAt"`
 	LastLoginAt time.Time `json:"lastLoginAt"`
+
+	TwoFactorEnabled bool       `json:"twoFactorEnabled"`
+	Role             string     `json:"role"`
+	DisabledAt       *time.Time `json:"disabledAt"`
+
+	// CustomProfile stops Google logins from overwriting the display name and avatar
+	CustomProfile bool            `json:"customProfile"`
+	Preferences   json.RawMessage `json:"preferences"`
+
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt"`
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// userColumns lists the users columns scanned by scanUser, aliased as "u".
+const userColumns = "u.id, u.email, u.name, u.image, u.display_name, u.avatar, u.created_at, u.last_login_at, u.totp_enabled, u.role, u.disabled_at, u.custom_profile, u.preferences, u.deletion_scheduled_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	err := row.Scan(
+		&user.ID, &user.Email, &user.Name, &user.Image, &user.DisplayName, &user.Avatar, &user.CreatedAt, &user.LastLoginAt,
+		&user.TwoFactorEnabled, &user.Role, &user.DisabledAt, &user.CustomProfile, &user.Preferences,
+		&user.DeletionScheduledAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
 type Session struct {
@@ -35,8 +74,15 @@ type Session struct {
 	UserID    string    `json:"userId"`
 	ExpiresAt time.Time `json:"expiresAt"`
 	CreatedAt time.Time `json:"createdAt"`
+
+	PendingSecondFactor bool `json:"pendingSecondFactor"`
 }
 
+const (
+	sessionDuration        = time.Hour * 24 * 7 // 7 days
+	pendingSessionDuration = time.Minute * 10
+)
+
 type GoogleUserInfo struct {
 	ID      string `json:"id"`
 	Email   string `json:"email"`
@@ -44,7 +90,7 @@ type GoogleUserInfo struct {
 	Picture string `json:"picture"`
 }
 
-func NewAuthService(db *sql.DB) *AuthService {
+func NewAuthService(db *sql.DB, box *SecretBox) *AuthService {
 	clientId := os.Getenv("GOOGLE_CLIENT_ID")
 	clientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
 	backendURL := os.Getenv("BACKEND_URL")
@@ -62,9 +108,18 @@ func NewAuthService(db *sql.DB) *AuthService {
 		Endpoint:     google.Endpoint,
 	}
 
+	// Emails that are granted the admin role when they sign in
+	adminEmails := make(map[string]bool)
+	for _, email := range getEnvList("ADMIN_EMAILS") {
+		adminEmails[strings.ToLower(email)] = true
+	}
+
 	return &AuthService{
 		db:           db,
+		box:          box,
 		googleConfig: googleConfig,
+		adminEmails:  adminEmails,
+		signupPolicy: NewSignupPolicy(),
 	}
 }
 
@@ -72,6 +127,7 @@ func (a *AuthService) SignInSocial(c *gin.Context) {
 	var req struct {
 		Provider    string `json:"provider"`
 		CallbackURL string `json:"callbackURL"`
+		InviteCode  string `json:"inviteCode"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -84,6 +140,11 @@ func (a *AuthService) SignInSocial(c *gin.Context) {
 		return
 	}
 
+	// Remember the invite code until Google redirects back
+	if req.InviteCode != "" {
+		c.SetCookie("invite_code", req.InviteCode, int(pendingSessionDuration/time.Second), "/", "", false, true)
+	}
+
 	// Store callback URL in session/state
 	state := uuid.New().String()
 	url := a.googleConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
@@ -125,24 +186,55 @@ func (a *AuthService) GoogleCallback(c *gin.Context) {
 	}
 
 	// Create or update user
-	user, err := a.createOrUpdateUser(googleUser)
-	if err != nil {
+	inviteCode, _ := c.Cookie("invite_code")
+	user, err := a.createOrUpdateUser(googleUser, inviteCode)
+	switch err {
+	case nil:
+		c.SetCookie("invite_code", "", -1, "/", "", false, true)
+	case errSignupDomain:
+		c.Redirect(http.StatusFound, frontendURL+"/login?error=signup_restricted")
+		return
+	case errInviteRequired:
+		c.Redirect(http.StatusFound, frontendURL+"/login?error=invite_required")
+		return
+	case errWaitlisted:
+		c.Redirect(http.StatusFound, frontendURL+"/login?error=waitlisted")
+		return
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
+	if user.DisabledAt != nil {
+		c.Redirect(http.StatusFound, frontendURL+"/login?error=account_disabled")
+		return
+	}
+
+	// Users with 2FA only get a restricted session until the code is verified
+	if user.TwoFactorEnabled {
+		session, err := a.createSession(user.ID, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+			return
+		}
+
+		c.SetCookie("session_id", session.ID, int(pendingSessionDuration/time.Second), "/", frontendURL, false, true)
+		c.Redirect(http.StatusFound, frontendURL+"/login?twoFactor=required")
+		return
+	}
+
 	// Create session
-	session, err := a.createSession(user.ID)
+	session, err := a.createSession(user.ID, false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
 
 	// Set session cookie
-	c.SetCookie("session_id", session.ID, int(time.Hour*24*7/time.Second), "/", frontendURL, false, true)
+	c.SetCookie("session_id", session.ID, int(sessionDuration/time.Second), "/", frontendURL, false, true)
 
 	// Redirect to frontend chats
-	c.Redirect(http.StatusFound, frontendURL + "/chats")
+	c.Redirect(http.StatusFound, frontendURL+"/chats")
 }
 
 func (a *AuthService) GetSession(c *gin.Context) {
@@ -154,6 +246,11 @@ func (a *AuthService) GetSession(c *gin.Context) {
 
 	user, err := a.getUserBySessionID(sessionID)
 	if err != nil {
+		// A restricted session is still waiting for its second factor
+		if _, pendingErr := a.getPendingSession(sessionID); pendingErr == nil {
+			c.JSON(http.StatusOK, gin.H{"data": nil, "twoFactorRequired": true})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"data": nil})
 		return
 	}
@@ -170,7 +267,7 @@ func (a *AuthService) GetSession(c *gin.Context) {
 
 func (a *AuthService) SignOut(c *gin.Context) {
 	frontendURL := os.Getenv("FRONTEND_URL")
-	
+
 	sessionID, err := c.Cookie("session_id")
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"success": true})
@@ -190,27 +287,60 @@ func (a *AuthService) SignOut(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func (a *AuthService) createOrUpdateUser(googleUser GoogleUserInfo) (*User, error) {
+// createOrUpdateUser signs in an existing user or, if the sign-up policy
+// allows it, creates a new account.
+func (a *AuthService) createOrUpdateUser(googleUser GoogleUserInfo, inviteCode string) (*User, error) {
 	userID := uuid.New().String()
 	now := time.Now()
 
+	role := RoleUser
+	if a.adminEmails[strings.ToLower(googleUser.Email)] {
+		role = RoleAdmin
+	}
+
 	// Try to find existing user
-	var existingUser User
-	err := a.db.QueryRow(
-		"SELECT id, email, name, image, display_name, avatar, created_at, last_login_at FROM users WHERE email = ?",
+	existingUser, err := scanUser(a.db.QueryRow(
+		"SELECT "+userColumns+" FROM users u WHERE u.email = ?",
 		googleUser.Email,
-	).Scan(&existingUser.ID, &existingUser.Email, &existingUser.Name, &existingUser.Image, &existingUser.DisplayName, &existingUser.Avatar, &existingUser.CreatedAt, &existingUser.LastLoginAt)
+	))
 
 	if err == sql.ErrNoRows {
+		tx, err := a.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+
+		// Bootstrap admins can always sign up
+		if role != RoleAdmin {
+			err := a.signupPolicy.authorize(tx, googleUser, inviteCode)
+			if err == errWaitlisted {
+				if joinErr := a.signupPolicy.joinWaitlist(a.db, googleUser); joinErr != nil {
+					return nil, joinErr
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Create new user
-		_, err = a.db.Exec(
-			"INSERT INTO users (id, email, name, image, display_name, avatar, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-			userID, googleUser.Email, googleUser.Name, googleUser.Picture, googleUser.Name, googleUser.Picture, now, now,
+		var roleAssignedAt *time.Time
+		if role == RoleAdmin {
+			roleAssignedAt = &now
+		}
+		_, err = tx.Exec(
+			"INSERT INTO users (id, email, name, image, display_name, avatar, created_at, last_login_at, role, role_assigned_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			userID, googleUser.Email, googleUser.Name, googleUser.Picture, googleUser.Name, googleUser.Picture, now, now, role, roleAssignedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
 		return &User{
 			ID:          userID,
 			Email:       googleUser.Email,
@@ -220,56 +350,141 @@ func (a *AuthService) createOrUpdateUser(googleUser GoogleUserInfo) (*User, erro
 			Avatar:      &googleUser.Picture,
 			CreatedAt:   now,
 			LastLoginAt: now,
+			Role:        role,
 		}, nil
 	} else if err != nil {
 		return nil, err
 	}
 
+	// Promote bootstrap admins once, a role an admin assigned since then wins
+	if role == RoleAdmin && existingUser.Role != RoleAdmin {
+		result, err := a.db.Exec(
+			"UPDATE users SET role = ?, role_assigned_at = ? WHERE id = ? AND role_assigned_at IS NULL",
+			RoleAdmin, now, existingUser.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if affected == 1 {
+			existingUser.Role = RoleAdmin
+		}
+	}
+
 	// Update existing user's last login
-	_, err = a.db.Exec("UPDATE users SET last_login_at = ? WHERE id = ?", now, existingUser.ID)
+	_, err = a.db.Exec(
+		"UPDATE users SET last_login_at = ?, name = ?, image = ? WHERE id = ?",
+		now, googleUser.Name, googleUser.Picture, existingUser.ID,
+	)
 	if err != nil {
 		return nil, err
 	}
+	existingUser.Name = googleUser.Name
+	existingUser.Image = &googleUser.Picture
+
+	// Keep the display values in sync with Google unless the user changed them
+	if !existingUser.CustomProfile {
+		_, err = a.db.Exec(
+			"UPDATE users SET display_name = ?, avatar = ? WHERE id = ?",
+			googleUser.Name, googleUser.Picture, existingUser.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		existingUser.DisplayName = &googleUser.Name
+		existingUser.Avatar = &googleUser.Picture
+	}
 
 	existingUser.LastLoginAt = now
-	return &existingUser, nil
+	return existingUser, nil
 }
 
-func (a *AuthService) createSession(userID string) (*Session, error) {
+// createSession stores a new session for the user. Pending sessions are
+// short-lived and only grant access to the second factor verification.
+func (a *AuthService) createSession(userID string, pendingSecondFactor bool) (*Session, error) {
 	sessionID := uuid.New().String()
-	expiresAt := time.Now().Add(time.Hour * 24 * 7) // 7 days
 	now := time.Now()
+	expiresAt := now.Add(sessionDuration)
+	if pendingSecondFactor {
+		expiresAt = now.Add(pendingSessionDuration)
+	}
 
 	_, err := a.db.Exec(
-		"INSERT INTO sessions (id, user_id, expires_at, created_at) VALUES (?, ?, ?, ?)",
-		sessionID, userID, expiresAt, now,
+		"INSERT INTO sessions (id, user_id, expires_at, created_at, pending_second_factor) VALUES (?, ?, ?, ?, ?)",
+		sessionID, userID, expiresAt, now, pendingSecondFactor,
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Session{
-		ID:        sessionID,
-		UserID:    userID,
-		ExpiresAt: expiresAt,
-		CreatedAt: now,
+		ID:                  sessionID,
+		UserID:              userID,
+		ExpiresAt:           expiresAt,
+		CreatedAt:           now,
+		PendingSecondFactor: pendingSecondFactor,
 	}, nil
 }
 
-func (a *AuthService) getUserBySessionID(sessionID string) (*User, error) {
-	var user User
+func (a *AuthService) getPendingSession(sessionID string) (*Session, error) {
+	var session Session
 	err := a.db.QueryRow(`
-		SELECT u.id, u.email, u.name, u.image, u.display_name, u.avatar, u.created_at, u.last_login_at
-		FROM users u
-		JOIN sessions s ON u.id = s.user_id
-		WHERE s.id = ? AND s.expires_at > NOW()
-	`, sessionID).Scan(
-		&user.ID, &user.Email, &user.Name, &user.Image, &user.DisplayName, &user.Avatar, &user.CreatedAt, &user.LastLoginAt,
-	)
+		SELECT id, user_id, expires_at, created_at, pending_second_factor
+		FROM sessions
+		WHERE id = ? AND pending_second_factor = TRUE AND expires_at > NOW()
+	`, sessionID).Scan(&session.ID, &session.UserID, &session.ExpiresAt, &session.CreatedAt, &session.PendingSecondFactor)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	return &session, nil
+}
+
+func (a *AuthService) getUserBySessionID(sessionID string) (*User, error) {
+	return scanUser(a.db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users u
+		JOIN sessions s ON u.id = s.user_id
+		WHERE s.id = ? AND s.expires_at > NOW() AND s.pending_second_factor = FALSE AND u.disabled_at IS NULL
+	`, sessionID))
+}
+
+// RequireAuth rejects requests without a fully verified session and stores
+// the authenticated user in the context under "user".
+func (a *AuthService) RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessionID, err := c.Cookie("session_id")
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		user, err := a.getUserBySessionID(sessionID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		c.Set("user", user)
+		c.Set("sessionID", sessionID)
+		c.Next()
+	}
+}
+
+// RequireAdmin must run after RequireAuth and rejects non-admin users.
+func (a *AuthService) RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentUser(c).Role != RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the user stored by RequireAuth.
+func currentUser(c *gin.Context) *User {
+	return c.MustGet("user").(*User)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobKeyPattern keeps keys portable between stores and free of path
+// traversal on the local filesystem.
+var blobKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9/_-]*$`)
+
+// validBlobKey reports whether a key matches blobKeyPattern, which already
+// rules out dot segments, and has no empty path segments.
+func validBlobKey(key string) bool {
+	return blobKeyPattern.MatchString(key) && !strings.Contains(key, "//") && !strings.HasSuffix(key, "/")
+}
+
+// BlobStore keeps uploaded files outside the database.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get returns errBlobNotFound when the key doesn't exist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds when the key doesn't exist
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore creates the store selected by BLOB_STORE, "local" (default)
+// or "s3".
+func NewBlobStore() (BlobStore, error) {
+	switch store := getEnv("BLOB_STORE", "local"); store {
+	case "local":
+		return &LocalBlobStore{dir: getEnv("BLOB_DIR", "uploads/blobs")}, nil
+	case "s3":
+		return NewS3BlobStore()
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", store)
+	}
+}
+
+// LocalBlobStore stores blobs as files below a directory.
+type LocalBlobStore struct {
+	dir string
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob
+	file, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return file, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
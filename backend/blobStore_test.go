@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	ctx := context.Background()
+	store := &LocalBlobStore{dir: t.TempDir()}
+
+	if err := store.Put(ctx, "user-1/file-1", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	blob, err := store.Get(ctx, "user-1/file-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Get = %q, %v, want hello", data, err)
+	}
+
+	// Put replaces an existing blob without leaving temporary files
+	if err := store.Put(ctx, "user-1/file-1", strings.NewReader("bye"), 3, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(store.dir, "user-1"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("blob directory holds %v, %v, want one file", entries, err)
+	}
+
+	if err := store.Delete(ctx, "user-1/file-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "user-1/file-1"); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("Get after Delete error = %v, want errBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, "user-1/file-1"); err != nil {
+		t.Errorf("Delete of a missing blob: %v", err)
+	}
+}
+
+func TestLocalBlobStoreRejectsInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	store := &LocalBlobStore{dir: t.TempDir()}
+
+	for _, key := range []string{"", "../secret", "/etc/passwd", "a//b", "a/", "A/b", "a/../b", ".hidden"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, errBlobNotFound) {
+			t.Errorf("Get(%q) error = %v, want an invalid key error", key, err)
+		}
+	}
+}
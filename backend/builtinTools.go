@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	// Time zones must resolve in containers without zoneinfo files
+	_ "time/tzdata"
+)
+
+// registerBuiltinTools adds the tools that need no configuration.
+func registerBuiltinTools(registry *ToolRegistry) {
+	for _, tool := range []Tool{CalculatorTool{}, CurrentTimeTool{}, NewFetchURLTool()} {
+		if err := registry.Register(tool); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// CalculatorTool evaluates arithmetic, which models are unreliable at.
+type CalculatorTool struct{}
+
+func (CalculatorTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, the constants pi and e, and the functions sqrt, abs, round, floor, ceil, exp, ln, log, log2, sin, cos, tan, asin, acos, atan, min, max and pow.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"expression": {"type": "string", "description": "The expression, for example (2 + 3) * sqrt(16)"}},
+			"required": ["expression"]
+		}`),
+	}
+}
+
+func (CalculatorTool) Call(_ context.Context, _ *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+
+	value, err := evaluateExpression(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', 15, 64), nil
+}
+
+// expressionParser is a recursive descent parser over the runes of an
+// arithmetic expression.
+type expressionParser struct {
+	input []rune
+	pos   int
+}
+
+func evaluateExpression(expression string) (float64, error) {
+	if len(expression) > 1000 {
+		return 0, errors.New("expression is too long")
+	}
+	p := &expressionParser{input: []rune(expression)}
+	value, err := p.sum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("result is not a finite number")
+	}
+	return value, nil
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// accept consumes r if it is the next rune.
+func (p *expressionParser) accept(r rune) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == r {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *expressionParser) sum() (float64, error) {
+	value, err := p.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			right, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			value += right
+		case p.accept('-'):
+			right, err := p.product()
+			if err != nil {
+				return 0, err
+			}
+			value -= right
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (p *expressionParser) product() (float64, error) {
+	value, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var operator rune
+		switch {
+		case p.accept('*'), p.accept('×'):
+			operator = '*'
+		case p.accept('/'), p.accept('÷'):
+			operator = '/'
+		case p.accept('%'):
+			operator = '%'
+		default:
+			return value, nil
+		}
+
+		right, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case operator == '*':
+			value *= right
+		case right == 0:
+			return 0, errors.New("division by zero")
+		case operator == '/':
+			value /= right
+		default:
+			value = math.Mod(value, right)
+		}
+	}
+}
+
+func (p *expressionParser) unary() (float64, error) {
+	if p.accept('-') {
+		value, err := p.unary()
+		return -value, err
+	}
+	if p.accept('+') {
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power is right associative and binds tighter than a leading minus on its
+// right operand only, so -2^2 is -4.
+func (p *expressionParser) power() (float64, error) {
+	base, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		exponent, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+var expressionFunctions = map[string]func(args []float64) (float64, error){
+	"sqrt":  unaryFunction(math.Sqrt),
+	"abs":   unaryFunction(math.Abs),
+	"round": unaryFunction(math.Round),
+	"floor": unaryFunction(math.Floor),
+	"ceil":  unaryFunction(math.Ceil),
+	"exp":   unaryFunction(math.Exp),
+	"ln":    unaryFunction(math.Log),
+	"log2":  unaryFunction(math.Log2),
+	"sin":   unaryFunction(math.Sin),
+	"cos":   unaryFunction(math.Cos),
+	"tan":   unaryFunction(math.Tan),
+	"asin":  unaryFunction(math.Asin),
+	"acos":  unaryFunction(math.Acos),
+	"atan":  unaryFunction(math.Atan),
+	"log": func(args []float64) (float64, error) {
+		switch len(args) {
+		case 1:
+			return math.Log10(args[0]), nil
+		case 2:
+			return math.Log(args[0]) / math.Log(args[1]), nil
+		}
+		return 0, errors.New("log takes a value and an optional base")
+	},
+	"pow": func(args []float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, errors.New("pow takes two arguments")
+		}
+		return math.Pow(args[0], args[1]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("min takes at least one argument")
+		}
+		return slices.Min(args), nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("max takes at least one argument")
+		}
+		return slices.Max(args), nil
+	},
+}
+
+func unaryFunction(fn func(float64) float64) func(args []float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, errors.New("function takes one argument")
+		}
+		return fn(args[0]), nil
+	}
+}
+
+func (p *expressionParser) primary() (float64, error) {
+	p.skipSpace()
+	if p.accept('(') {
+		value, err := p.sum()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, errors.New("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	start := p.pos
+	if p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.' || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		// Exponents such as 1.5e3
+		if p.pos+1 < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') &&
+			(unicode.IsDigit(p.input[p.pos+1]) || p.input[p.pos+1] == '-' || p.input[p.pos+1] == '+') {
+			p.pos += 2
+			for p.pos < len(p.input) && unicode.IsDigit(p.input[p.pos]) {
+				p.pos++
+			}
+		}
+		value, err := strconv.ParseFloat(strings.ReplaceAll(string(p.input[start:p.pos]), "_", ""), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", string(p.input[start:p.pos]))
+		}
+		return value, nil
+	}
+
+	for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos])) {
+		p.pos++
+	}
+	name := strings.ToLower(string(p.input[start:p.pos]))
+	switch name {
+	case "":
+		if p.pos >= len(p.input) {
+			return 0, errors.New("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	case "pi", "π":
+		return math.Pi, nil
+	case "e":
+		return math.E, nil
+	}
+
+	fn, ok := expressionFunctions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown function or constant %s", name)
+	}
+	if !p.accept('(') {
+		return 0, fmt.Errorf("%s must be followed by parentheses", name)
+	}
+	var args []float64
+	if !p.accept(')') {
+		for {
+			value, err := p.sum()
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, value)
+			if p.accept(')') {
+				break
+			}
+			if !p.accept(',') {
+				return 0, errors.New("expected , or ) in function arguments")
+			}
+		}
+	}
+	return fn(args)
+}
+
+// CurrentTimeTool tells the model the date and time, which it can't know.
+type CurrentTimeTool struct{}
+
+func (CurrentTimeTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        "current_time",
+		Description: "Get the current date and time, in UTC or an IANA time zone.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"timezone": {"type": "string", "description": "IANA time zone such as Europe/Berlin, UTC when omitted"}}
+		}`),
+	}
+}
+
+func (CurrentTimeTool) Call(_ context.Context, _ *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+
+	location := time.UTC
+	if args.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(args.Timezone); err != nil {
+			return "", fmt.Errorf("unknown time zone %s", args.Timezone)
+		}
+	}
+	now := time.Now().In(location)
+	return now.Format("Monday, 2 January 2006, 15:04:05 MST") + " (" + now.Format(time.RFC3339) + ")", nil
+}
+
+const (
+	maxFetchBytes = 2 << 20
+	maxFetchRunes = 12000
+
+	// CitationWeb marks citations of web pages read by tools
+	CitationWeb = "web"
+)
+
+var (
+	htmlDroppedBlocks = regexp.MustCompile(`(?is)<(script|style|noscript|svg|template|head)\b.*?</(script|style|noscript|svg|template|head)\s*>`)
+	htmlComments      = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlBreaks        = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6]|/section|/article|/blockquote|/pre)\b[^>]*>`)
+	htmlTags          = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlTitle         = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	repeatedSpaces    = regexp.MustCompile(`[ \t\f\v]+`)
+)
+
+// FetchURLTool reads a web page for the model. Private and local addresses
+// are refused, so the tool can't reach services behind the firewall.
+type FetchURLTool struct {
+	client *http.Client
+}
+
+func NewFetchURLTool() *FetchURLTool {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if getEnv("TOOL_FETCH_ALLOW_PRIVATE", "false") != "true" {
+		dialer.Control = refusePrivateAddresses
+	}
+	return &FetchURLTool{client: &http.Client{
+		Timeout:   20 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, Proxy: nil},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}}
+}
+
+// refusePrivateAddresses is checked on the resolved address of every
+// connection, which also covers redirects and DNS tricks.
+func refusePrivateAddresses(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("address %s is not public", host)
+	}
+	return nil
+}
+
+func (t *FetchURLTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        "fetch_url",
+		Description: "Fetch a web page or text file over HTTP(S) and return its text content.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"url": {"type": "string", "description": "Absolute http or https URL"}},
+			"required": ["url"]
+		}`),
+	}
+}
+
+func (t *FetchURLTool) Call(ctx context.Context, tc *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+	target, err := url.Parse(args.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return "", errors.New("url must be an absolute http or https URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "SafasChat/1.0 (+fetch_url tool)")
+	req.Header.Set("Accept", "text/html, text/plain, application/json;q=0.9, */*;q=0.5")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return "", err
+	}
+
+	title := resp.Request.URL.String()
+	var text string
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		text = htmlToText(string(body))
+		if match := htmlTitle.FindStringSubmatch(string(body)); match != nil {
+			if pageTitle := strings.TrimSpace(html.UnescapeString(match[1])); pageTitle != "" {
+				title = pageTitle
+			}
+		}
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "":
+		text = decodeUTF8(body)
+	default:
+		return "", fmt.Errorf("content type %s can't be read as text", mediaType)
+	}
+
+	text = truncateRunes(strings.TrimSpace(text), maxFetchRunes)
+	index := tc.Cite(Citation{
+		Source:  CitationWeb,
+		Title:   title,
+		URL:     resp.Request.URL.String(),
+		Snippet: truncateRunes(text, 300),
+	})
+	return fmt.Sprintf("Source [%d]: %s\nURL: %s\n\n%s", index, title, resp.Request.URL, text), nil
+}
+
+// htmlToText keeps the readable text of a page, with line breaks at block
+// elements.
+func htmlToText(page string) string {
+	page = htmlComments.ReplaceAllString(page, "")
+	page = htmlDroppedBlocks.ReplaceAllString(page, "")
+	page = htmlBreaks.ReplaceAllString(page, "\n")
+	page = html.UnescapeString(htmlTags.ReplaceAllString(page, " "))
+
+	lines := strings.Split(page, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(repeatedSpaces.ReplaceAllString(line, " "))
+	}
+	return collapseBlankLines(strings.Join(lines, "\n"))
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
@@ -10,18 +12,59 @@ import (
 )
 
 type ChatService struct {
-	db *sql.DB
+	db     *sql.DB
+	models *ModelCatalog
+	policy *ModelPolicyService
+	signer *AttachmentSigner
+	tools  *ToolRegistry
+	titles *TitleService
 }
 
 type Chat struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Model     string    `json:"model"`
-	UserID    string    `json:"userId"`
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	// TitleSource tells whether the title was chosen by a user, generated or is the default
+	TitleSource string `json:"titleSource"`
+	Model       string `json:"model"`
+	UserID      string `json:"userId"`
+	WorkspaceID *int   `json:"workspaceId"`
+	PersonaID   *int   `json:"personaId"`
+	// Params override the persona's generation parameters
+	Params GenerationParams `json:"params"`
+	// MemoryEnabled is false when the chat opted out of long-term memory
+	MemoryEnabled bool `json:"memoryEnabled"`
+	// KnowledgeBaseID is searched for every question asked in the chat
+	KnowledgeBaseID *int `json:"knowledgeBaseId"`
+	// Tools names the tools the model may call in the chat
+	Tools     []string  `json:"tools"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+// chatColumns lists the chats columns scanned by scanChat.
+const chatColumns = "id, title, title_source, model, user_id, workspace_id, persona_id, params, memory_enabled, knowledge_base_id, tools, created_at, updated_at"
+
+func scanChat(row rowScanner) (*Chat, error) {
+	var chat Chat
+	var params, tools []byte
+	err := row.Scan(&chat.ID, &chat.Title, &chat.TitleSource, &chat.Model, &chat.UserID, &chat.WorkspaceID, &chat.PersonaID, &params, &chat.MemoryEnabled, &chat.KnowledgeBaseID, &tools, &chat.CreatedAt, &chat.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		if err := json.Unmarshal(params, &chat.Params); err != nil {
+			return nil, err
+		}
+	}
+	chat.Tools = []string{}
+	if tools != nil {
+		if err := json.Unmarshal(tools, &chat.Tools); err != nil {
+			return nil, err
+		}
+	}
+	return &chat, nil
+}
+
 type Message struct {
 	ID          int       `json:"id"`
 	ChatID      int       `json:"chatId"`
@@ -31,12 +74,95 @@ type Message struct {
 	Reasoning   string    `json:"reasoning"`
 	Timestamp   time.Time `json:"timestamp"`
 	CreatedAt   time.Time `json:"createdAt"`
+	// Pinned messages are kept when older turns no longer fit the context
+	Pinned bool `json:"pinned"`
+	// Usage is only set on assistant messages generated by the server
+	Usage       *MessageUsage `json:"usage,omitempty"`
+	Attachments []Attachment  `json:"attachments,omitempty"`
+	// Citations are the sources the answer was generated from
+	Citations []Citation `json:"citations,omitempty"`
+	// ToolCalls are the tools the model called while answering
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+}
+
+// MessageUsage is the token usage and cost reported by the provider.
+type MessageUsage struct {
+	Model            string   `json:"model"`
+	PromptTokens     int      `json:"promptTokens"`
+	CompletionTokens int      `json:"completionTokens"`
+	ReasoningTokens  int      `json:"reasoningTokens"`
+	Cost             *float64 `json:"cost"`
+}
+
+// Citation is a source given to the model, numbered as it was referenced
+// in the prompt.
+type Citation struct {
+	Index   int    `json:"index"`
+	Source  string `json:"source"`
+	Title   string `json:"title"`
+	URL     string `json:"url,omitempty"`
+	Snippet string `json:"snippet"`
+	// Knowledge base sources point at the chunk that was retrieved
+	KnowledgeBaseID *int     `json:"knowledgeBaseId,omitempty"`
+	DocumentID      *int     `json:"documentId,omitempty"`
+	ChunkID         *int64   `json:"chunkId,omitempty"`
+	Score           *float64 `json:"score,omitempty"`
+}
+
+// messageColumns lists the messages columns scanned by scanMessage.
+const messageColumns = "id, chat_id, content, role, isStreaming, reasoning, timestamp, created_at, pinned, model, prompt_tokens, completion_tokens, reasoning_tokens, cost, citations"
+
+func scanMessage(row rowScanner) (*Message, error) {
+	var message Message
+	var reasoning, model sql.NullString
+	var promptTokens, completionTokens, reasoningTokens sql.NullInt64
+	var cost sql.NullFloat64
+	var citations []byte
+	err := row.Scan(
+		&message.ID, &message.ChatID, &message.Content, &message.Role, &message.IsStreaming, &reasoning, &message.Timestamp, &message.CreatedAt,
+		&message.Pinned, &model, &promptTokens, &completionTokens, &reasoningTokens, &cost, &citations,
+	)
+	if err != nil {
+		return nil, err
+	}
+	message.Reasoning = reasoning.String
+	if citations != nil {
+		if err := json.Unmarshal(citations, &message.Citations); err != nil {
+			return nil, err
+		}
+	}
+
+	if model.Valid {
+		message.Usage = &MessageUsage{
+			Model:            model.String,
+			PromptTokens:     int(promptTokens.Int64),
+			CompletionTokens: int(completionTokens.Int64),
+			ReasoningTokens:  int(reasoningTokens.Int64),
+		}
+		if cost.Valid {
+			message.Usage.Cost = &cost.Float64
+		}
+	}
+	return &message, nil
 }
 
 type CreateChatRequest struct {
-	Title  string `json:"title"`
-	Model  string `json:"model"`
-	UserID string `json:"userId"`
+	Title       string            `json:"title"`
+	Model       string            `json:"model"`
+	UserID      string            `json:"userId"`
+	WorkspaceID *int              `json:"workspaceId"`
+	PersonaID   *int              `json:"personaId"`
+	Params      *GenerationParams `json:"params"`
+	// MemoryEnabled defaults to true
+	MemoryEnabled   *bool    `json:"memoryEnabled"`
+	KnowledgeBaseID *int     `json:"knowledgeBaseId"`
+	Tools           []string `json:"tools"`
+}
+
+// isClientMessageRole reports whether clients may write a message with a
+// role. System prompts and tool results only come from the server.
+func isClientMessageRole(role string) bool {
+	return role == "user" || role == "assistant"
 }
 
 type CreateMessageRequest struct {
@@ -45,16 +171,44 @@ type CreateMessageRequest struct {
 	Role        string `json:"role"`
 	IsStreaming bool   `json:"isStreaming"`
 	Reasoning   string `json:"reasoning"`
+	// AttachmentIDs link uploaded files to the new message
+	AttachmentIDs []string `json:"attachmentIds"`
 }
 
 type UpdateMessageRequest struct {
 	Content     *string `json:"content,omitempty"`
 	IsStreaming *bool   `json:"isStreaming,omitempty"`
 	Reasoning   *string `json:"reasoning,omitempty"`
+	Pinned      *bool   `json:"pinned,omitempty"`
 }
 
-func NewChatService(db *sql.DB) *ChatService {
-	return &ChatService{db: db}
+func NewChatService(db *sql.DB, models *ModelCatalog, policy *ModelPolicyService, signer *AttachmentSigner, tools *ToolRegistry, titles *TitleService) *ChatService {
+	return &ChatService{db: db, models: models, policy: policy, signer: signer, tools: tools, titles: titles}
+}
+
+// scheduleTitle names chats whose answers are stored by the client instead of
+// CreateCompletion, once one of the given messages is a finished answer.
+func (cs *ChatService) scheduleTitle(chatID int, userID string, messages ...Message) {
+	for _, message := range messages {
+		if message.Role == "assistant" && !message.IsStreaming && message.Content != "" {
+			cs.titles.scheduleTitle(chatID, userID)
+			return
+		}
+	}
+}
+
+// encodeChatTools validates the tools enabled for a chat and encodes them
+// for the tools column.
+func (cs *ChatService) encodeChatTools(c *gin.Context, names []string) ([]string, string, error) {
+	if err := cs.tools.validateToolNames(c.Request.Context(), currentUser(c).ID, names); err != nil {
+		return nil, "", err
+	}
+	names = slices.Compact(slices.Sorted(slices.Values(names)))
+	if names == nil {
+		names = []string{}
+	}
+	data, err := json.Marshal(names)
+	return names, string(data), err
 }
 
 // Create a new chat
@@ -65,21 +219,109 @@ func (cs *ChatService) CreateChat(c *gin.Context) {
 		return
 	}
 
-	// Validate required fields
-	if req.Title == "" {
-		req.Title = "New Chat"
+	// Validate required fields, an explicit title is never replaced by a generated one
+	titleSource := TitleSourceUser
+	if req.Title == "" || req.Title == defaultChatTitle {
+		req.Title = defaultChatTitle
+		titleSource = TitleSourceDefault
+	}
+
+	// Chats always belong to the caller, the userId field is kept for older clients
+	user := currentUser(c)
+	if req.UserID != "" && req.UserID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot create chats for another user"})
+		return
+	}
+	req.UserID = user.ID
+
+	if req.WorkspaceID != nil && !cs.requireWorkspaceRole(c, *req.WorkspaceID, WorkspaceEditor) {
+		return
+	}
+
+	var persona *Persona
+	if req.PersonaID != nil {
+		var err error
+		persona, err = loadPersona(cs.db, *req.PersonaID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+			return
+		}
+		allowed := false
+		if persona != nil {
+			allowed, err = canUsePersona(cs.db, persona, user.ID, req.WorkspaceID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+				return
+			}
+		}
+		if !allowed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Persona not found"})
+			return
+		}
+	}
+
+	if req.KnowledgeBaseID != nil && !cs.authorizeKnowledgeBase(c, *req.KnowledgeBaseID, user.ID, req.WorkspaceID) {
+		return
+	}
+
+	if req.Model == "" && persona != nil && persona.DefaultModel != nil {
+		req.Model = *persona.DefaultModel
 	}
 	if req.Model == "" {
-		req.Model = "openai/gpt-4o"
+		model, err := cs.defaultModel(user, req.WorkspaceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load model policy"})
+			return
+		}
+		req.Model = model
 	}
-	if req.UserID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+	if !cs.models.IsKnown(req.Model) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model"})
+		return
+	}
+	if !cs.policy.authorizeModel(c, req.Model, req.WorkspaceID) {
 		return
 	}
 
+	var params GenerationParams
+	var storedParams interface{}
+	if req.Params != nil {
+		params = *req.Params
+		catalogModel, _ := cs.models.Lookup(req.Model)
+		if err := params.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := params.validateForModel(catalogModel); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := json.Marshal(params)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
+			return
+		}
+		storedParams = string(data)
+	}
+
+	memoryEnabled := req.MemoryEnabled == nil || *req.MemoryEnabled
+
+	tools := []string{}
+	var storedTools interface{}
+	if len(req.Tools) > 0 {
+		var encoded string
+		var err error
+		tools, encoded, err = cs.encodeChatTools(c, req.Tools)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		storedTools = encoded
+	}
+
 	now := time.Now()
-	query := `INSERT INTO chats (title, model, user_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`
-	result, err := cs.db.Exec(query, req.Title, req.Model, req.UserID, now, now)
+	query := `INSERT INTO chats (title, title_source, model, user_id, workspace_id, persona_id, params, memory_enabled, knowledge_base_id, tools, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := cs.db.Exec(query, req.Title, titleSource, req.Model, req.UserID, req.WorkspaceID, req.PersonaID, storedParams, memoryEnabled, req.KnowledgeBaseID, storedTools, now, now)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
 		return
@@ -92,27 +334,49 @@ func (cs *ChatService) CreateChat(c *gin.Context) {
 	}
 
 	chat := Chat{
-		ID:        int(chatID),
-		Title:     req.Title,
-		Model:     req.Model,
-		UserID:    req.UserID,
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:              int(chatID),
+		Title:           req.Title,
+		TitleSource:     titleSource,
+		Model:           req.Model,
+		UserID:          req.UserID,
+		WorkspaceID:     req.WorkspaceID,
+		PersonaID:       req.PersonaID,
+		Params:          params,
+		MemoryEnabled:   memoryEnabled,
+		KnowledgeBaseID: req.KnowledgeBaseID,
+		Tools:           tools,
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	}
 
 	c.JSON(http.StatusCreated, chat)
 }
 
-// Get all chats for a user
+// Get the user's personal chats, or the chats of a workspace when workspaceId is given
 func (cs *ChatService) GetChats(c *gin.Context) {
-	userID := c.Query("userId")
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+	user := currentUser(c)
+	if userID := c.Query("userId"); userID != "" && userID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot list chats of another user"})
 		return
 	}
 
-	query := `SELECT id, title, model, user_id, created_at, updated_at FROM chats WHERE user_id = ? ORDER BY updated_at DESC`
-	rows, err := cs.db.Query(query, userID)
+	query := `SELECT ` + chatColumns + ` FROM chats WHERE user_id = ? AND workspace_id IS NULL ORDER BY updated_at DESC`
+	args := []interface{}{user.ID}
+
+	if workspaceIDStr := c.Query("workspaceId"); workspaceIDStr != "" {
+		workspaceID, err := strconv.Atoi(workspaceIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		if !cs.requireWorkspaceRole(c, workspaceID, WorkspaceViewer) {
+			return
+		}
+		query = `SELECT ` + chatColumns + ` FROM chats WHERE workspace_id = ? ORDER BY updated_at DESC`
+		args = []interface{}{workspaceID}
+	}
+
+	rows, err := cs.db.Query(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chats"})
 		return
@@ -121,13 +385,12 @@ func (cs *ChatService) GetChats(c *gin.Context) {
 
 	var chats []Chat
 	for rows.Next() {
-		var chat Chat
-		err := rows.Scan(&chat.ID, &chat.Title, &chat.Model, &chat.UserID, &chat.CreatedAt, &chat.UpdatedAt)
+		chat, err := scanChat(rows)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan chat"})
 			return
 		}
-		chats = append(chats, chat)
+		chats = append(chats, *chat)
 	}
 
 	if chats == nil {
@@ -146,15 +409,8 @@ func (cs *ChatService) GetChat(c *gin.Context) {
 		return
 	}
 
-	query := `SELECT id, title, model, user_id, created_at, updated_at FROM chats WHERE id = ?`
-	var chat Chat
-	err = cs.db.QueryRow(query, chatID).Scan(&chat.ID, &chat.Title, &chat.Model, &chat.UserID, &chat.CreatedAt, &chat.UpdatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
-		}
+	chat, ok := cs.authorizeChat(c, chatID, WorkspaceViewer)
+	if !ok {
 		return
 	}
 
@@ -171,8 +427,15 @@ func (cs *ChatService) UpdateChat(c *gin.Context) {
 	}
 
 	var req struct {
-		Title *string `json:"title,omitempty"`
-		Model *string `json:"model,omitempty"`
+		Title  *string           `json:"title,omitempty"`
+		Model  *string           `json:"model,omitempty"`
+		Params *GenerationParams `json:"params,omitempty"`
+		// MemoryEnabled opts the chat in or out of long-term memory
+		MemoryEnabled *bool `json:"memoryEnabled,omitempty"`
+		// KnowledgeBaseID attaches a knowledge base, 0 detaches it
+		KnowledgeBaseID *int `json:"knowledgeBaseId,omitempty"`
+		// Tools replaces the enabled tools, an empty list disables them
+		Tools *[]string `json:"tools,omitempty"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -180,19 +443,85 @@ func (cs *ChatService) UpdateChat(c *gin.Context) {
 		return
 	}
 
+	chat, ok := cs.authorizeChat(c, chatID, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
 	// Build dynamic update query
 	updateFields := []string{}
 	args := []interface{}{}
 
 	if req.Title != nil {
-		updateFields = append(updateFields, "title = ?")
-		args = append(args, *req.Title)
+		updateFields = append(updateFields, "title = ?", "title_source = ?")
+		args = append(args, *req.Title, TitleSourceUser)
 	}
 	if req.Model != nil {
+		if !cs.models.IsKnown(*req.Model) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model"})
+			return
+		}
+		if *req.Model != chat.Model && !cs.policy.authorizeModel(c, *req.Model, chat.WorkspaceID) {
+			return
+		}
 		updateFields = append(updateFields, "model = ?")
 		args = append(args, *req.Model)
 	}
 
+	// Parameters are checked against the model the chat ends up with
+	if req.Params != nil || req.Model != nil {
+		model := chat.Model
+		if req.Model != nil {
+			model = *req.Model
+		}
+		params := chat.Params
+		if req.Params != nil {
+			params = *req.Params
+			if err := params.validate(); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		catalogModel, _ := cs.models.Lookup(model)
+		if err := params.validateForModel(catalogModel); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Params != nil {
+		data, err := json.Marshal(req.Params)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+			return
+		}
+		updateFields = append(updateFields, "params = ?")
+		args = append(args, string(data))
+	}
+	if req.MemoryEnabled != nil {
+		updateFields = append(updateFields, "memory_enabled = ?")
+		args = append(args, *req.MemoryEnabled)
+	}
+	if req.KnowledgeBaseID != nil {
+		var knowledgeBaseID interface{}
+		if *req.KnowledgeBaseID != 0 {
+			if !cs.authorizeKnowledgeBase(c, *req.KnowledgeBaseID, currentUser(c).ID, chat.WorkspaceID) {
+				return
+			}
+			knowledgeBaseID = *req.KnowledgeBaseID
+		}
+		updateFields = append(updateFields, "knowledge_base_id = ?")
+		args = append(args, knowledgeBaseID)
+	}
+	if req.Tools != nil {
+		_, tools, err := cs.encodeChatTools(c, *req.Tools)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updateFields = append(updateFields, "tools = ?")
+		args = append(args, tools)
+	}
+
 	if len(updateFields) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
@@ -226,6 +555,10 @@ func (cs *ChatService) DeleteChat(c *gin.Context) {
 		return
 	}
 
+	if _, ok := cs.authorizeChat(c, chatID, WorkspaceEditor); !ok {
+		return
+	}
+
 	// Delete messages first (foreign key constraint)
 	_, err = cs.db.Exec("DELETE FROM messages WHERE chat_id = ?", chatID)
 	if err != nil {
@@ -256,7 +589,7 @@ func (cs *ChatService) CreateMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID is required"})
 		return
 	}
-	if req.Content == "" {
+	if req.Content == "" && len(req.AttachmentIDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Content is required"})
 		return
 	}
@@ -264,6 +597,18 @@ func (cs *ChatService) CreateMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Role is required"})
 		return
 	}
+	if !isClientMessageRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	chat, ok := cs.authorizeChat(c, req.ChatID, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	if !requireVisionSupport(c, cs.db, cs.models, chat.Model, currentUser(c).ID, req.AttachmentIDs) {
+		return
+	}
 
 	now := time.Now()
 	query := `INSERT INTO messages (chat_id, content, role, isStreaming, reasoning, timestamp, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
@@ -279,6 +624,12 @@ func (cs *ChatService) CreateMessage(c *gin.Context) {
 		return
 	}
 
+	if err := linkAttachments(cs.db, int(messageID), currentUser(c).ID, req.AttachmentIDs); err != nil {
+		cs.db.Exec("DELETE FROM messages WHERE id = ?", messageID)
+		respondLinkError(c, err)
+		return
+	}
+
 	message := Message{
 		ID:          int(messageID),
 		ChatID:      req.ChatID,
@@ -289,41 +640,41 @@ func (cs *ChatService) CreateMessage(c *gin.Context) {
 		Timestamp:   now,
 		CreatedAt:   now,
 	}
+	if len(req.AttachmentIDs) > 0 {
+		attachments, err := queryChatAttachments(cs.db, req.ChatID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachments"})
+			return
+		}
+		message.Attachments = attachments[message.ID]
+		for i := range message.Attachments {
+			cs.signer.sign(&message.Attachments[i])
+		}
+	}
+	cs.scheduleTitle(req.ChatID, currentUser(c).ID, message)
 
 	c.JSON(http.StatusCreated, message)
 }
 
 // Get messages for a chat
 func (cs *ChatService) GetMessages(c *gin.Context) {
-	chatIDStr := c.Param("id")  // Changed from "chatId" to "id"
+	chatIDStr := c.Param("id") // Changed from "chatId" to "id"
 	chatID, err := strconv.Atoi(chatIDStr)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
 		return
 	}
 
-	query := `SELECT id, chat_id, content, role, isStreaming, reasoning, timestamp, created_at FROM messages WHERE chat_id = ? ORDER BY timestamp ASC`
-	rows, err := cs.db.Query(query, chatID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+	if _, ok := cs.authorizeChat(c, chatID, WorkspaceViewer); !ok {
 		return
 	}
-	defer rows.Close()
-
-	var messages []Message
-	for rows.Next() {
-		var message Message
-		err := rows.Scan(&message.ID, &message.ChatID, &message.Content, &message.Role, &message.IsStreaming, &message.Reasoning, &message.Timestamp, &message.CreatedAt)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan message"})
-			return
-		}
-		messages = append(messages, message)
-	}
 
-	if messages == nil {
-		messages = []Message{}
+	messages, err := queryChatMessages(cs.db, chatID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
 	}
+	cs.signer.signMessages(messages)
 
 	c.JSON(http.StatusOK, messages)
 }
@@ -343,6 +694,19 @@ func (cs *ChatService) UpdateMessage(c *gin.Context) {
 		return
 	}
 
+	var chatID int
+	if err := cs.db.QueryRow("SELECT chat_id FROM messages WHERE id = ?", messageID).Scan(&chatID); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message"})
+		}
+		return
+	}
+	if _, ok := cs.authorizeChat(c, chatID, WorkspaceEditor); !ok {
+		return
+	}
+
 	// Build dynamic update query
 	updateFields := []string{}
 	args := []interface{}{}
@@ -359,6 +723,10 @@ func (cs *ChatService) UpdateMessage(c *gin.Context) {
 		updateFields = append(updateFields, "reasoning = ?")
 		args = append(args, *req.Reasoning)
 	}
+	if req.Pinned != nil {
+		updateFields = append(updateFields, "pinned = ?")
+		args = append(args, *req.Pinned)
+	}
 
 	if len(updateFields) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
@@ -395,6 +763,60 @@ func (cs *ChatService) SyncChatData(c *gin.Context) {
 		return
 	}
 
+	// Existing chats need edit access, new ones are created for the caller
+	user := currentUser(c)
+	var exists bool
+	if err := cs.db.QueryRow("SELECT EXISTS(SELECT 1 FROM chats WHERE id = ?)", req.Chat.ID).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		return
+	}
+	workspaceID, currentModel := req.Chat.WorkspaceID, ""
+	if exists {
+		chat, ok := cs.authorizeChat(c, req.Chat.ID, WorkspaceEditor)
+		if !ok {
+			return
+		}
+		workspaceID, currentModel = chat.WorkspaceID, chat.Model
+	} else {
+		if req.Chat.WorkspaceID != nil && !cs.requireWorkspaceRole(c, *req.Chat.WorkspaceID, WorkspaceEditor) {
+			return
+		}
+		req.Chat.UserID = user.ID
+	}
+
+	// A synced model goes through the same checks as UpdateChat
+	if !exists || req.Chat.Model != currentModel {
+		if !cs.models.IsKnown(req.Chat.Model) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model"})
+			return
+		}
+		if !cs.policy.authorizeModel(c, req.Chat.Model, workspaceID) {
+			return
+		}
+	}
+
+	// Messages may only be written into the synced chat
+	for _, message := range req.Messages {
+		if message.ChatID != req.Chat.ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Message does not belong to the synced chat"})
+			return
+		}
+		if !isClientMessageRole(message.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+
+		var existingChatID int
+		err := cs.db.QueryRow("SELECT chat_id FROM messages WHERE id = ?", message.ID).Scan(&existingChatID)
+		if err == nil && existingChatID != req.Chat.ID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Message belongs to another chat"})
+			return
+		} else if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message"})
+			return
+		}
+	}
+
 	// Start transaction
 	tx, err := cs.db.Begin()
 	if err != nil {
@@ -403,14 +825,15 @@ func (cs *ChatService) SyncChatData(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	// Upsert chat (insert or update)
-	chatQuery := `INSERT INTO chats (id, title, model, user_id, created_at, updated_at) 
-					VALUES (?, ?, ?, ?, ?, ?) 
+	// Upsert chat (insert or update). A synced title only replaces the default
+	// one, so it can't undo a generated or user-chosen title.
+	chatQuery := `INSERT INTO chats (id, title, model, user_id, workspace_id, created_at, updated_at) 
+					VALUES (?, ?, ?, ?, ?, ?, ?) 
 					ON DUPLICATE KEY UPDATE 
-					title = VALUES(title), model = VALUES(model), updated_at = VALUES(updated_at)`
-	
-	_, err = tx.Exec(chatQuery, req.Chat.ID, req.Chat.Title, req.Chat.Model, 
-		req.Chat.UserID, req.Chat.CreatedAt, req.Chat.UpdatedAt)
+					title = IF(title_source = 'default', VALUES(title), title), model = VALUES(model), updated_at = VALUES(updated_at)`
+
+	_, err = tx.Exec(chatQuery, req.Chat.ID, req.Chat.Title, req.Chat.Model,
+		req.Chat.UserID, req.Chat.WorkspaceID, req.Chat.CreatedAt, req.Chat.UpdatedAt)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync chat"})
 		return
@@ -423,9 +846,9 @@ func (cs *ChatService) SyncChatData(c *gin.Context) {
 					ON DUPLICATE KEY UPDATE 
 					content = VALUES(content), role = VALUES(role), 
 					isStreaming = VALUES(isStreaming), reasoning = VALUES(reasoning)`
-		
-		_, err = tx.Exec(msgQuery, message.ID, message.ChatID, message.Content, 
-			message.Role, message.IsStreaming, message.Reasoning, 
+
+		_, err = tx.Exec(msgQuery, message.ID, message.ChatID, message.Content,
+			message.Role, message.IsStreaming, message.Reasoning,
 			message.Timestamp, message.CreatedAt)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync message"})
@@ -438,6 +861,140 @@ func (cs *ChatService) SyncChatData(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
 		return
 	}
+	cs.scheduleTitle(req.Chat.ID, user.ID, req.Messages...)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Data synced successfully"})
-}
\ No newline at end of file
+}
+
+// authorizeChat loads a chat and checks that the current user holds at least
+// minRole on it. Personal chats grant their owner every permission, workspace
+// chats use the caller's membership role. Responds and returns false otherwise.
+func (cs *ChatService) authorizeChat(c *gin.Context, chatID int, minRole string) (*Chat, bool) {
+	user := currentUser(c)
+
+	chat, err := scanChat(cs.db.QueryRow(`SELECT `+chatColumns+` FROM chats WHERE id = ?`, chatID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat"})
+		}
+		return nil, false
+	}
+
+	if chat.WorkspaceID == nil {
+		if chat.UserID != user.ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+			return nil, false
+		}
+		return chat, true
+	}
+
+	role, err := workspaceRole(cs.db, *chat.WorkspaceID, user.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace membership"})
+		return nil, false
+	}
+	if !hasWorkspaceRole(role, minRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient workspace permissions"})
+		return nil, false
+	}
+
+	return chat, true
+}
+
+// requireWorkspaceRole checks the current user's membership in a workspace.
+// Responds and returns false when the user lacks minRole.
+func (cs *ChatService) requireWorkspaceRole(c *gin.Context, workspaceID int, minRole string) bool {
+	role, err := workspaceRole(cs.db, workspaceID, currentUser(c).ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace membership"})
+		return false
+	}
+	if !hasWorkspaceRole(role, minRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient workspace permissions"})
+		return false
+	}
+	return true
+}
+
+// defaultModel picks the model for a new chat: the user's own default when
+// the policy allows it there, otherwise the policy default.
+func (cs *ChatService) defaultModel(user *User, workspaceID *int) (string, error) {
+	policy, err := cs.policy.effectivePolicy(user, workspaceID)
+	if err != nil {
+		return "", err
+	}
+
+	settings, err := loadUserSettings(cs.db, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if model := settings.String(SettingDefaultModel); model != "" && policy.Allows(model) && cs.models.IsKnown(model) {
+		return model, nil
+	}
+	return policy.DefaultModel, nil
+}
+
+// queryChatMessages returns the messages of a chat in chronological order.
+func queryChatMessages(db *sql.DB, chatID int) ([]Message, error) {
+	rows, err := db.Query(`SELECT `+messageColumns+` FROM messages WHERE chat_id = ? ORDER BY timestamp ASC, id ASC`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	attachments, err := queryChatAttachments(db, chatID)
+	if err != nil {
+		return nil, err
+	}
+	toolCalls, err := queryChatToolCalls(db, chatID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+		messages[i].ToolCalls = toolCalls[messages[i].ID]
+	}
+	return messages, nil
+}
+
+// insertMessage stores a new message and fills in its ID and timestamps.
+func insertMessage(db *sql.DB, message *Message) error {
+	now := time.Now()
+	result, err := db.Exec(
+		`INSERT INTO messages (chat_id, content, role, isStreaming, reasoning, timestamp, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		message.ChatID, message.Content, message.Role, message.IsStreaming, message.Reasoning, now, now,
+	)
+	if err != nil {
+		return err
+	}
+
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	message.ID = int(messageID)
+	message.Timestamp = now
+	message.CreatedAt = now
+	return nil
+}
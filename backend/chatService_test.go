@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+)
+
+// titleCheckDriver answers the title check query of TitleService.scheduleTitle
+// with the title source and answer count stored for a DSN.
+type titleCheckDriver struct{}
+
+type titleCheckRow struct {
+	titleSource string
+	answered    int64
+	queries     int
+}
+
+var (
+	titleCheckMu   sync.Mutex
+	titleCheckRows = map[string]*titleCheckRow{}
+)
+
+func init() {
+	sql.Register("titlecheck", titleCheckDriver{})
+}
+
+func (titleCheckDriver) Open(dsn string) (driver.Conn, error) {
+	return &titleCheckConn{dsn: dsn}, nil
+}
+
+type titleCheckConn struct{ dsn string }
+
+func (c *titleCheckConn) Prepare(query string) (driver.Stmt, error) {
+	return &titleCheckStmt{dsn: c.dsn}, nil
+}
+func (c *titleCheckConn) Close() error              { return nil }
+func (c *titleCheckConn) Begin() (driver.Tx, error) { return nil, driver.ErrSkip }
+
+type titleCheckStmt struct{ dsn string }
+
+func (s *titleCheckStmt) Close() error  { return nil }
+func (s *titleCheckStmt) NumInput() int { return -1 }
+func (s *titleCheckStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, driver.ErrSkip
+}
+func (s *titleCheckStmt) Query(args []driver.Value) (driver.Rows, error) {
+	titleCheckMu.Lock()
+	defer titleCheckMu.Unlock()
+	row := titleCheckRows[s.dsn]
+	row.queries++
+	return &titleCheckResult{values: []driver.Value{row.titleSource, row.answered}}, nil
+}
+
+type titleCheckResult struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *titleCheckResult) Columns() []string { return []string{"title_source", "answered"} }
+func (r *titleCheckResult) Close() error      { return nil }
+func (r *titleCheckResult) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+// newTitleTestChatService returns a chat service whose title checks see the
+// given chat state, and a queue without workers to inspect scheduled jobs.
+func newTitleTestChatService(t *testing.T, titleSource string, answered int64) (*ChatService, *JobQueue, *titleCheckRow) {
+	t.Helper()
+	row := &titleCheckRow{titleSource: titleSource, answered: answered}
+	titleCheckMu.Lock()
+	titleCheckRows[t.Name()] = row
+	titleCheckMu.Unlock()
+
+	db, err := sql.Open("titlecheck", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	jobs := &JobQueue{jobs: make(chan job, 4)}
+	titles := &TitleService{db: db, jobs: jobs}
+	return &ChatService{db: db, titles: titles}, jobs, row
+}
+
+func TestSyncedFirstExchangeSchedulesTitle(t *testing.T) {
+	cs, jobs, _ := newTitleTestChatService(t, TitleSourceDefault, 1)
+
+	cs.scheduleTitle(1, "user-1",
+		Message{ChatID: 1, Role: "user", Content: "How do tides work?"},
+		Message{ChatID: 1, Role: "assistant", Content: "The moon's gravity pulls on the oceans."},
+	)
+	if len(jobs.jobs) != 1 {
+		t.Fatalf("queued %d title jobs, want 1", len(jobs.jobs))
+	}
+}
+
+func TestUserTitledChatKeepsTitle(t *testing.T) {
+	cs, jobs, row := newTitleTestChatService(t, TitleSourceUser, 1)
+
+	cs.scheduleTitle(1, "user-1",
+		Message{ChatID: 1, Role: "user", Content: "How do tides work?"},
+		Message{ChatID: 1, Role: "assistant", Content: "The moon's gravity pulls on the oceans."},
+	)
+	if row.queries != 1 {
+		t.Fatalf("title check ran %d times, want 1", row.queries)
+	}
+	if len(jobs.jobs) != 0 {
+		t.Fatalf("queued %d title jobs for a user-titled chat", len(jobs.jobs))
+	}
+}
+
+func TestUnfinishedAnswerSkipsTitleCheck(t *testing.T) {
+	cs, jobs, row := newTitleTestChatService(t, TitleSourceDefault, 0)
+
+	cs.scheduleTitle(1, "user-1",
+		Message{ChatID: 1, Role: "user", Content: "How do tides work?"},
+		Message{ChatID: 1, Role: "assistant", IsStreaming: true},
+	)
+	if row.queries != 0 || len(jobs.jobs) != 0 {
+		t.Fatalf("streaming answer ran %d checks and queued %d jobs", row.queries, len(jobs.jobs))
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const completionErrorMessage = "Sorry, there was an error processing your request."
+
+type CompletionService struct {
+	db        *sql.DB
+	chats     *ChatService
+	providers *ProviderClient
+	keys      *ProviderKeyService
+	limiter   *RateLimiter
+	titles    *TitleService
+	contexts  *ContextService
+	memories  *MemoryService
+	knowledge *KnowledgeService
+	tools     *ToolRegistry
+}
+
+type CreateCompletionRequest struct {
+	// Content, when set, is stored as a new user message before completing
+	Content   string `json:"content"`
+	Reasoning bool   `json:"reasoning"`
+	// AttachmentIDs link uploaded files to the new user message
+	AttachmentIDs []string `json:"attachmentIds"`
+}
+
+func NewCompletionService(db *sql.DB, chats *ChatService, providers *ProviderClient, keys *ProviderKeyService, limiter *RateLimiter, titles *TitleService, contexts *ContextService, memories *MemoryService, knowledge *KnowledgeService, tools *ToolRegistry) *CompletionService {
+	return &CompletionService{
+		db:        db,
+		chats:     chats,
+		providers: providers,
+		keys:      keys,
+		limiter:   limiter,
+		titles:    titles,
+		contexts:  contexts,
+		memories:  memories,
+		knowledge: knowledge,
+		tools:     tools,
+	}
+}
+
+// Generate the next assistant message for a chat, streamed as server-sent events.
+//
+// Events: "start" with the stored message IDs, "delta" with content and
+// reasoning chunks, "tool_call" and "tool_result" around every tool the
+// model calls, then "done" with the final message or "error".
+func (cs *CompletionService) CreateCompletion(c *gin.Context) {
+	chatID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req CreateCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	chat, ok := cs.chats.authorizeChat(c, chatID, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	if !cs.chats.policy.authorizeModel(c, chat.Model, chat.WorkspaceID) {
+		return
+	}
+	user := currentUser(c)
+
+	apiKey, _, err := cs.keys.resolveAPIKey(user.ID, ProviderOpenRouter)
+	if err != nil {
+		if errors.Is(err, errNoAPIKey) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No API key configured for this provider"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load API key"})
+		}
+		return
+	}
+
+	if !requireVisionSupport(c, cs.db, cs.chats.models, chat.Model, user.ID, req.AttachmentIDs) {
+		return
+	}
+
+	var userMessage *Message
+	if req.Content != "" || len(req.AttachmentIDs) > 0 {
+		userMessage = &Message{ChatID: chat.ID, Content: req.Content, Role: "user"}
+		if err := insertMessage(cs.db, userMessage); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+			return
+		}
+		if err := linkAttachments(cs.db, userMessage.ID, user.ID, req.AttachmentIDs); err != nil {
+			cs.db.Exec("DELETE FROM messages WHERE id = ?", userMessage.ID)
+			respondLinkError(c, err)
+			return
+		}
+	}
+
+	history, err := queryChatMessages(cs.db, chat.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+		return
+	}
+
+	settings, err := loadUserSettings(cs.db, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+		return
+	}
+
+	var persona *Persona
+	if chat.PersonaID != nil {
+		if persona, err = loadPersona(cs.db, *chat.PersonaID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+			return
+		}
+	}
+
+	// The persona's system prompt replaces the user's default one
+	systemPrompt := settings.String(SettingDefaultSystemPrompt)
+	if persona != nil && persona.SystemPrompt != "" {
+		systemPrompt = persona.SystemPrompt
+	}
+
+	// Memories are personal, workspace chats are shared with other members
+	latestUserMessage := ""
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "user" {
+			latestUserMessage = history[i].Content
+			break
+		}
+	}
+	useMemory := chat.MemoryEnabled && chat.WorkspaceID == nil
+	if useMemory && settings.Bool(SettingMemoryEnabled) {
+		memories, err := cs.memories.relevantMemories(user.ID, latestUserMessage, modelTokenizer(chat.Model))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memories"})
+			return
+		}
+		systemPrompt = withMemories(systemPrompt, memories)
+	}
+
+	// A failed search shouldn't keep the question from being answered
+	var knowledge []RetrievedChunk
+	if chat.KnowledgeBaseID != nil && latestUserMessage != "" {
+		knowledge, err = cs.knowledge.retrieve(c.Request.Context(), *chat.KnowledgeBaseID, user.ID, latestUserMessage)
+		if err != nil {
+			log.Printf("Failed to search knowledge base %d for chat %d: %v", *chat.KnowledgeBaseID, chat.ID, err)
+		}
+		systemPrompt = withKnowledge(systemPrompt, knowledge)
+	}
+
+	completion := CompletionRequest{Model: chat.Model}
+	if effort := settings.String(SettingReasoningEffort); req.Reasoning && effort != "none" {
+		completion.Reasoning = &ReasoningConfig{Effort: effort}
+	}
+	if persona != nil {
+		persona.Params.apply(&completion)
+	}
+	chat.Params.apply(&completion)
+
+	prompt, err := cs.contexts.buildContext(c.Request.Context(), chat, settings.String(SettingContextStrategy), systemPrompt, history, completion.MaxTokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build context"})
+		return
+	}
+	completion.Messages = prompt.Messages
+
+	// Tools are offered when the chat enabled some and the model can call them
+	var enabledTools []string
+	var tools []ProviderTool
+	if catalogModel, known := cs.chats.models.Lookup(chat.Model); len(chat.Tools) > 0 && (!known || catalogModel.SupportsTools) {
+		enabledTools = chat.Tools
+		tools = providerTools(cs.tools.Definitions(c.Request.Context(), user.ID, enabledTools))
+	}
+
+	assistantMessage := &Message{ChatID: chat.ID, Role: "assistant", IsStreaming: true}
+	if err := insertMessage(cs.db, assistantMessage); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+		return
+	}
+	if err := cs.contexts.recordContext(assistantMessage.ID, chat.ID, prompt); err != nil {
+		log.Printf("Failed to record context for message %d: %v", assistantMessage.ID, err)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	start := gin.H{"assistantMessageId": assistantMessage.ID}
+	if userMessage != nil {
+		start["userMessageId"] = userMessage.ID
+	}
+	c.SSEvent("start", start)
+	c.Writer.Flush()
+
+	// Tool citations are numbered after the knowledge base excerpts
+	toolContext := &ToolContext{UserID: user.ID, ChatID: chat.ID, citations: chunkCitations(knowledge)}
+
+	// Text of later rounds starts a new paragraph, in the stream as well
+	paragraphBreak := false
+	onDelta := func(delta StreamDelta) error {
+		if paragraphBreak && delta.Content != "" {
+			delta.Content = "\n\n" + delta.Content
+			paragraphBreak = false
+		}
+		c.SSEvent("delta", delta)
+		c.Writer.Flush()
+		return nil
+	}
+
+	// Each round the model either answers or calls tools, whose results are
+	// sent back to it. The last round offers no tools to force an answer.
+	var streamErr error
+	for round := 0; ; round++ {
+		completion.Tools = nil
+		if len(tools) > 0 && round < maxToolRounds {
+			completion.Tools = tools
+		}
+		paragraphBreak = assistantMessage.Content != ""
+
+		var result *CompletionResult
+		result, streamErr = cs.providers.StreamChat(c.Request.Context(), ProviderOpenRouter, apiKey, completion, onDelta)
+		if result != nil {
+			if result.Content != "" && assistantMessage.Content != "" {
+				assistantMessage.Content += "\n\n"
+			}
+			assistantMessage.Content += result.Content
+			assistantMessage.Reasoning += result.Reasoning
+			addUsage(assistantMessage, result)
+		}
+		if streamErr != nil || result == nil || len(result.ToolCalls) == 0 || completion.Tools == nil {
+			break
+		}
+
+		completion.Messages = append(completion.Messages, ProviderMessage{Role: "assistant", Content: result.Content, ToolCalls: result.ToolCalls})
+		for _, request := range result.ToolCalls {
+			c.SSEvent("tool_call", gin.H{"callId": request.ID, "name": request.Function.Name, "arguments": request.Function.Arguments})
+			c.Writer.Flush()
+
+			call := cs.tools.runToolCall(c.Request.Context(), toolContext, enabledTools, request)
+			call.Round = round
+			if err := insertToolCall(cs.db, assistantMessage.ID, &call); err != nil {
+				log.Printf("Failed to store tool call %s for message %d: %v", call.Name, assistantMessage.ID, err)
+			}
+			assistantMessage.ToolCalls = append(assistantMessage.ToolCalls, call)
+			completion.Messages = append(completion.Messages, ProviderMessage{Role: "tool", Content: call.Result, ToolCallID: request.ID})
+
+			c.SSEvent("tool_result", call)
+			c.Writer.Flush()
+		}
+	}
+	assistantMessage.Citations = toolContext.citations
+	assistantMessage.IsStreaming = false
+
+	// Keep whatever arrived before the client went away
+	if streamErr != nil && !errors.Is(streamErr, context.Canceled) {
+		log.Printf("Completion for chat %d failed: %v", chat.ID, streamErr)
+		if assistantMessage.Content == "" {
+			assistantMessage.Content = completionErrorMessage
+		}
+	}
+
+	if err := cs.finishMessage(assistantMessage, user.ID); err != nil {
+		log.Printf("Failed to store completion for chat %d: %v", chat.ID, err)
+	}
+
+	if assistantMessage.Usage != nil {
+		cs.limiter.RecordTokens(c, int64(assistantMessage.Usage.PromptTokens+assistantMessage.Usage.CompletionTokens))
+	} else {
+		cs.limiter.RecordTokens(c, estimateCompletionTokens(completion.Messages, assistantMessage))
+	}
+
+	if streamErr != nil {
+		c.SSEvent("error", gin.H{"error": "The provider request failed", "message": assistantMessage})
+	} else {
+		c.SSEvent("done", assistantMessage)
+		cs.titles.scheduleTitle(chat.ID, user.ID)
+		cs.contexts.scheduleSummary(chat, user.ID, prompt)
+		if useMemory && settings.Bool(SettingMemoryExtraction) {
+			cs.memories.scheduleExtraction(chat, user.ID, latestUserMessage, assistantMessage.Content)
+		}
+	}
+	c.Writer.Flush()
+}
+
+// addUsage adds the usage of one provider request to a message, which may
+// take several requests when tools are called.
+func addUsage(message *Message, result *CompletionResult) {
+	if result.Usage == nil {
+		return
+	}
+	if message.Usage == nil {
+		message.Usage = &MessageUsage{}
+	}
+	message.Usage.Model = result.Model
+	message.Usage.PromptTokens += result.Usage.PromptTokens
+	message.Usage.CompletionTokens += result.Usage.CompletionTokens
+	message.Usage.ReasoningTokens += result.Usage.CompletionTokensDetails.ReasoningTokens
+	if result.Usage.Cost != nil {
+		cost := *result.Usage.Cost
+		if message.Usage.Cost != nil {
+			cost += *message.Usage.Cost
+		}
+		message.Usage.Cost = &cost
+	}
+}
+
+// finishMessage persists the final state of a streamed assistant message,
+// attributing its usage to the user who requested it.
+func (cs *CompletionService) finishMessage(message *Message, userID string) error {
+	var model sql.NullString
+	var promptTokens, completionTokens, reasoningTokens sql.NullInt64
+	var cost sql.NullFloat64
+	var citations interface{}
+	if len(message.Citations) > 0 {
+		data, err := json.Marshal(message.Citations)
+		if err != nil {
+			return err
+		}
+		citations = string(data)
+	}
+	if message.Usage != nil {
+		model = sql.NullString{String: message.Usage.Model, Valid: true}
+		promptTokens = sql.NullInt64{Int64: int64(message.Usage.PromptTokens), Valid: true}
+		completionTokens = sql.NullInt64{Int64: int64(message.Usage.CompletionTokens), Valid: true}
+		reasoningTokens = sql.NullInt64{Int64: int64(message.Usage.ReasoningTokens), Valid: true}
+		if message.Usage.Cost != nil {
+			cost = sql.NullFloat64{Float64: *message.Usage.Cost, Valid: true}
+		}
+	}
+
+	_, err := cs.db.Exec(`
+		UPDATE messages
+		SET content = ?, reasoning = ?, isStreaming = FALSE, user_id = ?,
+		model = ?, prompt_tokens = ?, completion_tokens = ?, reasoning_tokens = ?, cost = ?, citations = ?
+		WHERE id = ?
+	`, message.Content, message.Reasoning, userID, model, promptTokens, completionTokens, reasoningTokens, cost, citations, message.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.db.Exec("UPDATE chats SET updated_at = ? WHERE id = ?", time.Now(), message.ChatID)
+	return err
+}
+
+// estimateCompletionTokens approximates the tokens spent on a completion
+// from the prompt and the generated output.
+func estimateCompletionTokens(prompt []ProviderMessage, output *Message) int64 {
+	var tokens int64
+	for _, message := range prompt {
+		if len(message.Parts) == 0 {
+			tokens += estimateTokens(message.Content)
+		}
+		for _, part := range message.Parts {
+			if part.Type == "image_url" {
+				tokens += imagePartTokens
+			} else {
+				tokens += estimateTokens(part.Text)
+			}
+		}
+	}
+	return tokens + estimateTokens(output.Content) + estimateTokens(output.Reasoning)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context strategies decide which messages are sent when a chat no longer
+// fits the model's context window.
+const (
+	// ContextDropOldest sends the most recent messages that fit
+	ContextDropOldest = "drop_oldest"
+	// ContextKeepPinned always sends system and pinned messages, then the
+	// most recent messages that fit
+	ContextKeepPinned = "keep_pinned"
+	// ContextSummarize replaces older messages with a rolling summary that is
+	// updated in the background whenever messages fall out of the window
+	ContextSummarize = "summarize"
+)
+
+var contextStrategies = []string{ContextDropOldest, ContextKeepPinned, ContextSummarize}
+
+const (
+	// minDocumentTokens of each document are sent even when the latest
+	// message doesn't fit otherwise
+	minDocumentTokens    = 500
+	summaryMaxTokens     = 600
+	summaryMessagePrefix = "Summary of the earlier conversation:\n\n"
+	summaryPrompt        = "You maintain a running summary of a conversation. Merge the previous summary, if any, with the new messages into one concise summary. Keep names, decisions, facts, open questions and instructions the user gave. Only return the summary."
+)
+
+// ChatSummary condenses the messages of a chat up to and including
+// ThroughMessageID.
+type ChatSummary struct {
+	ChatID           int       `json:"chatId"`
+	Content          string    `json:"content"`
+	ThroughMessageID int       `json:"throughMessageId"`
+	MessageCount     int       `json:"messageCount"`
+	Model            string    `json:"model"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// PromptContext is the prompt built for one completion, together with the
+// record of what went into it.
+type PromptContext struct {
+	Messages         []ProviderMessage `json:"-"`
+	Strategy         string            `json:"strategy"`
+	MessageIDs       []int             `json:"messageIds"`
+	DroppedCount     int               `json:"droppedCount"`
+	SummaryThroughID *int              `json:"summaryThroughId"`
+	EstimatedTokens  int               `json:"estimatedTokens"`
+	ContextLength    int               `json:"contextLength"`
+	// unsummarized are the dropped messages the summary doesn't cover yet
+	unsummarized []Message
+	summary      *ChatSummary
+}
+
+// CompletionContextRecord is the stored PromptContext of an assistant message.
+type CompletionContextRecord struct {
+	MessageID int `json:"messageId"`
+	ChatID    int `json:"chatId"`
+	PromptContext
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ContextService struct {
+	db        *sql.DB
+	chats     *ChatService
+	jobs      *JobQueue
+	providers *ProviderClient
+	keys      *ProviderKeyService
+	vision    *VisionService
+	// defaultLength is assumed for models the catalog doesn't describe
+	defaultLength int
+	// reserveTokens are kept free for the answer when no maxTokens is set
+	reserveTokens int
+	// summaryModel is empty when chats are summarized by their own model
+	summaryModel string
+	// documentTokens caps each document attached to an earlier message
+	documentTokens int
+
+	mu          sync.Mutex
+	summarizing map[int]bool
+}
+
+func NewContextService(db *sql.DB, chats *ChatService, jobs *JobQueue, providers *ProviderClient, keys *ProviderKeyService, vision *VisionService) *ContextService {
+	return &ContextService{
+		db:             db,
+		chats:          chats,
+		jobs:           jobs,
+		providers:      providers,
+		keys:           keys,
+		vision:         vision,
+		defaultLength:  int(getEnvInt64("CONTEXT_DEFAULT_LENGTH", 8192)),
+		reserveTokens:  int(getEnvInt64("CONTEXT_RESERVE_TOKENS", 1024)),
+		summaryModel:   getEnv("SUMMARY_MODEL", ""),
+		documentTokens: int(getEnvInt64("DOCUMENT_PROMPT_TOKENS", 8000)),
+		summarizing:    make(map[int]bool),
+	}
+}
+
+// buildContext selects the messages of a chat that fit the model's context
+// window after the system prompt and the room reserved for the answer. The
+// latest message is always sent, even when it doesn't fit on its own.
+func (cs *ContextService) buildContext(ctx context.Context, chat *Chat, strategy, systemPrompt string, history []Message, maxTokens *int) (*PromptContext, error) {
+	tokenizer := modelTokenizer(chat.Model)
+
+	contextLength := cs.defaultLength
+	// Models the catalog doesn't describe are trusted to accept images
+	vision := true
+	if model, ok := cs.chats.models.Lookup(chat.Model); ok {
+		if model.ContextLength > 0 {
+			contextLength = model.ContextLength
+		}
+		vision = model.SupportsVision
+	}
+	reserve := cs.reserveTokens
+	if maxTokens != nil {
+		reserve = *maxTokens
+	}
+	// A maxTokens close to the context length must still leave room for the question
+	budget := max(contextLength-reserve, contextLength/4)
+
+	candidates := make([]Message, 0, len(history))
+	for _, message := range history {
+		if message.IsStreaming || (message.Content == "" && len(message.Attachments) == 0) {
+			continue
+		}
+		candidates = append(candidates, message)
+	}
+
+	prompt := &PromptContext{Strategy: strategy, ContextLength: contextLength, MessageIDs: []int{}}
+	var prefix []ProviderMessage
+	if systemPrompt != "" {
+		prefix = append(prefix, ProviderMessage{Role: "system", Content: systemPrompt})
+	}
+
+	if strategy == ContextSummarize {
+		summary, err := loadChatSummary(cs.db, chat.ID)
+		if err != nil {
+			return nil, err
+		}
+		// A summary whose last message was deleted no longer matches the chat
+		if summary != nil {
+			for i, message := range candidates {
+				if message.ID == summary.ThroughMessageID {
+					candidates = candidates[i+1:]
+					prefix = append(prefix, ProviderMessage{Role: "system", Content: summaryMessagePrefix + summary.Content})
+					prompt.SummaryThroughID = &summary.ThroughMessageID
+					prompt.summary = summary
+					break
+				}
+			}
+		}
+	}
+
+	used := 0
+	for _, message := range prefix {
+		used += tokenizer.countMessageTokens(message)
+	}
+
+	if err := cs.addDocuments(candidates, tokenizer, budget-used); err != nil {
+		return nil, err
+	}
+
+	keep := make([]bool, len(candidates))
+	if strategy == ContextKeepPinned {
+		for i, message := range candidates {
+			if message.Pinned || message.Role == "system" {
+				keep[i] = true
+				used += tokenizer.countStoredMessageTokens(message)
+			}
+		}
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if keep[i] {
+			continue
+		}
+		tokens := tokenizer.countStoredMessageTokens(candidates[i])
+		if used+tokens > budget && i != len(candidates)-1 {
+			break
+		}
+		keep[i] = true
+		used += tokens
+	}
+
+	prompt.Messages = prefix
+	for i, message := range candidates {
+		if !keep[i] {
+			prompt.DroppedCount++
+			prompt.unsummarized = append(prompt.unsummarized, message)
+			continue
+		}
+		prompt.Messages = append(prompt.Messages, cs.providerMessage(ctx, message, vision))
+		prompt.MessageIDs = append(prompt.MessageIDs, message.ID)
+	}
+	prompt.EstimatedTokens = used
+	return prompt, nil
+}
+
+// addDocuments puts the text of attached documents into the content of the
+// candidates. The latest message gets what is left of the budget, up to
+// documentTokens per document, earlier ones only documentTokens.
+func (cs *ContextService) addDocuments(candidates []Message, tokenizer tokenizerFamily, available int) error {
+	var ids []string
+	for _, message := range candidates {
+		for _, attachment := range message.Attachments {
+			if attachment.ExtractionStatus != nil && *attachment.ExtractionStatus == ExtractionDone {
+				ids = append(ids, attachment.ID)
+			}
+		}
+	}
+	texts, err := loadExtractedTexts(cs.db, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range candidates {
+		documents := documentCount(candidates[i])
+		if documents == 0 {
+			continue
+		}
+		limit := cs.documentTokens
+		if i == len(candidates)-1 {
+			remaining := available - tokenizer.countStoredMessageTokens(candidates[i])
+			limit = min(limit, max(remaining/documents, minDocumentTokens))
+		}
+		candidates[i].Content = withDocuments(candidates[i], texts, tokenizer, limit)
+	}
+	return nil
+}
+
+// providerMessage converts a stored message, with its images when the model
+// can see them. Images that can't be loaded are replaced by a note.
+func (cs *ContextService) providerMessage(ctx context.Context, message Message, vision bool) ProviderMessage {
+	providerMessage := ProviderMessage{Role: message.Role, Content: message.Content}
+	if imageCount(message) == 0 {
+		return providerMessage
+	}
+	if !vision {
+		providerMessage.Content = imagePlaceholder(message)
+		return providerMessage
+	}
+
+	parts, err := cs.vision.messageParts(ctx, message)
+	if err != nil {
+		log.Printf("Failed to prepare images of message %d: %v", message.ID, err)
+		providerMessage.Content = imagePlaceholder(message)
+		return providerMessage
+	}
+	providerMessage.Parts = parts
+	return providerMessage
+}
+
+// recordContext stores which messages were sent to generate a message.
+func (cs *ContextService) recordContext(messageID, chatID int, prompt *PromptContext) error {
+	messageIDs, err := json.Marshal(prompt.MessageIDs)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.db.Exec(`
+		INSERT INTO completion_contexts (message_id, chat_id, strategy, message_ids, dropped_count, summary_through_id, estimated_tokens, context_length, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, messageID, chatID, prompt.Strategy, string(messageIDs), prompt.DroppedCount, prompt.SummaryThroughID,
+		prompt.EstimatedTokens, prompt.ContextLength, time.Now())
+	return err
+}
+
+// scheduleSummary folds the messages that fell out of the window into the
+// chat's rolling summary. Only one summary per chat is generated at a time.
+func (cs *ContextService) scheduleSummary(chat *Chat, userID string, prompt *PromptContext) {
+	if prompt.Strategy != ContextSummarize || len(prompt.unsummarized) == 0 {
+		return
+	}
+
+	cs.mu.Lock()
+	if cs.summarizing[chat.ID] {
+		cs.mu.Unlock()
+		return
+	}
+	cs.summarizing[chat.ID] = true
+	cs.mu.Unlock()
+
+	queued := cs.jobs.Enqueue("chat summary", func() error {
+		defer func() {
+			cs.mu.Lock()
+			delete(cs.summarizing, chat.ID)
+			cs.mu.Unlock()
+		}()
+		return cs.summarize(chat, userID, prompt.summary, prompt.unsummarized)
+	})
+	if !queued {
+		cs.mu.Lock()
+		delete(cs.summarizing, chat.ID)
+		cs.mu.Unlock()
+		log.Printf("Job queue full, skipping summary for chat %d", chat.ID)
+	}
+}
+
+// summarize merges messages into the previous summary. Messages that don't
+// fit in one request are left for the next summary.
+func (cs *ContextService) summarize(chat *Chat, userID string, previous *ChatSummary, messages []Message) error {
+	model := cs.summaryModel
+	if model == "" {
+		model = chat.Model
+	}
+	tokenizer := modelTokenizer(model)
+
+	var input strings.Builder
+	if previous != nil {
+		input.WriteString("Previous summary:\n" + previous.Content + "\n\nNew messages:\n")
+	}
+	budget := cs.defaultLength / 2
+	included := 0
+	for _, message := range messages {
+		line := message.Role + ": " + truncateRunes(message.Content, 4000) + "\n\n"
+		if included > 0 && tokenizer.countTokens(input.String()+line) > budget {
+			break
+		}
+		input.WriteString(line)
+		included++
+	}
+	through := messages[included-1]
+
+	apiKey, _, err := cs.keys.resolveAPIKey(userID, ProviderOpenRouter)
+	if err != nil {
+		return err
+	}
+
+	maxTokens := summaryMaxTokens
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	result, err := cs.providers.StreamChat(ctx, ProviderOpenRouter, apiKey, CompletionRequest{
+		Model: model,
+		Messages: []ProviderMessage{
+			{Role: "system", Content: summaryPrompt},
+			{Role: "user", Content: input.String()},
+		},
+		MaxTokens: &maxTokens,
+	}, func(StreamDelta) error { return nil })
+	if err != nil {
+		return err
+	}
+	content := strings.TrimSpace(result.Content)
+	if content == "" {
+		return nil
+	}
+
+	// Only extend the summary the messages were selected against, a summary
+	// stored meanwhile or a reset wins
+	now := time.Now()
+	if previous == nil {
+		_, err = cs.db.Exec(`
+			INSERT IGNORE INTO chat_summaries (chat_id, content, through_message_id, message_count, model, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, chat.ID, content, through.ID, included, model, now)
+		return err
+	}
+	_, err = cs.db.Exec(`
+		UPDATE chat_summaries SET content = ?, through_message_id = ?, message_count = ?, model = ?, updated_at = ?
+		WHERE chat_id = ? AND through_message_id = ?
+	`, content, through.ID, previous.MessageCount+included, model, now, chat.ID, previous.ThroughMessageID)
+	return err
+}
+
+// loadChatSummary returns the rolling summary of a chat, or nil if it has none.
+func loadChatSummary(db *sql.DB, chatID int) (*ChatSummary, error) {
+	var summary ChatSummary
+	err := db.QueryRow(`
+		SELECT chat_id, content, through_message_id, message_count, model, updated_at
+		FROM chat_summaries WHERE chat_id = ?
+	`, chatID).Scan(&summary.ChatID, &summary.Content, &summary.ThroughMessageID, &summary.MessageCount, &summary.Model, &summary.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// Get the rolling summary of a chat
+func (cs *ContextService) GetChatSummary(c *gin.Context) {
+	chatID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	if _, ok := cs.chats.authorizeChat(c, chatID, WorkspaceViewer); !ok {
+		return
+	}
+
+	summary, err := loadChatSummary(cs.db, chatID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch summary"})
+		return
+	}
+	if summary == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat has no summary"})
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// Delete the rolling summary of a chat, the next completion starts a new one
+func (cs *ContextService) DeleteChatSummary(c *gin.Context) {
+	chatID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+	if _, ok := cs.chats.authorizeChat(c, chatID, WorkspaceEditor); !ok {
+		return
+	}
+
+	if _, err := cs.db.Exec("DELETE FROM chat_summaries WHERE chat_id = ?", chatID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete summary"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Summary deleted successfully"})
+}
+
+// Get the messages that were sent to generate an assistant message
+func (cs *ContextService) GetMessageContext(c *gin.Context) {
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var record CompletionContextRecord
+	var messageIDs []byte
+	var summaryThroughID sql.NullInt64
+	err = cs.db.QueryRow(`
+		SELECT message_id, chat_id, strategy, message_ids, dropped_count, summary_through_id, estimated_tokens, context_length, created_at
+		FROM completion_contexts WHERE message_id = ?
+	`, messageID).Scan(&record.MessageID, &record.ChatID, &record.Strategy, &messageIDs, &record.DroppedCount,
+		&summaryThroughID, &record.EstimatedTokens, &record.ContextLength, &record.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No context recorded for this message"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch context"})
+		}
+		return
+	}
+	if _, ok := cs.chats.authorizeChat(c, record.ChatID, WorkspaceViewer); !ok {
+		return
+	}
+
+	if err := json.Unmarshal(messageIDs, &record.MessageIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch context"})
+		return
+	}
+	if summaryThroughID.Valid {
+		through := int(summaryThroughID.Int64)
+		record.SummaryThroughID = &through
+	}
+
+	c.JSON(http.StatusOK, record)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	exportStatusPending = "pending"
+	exportStatusRunning = "running"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+
+	exportRetention = time.Hour * 24 * 7
+)
+
+type DataExport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Error       *string    `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+	DownloadURL string     `json:"downloadUrl,omitempty"`
+}
+
+type exportedSession struct {
+	CreatedAt           time.Time `json:"createdAt"`
+	ExpiresAt           time.Time `json:"expiresAt"`
+	PendingSecondFactor bool      `json:"pendingSecondFactor"`
+}
+
+type exportedMembership struct {
+	WorkspaceID int       `json:"workspaceId"`
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	JoinedAt    time.Time `json:"joinedAt"`
+}
+
+type exportedChat struct {
+	Chat
+	Messages []Message `json:"messages"`
+}
+
+// exportedAttachment names the file holding the upload in the archive,
+// empty when the blob no longer exists.
+type exportedAttachment struct {
+	Attachment
+	File string `json:"file,omitempty"`
+}
+
+type exportedKnowledgeBase struct {
+	KnowledgeBase
+	Documents []KnowledgeDocument `json:"documents"`
+}
+
+// Get the status of the user's data export, starting a new one when there
+// is no export in progress or available for download
+func (us *UserService) ExportData(c *gin.Context) {
+	user := currentUser(c)
+
+	export, err := us.latestExport(user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export"})
+		return
+	}
+
+	if err == nil && !exportNeedsRefresh(export) {
+		status := http.StatusAccepted
+		if export.Status == exportStatusReady {
+			status = http.StatusOK
+			export.DownloadURL = "/api/users/me/export/download"
+		}
+		c.JSON(status, export)
+		return
+	}
+
+	exportID := uuid.New().String()
+	now := time.Now()
+	_, err = us.db.Exec(
+		"INSERT INTO data_exports (id, user_id, status, created_at) VALUES (?, ?, ?, ?)",
+		exportID, user.ID, exportStatusPending, now,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export"})
+		return
+	}
+
+	queued := us.jobs.Enqueue("export "+exportID, func() error {
+		return us.runExport(exportID, user.ID)
+	})
+	if !queued {
+		us.db.Exec("DELETE FROM data_exports WHERE id = ?", exportID)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many pending jobs, try again later"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, DataExport{ID: exportID, Status: exportStatusPending, CreatedAt: now})
+}
+
+// Download the latest finished export archive
+func (us *UserService) DownloadExport(c *gin.Context) {
+	user := currentUser(c)
+
+	export, err := us.latestExport(user.ID)
+	if err != nil || export.Status != exportStatusReady || exportNeedsRefresh(export) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No export available"})
+		return
+	}
+
+	c.FileAttachment(us.exportPath(export.ID), "safaschat-export-"+export.CreatedAt.Format("2006-01-02")+".zip")
+}
+
+func (us *UserService) latestExport(userID string) (*DataExport, error) {
+	var export DataExport
+	err := us.db.QueryRow(`
+		SELECT id, status, error, created_at, completed_at, expires_at
+		FROM data_exports
+		WHERE user_id = ?
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID).Scan(&export.ID, &export.Status, &export.Error, &export.CreatedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// exportNeedsRefresh reports whether a new export should replace this one.
+func exportNeedsRefresh(export *DataExport) bool {
+	switch export.Status {
+	case exportStatusFailed:
+		return true
+	case exportStatusReady:
+		return export.ExpiresAt == nil || export.ExpiresAt.Before(time.Now())
+	default:
+		// Jobs lost to a restart never finish
+		return export.CreatedAt.Before(time.Now().Add(-time.Hour))
+	}
+}
+
+func (us *UserService) exportPath(exportID string) string {
+	return filepath.Join(us.exportDir, exportID+".zip")
+}
+
+// runExport builds the archive for an export job and records the outcome.
+func (us *UserService) runExport(exportID, userID string) error {
+	if _, err := us.db.Exec("UPDATE data_exports SET status = ? WHERE id = ?", exportStatusRunning, exportID); err != nil {
+		return err
+	}
+
+	if err := us.writeExportArchive(exportID, userID); err != nil {
+		os.Remove(us.exportPath(exportID))
+		us.db.Exec(
+			"UPDATE data_exports SET status = ?, error = ?, completed_at = ? WHERE id = ?",
+			exportStatusFailed, "Failed to build export", time.Now(), exportID,
+		)
+		return err
+	}
+
+	now := time.Now()
+	_, err := us.db.Exec(
+		"UPDATE data_exports SET status = ?, completed_at = ?, expires_at = ? WHERE id = ?",
+		exportStatusReady, now, now.Add(exportRetention), exportID,
+	)
+	return err
+}
+
+func (us *UserService) writeExportArchive(exportID, userID string) error {
+	if err := os.MkdirAll(us.exportDir, 0o700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(us.exportPath(exportID), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+
+	user, err := scanUser(us.db.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.id = ?`, userID))
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "profile.json", user); err != nil {
+		return err
+	}
+
+	settings, err := loadUserSettings(us.db, userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "settings.json", settings); err != nil {
+		return err
+	}
+
+	sessions, err := us.exportSessions(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "sessions.json", sessions); err != nil {
+		return err
+	}
+
+	memberships, err := us.exportMemberships(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "workspaces.json", memberships); err != nil {
+		return err
+	}
+
+	personas, err := us.exportPersonas(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "personas.json", personas); err != nil {
+		return err
+	}
+
+	templates, err := us.exportTemplates(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "templates.json", templates); err != nil {
+		return err
+	}
+
+	memories, err := us.exportMemories(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "memories.json", memories); err != nil {
+		return err
+	}
+
+	knowledgeBases, err := us.exportKnowledgeBases(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "knowledge_bases.json", knowledgeBases); err != nil {
+		return err
+	}
+
+	chats, err := us.exportChats(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "chats.json", chats); err != nil {
+		return err
+	}
+
+	attachments, err := us.exportAttachments(archive, userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "attachments.json", attachments); err != nil {
+		return err
+	}
+
+	// Include an uploaded avatar
+	if user.Avatar != nil {
+		prefix := os.Getenv("BACKEND_URL") + "/api/avatars/"
+		if filename := strings.TrimPrefix(*user.Avatar, prefix); filename != *user.Avatar && avatarFilePattern.MatchString(filename) {
+			if data, err := os.ReadFile(filepath.Join(us.avatarDir, filename)); err == nil {
+				if err := writeZipFile(archive, "avatar.png", data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+func (us *UserService) exportPersonas(userID string) ([]Persona, error) {
+	rows, err := us.db.Query("SELECT "+personaColumns+" FROM personas WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	personas := []Persona{}
+	for rows.Next() {
+		persona, err := scanPersona(rows)
+		if err != nil {
+			return nil, err
+		}
+		personas = append(personas, *persona)
+	}
+	return personas, rows.Err()
+}
+
+func (us *UserService) exportTemplates(userID string) ([]PromptTemplate, error) {
+	rows, err := us.db.Query("SELECT "+promptTemplateColumns+" FROM prompt_templates WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []PromptTemplate{}
+	for rows.Next() {
+		template, err := scanPromptTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, *template)
+	}
+	return templates, rows.Err()
+}
+
+func (us *UserService) exportMemories(userID string) ([]Memory, error) {
+	rows, err := us.db.Query("SELECT "+memoryColumns+" FROM memories WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memories := []Memory{}
+	for rows.Next() {
+		memory, err := scanMemory(rows)
+		if err != nil {
+			return nil, err
+		}
+		memories = append(memories, *memory)
+	}
+	return memories, rows.Err()
+}
+
+// exportKnowledgeBases lists the user's knowledge bases and their documents.
+// Chunks are left out, they only repeat the text of the documents.
+func (us *UserService) exportKnowledgeBases(userID string) ([]exportedKnowledgeBase, error) {
+	rows, err := us.db.Query("SELECT "+knowledgeBaseColumns+" FROM knowledge_bases WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	knowledgeBases := []exportedKnowledgeBase{}
+	for rows.Next() {
+		kb, err := scanKnowledgeBase(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		knowledgeBases = append(knowledgeBases, exportedKnowledgeBase{KnowledgeBase: *kb, Documents: []KnowledgeDocument{}})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range knowledgeBases {
+		rows, err := us.db.Query(
+			"SELECT "+knowledgeDocumentColumns+" FROM knowledge_documents WHERE knowledge_base_id = ? ORDER BY created_at",
+			knowledgeBases[i].ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			document, err := scanKnowledgeDocument(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			knowledgeBases[i].Documents = append(knowledgeBases[i].Documents, *document)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return knowledgeBases, nil
+}
+
+// exportAttachments copies the user's uploads from the blob store into the
+// archive and returns their metadata.
+func (us *UserService) exportAttachments(archive *zip.Writer, userID string) ([]exportedAttachment, error) {
+	rows, err := us.db.Query("SELECT "+attachmentColumns+" FROM attachments WHERE user_id = ? ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := []exportedAttachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		attachments = append(attachments, exportedAttachment{Attachment: *attachment})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range attachments {
+		attachment := &attachments[i]
+		blob, err := us.store.Get(context.Background(), attachment.storageKey)
+		if errors.Is(err, errBlobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read attachment %s: %w", attachment.ID, err)
+		}
+
+		// Filenames are user input, keep them from escaping the directory
+		filename := filepath.Base(strings.ReplaceAll(attachment.Filename, "\\", "/"))
+		if filename == "." || filename == ".." || filename == "/" {
+			filename = "file"
+		}
+		name := "attachments/" + attachment.ID + "/" + filename
+		w, err := archive.Create(name)
+		if err == nil {
+			_, err = io.Copy(w, blob)
+		}
+		blob.Close()
+		if err != nil {
+			return nil, fmt.Errorf("write attachment %s: %w", attachment.ID, err)
+		}
+		attachment.File = name
+	}
+	return attachments, nil
+}
+
+func (us *UserService) exportSessions(userID string) ([]exportedSession, error) {
+	rows, err := us.db.Query(
+		"SELECT created_at, expires_at, pending_second_factor FROM sessions WHERE user_id = ? ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []exportedSession{}
+	for rows.Next() {
+		var session exportedSession
+		if err := rows.Scan(&session.CreatedAt, &session.ExpiresAt, &session.PendingSecondFactor); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (us *UserService) exportChats(userID string) ([]exportedChat, error) {
+	rows, err := us.db.Query(
+		"SELECT "+chatColumns+" FROM chats WHERE user_id = ? ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	chats := []exportedChat{}
+	for rows.Next() {
+		chat, err := scanChat(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chats = append(chats, exportedChat{Chat: *chat})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range chats {
+		messages, err := queryChatMessages(us.db, chats[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		chats[i].Messages = messages
+	}
+	return chats, nil
+}
+
+func (us *UserService) exportMemberships(userID string) ([]exportedMembership, error) {
+	rows, err := us.db.Query(`
+		SELECT w.id, w.name, m.role, m.created_at
+		FROM workspace_members m
+		JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = ?
+		ORDER BY m.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []exportedMembership{}
+	for rows.Next() {
+		var membership exportedMembership
+		if err := rows.Scan(&membership.WorkspaceID, &membership.Name, &membership.Role, &membership.JoinedAt); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+// cleanupExports removes expired export archives.
+func (us *UserService) cleanupExports() error {
+	rows, err := us.db.Query("SELECT id FROM data_exports WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		os.Remove(us.exportPath(id))
+		if _, err := us.db.Exec("DELETE FROM data_exports WHERE id = ?", id); err != nil {
+			return fmt.Errorf("delete export %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeZipFile(archive, name, data)
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -81,20 +83,387 @@ func createTables(db *sql.DB) error {
 		FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
 	)`
 
-	if _, err := db.Exec(userTable); err != nil {
-		return err
-	}
+	recoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(36) NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	dataExportsTable := `
+	CREATE TABLE IF NOT EXISTS data_exports (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id VARCHAR(36) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		error VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP NULL,
+		expires_at TIMESTAMP NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	inviteCodesTable := `
+	CREATE TABLE IF NOT EXISTS invite_codes (
+		code VARCHAR(32) PRIMARY KEY,
+		created_by VARCHAR(36),
+		max_uses INT NOT NULL DEFAULT 1,
+		uses INT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP NULL,
+		revoked_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	waitlistTable := `
+	CREATE TABLE IF NOT EXISTS waitlist (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		email VARCHAR(255) UNIQUE NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		reviewed_by VARCHAR(36),
+		reviewed_at TIMESTAMP NULL,
+		FOREIGN KEY (reviewed_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	workspacesTable := `
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		created_by VARCHAR(36),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	workspaceMembersTable := `
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id INT NOT NULL,
+		user_id VARCHAR(36) NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (workspace_id, user_id),
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	workspaceInvitationsTable := `
+	CREATE TABLE IF NOT EXISTS workspace_invitations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		workspace_id INT NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		token CHAR(48) UNIQUE NOT NULL,
+		invited_by VARCHAR(36),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		accepted_at TIMESTAMP NULL,
+		INDEX (email),
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	providerKeysTable := `
+	CREATE TABLE IF NOT EXISTS provider_keys (
+		user_id VARCHAR(36) NOT NULL,
+		provider VARCHAR(50) NOT NULL,
+		ciphertext VARBINARY(1024) NOT NULL,
+		nonce VARBINARY(32) NOT NULL,
+		wrapped_key VARBINARY(128) NOT NULL,
+		key_nonce VARBINARY(32) NOT NULL,
+		master_key_id VARCHAR(16) NOT NULL,
+		key_hint VARCHAR(16) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_validated_at TIMESTAMP NULL,
+		PRIMARY KEY (user_id, provider),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	modelPoliciesTable := `
+	CREATE TABLE IF NOT EXISTS model_policies (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		scope_key VARCHAR(64) UNIQUE NOT NULL,
+		scope VARCHAR(20) NOT NULL,
+		role VARCHAR(20) NULL,
+		workspace_id INT NULL,
+		allow_patterns JSON NULL,
+		deny_patterns JSON NULL,
+		default_model VARCHAR(255) NULL,
+		updated_by VARCHAR(36) NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (updated_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	userSettingsTable := `
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id VARCHAR(36) PRIMARY KEY,
+		settings JSON NOT NULL,
+		schema_version INT NOT NULL,
+		version INT NOT NULL DEFAULT 1,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	personasTable := `
+	CREATE TABLE IF NOT EXISTS personas (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		description VARCHAR(500) NOT NULL DEFAULT '',
+		system_prompt TEXT NOT NULL,
+		default_model VARCHAR(255) NULL,
+		params JSON NULL,
+		user_id VARCHAR(36) NULL,
+		workspace_id INT NULL,
+		created_by VARCHAR(36) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (user_id),
+		INDEX (workspace_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	promptTemplatesTable := `
+	CREATE TABLE IF NOT EXISTS prompt_templates (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		description VARCHAR(500) NOT NULL DEFAULT '',
+		content TEXT NOT NULL,
+		variables JSON NULL,
+		user_id VARCHAR(36) NULL,
+		workspace_id INT NULL,
+		created_by VARCHAR(36) NULL,
+		usage_count INT NOT NULL DEFAULT 0,
+		last_used_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (user_id),
+		INDEX (workspace_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	chatSummariesTable := `
+	CREATE TABLE IF NOT EXISTS chat_summaries (
+		chat_id INT PRIMARY KEY,
+		content TEXT NOT NULL,
+		through_message_id INT NOT NULL,
+		message_count INT NOT NULL,
+		model VARCHAR(255) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+	)`
+
+	completionContextsTable := `
+	CREATE TABLE IF NOT EXISTS completion_contexts (
+		message_id INT PRIMARY KEY,
+		chat_id INT NOT NULL,
+		strategy VARCHAR(20) NOT NULL,
+		message_ids JSON NOT NULL,
+		dropped_count INT NOT NULL DEFAULT 0,
+		summary_through_id INT NULL,
+		estimated_tokens INT NOT NULL,
+		context_length INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (chat_id),
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE
+	)`
+
+	memoriesTable := `
+	CREATE TABLE IF NOT EXISTS memories (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(36) NOT NULL,
+		content VARCHAR(1000) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		source VARCHAR(20) NOT NULL,
+		source_chat_id INT NULL,
+		last_used_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (user_id, status),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_chat_id) REFERENCES chats(id) ON DELETE SET NULL
+	)`
+
+	attachmentsTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id VARCHAR(36) PRIMARY KEY,
+		message_id INT NULL,
+		user_id VARCHAR(36) NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		storage_key VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (message_id),
+		INDEX (user_id),
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE SET NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	knowledgeBasesTable := `
+	CREATE TABLE IF NOT EXISTS knowledge_bases (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		description VARCHAR(500) NOT NULL DEFAULT '',
+		user_id VARCHAR(36) NULL,
+		workspace_id INT NULL,
+		created_by VARCHAR(36) NULL,
+		embedding_model VARCHAR(255) NOT NULL,
+		version INT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (user_id),
+		INDEX (workspace_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
 
-	if _, err := db.Exec(sessionTable); err != nil {
-		return err
+	knowledgeDocumentsTable := `
+	CREATE TABLE IF NOT EXISTS knowledge_documents (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		knowledge_base_id INT NOT NULL,
+		filename VARCHAR(255) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		error VARCHAR(500) NULL,
+		chunk_count INT NOT NULL DEFAULT 0,
+		created_by VARCHAR(36) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (knowledge_base_id),
+		FOREIGN KEY (knowledge_base_id) REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+	)`
+
+	knowledgeChunksTable := `
+	CREATE TABLE IF NOT EXISTS knowledge_chunks (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		knowledge_base_id INT NOT NULL,
+		document_id INT NOT NULL,
+		chunk_index INT NOT NULL,
+		content TEXT NOT NULL,
+		embedding BLOB NOT NULL,
+		INDEX (knowledge_base_id),
+		INDEX (document_id),
+		FOREIGN KEY (knowledge_base_id) REFERENCES knowledge_bases(id) ON DELETE CASCADE,
+		FOREIGN KEY (document_id) REFERENCES knowledge_documents(id) ON DELETE CASCADE
+	)`
+
+	toolCallsTable := `
+	CREATE TABLE IF NOT EXISTS tool_calls (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		message_id INT NOT NULL,
+		call_id VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		arguments JSON NOT NULL,
+		result MEDIUMTEXT NOT NULL,
+		is_error BOOLEAN NOT NULL DEFAULT FALSE,
+		round INT NOT NULL,
+		duration_ms INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX (message_id),
+		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
+	)`
+
+	mcpServersTable := `
+	CREATE TABLE IF NOT EXISTS mcp_servers (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id VARCHAR(36) NOT NULL,
+		name VARCHAR(32) NOT NULL,
+		url VARCHAR(2048) NOT NULL,
+		header_names JSON NULL,
+		ciphertext VARBINARY(8192) NULL,
+		nonce VARBINARY(32) NULL,
+		wrapped_key VARBINARY(128) NULL,
+		key_nonce VARBINARY(32) NULL,
+		master_key_id VARCHAR(16) NULL,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`
+
+	tables := []string{
+		userTable, sessionTable, chatsTable, messagesTable, recoveryCodesTable, dataExportsTable,
+		inviteCodesTable, waitlistTable, workspacesTable, workspaceMembersTable, workspaceInvitationsTable,
+		providerKeysTable, modelPoliciesTable, userSettingsTable, personasTable,
+		promptTemplatesTable, chatSummariesTable, completionContextsTable,
+		memoriesTable, attachmentsTable, knowledgeBasesTable, knowledgeDocumentsTable, knowledgeChunksTable,
+		toolCallsTable, mcpServersTable,
 	}
+	for _, table := range tables {
+		if _, err := db.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	return migrateTables(db)
+}
 
-	if _, err := db.Exec(chatsTable); err != nil {
-		return err
+// migrateTables adds columns introduced after the initial schema. Every
+// statement must be safe to run against an already migrated database.
+func migrateTables(db *sql.DB) error {
+	migrations := []string{
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_ciphertext VARBINARY(128) NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_nonce VARBINARY(32) NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_wrapped_key VARBINARY(128) NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_key_nonce VARBINARY(32) NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_master_key_id VARCHAR(16) NULL`,
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS pending_second_factor BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS second_factor_failures INT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS second_factor_locked_until TIMESTAMP NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS role_assigned_at TIMESTAMP NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS custom_profile BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences JSON NULL`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMP NULL`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS workspace_id INT NULL`,
+		`ALTER TABLE chats ADD FOREIGN KEY IF NOT EXISTS fk_chats_workspace (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS user_id VARCHAR(36) NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS model VARCHAR(255) NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS prompt_tokens INT NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS completion_tokens INT NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS reasoning_tokens INT NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS cost DECIMAL(16,8) NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_usage ON messages (user_id, created_at)`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS persona_id INT NULL`,
+		`ALTER TABLE chats ADD FOREIGN KEY IF NOT EXISTS fk_chats_persona (persona_id) REFERENCES personas(id) ON DELETE SET NULL`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS params JSON NULL`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS title_source VARCHAR(20) NOT NULL DEFAULT 'default'`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS memory_enabled BOOLEAN NOT NULL DEFAULT TRUE`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS extraction_status VARCHAR(20) NULL`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS extraction_error VARCHAR(500) NULL`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS extracted_text MEDIUMTEXT NULL`,
+		`ALTER TABLE attachments ADD COLUMN IF NOT EXISTS extracted_at TIMESTAMP NULL`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS knowledge_base_id INT NULL`,
+		`ALTER TABLE chats ADD FOREIGN KEY IF NOT EXISTS fk_chats_knowledge_base (knowledge_base_id) REFERENCES knowledge_bases(id) ON DELETE SET NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS citations JSON NULL`,
+		`ALTER TABLE chats ADD COLUMN IF NOT EXISTS tools JSON NULL`,
 	}
 
-	if _, err := db.Exec(messagesTable); err != nil {
-		return err
+	for _, migration := range migrations {
+		if _, err := db.Exec(migration); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -105,4 +474,25 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
+}
+
+// getEnvInt64 parses an integer environment variable, using the default when
+// it is unset or invalid.
+func getEnvInt64(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList splits a comma separated environment variable, dropping empty entries.
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
\ No newline at end of file
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ExtractionPending     = "pending"
+	ExtractionDone        = "done"
+	ExtractionFailed      = "failed"
+	ExtractionUnsupported = "unsupported"
+
+	// maxExtractedRunes caps the stored text, far above what fits in a prompt
+	maxExtractedRunes = 500_000
+	maxDocxXMLSize    = 50 << 20
+)
+
+var errNoText = errors.New("document contains no extractable text")
+
+// codeLanguages names the fence language of source files, which are
+// uploaded as text/plain.
+var codeLanguages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".jsx": "jsx", ".ts": "typescript", ".tsx": "tsx",
+	".java": "java", ".kt": "kotlin", ".c": "c", ".h": "c", ".cpp": "cpp", ".hpp": "cpp", ".cs": "csharp",
+	".rb": "ruby", ".rs": "rust", ".php": "php", ".swift": "swift", ".sh": "bash", ".sql": "sql",
+	".html": "html", ".css": "css", ".scss": "scss", ".yaml": "yaml", ".yml": "yaml", ".toml": "toml",
+	".xml": "xml", ".vue": "vue", ".svelte": "svelte", ".lua": "lua", ".r": "r", ".dart": "dart",
+}
+
+// isDocumentType reports whether text can be extracted from a content type.
+func isDocumentType(contentType string) bool {
+	switch contentType {
+	case "application/pdf", "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"text/plain", "text/markdown", "text/csv", "application/json":
+		return true
+	}
+	return false
+}
+
+// extractText returns the plain text of a document. Source code comes back
+// in a fenced block so the model keeps its formatting.
+func extractText(filename, contentType string, data []byte) (string, error) {
+	var text string
+	var err error
+	switch contentType {
+	case "application/pdf":
+		text, err = extractPDFText(data)
+	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		text, err = extractDocxText(data)
+	case "text/csv":
+		text, err = normalizeCSV(data)
+	case "text/plain", "text/markdown", "application/json":
+		text = decodeUTF8(data)
+		if language, ok := codeLanguages[strings.ToLower(filepath.Ext(filename))]; ok {
+			text = "```" + language + "\n" + strings.TrimRight(text, "\n") + "\n```"
+		}
+	default:
+		return "", errors.New("unsupported document type " + contentType)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSpace(strings.ReplaceAll(text, "\r\n", "\n"))
+	if text == "" {
+		return "", errNoText
+	}
+	return truncateRunes(text, maxExtractedRunes), nil
+}
+
+// decodeUTF8 replaces invalid sequences, treating text that is mostly
+// invalid as Latin-1.
+func decodeUTF8(data []byte) string {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	invalid := 0
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			invalid++
+		}
+		i += size
+	}
+	if invalid*10 > len(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+// normalizeCSV re-encodes a CSV file, so ragged rows and odd quoting don't
+// confuse the model. Semicolon separated files are detected.
+func normalizeCSV(data []byte) (string, error) {
+	text := decodeUTF8(data)
+	firstLine, _, _ := strings.Cut(text, "\n")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+
+	var out strings.Builder
+	writer := csv.NewWriter(&out)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+		if out.Len() > maxExtractedRunes {
+			break
+		}
+	}
+	writer.Flush()
+	return out.String(), writer.Error()
+}
+
+// extractDocxText reads the paragraphs of word/document.xml, keeping tabs
+// and line breaks.
+func extractDocxText(data []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var document *zip.File
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			document = file
+			break
+		}
+	}
+	if document == nil {
+		return "", errors.New("docx has no word/document.xml")
+	}
+
+	reader, err := document.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	decoder := xml.NewDecoder(io.LimitReader(reader, maxDocxXMLSize))
+	var text strings.Builder
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteByte('\t')
+			case "br", "cr":
+				text.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteByte('\n')
+			case "tc":
+				text.WriteByte('\t')
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(element)
+			}
+		}
+	}
+	return text.String(), nil
+}
+
+// scheduleExtraction extracts the text of an uploaded document in the
+// background. Attachments whose job is lost stay pending until the cleanup
+// marks them failed.
+func (as *AttachmentService) scheduleExtraction(attachment Attachment) {
+	as.jobs.Enqueue("document extraction", func() error {
+		return as.extractAttachment(attachment)
+	})
+}
+
+func (as *AttachmentService) extractAttachment(attachment Attachment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	blob, err := as.store.Get(ctx, attachment.storageKey)
+	if errors.Is(err, errBlobNotFound) {
+		// Deleted before the job ran
+		return nil
+	}
+	if err != nil {
+		return as.finishExtraction(attachment.ID, ExtractionFailed, "", "File could not be read")
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return as.finishExtraction(attachment.ID, ExtractionFailed, "", "File could not be read")
+	}
+
+	text, err := extractText(attachment.Filename, attachment.ContentType, data)
+	switch {
+	case errors.Is(err, errNoText):
+		return as.finishExtraction(attachment.ID, ExtractionUnsupported, "", err.Error())
+	case err != nil:
+		log.Printf("Failed to extract text of attachment %s: %v", attachment.ID, err)
+		return as.finishExtraction(attachment.ID, ExtractionFailed, "", truncateRunes(err.Error(), 500))
+	}
+	return as.finishExtraction(attachment.ID, ExtractionDone, text, "")
+}
+
+func (as *AttachmentService) finishExtraction(attachmentID, status, text, message string) error {
+	_, err := as.db.Exec(`
+		UPDATE attachments SET extraction_status = ?, extracted_text = NULLIF(?, ''), extraction_error = NULLIF(?, ''),
+			extracted_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, status, text, message, attachmentID)
+	return err
+}
+
+// failInterruptedExtractions marks extractions that were lost to a restart
+// or a full job queue.
+func (as *AttachmentService) failInterruptedExtractions() error {
+	_, err := as.db.Exec(`
+		UPDATE attachments SET extraction_status = ?, extraction_error = 'Extraction was interrupted'
+		WHERE extraction_status = ? AND created_at < ?
+	`, ExtractionFailed, ExtractionPending, time.Now().Add(-time.Hour))
+	return err
+}
+
+// Get the text extracted from a document attachment
+func (as *AttachmentService) GetAttachmentText(c *gin.Context) {
+	attachment, ok := as.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+	if attachment.ExtractionStatus == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment is not a document"})
+		return
+	}
+
+	var text sql.NullString
+	if err := as.db.QueryRow("SELECT extracted_text FROM attachments WHERE id = ?", attachment.ID).Scan(&text); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment text"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":               attachment.ID,
+		"extractionStatus": attachment.ExtractionStatus,
+		"extractionError":  attachment.ExtractionError,
+		"text":             text.String,
+	})
+}
+
+// loadExtractedTexts loads the text of extracted documents by attachment ID.
+func loadExtractedTexts(db *sql.DB, attachmentIDs []string) (map[string]string, error) {
+	texts := map[string]string{}
+	if len(attachmentIDs) == 0 {
+		return texts, nil
+	}
+
+	args := []interface{}{ExtractionDone}
+	for _, id := range attachmentIDs {
+		args = append(args, id)
+	}
+	rows, err := db.Query(
+		`SELECT id, extracted_text FROM attachments WHERE extraction_status = ? AND id IN (?`+
+			strings.Repeat(", ?", len(attachmentIDs)-1)+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var text sql.NullString
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, err
+		}
+		texts[id] = text.String
+	}
+	return texts, rows.Err()
+}
+
+// documentCount counts the attachments of a message that have text for the
+// prompt.
+func documentCount(message Message) int {
+	count := 0
+	for _, attachment := range message.Attachments {
+		if attachment.ExtractionStatus != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// withDocuments appends the documents of a message to its content, each cut
+// to tokenLimit tokens. Documents without text are mentioned so the model
+// can tell the user.
+func withDocuments(message Message, texts map[string]string, tokenizer tokenizerFamily, tokenLimit int) string {
+	var content strings.Builder
+	content.WriteString(message.Content)
+	for _, attachment := range message.Attachments {
+		if attachment.ExtractionStatus == nil {
+			continue
+		}
+		if content.Len() > 0 {
+			content.WriteString("\n\n")
+		}
+
+		text, ok := texts[attachment.ID]
+		switch {
+		case ok:
+			content.WriteString(`<document name="` + html.EscapeString(attachment.Filename) + `">` + "\n")
+			content.WriteString(tokenizer.truncateToTokens(text, tokenLimit))
+			content.WriteString("\n</document>")
+		case *attachment.ExtractionStatus == ExtractionPending:
+			content.WriteString("[The text of " + attachment.Filename + " is still being extracted]")
+		default:
+			content.WriteString("[The text of " + attachment.Filename + " could not be extracted]")
+		}
+	}
+	return content.String()
+}
+
+// truncateToTokens cuts text to about limit tokens and notes how much was
+// left out.
+func (f tokenizerFamily) truncateToTokens(text string, limit int) string {
+	if f.countTokens(text) <= limit {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := min(len(runes), int(float64(max(limit, 0))*f.charsPerToken))
+	for cut > 0 && f.countTokens(string(runes[:cut])) > limit {
+		cut = cut * 9 / 10
+	}
+	return string(runes[:cut]) + "\n[... truncated, " + strconv.Itoa(cut) + " of " + strconv.Itoa(len(runes)) + " characters shown]"
+}
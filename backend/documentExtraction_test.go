@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractText(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		contentType string
+		want        string
+	}{
+		{
+			name:        "pdf with bfrange cmap",
+			file:        "cmap.pdf",
+			contentType: "application/pdf",
+			want:        "Hello World.\nQuarterly report\nPlain Helvetica line",
+		},
+		{
+			name:        "docx paragraphs, tabs and tables",
+			file:        "report.docx",
+			contentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			want:        "Quarterly report\nRevenue\t42\nA & B",
+		},
+		{
+			name:        "semicolon csv",
+			file:        "people.csv",
+			contentType: "text/csv",
+			want:        "name,city,note\nAda,London,first; programmer\nLinus,Helsinki",
+		},
+		{
+			name:        "markdown",
+			file:        "notes.md",
+			contentType: "text/markdown",
+			want:        "# Notes\n\n- one\n- two",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := extractText(tt.file, tt.contentType, data)
+			if err != nil {
+				t.Fatalf("extractText: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("extractText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTextFencesSourceCode(t *testing.T) {
+	got, err := extractText("main.go", "text/plain", []byte("package main\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "```go\npackage main\n```"; got != want {
+		t.Errorf("extractText = %q, want %q", got, want)
+	}
+}
+
+func TestExtractTextEmpty(t *testing.T) {
+	if _, err := extractText("empty.md", "text/markdown", []byte(" \n\n")); !errors.Is(err, errNoText) {
+		t.Errorf("extractText error = %v, want errNoText", err)
+	}
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "not a pdf",
+			data:    []byte("hello"),
+			wantErr: true,
+		},
+		{
+			name:    "encrypted",
+			data:    []byte("%PDF-1.4\n1 0 obj\n<</Encrypt 2 0 R>>\nendobj\n"),
+			wantErr: true,
+		},
+		{
+			name: "uncompressed literal strings",
+			data: []byte("%PDF-1.4\n" +
+				"1 0 obj\n<</Type /Catalog /Pages 2 0 R>>\nendobj\n" +
+				"2 0 obj\n<</Type /Pages /Kids [3 0 R] /Count 1>>\nendobj\n" +
+				"3 0 obj\n<</Type /Page /Parent 2 0 R /Contents 4 0 R>>\nendobj\n" +
+				"4 0 obj\n<</Length 44>>\nstream\nBT (First line) Tj 0 -14 Td (Second) Tj ET\nendstream\nendobj\n"),
+			want: "First line\nSecond",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPDFText(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("extractPDFText = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractPDFText: %v", err)
+			}
+			if got = strings.TrimSpace(got); got != tt.want {
+				t.Errorf("extractPDFText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePDFCMapRanges(t *testing.T) {
+	cmap := parsePDFCMap(`
+		1 begincodespacerange <0000> <FFFF> endcodespacerange
+		2 beginbfrange
+		<0041> <0043> <0061>
+		<0050> <0051> [<0058> <D83DDE00>]
+		endbfrange
+		1 beginbfchar <0001> <263A> endbfchar
+	`)
+	if cmap.codeLength != 2 {
+		t.Errorf("codeLength = %d, want 2", cmap.codeLength)
+	}
+	want := map[uint32]string{0x41: "a", 0x42: "b", 0x43: "c", 0x50: "X", 0x51: "😀", 0x01: "☺"}
+	for code, text := range want {
+		if got := cmap.mapping[code]; got != text {
+			t.Errorf("mapping[%#x] = %q, want %q", code, got, text)
+		}
+	}
+	if len(cmap.mapping) != len(want) {
+		t.Errorf("got %d mappings, want %d", len(cmap.mapping), len(want))
+	}
+}
+
+func TestParsePDFCMapRangeAtMaximumCode(t *testing.T) {
+	cmap := parsePDFCMap(`1 beginbfrange <FFFFFFFE> <FFFFFFFF> <0041> endbfrange`)
+	if len(cmap.mapping) != 2 || cmap.mapping[0xFFFFFFFF] != "B" {
+		t.Errorf("mapping = %v, want two codes ending in B", cmap.mapping)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// embeddingBatchSize is the number of texts sent in one embeddings request.
+const embeddingBatchSize = 64
+
+// Embedder turns texts into vectors. Vectors of different models can't be
+// compared, so knowledge bases remember the Model they were embedded with.
+type Embedder interface {
+	Model() string
+	// Embed returns one normalized vector per text. Calls are billed to the
+	// user's provider key where the embedder uses a provider.
+	Embed(ctx context.Context, userID string, texts []string) ([][]float32, error)
+}
+
+// NewEmbedder picks the embedder from EMBEDDING_BACKEND: "provider" uses the
+// embeddings endpoint of EMBEDDING_PROVIDER, "local" a hashing embedder that
+// needs no API at all but only matches shared words.
+func NewEmbedder(providers *ProviderClient, keys *ProviderKeyService) Embedder {
+	switch backend := getEnv("EMBEDDING_BACKEND", "provider"); backend {
+	case "provider":
+		return &ProviderEmbedder{
+			providers: providers,
+			keys:      keys,
+			provider:  getEnv("EMBEDDING_PROVIDER", ProviderOpenAI),
+			model:     getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+		}
+	case "local":
+		return &LocalEmbedder{dimensions: int(getEnvInt64("EMBEDDING_DIMENSIONS", 1024))}
+	default:
+		log.Fatalf("Unknown EMBEDDING_BACKEND %q", backend)
+		return nil
+	}
+}
+
+// ProviderEmbedder embeds through an OpenAI-compatible embeddings endpoint.
+type ProviderEmbedder struct {
+	providers *ProviderClient
+	keys      *ProviderKeyService
+	provider  string
+	model     string
+}
+
+func (e *ProviderEmbedder) Model() string {
+	return e.provider + ":" + e.model
+}
+
+func (e *ProviderEmbedder) Embed(ctx context.Context, userID string, texts []string) ([][]float32, error) {
+	apiKey, _, err := e.keys.resolveAPIKey(userID, e.provider)
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingBatchSize {
+		batch := texts[start:min(start+embeddingBatchSize, len(texts))]
+		embedded, err := e.providers.CreateEmbeddings(ctx, e.provider, apiKey, e.model, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, vector := range embedded {
+			vectors = append(vectors, normalizeVector(vector))
+		}
+	}
+	return vectors, nil
+}
+
+// LocalEmbedder hashes words and word pairs into a fixed number of
+// dimensions. It finds passages that share vocabulary with the question,
+// which is often enough for names, codes and technical terms.
+type LocalEmbedder struct {
+	dimensions int
+}
+
+func (e *LocalEmbedder) Model() string {
+	return "local:hashing-" + strconv.Itoa(e.dimensions)
+}
+
+func (e *LocalEmbedder) Embed(_ context.Context, _ string, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector := make([]float32, e.dimensions)
+		words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		for j, word := range words {
+			e.add(vector, word, 1)
+			if j > 0 {
+				e.add(vector, words[j-1]+" "+word, 0.5)
+			}
+		}
+		vectors[i] = normalizeVector(vector)
+	}
+	return vectors, nil
+}
+
+// add counts a feature in the vector, with a hashed sign so collisions
+// cancel out instead of piling up.
+func (e *LocalEmbedder) add(vector []float32, feature string, weight float32) {
+	hash := fnv.New64a()
+	hash.Write([]byte(feature))
+	sum := hash.Sum64()
+	if sum>>63 == 1 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+// normalizeVector scales a vector to unit length, so cosine similarity is a
+// dot product.
+func normalizeVector(vector []float32) []float32 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+	if norm == 0 {
+		return vector
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range vector {
+		vector[i] *= scale
+	}
+	return vector
+}
+
+func dotProduct(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return float64(sum)
+}
+
+// encodeVector stores a vector as little-endian float32 values, the binary
+// layout MariaDB uses for its VECTOR type.
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
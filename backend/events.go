@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	eventBufferSize  = 16
+	eventKeepAlive   = 25 * time.Second
+	EventChatUpdated = "chat.updated"
+)
+
+// Event is pushed to connected clients over GET /api/events.
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// EventHub fans events out to the open event streams of each user. It only
+// reaches clients connected to this process.
+type EventHub struct {
+	db          *sql.DB
+	mu          sync.RWMutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func NewEventHub(db *sql.DB) *EventHub {
+	return &EventHub{db: db, subscribers: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe registers a stream for a user. The returned function must be
+// called when the stream closes.
+func (h *EventHub) Subscribe(userID string) (chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers[userID], ch)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Publish sends an event to every stream of the given users. Slow clients
+// whose buffer is full miss the event rather than blocking the publisher.
+func (h *EventHub) Publish(userIDs []string, event Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range userIDs {
+		for ch := range h.subscribers[userID] {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+// PublishChat sends an event to everyone who can see a chat: its owner, or
+// every member of its workspace.
+func (h *EventHub) PublishChat(chat *Chat, event Event) {
+	if chat.WorkspaceID == nil {
+		h.Publish([]string{chat.UserID}, event)
+		return
+	}
+
+	rows, err := h.db.Query("SELECT user_id FROM workspace_members WHERE workspace_id = ?", *chat.WorkspaceID)
+	if err != nil {
+		log.Printf("Failed to fetch workspace members for event: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Failed to scan workspace member for event: %v", err)
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+	h.Publish(userIDs, event)
+}
+
+// Stream events for the current user as server-sent events
+func (h *EventHub) StreamEvents(c *gin.Context) {
+	events, unsubscribe := h.Subscribe(currentUser(c).ID)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.SSEvent(event.Type, event.Data)
+			return true
+		case <-keepAlive.C:
+			// Comment lines keep proxies from closing an idle stream
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return false
+			}
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
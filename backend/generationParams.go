@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var reasoningEfforts = []string{"none", "low", "medium", "high"}
+
+// GenerationParams tune a completion. Unset fields leave the provider default.
+type GenerationParams struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	MaxTokens       *int     `json:"maxTokens,omitempty"`
+	ReasoningEffort *string  `json:"reasoningEffort,omitempty"`
+	Stop            []string `json:"stop,omitempty"`
+	Seed            *int     `json:"seed,omitempty"`
+}
+
+// validate checks the parameters against the ranges providers accept.
+func (p *GenerationParams) validate() error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+		return errors.New("topP must be greater than 0 and at most 1")
+	}
+	if p.MaxTokens != nil && (*p.MaxTokens < 1 || *p.MaxTokens > 1000000) {
+		return errors.New("maxTokens must be between 1 and 1000000")
+	}
+	if p.ReasoningEffort != nil && !slices.Contains(reasoningEfforts, *p.ReasoningEffort) {
+		return errors.New("reasoningEffort must be one of " + strings.Join(reasoningEfforts, ", "))
+	}
+	if len(p.Stop) > 4 {
+		return errors.New("stop accepts at most 4 sequences")
+	}
+	for _, stop := range p.Stop {
+		if stop == "" || len(stop) > 100 {
+			return errors.New("stop sequences must be between 1 and 100 characters")
+		}
+	}
+	return nil
+}
+
+// apply copies the set parameters onto a completion request. A reasoning
+// effort of "none" turns reasoning off, any other effort turns it on.
+func (p *GenerationParams) apply(completion *CompletionRequest) {
+	if p.Temperature != nil {
+		completion.Temperature = p.Temperature
+	}
+	if p.TopP != nil {
+		completion.TopP = p.TopP
+	}
+	if p.MaxTokens != nil {
+		completion.MaxTokens = p.MaxTokens
+	}
+	if p.Stop != nil {
+		completion.Stop = p.Stop
+	}
+	if p.Seed != nil {
+		completion.Seed = p.Seed
+	}
+	if p.ReasoningEffort != nil {
+		if *p.ReasoningEffort == "none" {
+			completion.Reasoning = nil
+		} else {
+			completion.Reasoning = &ReasoningConfig{Effort: *p.ReasoningEffort}
+		}
+	}
+}
+
+// validateForModel checks that the model accepts every parameter that is set,
+// based on the catalog's supported_parameters. Models the catalog doesn't
+// describe are not checked.
+func (p *GenerationParams) validateForModel(model *CatalogModel) error {
+	if model == nil || len(model.SupportedParameters) == 0 {
+		return nil
+	}
+
+	checks := []struct {
+		set       bool
+		parameter string
+		field     string
+	}{
+		{p.Temperature != nil, "temperature", "temperature"},
+		{p.TopP != nil, "top_p", "topP"},
+		{p.MaxTokens != nil, "max_tokens", "maxTokens"},
+		{p.Stop != nil, "stop", "stop"},
+		{p.Seed != nil, "seed", "seed"},
+	}
+	for _, check := range checks {
+		if check.set && !slices.Contains(model.SupportedParameters, check.parameter) {
+			return fmt.Errorf("%s does not support %s", model.ID, check.field)
+		}
+	}
+
+	if p.ReasoningEffort != nil && *p.ReasoningEffort != "none" && !model.SupportsReasoning {
+		return fmt.Errorf("%s does not support reasoning", model.ID)
+	}
+
+	limit := model.MaxOutputTokens
+	if limit == 0 {
+		limit = model.ContextLength
+	}
+	if p.MaxTokens != nil && limit > 0 && *p.MaxTokens > limit {
+		return fmt.Errorf("maxTokens must be at most %d for %s", limit, model.ID)
+	}
+	return nil
+}
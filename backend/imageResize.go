@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// Largest source dimensions we are willing to decode. Checked against the
+// image header so oversized uploads are rejected before allocating pixels.
+const maxDecodePixels = 40_000_000
+
+var errImageTooLarge = errors.New("image dimensions too large")
+
+// decodeImage decodes a PNG, JPEG or GIF after checking its header.
+func decodeImage(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxDecodePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+// cropSquare returns the largest centered square of img.
+func cropSquare(img image.Image) image.Image {
+	bounds := img.Bounds()
+	size := bounds.Dx()
+	if bounds.Dy() < size {
+		size = bounds.Dy()
+	}
+
+	x := bounds.Min.X + (bounds.Dx()-size)/2
+	y := bounds.Min.Y + (bounds.Dy()-size)/2
+	square := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(square, square.Bounds(), img, image.Pt(x, y), draw.Src)
+	return square
+}
+
+// fitWithin scales img down so it fits inside maxWidth x maxHeight while
+// keeping its aspect ratio. Smaller images are returned unchanged.
+func fitWithin(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= maxWidth && bounds.Dy() <= maxHeight {
+		return img
+	}
+
+	width, height := maxWidth, bounds.Dy()*maxWidth/bounds.Dx()
+	if height > maxHeight {
+		width, height = bounds.Dx()*maxHeight/bounds.Dy(), maxHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return resizeImage(img, width, height)
+}
+
+// resizeImage scales img to width x height by averaging every source pixel
+// that falls into a destination pixel. Only intended for downscaling.
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := (y + 1) * srcH / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := (x + 1) * srcW / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeJPEG flattens transparency onto white, since JPEG has no alpha.
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// JobQueue runs background work on a fixed number of workers so request
+// handlers can return before slow tasks finish.
+type JobQueue struct {
+	jobs chan job
+}
+
+type job struct {
+	name string
+	run  func() error
+}
+
+func NewJobQueue(workers, size int) *JobQueue {
+	q := &JobQueue{jobs: make(chan job, size)}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue schedules fn and reports false when the queue is full.
+func (q *JobQueue) Enqueue(name string, fn func() error) bool {
+	select {
+	case q.jobs <- job{name: name, run: fn}:
+		return true
+	default:
+		log.Printf("Job queue full, dropping %s", name)
+		return false
+	}
+}
+
+func (q *JobQueue) work() {
+	for j := range q.jobs {
+		q.runJob(j)
+	}
+}
+
+func (q *JobQueue) runJob(j job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %s panicked: %v", j.name, r)
+		}
+	}()
+
+	if err := j.run(); err != nil {
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+}
+
+// runPeriodically calls fn every interval for the lifetime of the process.
+func runPeriodically(name string, interval time.Duration, fn func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := fn(); err != nil {
+				log.Printf("Periodic task %s failed: %v", name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// sealedSecretTables lists where sealed secrets are stored: the columns
+// addressing a row and the prefix of the sealed columns.
+var sealedSecretTables = []struct {
+	table  string
+	keys   []string
+	prefix string
+}{
+	{"provider_keys", []string{"user_id", "provider"}, ""},
+	{"mcp_servers", []string{"id"}, ""},
+	{"users", []string{"id"}, "totp_"},
+}
+
+// rewrapSecrets moves every stored secret to the current master key, so the
+// PREVIOUS_MASTER_KEYS can be dropped once it succeeded. TOTP secrets stored
+// before a master key was configured are sealed as well.
+func rewrapSecrets(db *sql.DB, box *SecretBox) error {
+	if !box.Enabled() {
+		return nil
+	}
+
+	rewrapped, failed := 0, 0
+	for _, t := range sealedSecretTables {
+		done, failures, err := rewrapTable(db, box, t.table, t.keys, t.prefix)
+		if err != nil {
+			return fmt.Errorf("rewrap %s: %w", t.table, err)
+		}
+		rewrapped += done
+		failed += failures
+	}
+
+	sealed, err := sealPlaintextTOTPSecrets(db, box)
+	if err != nil {
+		return fmt.Errorf("seal totp secrets: %w", err)
+	}
+
+	if rewrapped > 0 || sealed > 0 {
+		log.Printf("Re-wrapped %d secrets and sealed %d TOTP secrets with master key %s", rewrapped, sealed, box.keyID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d secrets use an unknown master key, keep PREVIOUS_MASTER_KEYS until they are replaced", failed)
+	}
+	return nil
+}
+
+// rewrapTable re-wraps the data keys of one table that were wrapped with a
+// previous master key. Secrets nobody can open are counted as failures.
+func rewrapTable(db *sql.DB, box *SecretBox, table string, keys []string, prefix string) (int, int, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT %s, %sciphertext, %snonce, %swrapped_key, %skey_nonce, %smaster_key_id
+		FROM %s
+		WHERE %smaster_key_id IS NOT NULL AND %smaster_key_id <> ?
+	`, strings.Join(keys, ", "), prefix, prefix, prefix, prefix, prefix, table, prefix, prefix), box.keyID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type row struct {
+		key    []interface{}
+		sealed SealedSecret
+	}
+	var stale []row
+	for rows.Next() {
+		r := row{key: make([]interface{}, len(keys))}
+		dest := make([]interface{}, 0, len(keys)+5)
+		for i := range keys {
+			dest = append(dest, &r.key[i])
+		}
+		dest = append(dest, &r.sealed.Ciphertext, &r.sealed.Nonce, &r.sealed.WrappedKey, &r.sealed.KeyNonce, &r.sealed.MasterKeyID)
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		stale = append(stale, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		conditions[i] = key + " = ?"
+	}
+	// The master key ID condition skips rows a user changed meanwhile
+	query := fmt.Sprintf(
+		"UPDATE %s SET %swrapped_key = ?, %skey_nonce = ?, %smaster_key_id = ? WHERE %s AND %smaster_key_id = ?",
+		table, prefix, prefix, prefix, strings.Join(conditions, " AND "), prefix,
+	)
+
+	rewrapped, failed := 0, 0
+	for _, r := range stale {
+		secret, err := box.Rewrap(&r.sealed)
+		if err != nil {
+			log.Printf("Failed to re-wrap secret in %s sealed with master key %s: %v", table, r.sealed.MasterKeyID, err)
+			failed++
+			continue
+		}
+		args := []interface{}{secret.WrappedKey, secret.KeyNonce, secret.MasterKeyID}
+		args = append(args, r.key...)
+		args = append(args, r.sealed.MasterKeyID)
+		if _, err := db.Exec(query, args...); err != nil {
+			return rewrapped, failed, err
+		}
+		rewrapped++
+	}
+	return rewrapped, failed, nil
+}
+
+// sealPlaintextTOTPSecrets seals the secrets enrolled while no master key
+// was configured.
+func sealPlaintextTOTPSecrets(db *sql.DB, box *SecretBox) (int, error) {
+	rows, err := db.Query("SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	secrets := map[string]string{}
+	for rows.Next() {
+		var userID, secret string
+		if err := rows.Scan(&userID, &secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		secrets[userID] = secret
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for userID, secret := range secrets {
+		sealed, err := box.Seal([]byte(secret))
+		if err != nil {
+			return 0, err
+		}
+		args := append(sealedColumns(sealed), userID, secret)
+		_, err = db.Exec(`
+			UPDATE users SET totp_secret = NULL, totp_ciphertext = ?, totp_nonce = ?, totp_wrapped_key = ?,
+				totp_key_nonce = ?, totp_master_key_id = ?
+			WHERE id = ? AND totp_secret = ?
+		`, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(secrets), nil
+}
@@ -0,0 +1,885 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxKnowledgeBaseNameLength        = 100
+	maxKnowledgeBaseDescriptionLength = 500
+	maxKnowledgeQueryLength           = 2000
+	knowledgeSnippetLength            = 300
+	reindexBatchSize                  = 256
+
+	DocumentIndexing = "indexing"
+	DocumentReady    = "ready"
+	DocumentFailed   = "failed"
+
+	CitationKnowledgeBase = "knowledge_base"
+
+	knowledgePrompt = "Answer using the following excerpts from the knowledge base when they are relevant. Cite the excerpts you use with their number in square brackets, like [1]. If the excerpts don't answer the question, say so before answering from general knowledge."
+)
+
+var errEmbeddingModelChanged = errors.New("knowledge base was embedded with another model and needs to be reindexed")
+
+// KnowledgeBase is a collection of documents searched to answer questions in
+// chats. It belongs either to a user or to a workspace.
+type KnowledgeBase struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	UserID      *string `json:"userId"`
+	WorkspaceID *int    `json:"workspaceId"`
+	CreatedBy   *string `json:"createdBy"`
+	// EmbeddingModel is the model every chunk was embedded with
+	EmbeddingModel string    `json:"embeddingModel"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// knowledgeBaseColumns lists the knowledge_bases columns scanned by scanKnowledgeBase.
+const knowledgeBaseColumns = "id, name, description, user_id, workspace_id, created_by, embedding_model, created_at, updated_at"
+
+func scanKnowledgeBase(row rowScanner) (*KnowledgeBase, error) {
+	var kb KnowledgeBase
+	err := row.Scan(
+		&kb.ID, &kb.Name, &kb.Description, &kb.UserID, &kb.WorkspaceID, &kb.CreatedBy, &kb.EmbeddingModel,
+		&kb.CreatedAt, &kb.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &kb, nil
+}
+
+// KnowledgeDocument is a file added to a knowledge base. Only its chunks are
+// kept, the uploaded file is removed once it is indexed.
+type KnowledgeDocument struct {
+	ID              int       `json:"id"`
+	KnowledgeBaseID int       `json:"knowledgeBaseId"`
+	Filename        string    `json:"filename"`
+	ContentType     string    `json:"contentType"`
+	Size            int64     `json:"size"`
+	SHA256          string    `json:"sha256"`
+	Status          string    `json:"status"`
+	Error           *string   `json:"error"`
+	ChunkCount      int       `json:"chunkCount"`
+	CreatedBy       *string   `json:"createdBy"`
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// knowledgeDocumentColumns lists the knowledge_documents columns scanned by scanKnowledgeDocument.
+const knowledgeDocumentColumns = "id, knowledge_base_id, filename, content_type, size, sha256, status, error, chunk_count, created_by, created_at, updated_at"
+
+func scanKnowledgeDocument(row rowScanner) (*KnowledgeDocument, error) {
+	var document KnowledgeDocument
+	err := row.Scan(
+		&document.ID, &document.KnowledgeBaseID, &document.Filename, &document.ContentType, &document.Size,
+		&document.SHA256, &document.Status, &document.Error, &document.ChunkCount, &document.CreatedBy,
+		&document.CreatedAt, &document.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+type KnowledgeBaseRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	// WorkspaceID is only read when creating a knowledge base
+	WorkspaceID *int `json:"workspaceId"`
+}
+
+// RetrievedChunk is a chunk found for a question, with the citation it is
+// stored under.
+type RetrievedChunk struct {
+	Citation
+	Content string
+}
+
+type KnowledgeService struct {
+	db       *sql.DB
+	chats    *ChatService
+	store    BlobStore
+	jobs     *JobQueue
+	embedder Embedder
+	index    VectorIndex
+
+	chunkTokens   int
+	overlapTokens int
+	topK          int
+	minScore      float64
+
+	mu         sync.Mutex
+	reindexing map[int]bool
+}
+
+func NewKnowledgeService(db *sql.DB, chats *ChatService, store BlobStore, jobs *JobQueue, embedder Embedder, index VectorIndex) *KnowledgeService {
+	// Hashed word vectors score far lower than learned embeddings
+	defaultMinScore := "0.2"
+	if _, ok := embedder.(*LocalEmbedder); ok {
+		defaultMinScore = "0.05"
+	}
+	minScore, err := strconv.ParseFloat(getEnv("RAG_MIN_SCORE", defaultMinScore), 64)
+	if err != nil {
+		log.Fatal("Invalid RAG_MIN_SCORE:", err)
+	}
+	return &KnowledgeService{
+		db:            db,
+		chats:         chats,
+		store:         store,
+		jobs:          jobs,
+		embedder:      embedder,
+		index:         index,
+		chunkTokens:   int(getEnvInt64("KNOWLEDGE_CHUNK_TOKENS", 400)),
+		overlapTokens: int(getEnvInt64("KNOWLEDGE_CHUNK_OVERLAP", 60)),
+		topK:          int(getEnvInt64("RAG_TOP_K", 5)),
+		minScore:      minScore,
+		reindexing:    make(map[int]bool),
+	}
+}
+
+// List the user's personal knowledge bases, or those of a workspace when workspaceId is given
+func (ks *KnowledgeService) GetKnowledgeBases(c *gin.Context) {
+	user := currentUser(c)
+
+	query := `SELECT ` + knowledgeBaseColumns + ` FROM knowledge_bases WHERE user_id = ? ORDER BY name ASC`
+	args := []interface{}{user.ID}
+	if value := c.Query("workspaceId"); value != "" {
+		workspaceID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		if !ks.chats.requireWorkspaceRole(c, workspaceID, WorkspaceViewer) {
+			return
+		}
+		query = `SELECT ` + knowledgeBaseColumns + ` FROM knowledge_bases WHERE workspace_id = ? ORDER BY name ASC`
+		args = []interface{}{workspaceID}
+	}
+
+	rows, err := ks.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch knowledge bases"})
+		return
+	}
+	defer rows.Close()
+
+	knowledgeBases := []KnowledgeBase{}
+	for rows.Next() {
+		kb, err := scanKnowledgeBase(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan knowledge base"})
+			return
+		}
+		knowledgeBases = append(knowledgeBases, *kb)
+	}
+
+	c.JSON(http.StatusOK, knowledgeBases)
+}
+
+// Create a knowledge base for the current user or a workspace
+func (ks *KnowledgeService) CreateKnowledgeBase(c *gin.Context) {
+	user := currentUser(c)
+
+	var req KnowledgeBaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if !validateKnowledgeBaseRequest(c, &req) {
+		return
+	}
+
+	kb := KnowledgeBase{
+		Name:           *req.Name,
+		CreatedBy:      &user.ID,
+		EmbeddingModel: ks.embedder.Model(),
+	}
+	if req.Description != nil {
+		kb.Description = *req.Description
+	}
+	if req.WorkspaceID != nil {
+		if !ks.chats.requireWorkspaceRole(c, *req.WorkspaceID, WorkspaceEditor) {
+			return
+		}
+		kb.WorkspaceID = req.WorkspaceID
+	} else {
+		kb.UserID = &user.ID
+	}
+
+	now := time.Now()
+	result, err := ks.db.Exec(`
+		INSERT INTO knowledge_bases (name, description, user_id, workspace_id, created_by, embedding_model, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, kb.Name, kb.Description, kb.UserID, kb.WorkspaceID, kb.CreatedBy, kb.EmbeddingModel, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create knowledge base"})
+		return
+	}
+
+	kbID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get knowledge base ID"})
+		return
+	}
+	kb.ID = int(kbID)
+	kb.CreatedAt = now
+	kb.UpdatedAt = now
+
+	c.JSON(http.StatusCreated, kb)
+}
+
+// Get a single knowledge base
+func (ks *KnowledgeService) GetKnowledgeBase(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, kb)
+}
+
+// Update the name or description of a knowledge base
+func (ks *KnowledgeService) UpdateKnowledgeBase(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	var req KnowledgeBaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !validateKnowledgeBaseRequest(c, &req) {
+		return
+	}
+
+	// Build dynamic update query
+	updateFields := []string{}
+	args := []interface{}{}
+
+	if req.Name != nil {
+		updateFields = append(updateFields, "name = ?")
+		args = append(args, *req.Name)
+	}
+	if req.Description != nil {
+		updateFields = append(updateFields, "description = ?")
+		args = append(args, *req.Description)
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updateFields = append(updateFields, "updated_at = ?")
+	args = append(args, time.Now(), kb.ID)
+
+	query := `UPDATE knowledge_bases SET ` + strings.Join(updateFields, ", ") + ` WHERE id = ?`
+	if _, err := ks.db.Exec(query, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update knowledge base"})
+		return
+	}
+
+	updated, err := scanKnowledgeBase(ks.db.QueryRow(`SELECT `+knowledgeBaseColumns+` FROM knowledge_bases WHERE id = ?`, kb.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch knowledge base"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// Delete a knowledge base with its documents, chats using it are detached
+func (ks *KnowledgeService) DeleteKnowledgeBase(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if _, err := ks.db.Exec("DELETE FROM knowledge_bases WHERE id = ?", kb.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete knowledge base"})
+		return
+	}
+	ks.index.Forget(kb.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Knowledge base deleted successfully"})
+}
+
+// List the documents of a knowledge base
+func (ks *KnowledgeService) GetKnowledgeDocuments(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	rows, err := ks.db.Query(
+		`SELECT `+knowledgeDocumentColumns+` FROM knowledge_documents WHERE knowledge_base_id = ? ORDER BY created_at ASC`,
+		kb.ID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch documents"})
+		return
+	}
+	defer rows.Close()
+
+	documents := []KnowledgeDocument{}
+	for rows.Next() {
+		document, err := scanKnowledgeDocument(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan document"})
+			return
+		}
+		documents = append(documents, *document)
+	}
+
+	c.JSON(http.StatusOK, documents)
+}
+
+// Add an uploaded attachment to a knowledge base, indexed in the background
+func (ks *KnowledgeService) AddKnowledgeDocument(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	user := currentUser(c)
+
+	var req struct {
+		AttachmentID string `json:"attachmentId" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment ID is required"})
+		return
+	}
+
+	// Only the uploader's unsent files can be added
+	attachment, err := scanAttachment(ks.db.QueryRow(
+		`SELECT `+attachmentColumns+` FROM attachments WHERE id = ? AND user_id = ? AND message_id IS NULL`,
+		req.AttachmentID, user.ID,
+	))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or already sent attachment"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment"})
+		return
+	}
+	if !isDocumentType(attachment.ContentType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only documents can be added to a knowledge base"})
+		return
+	}
+
+	now := time.Now()
+	document := KnowledgeDocument{
+		KnowledgeBaseID: kb.ID,
+		Filename:        attachment.Filename,
+		ContentType:     attachment.ContentType,
+		Size:            attachment.Size,
+		SHA256:          attachment.SHA256,
+		Status:          DocumentIndexing,
+		CreatedBy:       &user.ID,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	result, err := ks.db.Exec(`
+		INSERT INTO knowledge_documents (knowledge_base_id, filename, content_type, size, sha256, status, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, document.KnowledgeBaseID, document.Filename, document.ContentType, document.Size, document.SHA256,
+		document.Status, document.CreatedBy, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create document"})
+		return
+	}
+	documentID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get document ID"})
+		return
+	}
+	document.ID = int(documentID)
+
+	queued := ks.jobs.Enqueue("knowledge indexing", func() error {
+		return ks.indexDocument(document, *attachment, user.ID)
+	})
+	if !queued {
+		message := "The server is busy, please add the document again later"
+		ks.failDocument(document.ID, attachment.ID, message)
+		document.Status = DocumentFailed
+		document.Error = &message
+	}
+
+	c.JSON(http.StatusAccepted, document)
+}
+
+// Remove a document and its chunks from a knowledge base
+func (ks *KnowledgeService) DeleteKnowledgeDocument(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	documentID, err := strconv.Atoi(c.Param("documentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	result, err := ks.db.Exec("DELETE FROM knowledge_documents WHERE id = ? AND knowledge_base_id = ?", documentID, kb.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete document"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return
+	}
+	if err := ks.bumpVersion(kb.ID); err != nil {
+		log.Printf("Failed to update version of knowledge base %d: %v", kb.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Document deleted successfully"})
+}
+
+// Embed every chunk again with the configured embedding model
+func (ks *KnowledgeService) ReindexKnowledgeBase(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+	user := currentUser(c)
+
+	ks.mu.Lock()
+	running := ks.reindexing[kb.ID]
+	if !running {
+		ks.reindexing[kb.ID] = true
+	}
+	ks.mu.Unlock()
+	if running {
+		c.JSON(http.StatusConflict, gin.H{"error": "Knowledge base is already being reindexed"})
+		return
+	}
+
+	queued := ks.jobs.Enqueue("knowledge reindexing", func() error {
+		defer func() {
+			ks.mu.Lock()
+			delete(ks.reindexing, kb.ID)
+			ks.mu.Unlock()
+		}()
+		return ks.reindex(kb.ID, user.ID)
+	})
+	if !queued {
+		ks.mu.Lock()
+		delete(ks.reindexing, kb.ID)
+		ks.mu.Unlock()
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The server is busy, please try again later"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Reindexing started", "embeddingModel": ks.embedder.Model()})
+}
+
+// Search a knowledge base, to check what a question would retrieve
+func (ks *KnowledgeService) SearchKnowledgeBase(c *gin.Context) {
+	kb, ok := ks.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Query string `json:"query" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Query) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query is required"})
+		return
+	}
+	if len([]rune(req.Query)) > maxKnowledgeQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query must be at most 2000 characters"})
+		return
+	}
+
+	chunks, err := ks.retrieve(c.Request.Context(), kb.ID, currentUser(c).ID, req.Query)
+	if err != nil {
+		if errors.Is(err, errEmbeddingModelChanged) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Knowledge base needs to be reindexed"})
+		} else {
+			log.Printf("Failed to search knowledge base %d: %v", kb.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search knowledge base"})
+		}
+		return
+	}
+
+	results := make([]gin.H, len(chunks))
+	for i, chunk := range chunks {
+		results[i] = gin.H{"citation": chunk.Citation, "content": chunk.Content}
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// indexDocument extracts, chunks and embeds a document. The upload is
+// released to the attachment cleanup afterwards, whether indexing worked
+// or not.
+func (ks *KnowledgeService) indexDocument(document KnowledgeDocument, attachment Attachment, userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	fail := func(message string) error {
+		return ks.failDocument(document.ID, attachment.ID, message)
+	}
+
+	blob, err := ks.store.Get(ctx, attachment.storageKey)
+	if err != nil {
+		return fail("File could not be read")
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fail("File could not be read")
+	}
+
+	text, err := extractText(attachment.Filename, attachment.ContentType, data)
+	if errors.Is(err, errNoText) {
+		return fail(err.Error())
+	} else if err != nil {
+		log.Printf("Failed to extract text of knowledge document %d: %v", document.ID, err)
+		return fail(truncateRunes(err.Error(), 500))
+	}
+
+	chunks := chunkText(text, ks.chunkTokens, ks.overlapTokens)
+	vectors, err := ks.embedder.Embed(ctx, userID, chunks)
+	if err != nil {
+		log.Printf("Failed to embed knowledge document %d: %v", document.ID, err)
+		return fail("Embedding failed: " + truncateRunes(err.Error(), 400))
+	}
+
+	tx, err := ks.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The chunks must match the model the rest of the knowledge base uses
+	var model string
+	if err := tx.QueryRow("SELECT embedding_model FROM knowledge_bases WHERE id = ? FOR UPDATE", document.KnowledgeBaseID).Scan(&model); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if model != ks.embedder.Model() {
+		tx.Rollback()
+		return fail(errEmbeddingModelChanged.Error())
+	}
+
+	for i, chunk := range chunks {
+		_, err := tx.Exec(
+			"INSERT INTO knowledge_chunks (knowledge_base_id, document_id, chunk_index, content, embedding) VALUES (?, ?, ?, ?, ?)",
+			document.KnowledgeBaseID, document.ID, i, chunk, encodeVector(vectors[i]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec(
+		"UPDATE knowledge_documents SET status = ?, chunk_count = ?, updated_at = ? WHERE id = ?",
+		DocumentReady, len(chunks), time.Now(), document.ID,
+	)
+	if err != nil {
+		return err
+	}
+	// Deleted while it was being indexed
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE knowledge_bases SET version = version + 1 WHERE id = ?", document.KnowledgeBaseID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	ks.releaseAttachment(attachment.ID)
+	return nil
+}
+
+func (ks *KnowledgeService) failDocument(documentID int, attachmentID, message string) error {
+	ks.releaseAttachment(attachmentID)
+	_, err := ks.db.Exec(
+		"UPDATE knowledge_documents SET status = ?, error = ?, updated_at = ? WHERE id = ?",
+		DocumentFailed, message, time.Now(), documentID,
+	)
+	return err
+}
+
+// releaseAttachment hands an unsent upload to the cleanup job, which
+// removes attachments without a user.
+func (ks *KnowledgeService) releaseAttachment(attachmentID string) {
+	if _, err := ks.db.Exec("UPDATE attachments SET user_id = NULL WHERE id = ? AND message_id IS NULL", attachmentID); err != nil {
+		log.Printf("Failed to release attachment %s: %v", attachmentID, err)
+	}
+}
+
+func (ks *KnowledgeService) bumpVersion(knowledgeBaseID int) error {
+	ks.index.Forget(knowledgeBaseID)
+	_, err := ks.db.Exec("UPDATE knowledge_bases SET version = version + 1 WHERE id = ?", knowledgeBaseID)
+	return err
+}
+
+// reindex embeds the chunks of a knowledge base in batches. Searches fail
+// with errEmbeddingModelChanged until the last batch is written.
+func (ks *KnowledgeService) reindex(knowledgeBaseID int, userID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	model := ks.embedder.Model()
+	if _, err := ks.db.Exec("UPDATE knowledge_bases SET embedding_model = ? WHERE id = ?", "reindexing:"+model, knowledgeBaseID); err != nil {
+		return err
+	}
+
+	var lastID int64
+	for {
+		rows, err := ks.db.Query(
+			"SELECT id, content FROM knowledge_chunks WHERE knowledge_base_id = ? AND id > ? ORDER BY id ASC LIMIT ?",
+			knowledgeBaseID, lastID, reindexBatchSize,
+		)
+		if err != nil {
+			return err
+		}
+		var ids []int64
+		var contents []string
+		for rows.Next() {
+			var id int64
+			var content string
+			if err := rows.Scan(&id, &content); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+			contents = append(contents, content)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		vectors, err := ks.embedder.Embed(ctx, userID, contents)
+		if err != nil {
+			return fmt.Errorf("embedding chunks of knowledge base %d: %w", knowledgeBaseID, err)
+		}
+		for i, id := range ids {
+			if _, err := ks.db.Exec("UPDATE knowledge_chunks SET embedding = ? WHERE id = ?", encodeVector(vectors[i]), id); err != nil {
+				return err
+			}
+		}
+		lastID = ids[len(ids)-1]
+	}
+
+	if _, err := ks.db.Exec("UPDATE knowledge_bases SET embedding_model = ?, updated_at = ? WHERE id = ?", model, time.Now(), knowledgeBaseID); err != nil {
+		return err
+	}
+	return ks.bumpVersion(knowledgeBaseID)
+}
+
+// retrieve finds the chunks of a knowledge base most similar to a question,
+// numbered as citations in order of relevance.
+func (ks *KnowledgeService) retrieve(ctx context.Context, knowledgeBaseID int, userID, question string) ([]RetrievedChunk, error) {
+	var model string
+	if err := ks.db.QueryRowContext(ctx, "SELECT embedding_model FROM knowledge_bases WHERE id = ?", knowledgeBaseID).Scan(&model); err != nil {
+		return nil, err
+	}
+	if model != ks.embedder.Model() {
+		return nil, errEmbeddingModelChanged
+	}
+
+	vectors, err := ks.embedder.Embed(ctx, userID, []string{truncateRunes(question, maxKnowledgeQueryLength)})
+	if err != nil {
+		return nil, err
+	}
+	matches, err := ks.index.Search(ctx, knowledgeBaseID, vectors[0], ks.topK)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := map[int64]float64{}
+	args := []interface{}{knowledgeBaseID}
+	for _, match := range matches {
+		if match.Score >= ks.minScore {
+			scores[match.ChunkID] = match.Score
+			args = append(args, match.ChunkID)
+		}
+	}
+	if len(scores) == 0 {
+		return nil, nil
+	}
+
+	rows, err := ks.db.QueryContext(ctx, `
+		SELECT c.id, c.document_id, c.content, d.filename
+		FROM knowledge_chunks c JOIN knowledge_documents d ON d.id = c.document_id
+		WHERE c.knowledge_base_id = ? AND c.id IN (?`+strings.Repeat(", ?", len(scores)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := map[int64]RetrievedChunk{}
+	for rows.Next() {
+		var chunk RetrievedChunk
+		var chunkID int64
+		var documentID int
+		if err := rows.Scan(&chunkID, &documentID, &chunk.Content, &chunk.Title); err != nil {
+			return nil, err
+		}
+		score := scores[chunkID]
+		chunk.Source = CitationKnowledgeBase
+		chunk.Snippet = truncateRunes(chunk.Content, knowledgeSnippetLength)
+		chunk.KnowledgeBaseID = &knowledgeBaseID
+		chunk.DocumentID = &documentID
+		chunk.ChunkID = &chunkID
+		chunk.Score = &score
+		found[chunkID] = chunk
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keep the order of the search, chunks deleted meanwhile are skipped
+	chunks := []RetrievedChunk{}
+	for _, match := range matches {
+		if chunk, ok := found[match.ChunkID]; ok {
+			chunk.Index = len(chunks) + 1
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks, nil
+}
+
+// withKnowledge appends retrieved chunks to the system prompt, numbered as
+// their citations.
+func withKnowledge(systemPrompt string, chunks []RetrievedChunk) string {
+	if len(chunks) == 0 {
+		return systemPrompt
+	}
+
+	var section strings.Builder
+	section.WriteString(knowledgePrompt)
+	for _, chunk := range chunks {
+		fmt.Fprintf(&section, "\n\n[%d] %s\n%s", chunk.Index, chunk.Title, chunk.Content)
+	}
+	if systemPrompt == "" {
+		return section.String()
+	}
+	return systemPrompt + "\n\n" + section.String()
+}
+
+// chunkCitations returns the citations of retrieved chunks.
+func chunkCitations(chunks []RetrievedChunk) []Citation {
+	citations := make([]Citation, len(chunks))
+	for i, chunk := range chunks {
+		citations[i] = chunk.Citation
+	}
+	return citations
+}
+
+// validateKnowledgeBaseRequest checks the fields that are set and trims the
+// name, writing the error response when something is invalid.
+func validateKnowledgeBaseRequest(c *gin.Context, req *KnowledgeBaseRequest) bool {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len([]rune(name)) > maxKnowledgeBaseNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be between 1 and 100 characters"})
+			return false
+		}
+		req.Name = &name
+	}
+	if req.Description != nil && len([]rune(*req.Description)) > maxKnowledgeBaseDescriptionLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Description must be at most 500 characters"})
+		return false
+	}
+	return true
+}
+
+// authorize loads the knowledge base named by the :id parameter and checks
+// access. Personal knowledge bases are only visible to their owner.
+func (ks *KnowledgeService) authorize(c *gin.Context, minRole string) (*KnowledgeBase, bool) {
+	kbID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid knowledge base ID"})
+		return nil, false
+	}
+
+	kb, err := scanKnowledgeBase(ks.db.QueryRow(`SELECT `+knowledgeBaseColumns+` FROM knowledge_bases WHERE id = ?`, kbID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Knowledge base not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch knowledge base"})
+		return nil, false
+	}
+
+	if kb.WorkspaceID == nil {
+		if kb.UserID == nil || *kb.UserID != currentUser(c).ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Knowledge base not found"})
+			return nil, false
+		}
+		return kb, true
+	}
+
+	if !ks.chats.requireWorkspaceRole(c, *kb.WorkspaceID, minRole) {
+		return nil, false
+	}
+	return kb, true
+}
+
+// authorizeKnowledgeBase checks that a knowledge base may be attached to a
+// chat, following the rules of canUsePersona. Responds and returns false
+// otherwise.
+func (cs *ChatService) authorizeKnowledgeBase(c *gin.Context, knowledgeBaseID int, userID string, chatWorkspaceID *int) bool {
+	kb, err := scanKnowledgeBase(cs.db.QueryRow(`SELECT `+knowledgeBaseColumns+` FROM knowledge_bases WHERE id = ?`, knowledgeBaseID))
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch knowledge base"})
+		return false
+	}
+
+	allowed := false
+	if kb != nil {
+		switch {
+		case chatWorkspaceID != nil:
+			allowed = kb.WorkspaceID != nil && *kb.WorkspaceID == *chatWorkspaceID
+		case kb.WorkspaceID == nil:
+			allowed = kb.UserID != nil && *kb.UserID == userID
+		default:
+			_, err := workspaceRole(cs.db, *kb.WorkspaceID, userID)
+			if err != nil && err != sql.ErrNoRows {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch knowledge base"})
+				return false
+			}
+			allowed = err == nil
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Knowledge base not found"})
+		return false
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -23,13 +24,89 @@ func main() {
 	}
 	defer db.Close()
 
+	// Background jobs
+	jobs := NewJobQueue(4, 100)
+
+	// Encryption for secrets stored on behalf of users
+	secretBox, err := NewSecretBox()
+	if err != nil {
+		log.Fatal("Failed to load master key:", err)
+	}
+	if !secretBox.Enabled() {
+		log.Println("No MASTER_KEY configured, users cannot store provider keys")
+	} else {
+		// Moves secrets off PREVIOUS_MASTER_KEYS after a rotation
+		jobs.Enqueue("secret re-wrapping", func() error {
+			return rewrapSecrets(db, secretBox)
+		})
+	}
+	providerClient := NewProviderClient()
+
+	// Quotas, counted in memory until several backends share a store
+	rateLimiter := NewRateLimiter(NewMemoryCounterStore())
+
+	// Uploaded files and their download links
+	blobStore, err := NewBlobStore()
+	if err != nil {
+		log.Fatal("Failed to initialize blob store:", err)
+	}
+	attachmentSigner := NewAttachmentSigner()
+
+	// Tools models may call, chats choose which ones are enabled
+	toolRegistry := NewToolRegistry()
+	registerBuiltinTools(toolRegistry)
+	searchBackend, err := NewSearchBackend()
+	if err != nil {
+		log.Fatal("Failed to configure web search:", err)
+	}
+	if searchBackend != nil {
+		toolRegistry.Register(NewWebSearchTool(searchBackend))
+	}
+	mcpService, err := NewMCPService(db, secretBox, toolRegistry)
+	if err != nil {
+		log.Fatal("Failed to load MCP servers:", err)
+	}
+
 	// Initialize services
-	authService := NewAuthService(db)
-	chatService := NewChatService(db)
+	authService := NewAuthService(db, secretBox)
+	modelCatalog := NewModelCatalog(providerClient)
+	modelPolicyService, err := NewModelPolicyService(db, modelCatalog)
+	if err != nil {
+		log.Fatal("Failed to load model policy:", err)
+	}
+	providerKeyService := NewProviderKeyService(db, secretBox, providerClient)
+	eventHub := NewEventHub(db)
+	titleService := NewTitleService(db, jobs, providerClient, providerKeyService, eventHub)
+	chatService := NewChatService(db, modelCatalog, modelPolicyService, attachmentSigner, toolRegistry, titleService)
+	settingsService := NewSettingsService(db, modelCatalog, modelPolicyService)
+	personaService := NewPersonaService(db, chatService, modelCatalog)
+	templateService := NewPromptTemplateService(db, chatService)
+	userService := NewUserService(db, jobs, blobStore)
+	adminService := NewAdminService(db, userService)
+	workspaceService := NewWorkspaceService(db)
+	usageService := NewUsageService(db)
+	visionService := NewVisionService(blobStore)
+	contextService := NewContextService(db, chatService, jobs, providerClient, providerKeyService, visionService)
+	memoryService := NewMemoryService(db, jobs, providerClient, providerKeyService)
+	attachmentService := NewAttachmentService(db, chatService, blobStore, attachmentSigner, jobs)
+	embedder := NewEmbedder(providerClient, providerKeyService)
+	knowledgeService := NewKnowledgeService(db, chatService, blobStore, jobs, embedder, NewVectorIndex(db))
+	completionService := NewCompletionService(db, chatService, providerClient, providerKeyService, rateLimiter, titleService, contextService, memoryService, knowledgeService, toolRegistry)
+
+	runPeriodically("account deletion", time.Hour, userService.purgeScheduledDeletions)
+	runPeriodically("export cleanup", time.Hour, userService.cleanupExports)
+	runPeriodically("attachment cleanup", time.Hour, attachmentService.cleanupAttachments)
+	runPeriodically("MCP connections", 5*time.Minute, mcpService.maintainConnections)
 
 	// Setup Gin router
 	r := gin.Default()
 
+	// Client IPs for per-IP rate limits come from X-Forwarded-For only when
+	// the request passed through one of these proxies
+	if err := r.SetTrustedProxies(getEnvList("TRUSTED_PROXIES")); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+
 	allowedOriginsEnv := os.Getenv("CORS_ALLOWED_ORIGINS")
 	var allowedList []string
 
@@ -44,14 +121,14 @@ func main() {
 			"https://chat.safasfly.dev",
 			"https://safasfly.dev",
 			"https://www.safasfly.dev",
-			"https://ai.safasfly.dev"
+			"https://ai.safasfly.dev",
 		}
 	}
 
 	// CORS middleware
 	r.Use(cors.New(cors.Config{
 		AllowOrigins: 	  allowedList,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Cookie"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -64,10 +141,23 @@ func main() {
 		auth.POST("/sign-in/social", authService.SignInSocial)
 		auth.GET("/callback/google", authService.GoogleCallback)
 		auth.POST("/sign-out", authService.SignOut)
+		auth.GET("/signup-policy", authService.GetSignupPolicy)
+
+		// Second factor for a pending session
+		auth.POST("/2fa/verify", authService.VerifyTwoFactor)
+	}
+
+	// Two-factor management routes
+	twoFactor := r.Group("/api/auth/2fa", authService.RequireAuth())
+	{
+		twoFactor.POST("/enroll", authService.EnrollTwoFactor)
+		twoFactor.POST("/enable", authService.EnableTwoFactor)
+		twoFactor.POST("/disable", authService.DisableTwoFactor)
+		twoFactor.POST("/recovery-codes", authService.RegenerateRecoveryCodes)
 	}
 
 	// Chat routes
-	api := r.Group("/api")
+	api := r.Group("/api", authService.RequireAuth())
 	{
 		// Chat endpoints
 		api.POST("/chats", chatService.CreateChat)
@@ -76,13 +166,135 @@ func main() {
 		api.PUT("/chats/:id", chatService.UpdateChat)
 		api.DELETE("/chats/:id", chatService.DeleteChat)
 		api.GET("/chats/:id/messages", chatService.GetMessages)
+		api.POST("/chats/:id/completions", rateLimiter.Requests(), rateLimiter.Messages(), rateLimiter.Tokens(), completionService.CreateCompletion)
+		api.GET("/chats/:id/summary", contextService.GetChatSummary)
+		api.DELETE("/chats/:id/summary", contextService.DeleteChatSummary)
+
+		// Event endpoints
+		api.GET("/events", eventHub.StreamEvents)
 
 		// Message endpoints
-		api.POST("/messages", chatService.CreateMessage)
+		api.POST("/messages", rateLimiter.Requests(), rateLimiter.Messages(), chatService.CreateMessage)
 		api.PUT("/messages/:id", chatService.UpdateMessage)
+		api.GET("/messages/:id/context", contextService.GetMessageContext)
 		
 		// Sync endpoint
-		api.POST("/sync", chatService.SyncChatData)
+		api.POST("/sync", rateLimiter.Requests(), rateLimiter.Messages(), chatService.SyncChatData)
+
+		// Workspace endpoints
+		api.POST("/workspaces", workspaceService.CreateWorkspace)
+		api.GET("/workspaces", workspaceService.GetWorkspaces)
+		api.GET("/workspaces/:id", workspaceService.GetWorkspace)
+		api.PUT("/workspaces/:id", workspaceService.UpdateWorkspace)
+		api.DELETE("/workspaces/:id", workspaceService.DeleteWorkspace)
+		api.GET("/workspaces/:id/members", workspaceService.GetMembers)
+		api.PUT("/workspaces/:id/members/:userId", workspaceService.UpdateMember)
+		api.DELETE("/workspaces/:id/members/:userId", workspaceService.RemoveMember)
+		api.POST("/workspaces/:id/invitations", workspaceService.CreateInvitation)
+		api.GET("/workspaces/:id/invitations", workspaceService.GetInvitations)
+		api.DELETE("/workspaces/:id/invitations/:invitationId", workspaceService.RevokeInvitation)
+
+		// Persona endpoints
+		api.GET("/personas", personaService.GetPersonas)
+		api.POST("/personas", personaService.CreatePersona)
+		api.GET("/personas/:id", personaService.GetPersona)
+		api.PUT("/personas/:id", personaService.UpdatePersona)
+		api.DELETE("/personas/:id", personaService.DeletePersona)
+
+		// Prompt template endpoints
+		api.GET("/templates", templateService.GetTemplates)
+		api.POST("/templates", templateService.CreateTemplate)
+		api.GET("/templates/:id", templateService.GetTemplate)
+		api.PUT("/templates/:id", templateService.UpdateTemplate)
+		api.DELETE("/templates/:id", templateService.DeleteTemplate)
+		api.POST("/templates/:id/render", rateLimiter.Requests(), rateLimiter.Messages(), templateService.RenderTemplate)
+
+		// Attachment endpoints
+		api.POST("/attachments", rateLimiter.Requests(), attachmentService.UploadAttachment)
+		api.GET("/attachments/:id", attachmentService.GetAttachment)
+		api.GET("/attachments/:id/text", attachmentService.GetAttachmentText)
+		api.DELETE("/attachments/:id", attachmentService.DeleteAttachment)
+
+		// Knowledge base endpoints
+		api.GET("/knowledge-bases", knowledgeService.GetKnowledgeBases)
+		api.POST("/knowledge-bases", knowledgeService.CreateKnowledgeBase)
+		api.GET("/knowledge-bases/:id", knowledgeService.GetKnowledgeBase)
+		api.PUT("/knowledge-bases/:id", knowledgeService.UpdateKnowledgeBase)
+		api.DELETE("/knowledge-bases/:id", knowledgeService.DeleteKnowledgeBase)
+		api.GET("/knowledge-bases/:id/documents", knowledgeService.GetKnowledgeDocuments)
+		api.POST("/knowledge-bases/:id/documents", rateLimiter.Requests(), knowledgeService.AddKnowledgeDocument)
+		api.DELETE("/knowledge-bases/:id/documents/:documentId", knowledgeService.DeleteKnowledgeDocument)
+		api.POST("/knowledge-bases/:id/reindex", rateLimiter.Requests(), knowledgeService.ReindexKnowledgeBase)
+		api.POST("/knowledge-bases/:id/search", rateLimiter.Requests(), knowledgeService.SearchKnowledgeBase)
+
+		// Tool endpoints
+		api.GET("/tools", toolRegistry.GetTools)
+		api.GET("/mcp/servers", mcpService.GetMCPServers)
+		api.POST("/mcp/servers", rateLimiter.Requests(), mcpService.CreateMCPServer)
+		api.PUT("/mcp/servers/:id", rateLimiter.Requests(), mcpService.UpdateMCPServer)
+		api.DELETE("/mcp/servers/:id", mcpService.DeleteMCPServer)
+
+		// Memory endpoints
+		api.GET("/memories", memoryService.GetMemories)
+		api.POST("/memories", memoryService.CreateMemory)
+		api.DELETE("/memories", memoryService.DeleteAllMemories)
+		api.PUT("/memories/:id", memoryService.UpdateMemory)
+		api.DELETE("/memories/:id", memoryService.DeleteMemory)
+
+		api.GET("/usage", usageService.GetUsage)
+		api.GET("/models", modelPolicyService.GetModels)
+
+		// Invitations addressed to the current user
+		api.GET("/invitations", workspaceService.GetMyInvitations)
+		api.POST("/invitations/:invitationId/accept", workspaceService.AcceptInvitation)
+		api.DELETE("/invitations/:invitationId", workspaceService.DeclineInvitation)
+	}
+
+	// User profile routes
+	users := r.Group("/api/users/me", authService.RequireAuth())
+	{
+		users.GET("", userService.GetProfile)
+		users.PATCH("", userService.UpdateProfile)
+		users.DELETE("", userService.DeleteAccount)
+		users.POST("/avatar", userService.UploadAvatar)
+		users.GET("/export", userService.ExportData)
+		users.GET("/export/download", userService.DownloadExport)
+		users.POST("/deletion/cancel", userService.CancelAccountDeletion)
+		users.GET("/settings", settingsService.GetSettings)
+		users.PATCH("/settings", settingsService.UpdateSettings)
+
+		// Provider keys are write-only, listing only shows a hint
+		users.GET("/provider-keys", providerKeyService.GetProviderKeys)
+		users.PUT("/provider-keys", providerKeyService.SaveProviderKey)
+		users.DELETE("/provider-keys/:provider", providerKeyService.DeleteProviderKey)
+	}
+	r.GET("/api/avatars/:file", userService.GetAvatar)
+	// Signed download links work without a session
+	r.GET("/api/files/:id", attachmentService.DownloadAttachment)
+
+	// Admin routes
+	admin := r.Group("/api/admin", authService.RequireAuth(), authService.RequireAdmin())
+	{
+		admin.GET("/users", adminService.ListUsers)
+		admin.GET("/users/:id", adminService.GetUser)
+		admin.GET("/users/:id/usage", adminService.GetUserUsage)
+		admin.GET("/usage", usageService.GetAllUsage)
+
+		admin.GET("/model-policies", modelPolicyService.GetModelPolicies)
+		admin.PUT("/model-policies", modelPolicyService.SaveModelPolicy)
+		admin.DELETE("/model-policies", modelPolicyService.DeleteModelPolicy)
+		admin.POST("/users/:id/disable", adminService.DisableUser)
+		admin.POST("/users/:id/enable", adminService.EnableUser)
+		admin.PUT("/users/:id/role", adminService.UpdateUserRole)
+		admin.DELETE("/users/:id", adminService.DeleteUser)
+
+		admin.GET("/invites", adminService.ListInvites)
+		admin.POST("/invites", adminService.CreateInvite)
+		admin.DELETE("/invites/:code", adminService.RevokeInvite)
+
+		admin.GET("/waitlist", adminService.ListWaitlist)
+		admin.POST("/waitlist/:id/approve", adminService.ApproveWaitlistEntry)
+		admin.POST("/waitlist/:id/reject", adminService.RejectWaitlistEntry)
 	}
 
 	port := os.Getenv("BACKEND_PORT")
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mcpProtocolVersion = "2025-03-26"
+	// maxMCPMessageBytes bounds a single message read from a server
+	maxMCPMessageBytes = 16 << 20
+	// maxMCPListPages stops servers from paginating forever
+	maxMCPListPages = 20
+)
+
+var errMCPClosed = errors.New("MCP connection closed")
+
+// mcpError is a JSON-RPC error returned by a server.
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string {
+	return fmt.Sprintf("MCP error %d: %s", e.Code, e.Message)
+}
+
+// mcpMessage is any JSON-RPC message: a request, a notification or a
+// response.
+type mcpMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  interface{}      `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *mcpError        `json:"error,omitempty"`
+}
+
+// mcpTransport carries JSON-RPC messages to a server. Messages from the
+// server are handed to the receive function given when the transport was
+// created.
+type mcpTransport interface {
+	send(ctx context.Context, message []byte) error
+	close() error
+}
+
+// MCPClient speaks the Model Context Protocol with one server.
+type MCPClient struct {
+	name      string
+	transport mcpTransport
+	nextID    atomic.Int64
+
+	mu      sync.Mutex
+	pending map[int64]chan *mcpMessage
+	done    chan struct{}
+	err     error
+
+	// Capabilities are those the server announced during initialization
+	Capabilities struct {
+		Tools     *json.RawMessage `json:"tools"`
+		Prompts   *json.RawMessage `json:"prompts"`
+		Resources *json.RawMessage `json:"resources"`
+	}
+	ServerInfo struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	// onChange is called when the server reports changed lists
+	onChange func()
+}
+
+// MCPTool, MCPPrompt and MCPResource are what a server offers.
+type MCPTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type MCPPrompt struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Arguments   []MCPPromptArgument `json:"arguments"`
+}
+
+type MCPPromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+}
+
+type MCPResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MimeType    string `json:"mimeType"`
+}
+
+// mcpContent is an item of a tool result, prompt message or resource.
+type mcpContent struct {
+	Type     string      `json:"type"`
+	Text     string      `json:"text"`
+	MimeType string      `json:"mimeType"`
+	URI      string      `json:"uri"`
+	Blob     string      `json:"blob"`
+	Resource *mcpContent `json:"resource"`
+}
+
+func newMCPClient(name string) *MCPClient {
+	return &MCPClient{name: name, pending: make(map[int64]chan *mcpMessage), done: make(chan struct{})}
+}
+
+// connectMCP starts the transport described by config and initializes the
+// session. publicOnly refuses HTTP servers on private addresses, onChange
+// may be nil.
+func connectMCP(ctx context.Context, name string, config MCPServerConfig, publicOnly bool, onChange func()) (*MCPClient, error) {
+	client := newMCPClient(name)
+	client.onChange = onChange
+
+	var err error
+	if config.Command != "" {
+		client.transport, err = startStdioTransport(name, config, client.receive, client.shutdown)
+	} else {
+		client.transport = newHTTPTransport(config, publicOnly, client.receive, client.shutdown)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.initialize(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (mc *MCPClient) initialize(ctx context.Context) error {
+	params := map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "SafasChat", "version": "1.0"},
+	}
+	result := struct {
+		ProtocolVersion string      `json:"protocolVersion"`
+		Capabilities    interface{} `json:"capabilities"`
+		ServerInfo      interface{} `json:"serverInfo"`
+	}{Capabilities: &mc.Capabilities, ServerInfo: &mc.ServerInfo}
+	if err := mc.call(ctx, "initialize", params, &result); err != nil {
+		return err
+	}
+
+	if transport, ok := mc.transport.(*httpTransport); ok {
+		transport.mu.Lock()
+		transport.protocolVersion = result.ProtocolVersion
+		transport.mu.Unlock()
+	}
+	return mc.notify(ctx, "notifications/initialized", nil)
+}
+
+// Done is closed when the connection is lost.
+func (mc *MCPClient) Done() <-chan struct{} {
+	return mc.done
+}
+
+// Err tells why the connection was lost.
+func (mc *MCPClient) Err() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.err
+}
+
+func (mc *MCPClient) Close() error {
+	mc.shutdown(errMCPClosed)
+	return mc.transport.close()
+}
+
+// shutdown fails every pending request.
+func (mc *MCPClient) shutdown(err error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.err != nil {
+		return
+	}
+	if err == nil {
+		err = errMCPClosed
+	}
+	mc.err = err
+	close(mc.done)
+	for id, ch := range mc.pending {
+		close(ch)
+		delete(mc.pending, id)
+	}
+}
+
+// call sends a request and decodes its result into result.
+func (mc *MCPClient) call(ctx context.Context, method string, params, result interface{}) error {
+	raw, err := mc.callRaw(ctx, method, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func (mc *MCPClient) callRaw(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id := mc.nextID.Add(1)
+	ch := make(chan *mcpMessage, 1)
+
+	mc.mu.Lock()
+	if mc.err != nil {
+		mc.mu.Unlock()
+		return nil, mc.err
+	}
+	mc.pending[id] = ch
+	mc.mu.Unlock()
+
+	rawID := json.RawMessage(strconv.FormatInt(id, 10))
+	data, err := json.Marshal(mcpMessage{JSONRPC: "2.0", ID: &rawID, Method: method, Params: params})
+	if err == nil {
+		err = mc.transport.send(ctx, data)
+	}
+	if err != nil {
+		mc.forget(id)
+		return nil, err
+	}
+
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return nil, mc.Err()
+		}
+		if response.Error != nil {
+			return nil, response.Error
+		}
+		return response.Result, nil
+	case <-ctx.Done():
+		mc.forget(id)
+		// Let the server stop working on a request nobody waits for
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		mc.notify(cancelCtx, "notifications/cancelled", map[string]interface{}{"requestId": id, "reason": ctx.Err().Error()})
+		return nil, ctx.Err()
+	}
+}
+
+func (mc *MCPClient) forget(id int64) {
+	mc.mu.Lock()
+	delete(mc.pending, id)
+	mc.mu.Unlock()
+}
+
+func (mc *MCPClient) notify(ctx context.Context, method string, params interface{}) error {
+	data, err := json.Marshal(mcpMessage{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	return mc.transport.send(ctx, data)
+}
+
+// receive handles a message or batch from the server.
+func (mc *MCPClient) receive(data []byte) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			log.Printf("Invalid message from MCP server %s: %v", mc.name, err)
+			return
+		}
+		for _, message := range batch {
+			mc.receive(message)
+		}
+		return
+	}
+
+	var message mcpMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		log.Printf("Invalid message from MCP server %s: %v", mc.name, err)
+		return
+	}
+
+	switch {
+	case message.Method != "" && message.ID != nil:
+		// Requests from the server run apart so they can't block the reader
+		go mc.answer(message)
+	case message.Method != "":
+		if strings.HasSuffix(message.Method, "/list_changed") && mc.onChange != nil {
+			go mc.onChange()
+		}
+	case message.ID != nil:
+		id, err := strconv.ParseInt(string(*message.ID), 10, 64)
+		if err != nil {
+			return
+		}
+		mc.mu.Lock()
+		ch, ok := mc.pending[id]
+		delete(mc.pending, id)
+		mc.mu.Unlock()
+		if ok {
+			ch <- &message
+		}
+	}
+}
+
+// answer replies to a server request. The client offers no capabilities,
+// so only pings are supported.
+func (mc *MCPClient) answer(request mcpMessage) {
+	response := mcpMessage{JSONRPC: "2.0", ID: request.ID}
+	if request.Method == "ping" {
+		response.Result = json.RawMessage("{}")
+	} else {
+		response.Error = &mcpError{Code: -32601, Message: "Method not found"}
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mc.transport.send(ctx, data); err != nil {
+		log.Printf("Failed to answer MCP server %s: %v", mc.name, err)
+	}
+}
+
+// listAll follows the pagination of a list method and collects the items
+// under key.
+func listAll[T any](ctx context.Context, mc *MCPClient, method, key string) ([]T, error) {
+	var items []T
+	cursor := ""
+	for page := 0; page < maxMCPListPages; page++ {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var result map[string]json.RawMessage
+		if err := mc.call(ctx, method, params, &result); err != nil {
+			return nil, err
+		}
+		var pageItems []T
+		if raw, ok := result[key]; ok {
+			if err := json.Unmarshal(raw, &pageItems); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, pageItems...)
+
+		cursor = ""
+		if raw, ok := result["nextCursor"]; ok {
+			json.Unmarshal(raw, &cursor)
+		}
+		if cursor == "" {
+			break
+		}
+	}
+	return items, nil
+}
+
+func (mc *MCPClient) ListTools(ctx context.Context) ([]MCPTool, error) {
+	if mc.Capabilities.Tools == nil {
+		return nil, nil
+	}
+	return listAll[MCPTool](ctx, mc, "tools/list", "tools")
+}
+
+func (mc *MCPClient) ListPrompts(ctx context.Context) ([]MCPPrompt, error) {
+	if mc.Capabilities.Prompts == nil {
+		return nil, nil
+	}
+	return listAll[MCPPrompt](ctx, mc, "prompts/list", "prompts")
+}
+
+func (mc *MCPClient) ListResources(ctx context.Context) ([]MCPResource, error) {
+	if mc.Capabilities.Resources == nil {
+		return nil, nil
+	}
+	return listAll[MCPResource](ctx, mc, "resources/list", "resources")
+}
+
+// CallTool runs a tool. Failures the tool reports itself are returned as
+// an error with the text of the result.
+func (mc *MCPClient) CallTool(ctx context.Context, name string, arguments json.RawMessage) (string, error) {
+	var result struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	err := mc.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": arguments}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	text := mcpContentText(result.Content)
+	if result.IsError {
+		if text == "" {
+			text = "the tool failed"
+		}
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// GetPrompt renders a prompt as a transcript of its messages.
+func (mc *MCPClient) GetPrompt(ctx context.Context, name string, arguments map[string]string) (string, error) {
+	var result struct {
+		Description string `json:"description"`
+		Messages    []struct {
+			Role    string     `json:"role"`
+			Content mcpContent `json:"content"`
+		} `json:"messages"`
+	}
+	err := mc.call(ctx, "prompts/get", map[string]interface{}{"name": name, "arguments": arguments}, &result)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if result.Description != "" {
+		sb.WriteString(result.Description + "\n\n")
+	}
+	for _, message := range result.Messages {
+		sb.WriteString(message.Role + ": " + mcpContentText([]mcpContent{message.Content}) + "\n\n")
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// ReadResource returns the text of a resource.
+func (mc *MCPClient) ReadResource(ctx context.Context, uri string) (string, error) {
+	var result struct {
+		Contents []mcpContent `json:"contents"`
+	}
+	if err := mc.call(ctx, "resources/read", map[string]string{"uri": uri}, &result); err != nil {
+		return "", err
+	}
+	for i := range result.Contents {
+		result.Contents[i].Type = "resource_contents"
+	}
+	return mcpContentText(result.Contents), nil
+}
+
+// mcpContentText keeps the text of content items and describes the rest,
+// which the model can't read.
+func mcpContentText(content []mcpContent) string {
+	var parts []string
+	for _, item := range content {
+		switch {
+		case item.Type == "resource" && item.Resource != nil:
+			item.Resource.Type = "resource_contents"
+			parts = append(parts, mcpContentText([]mcpContent{*item.Resource}))
+		case item.Text != "" || item.Type == "text":
+			parts = append(parts, item.Text)
+		case item.Blob != "":
+			parts = append(parts, fmt.Sprintf("[binary content %s %s]", item.URI, item.MimeType))
+		case item.Type == "resource_link":
+			parts = append(parts, fmt.Sprintf("[resource %s]", item.URI))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content %s]", item.Type, item.MimeType))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// stdioTransport runs a server as a child process and exchanges
+// newline-delimited messages over its standard input and output.
+type stdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu     sync.Mutex
+	exited chan struct{}
+}
+
+func startStdioTransport(name string, config MCPServerConfig, receive func([]byte), closed func(error)) (*stdioTransport, error) {
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Dir = config.Cwd
+	cmd.Env = os.Environ()
+	for key, value := range config.Env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", config.Command, err)
+	}
+
+	t := &stdioTransport{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("MCP server %s: %s", name, truncateRunes(scanner.Text(), 500))
+		}
+		// Keep draining after an overlong line, so the server never blocks
+		io.Copy(io.Discard, stderr)
+	}()
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), maxMCPMessageBytes)
+		for scanner.Scan() {
+			if line := scanner.Bytes(); len(bytes.TrimSpace(line)) > 0 {
+				receive(slices.Clone(line))
+			}
+		}
+		scanErr := scanner.Err()
+		if scanErr != nil {
+			// The stream can't be resynchronized after a message over the limit
+			cmd.Process.Kill()
+		}
+		// Wait closes the pipes, so both have to be read to the end first
+		io.Copy(io.Discard, stdout)
+		<-stderrDone
+
+		err := cmd.Wait()
+		close(t.exited)
+		switch {
+		case scanErr != nil:
+			err = fmt.Errorf("read output: %w", scanErr)
+		case err == nil:
+			err = errors.New("server exited")
+		}
+		closed(fmt.Errorf("MCP server %s stopped: %w", name, err))
+	}()
+	return t, nil
+}
+
+func (t *stdioTransport) send(ctx context.Context, message []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, err := t.stdin.Write(append(message, '\n'))
+	return err
+}
+
+// close ends the input, which asks the server to exit, and kills it when it
+// doesn't.
+func (t *stdioTransport) close() error {
+	t.stdin.Close()
+	select {
+	case <-t.exited:
+	case <-time.After(5 * time.Second):
+		t.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// httpTransport posts every message to the server's endpoint. Responses
+// arrive as JSON or as an event stream in the response to the request.
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	receive func([]byte)
+	closed  func(error)
+
+	mu              sync.Mutex
+	sessionID       string
+	protocolVersion string
+}
+
+func newHTTPTransport(config MCPServerConfig, publicOnly bool, receive func([]byte), closed func(error)) *httpTransport {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if publicOnly {
+		dialer := &net.Dialer{Timeout: 10 * time.Second, Control: refusePrivateAddresses}
+		transport.DialContext = dialer.DialContext
+		transport.Proxy = nil
+	}
+	return &httpTransport{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Transport: transport},
+		receive: receive,
+		closed:  closed,
+	}
+}
+
+func (t *httpTransport) send(ctx context.Context, message []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		t.mu.Lock()
+		t.sessionID = sessionID
+		t.mu.Unlock()
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		return nil
+	}
+	// The server forgot the session, a new connection has to initialize again
+	if resp.StatusCode == http.StatusNotFound && req.Header.Get("Mcp-Session-Id") != "" {
+		err := errors.New("MCP session expired")
+		t.closed(err)
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("MCP server answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		return readEventStream(resp.Body, t.receive)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMCPMessageBytes))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		t.receive(body)
+	}
+	return nil
+}
+
+func (t *httpTransport) setHeaders(req *http.Request) {
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set("MCP-Protocol-Version", t.protocolVersion)
+	}
+}
+
+// close ends the session on the server.
+func (t *httpTransport) close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// readEventStream hands the data of every server-sent event to receive.
+func readEventStream(body io.Reader, receive func([]byte)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxMCPMessageBytes)
+
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				receive(data)
+				data = nil
+			}
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	if len(data) > 0 {
+		receive(data)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMCPServerEnv makes the test binary act as a stdio MCP server, so the
+// stdio transport runs against a real child process.
+const fakeMCPServerEnv = "SAFASCHAT_FAKE_MCP_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeMCPServerEnv) == "1" {
+		serveFakeMCPStdio(os.Stdin, os.Stdout)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type fakeMCPRequest struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+// fakeMCPResult answers a request of the fake server. Notifications get no
+// answer.
+func fakeMCPResult(request fakeMCPRequest) (result interface{}, rpcErr *mcpError) {
+	var params struct {
+		Cursor    string            `json:"cursor"`
+		Name      string            `json:"name"`
+		URI       string            `json:"uri"`
+		Arguments map[string]string `json:"arguments"`
+	}
+	json.Unmarshal(request.Params, &params)
+
+	switch request.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}, "prompts": map[string]interface{}{}, "resources": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "fake", "version": "1.0"},
+		}, nil
+	case "tools/list":
+		// Two pages, to exercise pagination
+		if params.Cursor == "" {
+			return map[string]interface{}{"tools": []MCPTool{{Name: "echo", InputSchema: json.RawMessage(`{"type":"object"}`)}}, "nextCursor": "2"}, nil
+		}
+		return map[string]interface{}{"tools": []MCPTool{{Name: "fail", InputSchema: json.RawMessage(`{"type":"object"}`)}}}, nil
+	case "tools/call":
+		if params.Name == "fail" {
+			return map[string]interface{}{"content": []mcpContent{{Type: "text", Text: "boom"}}, "isError": true}, nil
+		}
+		return map[string]interface{}{"content": []mcpContent{{Type: "text", Text: "echo: " + params.Arguments["text"]}}}, nil
+	case "prompts/get":
+		return map[string]interface{}{"messages": []map[string]interface{}{
+			{"role": "user", "content": mcpContent{Type: "text", Text: "Summarize " + params.Arguments["topic"]}},
+		}}, nil
+	case "resources/read":
+		return map[string]interface{}{"contents": []mcpContent{{URI: params.URI, Text: "contents of " + params.URI}}}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	}
+	return nil, &mcpError{Code: -32601, Message: "Method not found"}
+}
+
+func fakeMCPResponse(request fakeMCPRequest) []byte {
+	if request.ID == nil {
+		return nil
+	}
+	result, rpcErr := fakeMCPResult(request)
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+	if rpcErr != nil {
+		response["error"] = rpcErr
+	} else {
+		response["result"] = result
+	}
+	data, _ := json.Marshal(response)
+	return data
+}
+
+func serveFakeMCPStdio(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var request fakeMCPRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			continue
+		}
+		if request.Method == "tools/call" && strings.Contains(string(request.Params), `"oversize"`) {
+			// A line longer than the client accepts
+			out.Write([]byte(strings.Repeat("x", maxMCPMessageBytes+1) + "\n"))
+			continue
+		}
+		if response := fakeMCPResponse(request); response != nil {
+			out.Write(append(response, '\n'))
+		}
+	}
+}
+
+func connectFakeStdioServer(t *testing.T) *MCPClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	config := MCPServerConfig{Command: os.Args[0], Args: []string{"-test.run=^$"}, Env: map[string]string{fakeMCPServerEnv: "1"}}
+	client, err := connectMCP(ctx, "fake", config, true, nil)
+	if err != nil {
+		t.Fatalf("connectMCP: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// exerciseMCPClient runs every client method against the fake server.
+func exerciseMCPClient(t *testing.T, client *MCPClient) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if client.ServerInfo.Name != "fake" {
+		t.Errorf("ServerInfo.Name = %q, want fake", client.ServerInfo.Name)
+	}
+
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		t.Fatalf("ListTools: %v", err)
+	}
+	if len(tools) != 2 || tools[0].Name != "echo" || tools[1].Name != "fail" {
+		t.Errorf("ListTools = %+v, want echo and fail", tools)
+	}
+
+	text, err := client.CallTool(ctx, "echo", json.RawMessage(`{"text":"hi"}`))
+	if err != nil || text != "echo: hi" {
+		t.Errorf("CallTool(echo) = %q, %v, want echo: hi", text, err)
+	}
+	if _, err := client.CallTool(ctx, "fail", json.RawMessage(`{}`)); err == nil || err.Error() != "boom" {
+		t.Errorf("CallTool(fail) error = %v, want boom", err)
+	}
+
+	prompt, err := client.GetPrompt(ctx, "summary", map[string]string{"topic": "Go"})
+	if err != nil || prompt != "user: Summarize Go" {
+		t.Errorf("GetPrompt = %q, %v", prompt, err)
+	}
+
+	resource, err := client.ReadResource(ctx, "file:///notes.txt")
+	if err != nil || resource != "contents of file:///notes.txt" {
+		t.Errorf("ReadResource = %q, %v", resource, err)
+	}
+
+	var rpcErr *mcpError
+	if _, err := client.callRaw(ctx, "unknown/method", nil); !errors.As(err, &rpcErr) || rpcErr.Code != -32601 {
+		t.Errorf("unknown method error = %v, want method not found", err)
+	}
+}
+
+func TestMCPClientStdio(t *testing.T) {
+	exerciseMCPClient(t, connectFakeStdioServer(t))
+}
+
+func TestMCPClientStdioOversizedMessage(t *testing.T) {
+	client := connectFakeStdioServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.CallTool(ctx, "oversize", nil); err == nil {
+		t.Fatal("CallTool succeeded with an oversized answer")
+	}
+	select {
+	case <-client.Done():
+	case <-ctx.Done():
+		t.Fatal("connection wasn't closed after an oversized message")
+	}
+	if err := client.Err(); err == nil || !strings.Contains(err.Error(), "read output") {
+		t.Errorf("Err = %v, want a read error", err)
+	}
+}
+
+func TestMCPClientStdioServerExit(t *testing.T) {
+	client := connectFakeStdioServer(t)
+	client.transport.(*stdioTransport).cmd.Process.Kill()
+
+	select {
+	case <-client.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection wasn't closed after the server exited")
+	}
+	if _, err := client.ListTools(context.Background()); err == nil {
+		t.Error("ListTools succeeded after the server exited")
+	}
+}
+
+// fakeMCPHTTPServer serves the fake server over streamable HTTP. Tool calls
+// are answered as event streams, everything else as JSON.
+type fakeMCPHTTPServer struct {
+	mu       sync.Mutex
+	sessions map[string]bool
+	deleted  []string
+}
+
+func (s *fakeMCPHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionID := r.Header.Get("Mcp-Session-Id")
+
+	if r.Method == http.MethodDelete {
+		delete(s.sessions, sessionID)
+		s.deleted = append(s.deleted, sessionID)
+		return
+	}
+
+	var request fakeMCPRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Method == "initialize" {
+		sessionID = fmt.Sprintf("session-%d", len(s.sessions)+len(s.deleted)+1)
+		s.sessions[sessionID] = true
+		w.Header().Set("Mcp-Session-Id", sessionID)
+	} else if !s.sessions[sessionID] {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	} else if r.Header.Get("MCP-Protocol-Version") != mcpProtocolVersion {
+		http.Error(w, "missing protocol version", http.StatusBadRequest)
+		return
+	}
+
+	response := fakeMCPResponse(request)
+	switch {
+	case response == nil:
+		w.WriteHeader(http.StatusAccepted)
+	case request.Method == "tools/call":
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", response)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}
+}
+
+func (s *fakeMCPHTTPServer) forgetSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+func connectFakeHTTPServer(t *testing.T) (*MCPClient, *fakeMCPHTTPServer) {
+	t.Helper()
+	fake := &fakeMCPHTTPServer{sessions: map[string]bool{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := connectMCP(ctx, "fake", MCPServerConfig{URL: server.URL}, false, nil)
+	if err != nil {
+		t.Fatalf("connectMCP: %v", err)
+	}
+	return client, fake
+}
+
+func TestMCPClientHTTP(t *testing.T) {
+	client, fake := connectFakeHTTPServer(t)
+	exerciseMCPClient(t, client)
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.deleted) != 1 || fake.deleted[0] != "session-1" {
+		t.Errorf("deleted sessions = %v, want session-1", fake.deleted)
+	}
+}
+
+func TestMCPClientHTTPSessionExpired(t *testing.T) {
+	client, fake := connectFakeHTTPServer(t)
+	fake.forgetSessions()
+
+	if _, err := client.ListTools(context.Background()); err == nil {
+		t.Fatal("ListTools succeeded with an expired session")
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Fatal("connection wasn't closed after the session expired")
+	}
+}
+
+func TestMCPClientHTTPRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(&fakeMCPHTTPServer{sessions: map[string]bool{}})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if client, err := connectMCP(ctx, "fake", MCPServerConfig{URL: server.URL}, true, nil); err == nil {
+		client.Close()
+		t.Fatal("connectMCP reached a loopback server with publicOnly")
+	}
+}
@@ -0,0 +1,976 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MCPScopeInstance = "instance"
+	MCPScopeUser     = "user"
+
+	mcpConnectTimeout = 15 * time.Second
+	mcpRetryInterval  = time.Minute
+	mcpIdleTimeout    = 15 * time.Minute
+	maxMCPServers     = 10
+	maxMCPHeaders     = 10
+	maxMCPHeaderBytes = 4096
+	maxMCPURLLength   = 2048
+	maxMCPListedItems = 50
+)
+
+var (
+	mcpServerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+	invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+// MCPServerConfig tells how to reach an MCP server: Command starts a stdio
+// server, URL connects to a streamable HTTP server.
+type MCPServerConfig struct {
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// loadMCPConfig reads the instance servers from the file named by
+// MCP_CONFIG, in the {"mcpServers": {"name": {...}}} layout other MCP
+// clients use. ${VAR} references are replaced with environment variables so
+// secrets can stay out of the file.
+func loadMCPConfig() (map[string]MCPServerConfig, error) {
+	path := getEnv("MCP_CONFIG", "")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read MCP config: %w", err)
+	}
+	var file struct {
+		MCPServers map[string]MCPServerConfig `json:"mcpServers"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse MCP config: %w", err)
+	}
+
+	for name, config := range file.MCPServers {
+		if !mcpServerNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid MCP server name %q", name)
+		}
+		if (config.Command == "") == (config.URL == "") {
+			return nil, fmt.Errorf("MCP server %s needs either a command or a url", name)
+		}
+		config.Command = os.ExpandEnv(config.Command)
+		config.Cwd = os.ExpandEnv(config.Cwd)
+		config.URL = os.ExpandEnv(config.URL)
+		for i, arg := range config.Args {
+			config.Args[i] = os.ExpandEnv(arg)
+		}
+		for key, value := range config.Env {
+			config.Env[key] = os.ExpandEnv(value)
+		}
+		for key, value := range config.Headers {
+			config.Headers[key] = os.ExpandEnv(value)
+		}
+		file.MCPServers[name] = config
+	}
+	return file.MCPServers, nil
+}
+
+// mcpConnection is a server with what it offers. Lost connections are
+// reopened on next use, failed attempts are retried after mcpRetryInterval.
+type mcpConnection struct {
+	name       string
+	config     MCPServerConfig
+	publicOnly bool
+	// onChange is called after the server's offerings were discovered
+	onChange func(*mcpConnection)
+
+	mu        sync.Mutex
+	client    *MCPClient
+	tools     []MCPTool
+	prompts   []MCPPrompt
+	resources []MCPResource
+	lastError string
+	retryAt   time.Time
+	lastUsed  time.Time
+}
+
+// ensure returns a connected client, connecting when needed.
+func (conn *mcpConnection) ensure(ctx context.Context) (*MCPClient, error) {
+	client, connected, err := conn.connect(ctx)
+	if connected && conn.onChange != nil {
+		conn.onChange(conn)
+	}
+	return client, err
+}
+
+func (conn *mcpConnection) connect(ctx context.Context) (*MCPClient, bool, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.lastUsed = time.Now()
+	if conn.client != nil {
+		select {
+		case <-conn.client.Done():
+			conn.lastError = conn.client.Err().Error()
+			conn.client = nil
+		default:
+			return conn.client, false, nil
+		}
+	}
+	if time.Now().Before(conn.retryAt) {
+		return nil, false, errors.New(conn.lastError)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mcpConnectTimeout)
+	defer cancel()
+	client, err := connectMCP(ctx, conn.name, conn.config, conn.publicOnly, conn.refresh)
+	if err == nil {
+		if err = conn.discover(ctx, client); err != nil {
+			client.Close()
+		}
+	}
+	if err != nil {
+		conn.lastError = err.Error()
+		conn.retryAt = time.Now().Add(mcpRetryInterval)
+		return nil, false, err
+	}
+
+	conn.client = client
+	conn.lastError = ""
+	return client, true, nil
+}
+
+// discover lists what the server offers. Only the tools are required,
+// prompts and resources are optional extras.
+func (conn *mcpConnection) discover(ctx context.Context, client *MCPClient) error {
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		return fmt.Errorf("list tools: %w", err)
+	}
+	prompts, err := client.ListPrompts(ctx)
+	if err != nil {
+		log.Printf("Failed to list prompts of MCP server %s: %v", conn.name, err)
+	}
+	resources, err := client.ListResources(ctx)
+	if err != nil {
+		log.Printf("Failed to list resources of MCP server %s: %v", conn.name, err)
+	}
+	conn.tools, conn.prompts, conn.resources = tools, prompts, resources
+	return nil
+}
+
+// refresh rediscovers after the server reported changes.
+func (conn *mcpConnection) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+	defer cancel()
+
+	conn.mu.Lock()
+	client := conn.client
+	err := errMCPClosed
+	if client != nil {
+		err = conn.discover(ctx, client)
+	}
+	conn.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to refresh MCP server %s: %v", conn.name, err)
+		return
+	}
+	if conn.onChange != nil {
+		conn.onChange(conn)
+	}
+}
+
+func (conn *mcpConnection) close() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.client != nil {
+		conn.client.Close()
+		conn.client = nil
+	}
+}
+
+// toolset wraps what the server offers as tools: its own tools, plus one
+// tool for its prompts and one for its resources.
+func (conn *mcpConnection) toolset() []Tool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	var tools []Tool
+	names := map[string]bool{}
+	add := func(tool Tool) {
+		name := tool.Definition().Name
+		if names[name] {
+			log.Printf("MCP server %s offers %s twice, skipping", conn.name, name)
+			return
+		}
+		names[name] = true
+		tools = append(tools, tool)
+	}
+
+	for _, tool := range conn.tools {
+		add(&mcpTool{conn: conn, name: mcpToolName(conn.name, tool.Name), tool: tool})
+	}
+	if len(conn.prompts) > 0 {
+		add(&mcpPromptTool{conn: conn, prompts: conn.prompts})
+	}
+	if len(conn.resources) > 0 {
+		add(&mcpResourceTool{conn: conn, resources: conn.resources})
+	}
+	return tools
+}
+
+// mcpToolName prefixes a tool with its server so servers can't shadow each
+// other's tools.
+func mcpToolName(server, tool string) string {
+	name := server + "__" + invalidToolNameChars.ReplaceAllString(tool, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// mcpTool calls a tool of an MCP server.
+type mcpTool struct {
+	conn *mcpConnection
+	name string
+	tool MCPTool
+}
+
+func (t *mcpTool) Definition() ToolDefinition {
+	parameters := t.tool.InputSchema
+	if len(parameters) == 0 || string(parameters) == "null" {
+		parameters = json.RawMessage(`{"type": "object", "properties": {}}`)
+	}
+	return ToolDefinition{
+		Name:        t.name,
+		Description: truncateRunes(strings.TrimSpace("From "+t.conn.name+". "+t.tool.Description), 1024),
+		Parameters:  parameters,
+	}
+}
+
+func (t *mcpTool) Call(ctx context.Context, _ *ToolContext, arguments json.RawMessage) (string, error) {
+	client, err := t.conn.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.CallTool(ctx, t.tool.Name, arguments)
+}
+
+// mcpPromptTool lets the model fetch the prompts of a server.
+type mcpPromptTool struct {
+	conn    *mcpConnection
+	prompts []MCPPrompt
+}
+
+func (t *mcpPromptTool) Definition() ToolDefinition {
+	var sb strings.Builder
+	sb.WriteString("Get a prompt of " + t.conn.name + ". Available prompts:")
+	names := make([]string, 0, len(t.prompts))
+	for i, prompt := range t.prompts {
+		names = append(names, prompt.Name)
+		if i >= maxMCPListedItems {
+			continue
+		}
+		var arguments []string
+		for _, argument := range prompt.Arguments {
+			if argument.Required {
+				arguments = append(arguments, argument.Name)
+			} else {
+				arguments = append(arguments, argument.Name+"?")
+			}
+		}
+		sb.WriteString(fmt.Sprintf("\n- %s(%s): %s", prompt.Name, strings.Join(arguments, ", "), truncateRunes(prompt.Description, 200)))
+	}
+
+	parameters, _ := json.Marshal(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name":      map[string]interface{}{"type": "string", "enum": names},
+			"arguments": map[string]interface{}{"type": "object", "additionalProperties": map[string]string{"type": "string"}},
+		},
+		"required": []string{"name"},
+	})
+	return ToolDefinition{Name: mcpToolName(t.conn.name, "get_prompt"), Description: sb.String(), Parameters: parameters}
+}
+
+func (t *mcpPromptTool) Call(ctx context.Context, _ *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Name      string            `json:"name"`
+		Arguments map[string]string `json:"arguments"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+	client, err := t.conn.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.GetPrompt(ctx, args.Name, args.Arguments)
+}
+
+// mcpResourceTool lets the model read the resources of a server.
+type mcpResourceTool struct {
+	conn      *mcpConnection
+	resources []MCPResource
+}
+
+func (t *mcpResourceTool) Definition() ToolDefinition {
+	var sb strings.Builder
+	sb.WriteString("Read a resource of " + t.conn.name + " by URI. Available resources:")
+	for i, resource := range t.resources {
+		if i >= maxMCPListedItems {
+			sb.WriteString(fmt.Sprintf("\n- and %d more", len(t.resources)-i))
+			break
+		}
+		sb.WriteString(fmt.Sprintf("\n- %s: %s", resource.URI, truncateRunes(strings.TrimSpace(resource.Name+" "+resource.Description), 200)))
+	}
+	return ToolDefinition{
+		Name:        mcpToolName(t.conn.name, "read_resource"),
+		Description: sb.String(),
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {"uri": {"type": "string", "description": "URI of the resource"}},
+			"required": ["uri"]
+		}`),
+	}
+}
+
+func (t *mcpResourceTool) Call(ctx context.Context, _ *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+	client, err := t.conn.ensure(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.ReadResource(ctx, args.URI)
+}
+
+// MCPService connects MCP servers and offers their tools to chats. Instance
+// servers come from MCP_CONFIG and are available to everyone, users add
+// their own HTTP servers. Users can't add stdio servers, which would run
+// commands on the backend host.
+type MCPService struct {
+	db       *sql.DB
+	box      *SecretBox
+	registry *ToolRegistry
+	// allowPrivate lets user servers live on private networks
+	allowPrivate bool
+
+	instance []*mcpConnection
+
+	mu         sync.Mutex
+	registered map[string][]string
+	users      map[int]*mcpConnection
+}
+
+// MCPServer describes a server and its state without exposing secrets.
+type MCPServer struct {
+	// ID is only set for user servers
+	ID          *int          `json:"id,omitempty"`
+	Name        string        `json:"name"`
+	Scope       string        `json:"scope"`
+	Transport   string        `json:"transport"`
+	URL         string        `json:"url,omitempty"`
+	HeaderNames []string      `json:"headerNames,omitempty"`
+	Enabled     bool          `json:"enabled"`
+	Connected   bool          `json:"connected"`
+	Error       string        `json:"error,omitempty"`
+	ServerName  string        `json:"serverName,omitempty"`
+	Tools       []string      `json:"tools"`
+	Prompts     []MCPPrompt   `json:"prompts"`
+	Resources   []MCPResource `json:"resources"`
+	CreatedAt   *time.Time    `json:"createdAt,omitempty"`
+	UpdatedAt   *time.Time    `json:"updatedAt,omitempty"`
+}
+
+// storedMCPServer is a row of mcp_servers.
+type storedMCPServer struct {
+	ID          int
+	UserID      string
+	Name        string
+	URL         string
+	HeaderNames []string
+	Headers     *SealedSecret
+	Enabled     bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// mcpServerColumns lists the mcp_servers columns scanned by scanMCPServer.
+const mcpServerColumns = "id, user_id, name, url, header_names, ciphertext, nonce, wrapped_key, key_nonce, master_key_id, enabled, created_at, updated_at"
+
+func scanMCPServer(row rowScanner) (*storedMCPServer, error) {
+	var server storedMCPServer
+	var headerNames []byte
+	var sealed SealedSecret
+	var masterKeyID sql.NullString
+	err := row.Scan(
+		&server.ID, &server.UserID, &server.Name, &server.URL, &headerNames,
+		&sealed.Ciphertext, &sealed.Nonce, &sealed.WrappedKey, &sealed.KeyNonce, &masterKeyID,
+		&server.Enabled, &server.CreatedAt, &server.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	server.HeaderNames = []string{}
+	if headerNames != nil {
+		if err := json.Unmarshal(headerNames, &server.HeaderNames); err != nil {
+			return nil, err
+		}
+	}
+	if masterKeyID.Valid {
+		sealed.MasterKeyID = masterKeyID.String
+		server.Headers = &sealed
+	}
+	return &server, nil
+}
+
+func NewMCPService(db *sql.DB, box *SecretBox, registry *ToolRegistry) (*MCPService, error) {
+	configs, err := loadMCPConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MCPService{
+		db:           db,
+		box:          box,
+		registry:     registry,
+		allowPrivate: getEnv("MCP_ALLOW_PRIVATE", "false") == "true",
+		registered:   make(map[string][]string),
+		users:        make(map[int]*mcpConnection),
+	}
+	for name, config := range configs {
+		s.instance = append(s.instance, &mcpConnection{name: name, config: config, onChange: s.registerInstanceTools})
+	}
+	sort.Slice(s.instance, func(i, j int) bool { return s.instance[i].name < s.instance[j].name })
+	registry.AddSource(s)
+
+	for _, conn := range s.instance {
+		go func(conn *mcpConnection) {
+			if _, err := conn.ensure(context.Background()); err != nil {
+				log.Printf("Failed to connect MCP server %s: %v", conn.name, err)
+			}
+		}(conn)
+	}
+	return s, nil
+}
+
+// registerInstanceTools replaces the registered tools of an instance server
+// with what it currently offers.
+func (s *MCPService) registerInstanceTools(conn *mcpConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range s.registered[conn.name] {
+		s.registry.Unregister(name)
+	}
+	var names []string
+	for _, tool := range conn.toolset() {
+		if err := s.registry.Register(tool); err != nil {
+			log.Printf("Failed to register tool of MCP server %s: %v", conn.name, err)
+			continue
+		}
+		names = append(names, tool.Definition().Name)
+	}
+	s.registered[conn.name] = names
+}
+
+// UserTools returns the tools of the user's enabled servers, connecting
+// them in parallel when needed.
+func (s *MCPService) UserTools(ctx context.Context, userID string) []Tool {
+	servers, err := s.loadServers(userID)
+	if err != nil {
+		log.Printf("Failed to load MCP servers of user %s: %v", userID, err)
+		return nil
+	}
+
+	var connections []*mcpConnection
+	for _, server := range servers {
+		if !server.Enabled {
+			continue
+		}
+		conn, err := s.userConnection(server)
+		if err != nil {
+			log.Printf("Failed to open MCP server %d: %v", server.ID, err)
+			continue
+		}
+		connections = append(connections, conn)
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range connections {
+		wg.Add(1)
+		go func(conn *mcpConnection) {
+			defer wg.Done()
+			conn.ensure(ctx)
+		}(conn)
+	}
+	wg.Wait()
+
+	var tools []Tool
+	for _, conn := range connections {
+		tools = append(tools, conn.toolset()...)
+	}
+	return tools
+}
+
+// userConnection returns the cached connection of a user server.
+func (s *MCPService) userConnection(server *storedMCPServer) (*mcpConnection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.users[server.ID]; ok {
+		return conn, nil
+	}
+
+	config, err := s.serverConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	conn := &mcpConnection{name: server.Name, config: config, publicOnly: !s.allowPrivate}
+	s.users[server.ID] = conn
+	return conn, nil
+}
+
+// serverConfig decrypts the headers of a user server.
+func (s *MCPService) serverConfig(server *storedMCPServer) (MCPServerConfig, error) {
+	config := MCPServerConfig{URL: server.URL}
+	if server.Headers != nil {
+		plaintext, err := s.box.Open(server.Headers)
+		if err != nil {
+			return config, err
+		}
+		if err := json.Unmarshal(plaintext, &config.Headers); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// forget closes the connection of a changed or deleted user server.
+func (s *MCPService) forget(serverID int) {
+	s.mu.Lock()
+	conn, ok := s.users[serverID]
+	delete(s.users, serverID)
+	s.mu.Unlock()
+	if ok {
+		conn.close()
+	}
+}
+
+// maintainConnections closes user connections nobody used for a while and
+// retries instance servers that failed to connect.
+func (s *MCPService) maintainConnections() error {
+	s.mu.Lock()
+	var idle []*mcpConnection
+	for id, conn := range s.users {
+		conn.mu.Lock()
+		unused := time.Since(conn.lastUsed) > mcpIdleTimeout
+		conn.mu.Unlock()
+		if unused {
+			idle = append(idle, conn)
+			delete(s.users, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, conn := range idle {
+		conn.close()
+	}
+
+	for _, conn := range s.instance {
+		if _, err := conn.ensure(context.Background()); err != nil {
+			log.Printf("MCP server %s is unavailable: %v", conn.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *MCPService) loadServers(userID string) ([]*storedMCPServer, error) {
+	rows, err := s.db.Query(`SELECT `+mcpServerColumns+` FROM mcp_servers WHERE user_id = ? ORDER BY name ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	servers := []*storedMCPServer{}
+	for rows.Next() {
+		server, err := scanMCPServer(rows)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, rows.Err()
+}
+
+func (s *MCPService) loadServer(c *gin.Context) (*storedMCPServer, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid server ID"})
+		return nil, false
+	}
+	server, err := scanMCPServer(s.db.QueryRow(`SELECT `+mcpServerColumns+` FROM mcp_servers WHERE id = ? AND user_id = ?`, id, currentUser(c).ID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "MCP server not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch MCP server"})
+		return nil, false
+	}
+	return server, true
+}
+
+// describeMCPConnection reports the state of a connection.
+func describeMCPConnection(server *MCPServer, conn *mcpConnection) {
+	server.Tools = []string{}
+	server.Prompts = []MCPPrompt{}
+	server.Resources = []MCPResource{}
+	if conn == nil {
+		return
+	}
+	for _, tool := range conn.toolset() {
+		server.Tools = append(server.Tools, tool.Definition().Name)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.client != nil {
+		select {
+		case <-conn.client.Done():
+		default:
+			server.Connected = true
+			server.ServerName = conn.client.ServerInfo.Name
+		}
+	}
+	server.Error = conn.lastError
+	if conn.prompts != nil {
+		server.Prompts = conn.prompts
+	}
+	if conn.resources != nil {
+		server.Resources = conn.resources
+	}
+}
+
+func (s *MCPService) describeUserServer(server *storedMCPServer) MCPServer {
+	description := MCPServer{
+		ID:          &server.ID,
+		Name:        server.Name,
+		Scope:       MCPScopeUser,
+		Transport:   "http",
+		URL:         server.URL,
+		HeaderNames: server.HeaderNames,
+		Enabled:     server.Enabled,
+		CreatedAt:   &server.CreatedAt,
+		UpdatedAt:   &server.UpdatedAt,
+	}
+	s.mu.Lock()
+	conn := s.users[server.ID]
+	s.mu.Unlock()
+	describeMCPConnection(&description, conn)
+	return description
+}
+
+// List the instance's MCP servers and the current user's own
+func (s *MCPService) GetMCPServers(c *gin.Context) {
+	user := currentUser(c)
+
+	servers, err := s.loadServers(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch MCP servers"})
+		return
+	}
+	// Connects the user's servers so their state is current
+	s.UserTools(c.Request.Context(), user.ID)
+
+	result := []MCPServer{}
+	for _, conn := range s.instance {
+		description := MCPServer{Name: conn.name, Scope: MCPScopeInstance, Transport: "http", Enabled: true}
+		if conn.config.Command != "" {
+			description.Transport = "stdio"
+		}
+		describeMCPConnection(&description, conn)
+		result = append(result, description)
+	}
+	for _, server := range servers {
+		result = append(result, s.describeUserServer(server))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+type SaveMCPServerRequest struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Headers are sent with every request, for example for authorization
+	Headers map[string]string `json:"headers"`
+	Enabled *bool             `json:"enabled"`
+}
+
+// validateMCPServer checks a user server and makes sure it can be reached.
+func (s *MCPService) validateMCPServer(c *gin.Context, name string, config MCPServerConfig) bool {
+	if !mcpServerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be 1 to 32 letters, digits, dashes or underscores"})
+		return false
+	}
+	for _, conn := range s.instance {
+		if conn.name == name {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name is used by a server of this instance"})
+			return false
+		}
+	}
+	target, err := url.Parse(config.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" || len(config.URL) > maxMCPURLLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "URL must be an absolute http or https URL"})
+		return false
+	}
+	if len(config.Headers) > maxMCPHeaders {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d headers are allowed", maxMCPHeaders)})
+		return false
+	}
+	if data, _ := json.Marshal(config.Headers); len(data) > maxMCPHeaderBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Headers are too long"})
+		return false
+	}
+	if len(config.Headers) > 0 && !s.box.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Secret storage is not configured on this instance"})
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), mcpConnectTimeout)
+	defer cancel()
+	client, err := connectMCP(ctx, name, config, !s.allowPrivate, nil)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Could not connect to the MCP server: " + err.Error()})
+		return false
+	}
+	client.Close()
+	return true
+}
+
+// sealHeaders encrypts headers for storage, nil without headers.
+func (s *MCPService) sealHeaders(headers map[string]string) (*SealedSecret, []byte, error) {
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headerNames, err := json.Marshal(names)
+	if err != nil || len(headers) == 0 {
+		return nil, headerNames, err
+	}
+
+	plaintext, err := json.Marshal(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := s.box.Seal(plaintext)
+	return sealed, headerNames, err
+}
+
+// sealedColumns spreads a sealed secret over its columns, all NULL for nil.
+func sealedColumns(sealed *SealedSecret) []interface{} {
+	if sealed == nil {
+		return []interface{}{nil, nil, nil, nil, nil}
+	}
+	return []interface{}{sealed.Ciphertext, sealed.Nonce, sealed.WrappedKey, sealed.KeyNonce, sealed.MasterKeyID}
+}
+
+// Add an MCP server for the current user
+func (s *MCPService) CreateMCPServer(c *gin.Context) {
+	user := currentUser(c)
+
+	var req SaveMCPServerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	req.URL = strings.TrimSpace(req.URL)
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM mcp_servers WHERE user_id = ?", user.ID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MCP server"})
+		return
+	}
+	if count >= maxMCPServers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d MCP servers are allowed", maxMCPServers)})
+		return
+	}
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM mcp_servers WHERE user_id = ? AND name = ?)", user.ID, req.Name).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MCP server"})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, gin.H{"error": "An MCP server with this name already exists"})
+		return
+	}
+
+	if !s.validateMCPServer(c, req.Name, MCPServerConfig{URL: req.URL, Headers: req.Headers}) {
+		return
+	}
+	sealed, headerNames, err := s.sealHeaders(req.Headers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt headers"})
+		return
+	}
+
+	enabled := req.Enabled == nil || *req.Enabled
+	now := time.Now()
+	args := append([]interface{}{user.ID, req.Name, req.URL, string(headerNames)}, sealedColumns(sealed)...)
+	args = append(args, enabled, now, now)
+	result, err := s.db.Exec(`
+		INSERT INTO mcp_servers (user_id, name, url, header_names, ciphertext, nonce, wrapped_key, key_nonce, master_key_id, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MCP server"})
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MCP server"})
+		return
+	}
+
+	server, err := scanMCPServer(s.db.QueryRow(`SELECT `+mcpServerColumns+` FROM mcp_servers WHERE id = ?`, id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch MCP server"})
+		return
+	}
+	s.UserTools(c.Request.Context(), user.ID)
+	c.JSON(http.StatusCreated, s.describeUserServer(server))
+}
+
+// Update one of the current user's MCP servers
+func (s *MCPService) UpdateMCPServer(c *gin.Context) {
+	var req struct {
+		Name *string `json:"name,omitempty"`
+		URL  *string `json:"url,omitempty"`
+		// Headers replace all stored headers
+		Headers *map[string]string `json:"headers,omitempty"`
+		Enabled *bool              `json:"enabled,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	server, ok := s.loadServer(c)
+	if !ok {
+		return
+	}
+
+	updateFields := []string{}
+	args := []interface{}{}
+
+	name := server.Name
+	if req.Name != nil && strings.TrimSpace(*req.Name) != server.Name {
+		name = strings.TrimSpace(*req.Name)
+		var exists bool
+		if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM mcp_servers WHERE user_id = ? AND name = ?)", server.UserID, name).Scan(&exists); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update MCP server"})
+			return
+		}
+		if exists {
+			c.JSON(http.StatusConflict, gin.H{"error": "An MCP server with this name already exists"})
+			return
+		}
+		updateFields = append(updateFields, "name = ?")
+		args = append(args, name)
+	}
+
+	if req.URL != nil || req.Headers != nil {
+		config, err := s.serverConfig(server)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt headers"})
+			return
+		}
+		if req.URL != nil {
+			config.URL = strings.TrimSpace(*req.URL)
+			updateFields = append(updateFields, "url = ?")
+			args = append(args, config.URL)
+		}
+		if req.Headers != nil {
+			config.Headers = *req.Headers
+			sealed, headerNames, err := s.sealHeaders(config.Headers)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt headers"})
+				return
+			}
+			updateFields = append(updateFields, "header_names = ?", "ciphertext = ?", "nonce = ?", "wrapped_key = ?", "key_nonce = ?", "master_key_id = ?")
+			args = append(args, string(headerNames))
+			args = append(args, sealedColumns(sealed)...)
+		}
+		if !s.validateMCPServer(c, name, config) {
+			return
+		}
+	} else if req.Name != nil && !mcpServerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be 1 to 32 letters, digits, dashes or underscores"})
+		return
+	}
+
+	if req.Enabled != nil {
+		updateFields = append(updateFields, "enabled = ?")
+		args = append(args, *req.Enabled)
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updateFields = append(updateFields, "updated_at = ?")
+	args = append(args, time.Now(), server.ID)
+	if _, err := s.db.Exec(`UPDATE mcp_servers SET `+strings.Join(updateFields, ", ")+` WHERE id = ?`, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update MCP server"})
+		return
+	}
+	s.forget(server.ID)
+
+	server, err := scanMCPServer(s.db.QueryRow(`SELECT `+mcpServerColumns+` FROM mcp_servers WHERE id = ?`, server.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch MCP server"})
+		return
+	}
+	s.UserTools(c.Request.Context(), server.UserID)
+	c.JSON(http.StatusOK, s.describeUserServer(server))
+}
+
+// Delete one of the current user's MCP servers
+func (s *MCPService) DeleteMCPServer(c *gin.Context) {
+	server, ok := s.loadServer(c)
+	if !ok {
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM mcp_servers WHERE id = ?", server.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete MCP server"})
+		return
+	}
+	s.forget(server.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "MCP server deleted successfully"})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	MemoryStatusActive = "active"
+	// MemoryStatusPending marks extracted memories the user hasn't reviewed,
+	// they are never put into prompts
+	MemoryStatusPending = "pending"
+
+	MemorySourceUser      = "user"
+	MemorySourceExtracted = "extracted"
+
+	maxMemoryLength        = 1000
+	maxMemoriesPerUser     = 200
+	memoryPromptLimit      = 12
+	memoryPromptTokens     = 1000
+	memoryPromptHeading    = "Things you remember about the user from earlier conversations. Use them when relevant, never mention this list:"
+	memoryExtractionPrompt = `You extract long-term memories about a user from a conversation. Only keep stable facts that will still matter in future, unrelated conversations: preferences, personal details they shared, ongoing projects, tools they use. Ignore anything about the current task only. Do not repeat known memories.
+Return a JSON array of short third-person statements, for example ["Prefers Go over Python", "Works on a chat app called SafasChat"]. Return [] when there is nothing worth remembering.`
+)
+
+// Memory is a stable fact about a user that is given to the model in later
+// chats.
+type Memory struct {
+	ID           int        `json:"id"`
+	Content      string     `json:"content"`
+	Status       string     `json:"status"`
+	Source       string     `json:"source"`
+	SourceChatID *int       `json:"sourceChatId"`
+	LastUsedAt   *time.Time `json:"lastUsedAt"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+// memoryColumns lists the memories columns scanned by scanMemory.
+const memoryColumns = "id, content, status, source, source_chat_id, last_used_at, created_at, updated_at"
+
+func scanMemory(row rowScanner) (*Memory, error) {
+	var memory Memory
+	err := row.Scan(
+		&memory.ID, &memory.Content, &memory.Status, &memory.Source, &memory.SourceChatID,
+		&memory.LastUsedAt, &memory.CreatedAt, &memory.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &memory, nil
+}
+
+type MemoryRequest struct {
+	Content *string `json:"content"`
+	Status  *string `json:"status"`
+}
+
+type MemoryService struct {
+	db        *sql.DB
+	jobs      *JobQueue
+	providers *ProviderClient
+	keys      *ProviderKeyService
+	// model is empty when memories are extracted by the chat's own model
+	model string
+}
+
+func NewMemoryService(db *sql.DB, jobs *JobQueue, providers *ProviderClient, keys *ProviderKeyService) *MemoryService {
+	return &MemoryService{db: db, jobs: jobs, providers: providers, keys: keys, model: getEnv("MEMORY_MODEL", "")}
+}
+
+// List the current user's memories, optionally only those with a status
+func (ms *MemoryService) GetMemories(c *gin.Context) {
+	query := `SELECT ` + memoryColumns + ` FROM memories WHERE user_id = ?`
+	args := []interface{}{currentUser(c).ID}
+	if status := c.Query("status"); status != "" {
+		if status != MemoryStatusActive && status != MemoryStatusPending {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+			return
+		}
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+
+	memories, err := ms.queryMemories(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, memories)
+}
+
+// Add a memory for the current user
+func (ms *MemoryService) CreateMemory(c *gin.Context) {
+	user := currentUser(c)
+
+	var req MemoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Content == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content is required"})
+		return
+	}
+	if !validateMemoryRequest(c, &req) {
+		return
+	}
+
+	var count int
+	if err := ms.db.QueryRow("SELECT COUNT(*) FROM memories WHERE user_id = ?", user.ID).Scan(&count); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create memory"})
+		return
+	}
+	if count >= maxMemoriesPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": "Memory limit reached, delete some memories first"})
+		return
+	}
+
+	now := time.Now()
+	memory := Memory{
+		Content:   *req.Content,
+		Status:    MemoryStatusActive,
+		Source:    MemorySourceUser,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	result, err := ms.db.Exec(`
+		INSERT INTO memories (user_id, content, status, source, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, user.ID, memory.Content, memory.Status, memory.Source, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create memory"})
+		return
+	}
+
+	memoryID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get memory ID"})
+		return
+	}
+	memory.ID = int(memoryID)
+
+	c.JSON(http.StatusCreated, memory)
+}
+
+// Edit a memory, setting the status to active accepts an extracted memory
+func (ms *MemoryService) UpdateMemory(c *gin.Context) {
+	memory, ok := ms.authorize(c)
+	if !ok {
+		return
+	}
+
+	var req MemoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !validateMemoryRequest(c, &req) {
+		return
+	}
+
+	// Build dynamic update query
+	updateFields := []string{}
+	args := []interface{}{}
+
+	if req.Content != nil {
+		updateFields = append(updateFields, "content = ?")
+		args = append(args, *req.Content)
+	}
+	if req.Status != nil {
+		updateFields = append(updateFields, "status = ?")
+		args = append(args, *req.Status)
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updateFields = append(updateFields, "updated_at = ?")
+	args = append(args, time.Now(), memory.ID)
+
+	query := `UPDATE memories SET ` + strings.Join(updateFields, ", ") + ` WHERE id = ?`
+	if _, err := ms.db.Exec(query, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update memory"})
+		return
+	}
+
+	updated, err := scanMemory(ms.db.QueryRow(`SELECT `+memoryColumns+` FROM memories WHERE id = ?`, memory.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// Delete a memory
+func (ms *MemoryService) DeleteMemory(c *gin.Context) {
+	memory, ok := ms.authorize(c)
+	if !ok {
+		return
+	}
+
+	if _, err := ms.db.Exec("DELETE FROM memories WHERE id = ?", memory.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete memory"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Memory deleted successfully"})
+}
+
+// Delete all of the current user's memories
+func (ms *MemoryService) DeleteAllMemories(c *gin.Context) {
+	if _, err := ms.db.Exec("DELETE FROM memories WHERE user_id = ?", currentUser(c).ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete memories"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Memories deleted successfully"})
+}
+
+// authorize loads the memory named in the path, which must belong to the
+// current user. Other users' memories are reported as missing.
+func (ms *MemoryService) authorize(c *gin.Context) (*Memory, bool) {
+	memoryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid memory ID"})
+		return nil, false
+	}
+
+	memory, err := scanMemory(ms.db.QueryRow(
+		`SELECT `+memoryColumns+` FROM memories WHERE id = ? AND user_id = ?`, memoryID, currentUser(c).ID,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Memory not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch memory"})
+		}
+		return nil, false
+	}
+	return memory, true
+}
+
+func (ms *MemoryService) queryMemories(query string, args ...interface{}) ([]Memory, error) {
+	rows, err := ms.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memories := []Memory{}
+	for rows.Next() {
+		memory, err := scanMemory(rows)
+		if err != nil {
+			return nil, err
+		}
+		memories = append(memories, *memory)
+	}
+	return memories, rows.Err()
+}
+
+// validateMemoryRequest trims the content and checks the fields that are set,
+// writing the error response when something is invalid.
+func validateMemoryRequest(c *gin.Context, req *MemoryRequest) bool {
+	if req.Content != nil {
+		content := strings.TrimSpace(*req.Content)
+		if content == "" || len([]rune(content)) > maxMemoryLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Content must be between 1 and 1000 characters"})
+			return false
+		}
+		req.Content = &content
+	}
+	if req.Status != nil && *req.Status != MemoryStatusActive && *req.Status != MemoryStatusPending {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be active or pending"})
+		return false
+	}
+	return true
+}
+
+// relevantMemories picks the active memories to put into a prompt. When the
+// user has more than fit, memories sharing words with the latest message
+// win, then the most recently updated ones. Tokens are counted with the
+// tokenizer of the chat's model.
+func (ms *MemoryService) relevantMemories(userID, latestMessage string, tokenizer tokenizerFamily) ([]Memory, error) {
+	memories, err := ms.queryMemories(
+		`SELECT `+memoryColumns+` FROM memories WHERE user_id = ? AND status = ? ORDER BY updated_at DESC, id DESC`,
+		userID, MemoryStatusActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(memories) > memoryPromptLimit {
+		words := memoryWords(latestMessage)
+		scores := make(map[int]int, len(memories))
+		for _, memory := range memories {
+			for word := range memoryWords(memory.Content) {
+				if words[word] {
+					scores[memory.ID]++
+				}
+			}
+		}
+		sort.SliceStable(memories, func(i, j int) bool {
+			return scores[memories[i].ID] > scores[memories[j].ID]
+		})
+	}
+
+	selected := []Memory{}
+	tokens := 0
+	for _, memory := range memories {
+		if len(selected) == memoryPromptLimit {
+			break
+		}
+		tokens += tokenizer.countTokens(memory.Content)
+		if tokens > memoryPromptTokens {
+			break
+		}
+		selected = append(selected, memory)
+	}
+
+	if len(selected) > 0 {
+		ids := make([]interface{}, len(selected))
+		for i, memory := range selected {
+			ids[i] = memory.ID
+		}
+		query := `UPDATE memories SET last_used_at = ? WHERE id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+		if _, err := ms.db.Exec(query, append([]interface{}{time.Now()}, ids...)...); err != nil {
+			log.Printf("Failed to mark memories as used: %v", err)
+		}
+	}
+	return selected, nil
+}
+
+// memoryWords returns the lowercased words of a text that are long enough to
+// say something about its topic.
+func memoryWords(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) >= 4 {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// withMemories appends memories to a system prompt.
+func withMemories(systemPrompt string, memories []Memory) string {
+	if len(memories) == 0 {
+		return systemPrompt
+	}
+
+	var prompt strings.Builder
+	if systemPrompt != "" {
+		prompt.WriteString(systemPrompt + "\n\n")
+	}
+	prompt.WriteString(memoryPromptHeading)
+	for _, memory := range memories {
+		prompt.WriteString("\n- " + memory.Content)
+	}
+	return prompt.String()
+}
+
+// scheduleExtraction looks for new memories in the latest exchange of a chat.
+func (ms *MemoryService) scheduleExtraction(chat *Chat, userID, userMessage, assistantMessage string) {
+	if userMessage == "" || assistantMessage == "" {
+		return
+	}
+	ms.jobs.Enqueue("memory extraction", func() error {
+		return ms.extractMemories(chat, userID, userMessage, assistantMessage)
+	})
+}
+
+// extractMemories asks the model for candidate memories and stores the new
+// ones as pending, for the user to review.
+func (ms *MemoryService) extractMemories(chat *Chat, userID, userMessage, assistantMessage string) error {
+	existing, err := ms.queryMemories(`SELECT `+memoryColumns+` FROM memories WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+	if len(existing) >= maxMemoriesPerUser {
+		return nil
+	}
+
+	known := make(map[string]bool, len(existing))
+	var input strings.Builder
+	input.WriteString("Known memories:\n")
+	for _, memory := range existing {
+		known[strings.ToLower(memory.Content)] = true
+		input.WriteString("- " + memory.Content + "\n")
+	}
+	input.WriteString("\nUser: " + truncateRunes(userMessage, 4000))
+	input.WriteString("\n\nAssistant: " + truncateRunes(assistantMessage, 4000))
+
+	apiKey, _, err := ms.keys.resolveAPIKey(userID, ProviderOpenRouter)
+	if err != nil {
+		return err
+	}
+	model := ms.model
+	if model == "" {
+		model = chat.Model
+	}
+
+	maxTokens := 300
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	result, err := ms.providers.StreamChat(ctx, ProviderOpenRouter, apiKey, CompletionRequest{
+		Model: model,
+		Messages: []ProviderMessage{
+			{Role: "system", Content: memoryExtractionPrompt},
+			{Role: "user", Content: input.String()},
+		},
+		MaxTokens: &maxTokens,
+	}, func(StreamDelta) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	candidates, err := parseMemoryCandidates(result.Content)
+	if err != nil {
+		log.Printf("Ignoring memory extraction for chat %d: %v", chat.ID, err)
+		return nil
+	}
+
+	now := time.Now()
+	stored := len(existing)
+	for _, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" || len([]rune(candidate)) > maxMemoryLength || known[strings.ToLower(candidate)] {
+			continue
+		}
+		if stored >= maxMemoriesPerUser {
+			break
+		}
+		_, err := ms.db.Exec(`
+			INSERT INTO memories (user_id, content, status, source, source_chat_id, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, userID, candidate, MemoryStatusPending, MemorySourceExtracted, chat.ID, now, now)
+		if err != nil {
+			return err
+		}
+		known[strings.ToLower(candidate)] = true
+		stored++
+	}
+	return nil
+}
+
+// parseMemoryCandidates reads the JSON array from a model answer, which may
+// be wrapped in a code fence or surrounded by text.
+func parseMemoryCandidates(answer string) ([]string, error) {
+	start := strings.IndexByte(answer, '[')
+	end := strings.LastIndexByte(answer, ']')
+	if start < 0 || end < start {
+		return nil, nil
+	}
+
+	var candidates []string
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CatalogModel is a model offered to users, with the capabilities the
+// frontend and the completion path need to know about.
+type CatalogModel struct {
+	ID                  string       `json:"id"`
+	Name                string       `json:"name"`
+	Description         string       `json:"description,omitempty"`
+	Provider            string       `json:"provider"`
+	ContextLength       int          `json:"contextLength"`
+	MaxOutputTokens     int          `json:"maxOutputTokens,omitempty"`
+	Pricing             ModelPricing `json:"pricing"`
+	Free                bool         `json:"free"`
+	SupportsReasoning   bool         `json:"supportsReasoning"`
+	SupportsVision      bool         `json:"supportsVision"`
+	SupportsTools       bool         `json:"supportsTools"`
+	SupportedParameters []string     `json:"supportedParameters"`
+}
+
+// ModelPricing is in USD per token, as reported by the provider.
+type ModelPricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+	Image      float64 `json:"image"`
+	Request    float64 `json:"request"`
+}
+
+// ModelCatalog caches the provider's model listing in memory and refreshes
+// it periodically.
+type ModelCatalog struct {
+	providers *ProviderClient
+	provider  string
+
+	mu        sync.RWMutex
+	models    map[string]*CatalogModel
+	list      []*CatalogModel
+	updatedAt time.Time
+}
+
+func NewModelCatalog(providers *ProviderClient) *ModelCatalog {
+	catalog := &ModelCatalog{
+		providers: providers,
+		provider:  ProviderOpenRouter,
+		models:    make(map[string]*CatalogModel),
+	}
+
+	interval := time.Duration(getEnvInt64("MODEL_CATALOG_REFRESH_MINUTES", 60)) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		if err := catalog.Refresh(); err != nil {
+			log.Printf("Failed to load model catalog: %v", err)
+		}
+	}()
+	runPeriodically("model catalog refresh", interval, catalog.Refresh)
+
+	return catalog
+}
+
+// Refresh replaces the cached models with a fresh listing. On failure the
+// previous listing is kept.
+func (mc *ModelCatalog) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	providerModels, err := mc.providers.ListModels(ctx, mc.provider)
+	if err != nil {
+		return err
+	}
+
+	models := make(map[string]*CatalogModel, len(providerModels))
+	list := make([]*CatalogModel, 0, len(providerModels))
+	for _, providerModel := range providerModels {
+		if providerModel.ID == "" {
+			continue
+		}
+		model := catalogModelFrom(mc.provider, providerModel)
+		models[model.ID] = model
+		list = append(list, model)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	mc.mu.Lock()
+	mc.models = models
+	mc.list = list
+	mc.updatedAt = time.Now()
+	mc.mu.Unlock()
+	return nil
+}
+
+// Lookup returns a model by ID.
+func (mc *ModelCatalog) Lookup(id string) (*CatalogModel, bool) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	model, ok := mc.models[id]
+	return model, ok
+}
+
+// Loaded reports whether a listing has been fetched at least once.
+func (mc *ModelCatalog) Loaded() bool {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return !mc.updatedAt.IsZero()
+}
+
+// IsKnown reports whether a model can be used. Until the first listing
+// arrives every model is accepted, so a provider outage at startup doesn't
+// block creating chats.
+func (mc *ModelCatalog) IsKnown(id string) bool {
+	if !mc.Loaded() {
+		return true
+	}
+	_, ok := mc.Lookup(id)
+	return ok
+}
+
+// Models returns the cached listing and when it was fetched.
+func (mc *ModelCatalog) Models() ([]*CatalogModel, time.Time) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return mc.list, mc.updatedAt
+}
+
+// filterModels returns the cached models matching the free and capability
+// query parameters, writing the error response when it fails.
+func (mc *ModelCatalog) filterModels(c *gin.Context) ([]*CatalogModel, time.Time, bool) {
+	if !mc.Loaded() {
+		if err := mc.Refresh(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Model catalog is not available yet"})
+			return nil, time.Time{}, false
+		}
+	}
+
+	models, updatedAt := mc.Models()
+	free := c.Query("free")
+	capability := c.Query("capability")
+
+	result := []*CatalogModel{}
+	for _, model := range models {
+		if free != "" && model.Free != (free == "true") {
+			continue
+		}
+		switch capability {
+		case "":
+		case "reasoning":
+			if !model.SupportsReasoning {
+				continue
+			}
+		case "vision":
+			if !model.SupportsVision {
+				continue
+			}
+		case "tools":
+			if !model.SupportsTools {
+				continue
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid capability"})
+			return nil, time.Time{}, false
+		}
+		result = append(result, model)
+	}
+
+	return result, updatedAt, true
+}
+
+// catalogModelFrom derives capabilities from the provider's listing entry.
+func catalogModelFrom(provider string, providerModel ProviderModel) *CatalogModel {
+	model := &CatalogModel{
+		ID:                  providerModel.ID,
+		Name:                providerModel.Name,
+		Description:         providerModel.Description,
+		Provider:            provider,
+		ContextLength:       providerModel.ContextLength,
+		MaxOutputTokens:     providerModel.TopProvider.MaxCompletionTokens,
+		SupportedParameters: providerModel.SupportedParameters,
+		Pricing: ModelPricing{
+			Prompt:     parsePrice(providerModel.Pricing.Prompt),
+			Completion: parsePrice(providerModel.Pricing.Completion),
+			Image:      parsePrice(providerModel.Pricing.Image),
+			Request:    parsePrice(providerModel.Pricing.Request),
+		},
+	}
+	if model.Name == "" {
+		model.Name = model.ID
+	}
+	if model.SupportedParameters == nil {
+		model.SupportedParameters = []string{}
+	}
+
+	model.Free = strings.HasSuffix(model.ID, ":free") ||
+		(isZeroPrice(providerModel.Pricing.Prompt) && isZeroPrice(providerModel.Pricing.Completion))
+	model.SupportsReasoning = slices.Contains(model.SupportedParameters, "reasoning") || slices.Contains(model.SupportedParameters, "include_reasoning")
+	model.SupportsTools = slices.Contains(model.SupportedParameters, "tools")
+	model.SupportsVision = slices.Contains(providerModel.Architecture.InputModalities, "image")
+	return model
+}
+
+// parsePrice reads a price string such as "0.0000025". Negative values mean
+// the price is variable and are treated as unknown.
+func parsePrice(value string) float64 {
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil || price < 0 {
+		return 0
+	}
+	return price
+}
+
+// isZeroPrice reports whether a price is known to be zero, as opposed to
+// missing or variable.
+func isZeroPrice(value string) bool {
+	price, err := strconv.ParseFloat(value, 64)
+	return err == nil && price == 0
+}
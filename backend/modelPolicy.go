@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	PolicyScopeInstance  = "instance"
+	PolicyScopeRole      = "role"
+	PolicyScopeWorkspace = "workspace"
+
+	maxPolicyPatterns = 100
+)
+
+// ModelPolicy is one layer of the model access policy. Nil fields inherit
+// from the less specific layer: instance, then role, then workspace.
+type ModelPolicy struct {
+	Scope        string    `json:"scope"`
+	Role         string    `json:"role,omitempty"`
+	WorkspaceID  *int      `json:"workspaceId,omitempty"`
+	Allow        []string  `json:"allow"`
+	Deny         []string  `json:"deny"`
+	DefaultModel *string   `json:"defaultModel"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// EffectiveModelPolicy is the result of layering every matching policy.
+type EffectiveModelPolicy struct {
+	Allow        []string `json:"allow"`
+	Deny         []string `json:"deny"`
+	DefaultModel string   `json:"defaultModel"`
+}
+
+type SaveModelPolicyRequest struct {
+	Scope        string   `json:"scope"`
+	Role         string   `json:"role"`
+	WorkspaceID  *int     `json:"workspaceId"`
+	Allow        []string `json:"allow"`
+	Deny         []string `json:"deny"`
+	DefaultModel *string  `json:"defaultModel"`
+}
+
+type ModelPolicyService struct {
+	db     *sql.DB
+	models *ModelCatalog
+	// base is configured through the environment, stored instance policies
+	// override it
+	base EffectiveModelPolicy
+}
+
+func NewModelPolicyService(db *sql.DB, models *ModelCatalog) (*ModelPolicyService, error) {
+	base := EffectiveModelPolicy{
+		Allow:        getEnvList("MODEL_ALLOW"),
+		Deny:         getEnvList("MODEL_DENY"),
+		DefaultModel: getEnv("DEFAULT_MODEL", "openai/gpt-4o"),
+	}
+	if !base.Allows(base.DefaultModel) {
+		return nil, fmt.Errorf("DEFAULT_MODEL %s is denied by MODEL_ALLOW or MODEL_DENY", base.DefaultModel)
+	}
+	return &ModelPolicyService{db: db, models: models, base: base}, nil
+}
+
+// effectivePolicy layers the instance, role and workspace policies for a user.
+func (ps *ModelPolicyService) effectivePolicy(user *User, workspaceID *int) (*EffectiveModelPolicy, error) {
+	scopeKeys := []string{policyScopeKey(PolicyScopeInstance, "", nil), policyScopeKey(PolicyScopeRole, user.Role, nil)}
+	if workspaceID != nil {
+		scopeKeys = append(scopeKeys, policyScopeKey(PolicyScopeWorkspace, "", workspaceID))
+	}
+
+	placeholders := make([]string, len(scopeKeys))
+	args := make([]interface{}, len(scopeKeys))
+	for i, scopeKey := range scopeKeys {
+		placeholders[i] = "?"
+		args[i] = scopeKey
+	}
+
+	policies := make(map[string]*ModelPolicy)
+	rows, err := ps.db.Query(`SELECT `+modelPolicyColumns+` FROM model_policies WHERE scope_key IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		policy, scopeKey, err := scanModelPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		policies[scopeKey] = policy
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	layers := make([]*ModelPolicy, 0, len(scopeKeys))
+	for _, scopeKey := range scopeKeys {
+		if policy, ok := policies[scopeKey]; ok {
+			layers = append(layers, policy)
+		}
+	}
+	catalog, _ := ps.models.Models()
+	effective := mergeModelPolicies(ps.base, layers, catalog)
+	return &effective, nil
+}
+
+// mergeModelPolicies applies layers from least to most specific over base.
+// Allow, deny and default are inherited independently, so when a layer denies
+// the default it inherited, the default falls back to the nearest allowed
+// layer default, then the first allowed catalog model, or stays empty.
+func mergeModelPolicies(base EffectiveModelPolicy, layers []*ModelPolicy, catalog []*CatalogModel) EffectiveModelPolicy {
+	effective := base
+	defaults := []string{base.DefaultModel}
+	for _, policy := range layers {
+		if policy.Allow != nil {
+			effective.Allow = policy.Allow
+		}
+		if policy.Deny != nil {
+			effective.Deny = policy.Deny
+		}
+		if policy.DefaultModel != nil {
+			effective.DefaultModel = *policy.DefaultModel
+			defaults = append(defaults, *policy.DefaultModel)
+		}
+	}
+	if effective.Allows(effective.DefaultModel) {
+		return effective
+	}
+
+	effective.DefaultModel = ""
+	for i := len(defaults) - 1; i >= 0; i-- {
+		if defaults[i] != "" && effective.Allows(defaults[i]) {
+			effective.DefaultModel = defaults[i]
+			return effective
+		}
+	}
+	for _, model := range catalog {
+		if effective.Allows(model.ID) {
+			effective.DefaultModel = model.ID
+			break
+		}
+	}
+	return effective
+}
+
+// Allows reports whether a model passes the allow and deny lists. An empty
+// allow list allows everything that isn't denied.
+func (p *EffectiveModelPolicy) Allows(model string) bool {
+	for _, pattern := range p.Deny {
+		if matchGlob(pattern, model) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if matchGlob(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeModel checks that the user may use a model, in a workspace when
+// workspaceID is set, and writes the error response when not.
+func (ps *ModelPolicyService) authorizeModel(c *gin.Context, model string, workspaceID *int) bool {
+	policy, err := ps.effectivePolicy(currentUser(c), workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load model policy"})
+		return false
+	}
+	if !policy.Allows(model) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This model is not available on this instance"})
+		return false
+	}
+	return true
+}
+
+// List the models the current user may use, optionally within a workspace
+func (ps *ModelPolicyService) GetModels(c *gin.Context) {
+	var workspaceID *int
+	if value := c.Query("workspaceId"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		if _, err := workspaceRole(ps.db, id, currentUser(c).ID); err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace"})
+			return
+		}
+		workspaceID = &id
+	}
+
+	models, updatedAt, ok := ps.models.filterModels(c)
+	if !ok {
+		return
+	}
+
+	policy, err := ps.effectivePolicy(currentUser(c), workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load model policy"})
+		return
+	}
+
+	allowed := []*CatalogModel{}
+	for _, model := range models {
+		if policy.Allows(model.ID) {
+			allowed = append(allowed, model)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"models": allowed, "defaultModel": policy.DefaultModel, "updatedAt": updatedAt})
+}
+
+// List all stored model policies and the environment defaults
+func (ps *ModelPolicyService) GetModelPolicies(c *gin.Context) {
+	rows, err := ps.db.Query(`SELECT ` + modelPolicyColumns + ` FROM model_policies ORDER BY scope ASC, scope_key ASC`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch model policies"})
+		return
+	}
+	defer rows.Close()
+
+	policies := []ModelPolicy{}
+	for rows.Next() {
+		policy, _, err := scanModelPolicy(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan model policy"})
+			return
+		}
+		policies = append(policies, *policy)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"defaults": ps.base, "policies": policies})
+}
+
+// Create or replace the model policy of the instance, a role or a workspace
+func (ps *ModelPolicyService) SaveModelPolicy(c *gin.Context) {
+	var req SaveModelPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	switch req.Scope {
+	case PolicyScopeInstance:
+		req.Role, req.WorkspaceID = "", nil
+	case PolicyScopeRole:
+		if req.Role != RoleUser && req.Role != RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		req.WorkspaceID = nil
+	case PolicyScopeWorkspace:
+		if req.WorkspaceID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "workspaceId is required"})
+			return
+		}
+		var exists bool
+		if err := ps.db.QueryRow("SELECT EXISTS(SELECT 1 FROM workspaces WHERE id = ?)", *req.WorkspaceID).Scan(&exists); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+			return
+		}
+		req.Role = ""
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope"})
+		return
+	}
+
+	var ok bool
+	if req.Allow, ok = normalizePatterns(req.Allow); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid allow patterns"})
+		return
+	}
+	if req.Deny, ok = normalizePatterns(req.Deny); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid deny patterns"})
+		return
+	}
+	if req.DefaultModel != nil && !ps.models.IsKnown(*req.DefaultModel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown default model"})
+		return
+	}
+	// The default must survive the lists of its own layer
+	if req.DefaultModel != nil && !(&EffectiveModelPolicy{Allow: req.Allow, Deny: req.Deny}).Allows(*req.DefaultModel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Default model is not allowed by this policy"})
+		return
+	}
+
+	allow, err := marshalPatterns(req.Allow)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save model policy"})
+		return
+	}
+	deny, err := marshalPatterns(req.Deny)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save model policy"})
+		return
+	}
+
+	now := time.Now()
+	var role sql.NullString
+	if req.Role != "" {
+		role = sql.NullString{String: req.Role, Valid: true}
+	}
+	_, err = ps.db.Exec(`
+		INSERT INTO model_policies (scope_key, scope, role, workspace_id, allow_patterns, deny_patterns, default_model, updated_by, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		allow_patterns = VALUES(allow_patterns), deny_patterns = VALUES(deny_patterns),
+		default_model = VALUES(default_model), updated_by = VALUES(updated_by), updated_at = VALUES(updated_at)
+	`, policyScopeKey(req.Scope, req.Role, req.WorkspaceID), req.Scope, role, req.WorkspaceID, allow, deny, req.DefaultModel, currentUser(c).ID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save model policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ModelPolicy{
+		Scope:        req.Scope,
+		Role:         req.Role,
+		WorkspaceID:  req.WorkspaceID,
+		Allow:        req.Allow,
+		Deny:         req.Deny,
+		DefaultModel: req.DefaultModel,
+		UpdatedAt:    now,
+	})
+}
+
+// Delete a stored model policy, falling back to the less specific layers
+func (ps *ModelPolicyService) DeleteModelPolicy(c *gin.Context) {
+	scope := c.Query("scope")
+	var workspaceID *int
+	if scope == PolicyScopeWorkspace {
+		id, err := strconv.Atoi(c.Query("workspaceId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		workspaceID = &id
+	}
+
+	result, err := ps.db.Exec("DELETE FROM model_policies WHERE scope_key = ?", policyScopeKey(scope, c.Query("role"), workspaceID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete model policy"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Model policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Model policy deleted successfully"})
+}
+
+// modelPolicyColumns lists the model_policies columns scanned by scanModelPolicy.
+const modelPolicyColumns = "scope_key, scope, role, workspace_id, allow_patterns, deny_patterns, default_model, updated_at"
+
+func scanModelPolicy(row rowScanner) (*ModelPolicy, string, error) {
+	var policy ModelPolicy
+	var scopeKey string
+	var role, defaultModel sql.NullString
+	var allow, deny []byte
+	if err := row.Scan(&scopeKey, &policy.Scope, &role, &policy.WorkspaceID, &allow, &deny, &defaultModel, &policy.UpdatedAt); err != nil {
+		return nil, "", err
+	}
+	policy.Role = role.String
+	if defaultModel.Valid {
+		policy.DefaultModel = &defaultModel.String
+	}
+	if allow != nil {
+		if err := json.Unmarshal(allow, &policy.Allow); err != nil {
+			return nil, "", err
+		}
+	}
+	if deny != nil {
+		if err := json.Unmarshal(deny, &policy.Deny); err != nil {
+			return nil, "", err
+		}
+	}
+	return &policy, scopeKey, nil
+}
+
+// policyScopeKey identifies a policy layer, e.g. "role:admin" or "workspace:12".
+func policyScopeKey(scope, role string, workspaceID *int) string {
+	switch scope {
+	case PolicyScopeRole:
+		return PolicyScopeRole + ":" + role
+	case PolicyScopeWorkspace:
+		if workspaceID == nil {
+			return PolicyScopeWorkspace + ":"
+		}
+		return PolicyScopeWorkspace + ":" + strconv.Itoa(*workspaceID)
+	default:
+		return scope
+	}
+}
+
+// normalizePatterns trims and validates glob patterns. A nil list stays nil
+// so the layer inherits, an empty list clears the inherited one.
+func normalizePatterns(patterns []string) ([]string, bool) {
+	if patterns == nil {
+		return nil, true
+	}
+	if len(patterns) > maxPolicyPatterns {
+		return nil, false
+	}
+
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || len(pattern) > 255 {
+			return nil, false
+		}
+		normalized = append(normalized, pattern)
+	}
+	return normalized, true
+}
+
+func marshalPatterns(patterns []string) ([]byte, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+	return json.Marshal(patterns)
+}
+
+// matchGlob matches a model ID against a pattern where * matches any run of
+// characters, including slashes, and ? matches a single character.
+func matchGlob(pattern, value string) bool {
+	p, v := 0, 0
+	starP, starV := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]):
+			p++
+			v++
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starV = p, v
+			p++
+		case starP >= 0:
+			// Let the last star swallow one more character
+			starV++
+			p, v = starP+1, starV
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"openai/gpt-4o", "openai/gpt-4o", true},
+		{"openai/gpt-4o", "openai/gpt-4o-mini", false},
+		{"openai/*", "openai/gpt-4o", true},
+		{"openai/*", "anthropic/claude-3.5-sonnet", false},
+		{"*:free", "mistralai/mistral-7b-instruct:free", true},
+		{"*:free", "mistralai/mistral-7b-instruct", false},
+		{"*", "", true},
+		{"*", "anything/at-all", true},
+		{"", "", true},
+		{"", "openai/gpt-4o", false},
+		{"openai/gpt-?o", "openai/gpt-4o", true},
+		{"openai/gpt-?o", "openai/gpt-4", false},
+		{"*gpt*mini", "openai/gpt-4o-mini", true},
+		{"*gpt*mini", "openai/gpt-4o-mini-2024", false},
+		{"a*b*c", "abbbc", true},
+		{"a*b*c", "acb", false},
+		{"**", "x", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.value); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestMergeModelPolicies(t *testing.T) {
+	str := func(s string) *string { return &s }
+	base := EffectiveModelPolicy{DefaultModel: "openai/gpt-4o"}
+	catalog := []*CatalogModel{
+		{ID: "openai/gpt-4o"},
+		{ID: "meta-llama/llama-3-8b-instruct:free"},
+		{ID: "mistralai/mistral-7b-instruct:free"},
+	}
+
+	tests := []struct {
+		name   string
+		base   EffectiveModelPolicy
+		layers []*ModelPolicy
+		want   EffectiveModelPolicy
+	}{
+		{
+			name: "no layers keeps the environment policy",
+			base: base,
+			want: base,
+		},
+		{
+			name: "more specific layers replace each field",
+			base: base,
+			layers: []*ModelPolicy{
+				{Scope: PolicyScopeInstance, Allow: []string{"openai/*"}, DefaultModel: str("openai/gpt-4o-mini")},
+				{Scope: PolicyScopeRole, Deny: []string{"openai/o1*"}},
+				{Scope: PolicyScopeWorkspace, Allow: []string{"openai/gpt-*"}},
+			},
+			want: EffectiveModelPolicy{Allow: []string{"openai/gpt-*"}, Deny: []string{"openai/o1*"}, DefaultModel: "openai/gpt-4o-mini"},
+		},
+		{
+			name: "empty lists clear inherited lists",
+			base: EffectiveModelPolicy{Allow: []string{"openai/*"}, Deny: []string{"openai/o1"}, DefaultModel: "openai/gpt-4o"},
+			layers: []*ModelPolicy{
+				{Scope: PolicyScopeWorkspace, Allow: []string{}, Deny: []string{}},
+			},
+			want: EffectiveModelPolicy{Allow: []string{}, Deny: []string{}, DefaultModel: "openai/gpt-4o"},
+		},
+		{
+			name: "denied default falls back to the nearest allowed layer default",
+			base: base,
+			layers: []*ModelPolicy{
+				{Scope: PolicyScopeInstance, DefaultModel: str("mistralai/mistral-7b-instruct:free")},
+				{Scope: PolicyScopeRole, DefaultModel: str("openai/gpt-4o-mini")},
+				{Scope: PolicyScopeWorkspace, Allow: []string{"*:free"}},
+			},
+			want: EffectiveModelPolicy{Allow: []string{"*:free"}, DefaultModel: "mistralai/mistral-7b-instruct:free"},
+		},
+		{
+			name: "denied default falls back to the first allowed catalog model",
+			base: base,
+			layers: []*ModelPolicy{
+				{Scope: PolicyScopeRole, Allow: []string{"*:free"}},
+			},
+			want: EffectiveModelPolicy{Allow: []string{"*:free"}, DefaultModel: "meta-llama/llama-3-8b-instruct:free"},
+		},
+		{
+			name: "denied default without allowed models is empty",
+			base: base,
+			layers: []*ModelPolicy{
+				{Scope: PolicyScopeRole, Deny: []string{"*"}},
+			},
+			want: EffectiveModelPolicy{Deny: []string{"*"}, DefaultModel: ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeModelPolicies(tt.base, tt.layers, catalog)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeModelPolicies() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
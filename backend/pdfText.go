@@ -0,0 +1,813 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// This is a small PDF text extractor, enough for the text layer of typical
+// generated documents. It reads every object without the cross-reference
+// table, decodes Flate streams, follows the page tree and maps glyph codes
+// through ToUnicode CMaps. Scanned PDFs without a text layer yield no text.
+
+const (
+	maxPDFStreamSize = 50 << 20
+	// maxPDFDecodedSize caps the inflated streams of a whole document,
+	// which all stay in memory while the text is extracted.
+	maxPDFDecodedSize = 200 << 20
+)
+
+var (
+	pdfObjectHeader = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfReference    = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	pdfLength       = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfPageType     = regexp.MustCompile(`/Type\s*/Page(?:[^A-Za-z]|$)`)
+	pdfNamedRef     = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R\b`)
+	pdfHexString    = regexp.MustCompile(`<([0-9A-Fa-f\s]*)>`)
+)
+
+type pdfObject struct {
+	dict   string
+	stream []byte
+}
+
+type pdfDocument struct {
+	objects map[int]*pdfObject
+	cmaps   map[int]*pdfCMap
+}
+
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", errors.New("encrypted PDFs are not supported")
+	}
+
+	objects, err := parsePDFObjects(data)
+	if err != nil {
+		return "", err
+	}
+	doc := &pdfDocument{objects: objects, cmaps: map[int]*pdfCMap{}}
+	doc.expandObjectStreams()
+
+	var text strings.Builder
+	for _, page := range doc.pages() {
+		fonts := doc.pageFonts(page)
+		for _, contentID := range doc.contentStreams(page) {
+			if content, ok := doc.objects[contentID]; ok && content.stream != nil {
+				text.WriteString(pdfContentText(content.stream, fonts))
+				text.WriteByte('\n')
+			}
+		}
+		text.WriteString("\n")
+	}
+	return collapseBlankLines(text.String()), nil
+}
+
+// parsePDFObjects reads every "n 0 obj ... endobj" in the file. Later
+// objects win, which is what incremental updates expect. Parsing stops
+// once the inflated streams use up maxPDFDecodedSize.
+func parsePDFObjects(data []byte) (map[int]*pdfObject, error) {
+	objects := map[int]*pdfObject{}
+	budget := maxPDFDecodedSize
+	headers := pdfObjectHeader.FindAllSubmatchIndex(data, -1)
+	for i, header := range headers {
+		id, err := strconv.Atoi(string(data[header[2]:header[3]]))
+		if err != nil {
+			continue
+		}
+		end := len(data)
+		if i+1 < len(headers) {
+			end = headers[i+1][0]
+		}
+		body := data[header[1]:end]
+		if index := bytes.Index(body, []byte("endobj")); index >= 0 && !bytes.Contains(body[:index], []byte("stream")) {
+			body = body[:index]
+		}
+
+		object := &pdfObject{dict: string(body)}
+		if index := bytes.Index(body, []byte("stream")); index >= 0 {
+			object.dict = string(body[:index])
+			object.stream = decodePDFStream(object.dict, pdfStreamData(object.dict, body[index+len("stream"):]), budget)
+			budget -= len(object.stream)
+			if budget <= 0 {
+				return nil, errors.New("PDF is too large to extract")
+			}
+		}
+		objects[id] = object
+	}
+	return objects, nil
+}
+
+// pdfStreamData cuts the raw data of a stream, trusting a direct /Length
+// when it lines up with the endstream keyword.
+func pdfStreamData(dict string, rest []byte) []byte {
+	rest = bytes.TrimPrefix(rest, []byte("\r"))
+	rest = bytes.TrimPrefix(rest, []byte("\n"))
+
+	if match := pdfLength.FindStringSubmatch(dict); match != nil && match[2] == "" {
+		if length, err := strconv.Atoi(match[1]); err == nil && length <= len(rest) {
+			if bytes.HasPrefix(bytes.TrimLeft(rest[length:], "\r\n "), []byte("endstream")) {
+				return rest[:length]
+			}
+		}
+	}
+	if index := bytes.LastIndex(rest, []byte("endstream")); index >= 0 {
+		return bytes.TrimRight(rest[:index], "\r\n")
+	}
+	return rest
+}
+
+// decodePDFStream inflates Flate streams up to limit bytes. Streams with
+// other filters, such as images, are dropped.
+func decodePDFStream(dict string, raw []byte, limit int) []byte {
+	if !strings.Contains(dict, "/Filter") {
+		return raw
+	}
+	filters := strings.Count(dict, "Decode")
+	if !strings.Contains(dict, "/FlateDecode") || filters > 1 {
+		return nil
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(min(limit, maxPDFStreamSize))))
+	// Truncated streams still hold useful text
+	if err != nil && len(decoded) == 0 {
+		return nil
+	}
+	return decoded
+}
+
+// expandObjectStreams adds the objects packed into /ObjStm streams, where
+// newer PDFs keep their page and font dictionaries.
+func (doc *pdfDocument) expandObjectStreams() {
+	for _, object := range doc.objects {
+		if object.stream == nil || !strings.Contains(object.dict, "/ObjStm") {
+			continue
+		}
+		first := pdfDictInt(object.dict, "First")
+		count := pdfDictInt(object.dict, "N")
+		if first <= 0 || first > len(object.stream) || count <= 0 {
+			continue
+		}
+
+		fields := strings.Fields(string(object.stream[:first]))
+		type entry struct{ id, offset int }
+		var entries []entry
+		for i := 0; i+1 < len(fields) && len(entries) < count; i += 2 {
+			id, err1 := strconv.Atoi(fields[i])
+			offset, err2 := strconv.Atoi(fields[i+1])
+			if err1 != nil || err2 != nil {
+				break
+			}
+			entries = append(entries, entry{id, offset})
+		}
+		for i, e := range entries {
+			start := first + e.offset
+			end := len(object.stream)
+			if i+1 < len(entries) {
+				end = first + entries[i+1].offset
+			}
+			if start < 0 || start > end || end > len(object.stream) {
+				continue
+			}
+			if _, exists := doc.objects[e.id]; !exists {
+				doc.objects[e.id] = &pdfObject{dict: string(object.stream[start:end])}
+			}
+		}
+	}
+}
+
+// pages walks the page tree from the catalog. Files with a broken tree fall
+// back to every page object in object number order.
+func (doc *pdfDocument) pages() []int {
+	var pages []int
+	visited := map[int]bool{}
+	var walk func(id int)
+	walk = func(id int) {
+		object, ok := doc.objects[id]
+		if !ok || visited[id] {
+			return
+		}
+		visited[id] = true
+		if kids := pdfDictArray(object.dict, "Kids"); kids != "" {
+			for _, kid := range pdfRefs(kids) {
+				walk(kid)
+			}
+			return
+		}
+		if pdfPageType.MatchString(object.dict) {
+			pages = append(pages, id)
+		}
+	}
+
+	for _, object := range doc.objects {
+		if strings.Contains(object.dict, "/Catalog") {
+			if root, ok := pdfDictRef(object.dict, "Pages"); ok {
+				walk(root)
+			}
+			break
+		}
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	for id, object := range doc.objects {
+		if pdfPageType.MatchString(object.dict) {
+			pages = append(pages, id)
+		}
+	}
+	sort.Ints(pages)
+	return pages
+}
+
+func (doc *pdfDocument) contentStreams(page int) []int {
+	dict := doc.objects[page].dict
+	if contents := pdfDictArray(dict, "Contents"); contents != "" {
+		return pdfRefs(contents)
+	}
+	if id, ok := pdfDictRef(dict, "Contents"); ok {
+		// A reference may point at an array of streams
+		if object, exists := doc.objects[id]; exists && object.stream == nil {
+			return pdfRefs(object.dict)
+		}
+		return []int{id}
+	}
+	return nil
+}
+
+// pageFonts maps the font resource names of a page to their ToUnicode
+// CMaps, looking up inherited resources through the parent pages.
+func (doc *pdfDocument) pageFonts(page int) map[string]*pdfCMap {
+	fonts := map[string]*pdfCMap{}
+	for id, depth := page, 0; depth < 32; depth++ {
+		object, ok := doc.objects[id]
+		if !ok {
+			break
+		}
+		resources := object.dict
+		if ref, ok := pdfDictRef(object.dict, "Resources"); ok {
+			if resolved, exists := doc.objects[ref]; exists {
+				resources = resolved.dict
+			}
+		} else if !strings.Contains(object.dict, "/Resources") {
+			resources = ""
+		}
+
+		fontDict := pdfDictInline(resources, "Font")
+		if ref, ok := pdfDictRef(resources, "Font"); ok {
+			if resolved, exists := doc.objects[ref]; exists {
+				fontDict = resolved.dict
+			}
+		}
+		for _, match := range pdfNamedRef.FindAllStringSubmatch(fontDict, -1) {
+			if _, seen := fonts[match[1]]; seen {
+				continue
+			}
+			fontID, _ := strconv.Atoi(match[2])
+			fonts[match[1]] = doc.fontCMap(fontID)
+		}
+
+		parent, ok := pdfDictRef(object.dict, "Parent")
+		if !ok {
+			break
+		}
+		id = parent
+	}
+	return fonts
+}
+
+func (doc *pdfDocument) fontCMap(fontID int) *pdfCMap {
+	font, ok := doc.objects[fontID]
+	if !ok {
+		return nil
+	}
+	ref, ok := pdfDictRef(font.dict, "ToUnicode")
+	if !ok {
+		return nil
+	}
+	if cmap, cached := doc.cmaps[ref]; cached {
+		return cmap
+	}
+	var cmap *pdfCMap
+	if object, exists := doc.objects[ref]; exists && object.stream != nil {
+		cmap = parsePDFCMap(string(object.stream))
+	}
+	doc.cmaps[ref] = cmap
+	return cmap
+}
+
+// pdfCMap maps character codes of a font to Unicode text.
+type pdfCMap struct {
+	codeLength int
+	mapping    map[uint32]string
+}
+
+func parsePDFCMap(data string) *pdfCMap {
+	cmap := &pdfCMap{codeLength: 1, mapping: map[uint32]string{}}
+	if section := pdfSection(data, "begincodespacerange", "endcodespacerange"); section != "" {
+		if match := pdfHexString.FindStringSubmatch(section); match != nil {
+			cmap.codeLength = max(1, len(strings.Join(strings.Fields(match[1]), ""))/2)
+		}
+	}
+
+	for _, section := range pdfSections(data, "beginbfchar", "endbfchar") {
+		values := pdfHexString.FindAllStringSubmatch(section, -1)
+		for i := 0; i+1 < len(values); i += 2 {
+			code, _ := pdfHexValue(values[i][1])
+			cmap.mapping[code] = pdfUTF16(values[i+1][1])
+		}
+	}
+
+	for _, section := range pdfSections(data, "beginbfrange", "endbfrange") {
+		lexer := &pdfLexer{data: []byte(section)}
+		var operands []pdfToken
+		for {
+			token := lexer.next()
+			if token.kind == pdfEOF {
+				break
+			}
+			operands = append(operands, token)
+			if len(operands) < 3 {
+				continue
+			}
+			low := pdfBytesValue(operands[0].hex)
+			high := pdfBytesValue(operands[1].hex)
+			if high < low || high-low > 0xFFFF {
+				operands = nil
+				continue
+			}
+			switch destination := operands[2]; destination.kind {
+			case pdfString:
+				base := []rune(pdfUTF16Bytes(destination.hex))
+				for code := low; len(base) > 0; code++ {
+					mapped := append([]rune{}, base...)
+					mapped[len(mapped)-1] += rune(code - low)
+					cmap.mapping[code] = string(mapped)
+					// Stop before code wraps around at 0xFFFFFFFF
+					if code == high {
+						break
+					}
+				}
+			case pdfArray:
+				for i, element := range destination.array {
+					cmap.mapping[low+uint32(i)] = pdfUTF16Bytes(element.hex)
+				}
+			}
+			operands = nil
+		}
+	}
+	return cmap
+}
+
+func (cmap *pdfCMap) decode(data []byte) string {
+	var text strings.Builder
+	for i := 0; i+cmap.codeLength <= len(data); i += cmap.codeLength {
+		var code uint32
+		for _, b := range data[i : i+cmap.codeLength] {
+			code = code<<8 | uint32(b)
+		}
+		if mapped, ok := cmap.mapping[code]; ok {
+			text.WriteString(mapped)
+		} else if cmap.codeLength == 1 {
+			text.WriteRune(rune(code))
+		}
+	}
+	return text.String()
+}
+
+// pdfContentText runs the text operators of a content stream.
+func pdfContentText(content []byte, fonts map[string]*pdfCMap) string {
+	var text strings.Builder
+	var operands []pdfToken
+	var font *pdfCMap
+	lastY, hasY := 0.0, false
+
+	write := func(data []byte) {
+		if font != nil {
+			text.WriteString(font.decode(data))
+			return
+		}
+		for _, b := range data {
+			text.WriteRune(rune(b))
+		}
+	}
+	newline := func() {
+		if text.Len() > 0 && !strings.HasSuffix(text.String(), "\n") {
+			text.WriteByte('\n')
+		}
+	}
+	space := func() {
+		if s := text.String(); s != "" && !strings.HasSuffix(s, " ") && !strings.HasSuffix(s, "\n") {
+			text.WriteByte(' ')
+		}
+	}
+
+	lexer := &pdfLexer{data: content}
+	for {
+		token := lexer.next()
+		if token.kind == pdfEOF {
+			break
+		}
+		if token.kind != pdfOperator {
+			operands = append(operands, token)
+			continue
+		}
+
+		switch token.value {
+		case "Tf":
+			if len(operands) >= 2 && operands[0].kind == pdfName {
+				font = fonts[operands[0].value]
+			}
+		case "Tj":
+			if n := len(operands); n > 0 && operands[n-1].kind == pdfString {
+				write(operands[n-1].hex)
+			}
+		case "'", "\"":
+			newline()
+			if n := len(operands); n > 0 && operands[n-1].kind == pdfString {
+				write(operands[n-1].hex)
+			}
+		case "TJ":
+			if n := len(operands); n > 0 && operands[n-1].kind == pdfArray {
+				for _, element := range operands[n-1].array {
+					switch element.kind {
+					case pdfString:
+						write(element.hex)
+					case pdfNumber:
+						// Large negative kerning separates words
+						if element.number < -250 {
+							space()
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 && operands[1].number != 0 {
+				newline()
+			} else {
+				space()
+			}
+		case "T*":
+			newline()
+		case "Tm":
+			if len(operands) >= 6 {
+				y := operands[5].number
+				if hasY && y != lastY {
+					newline()
+				} else {
+					space()
+				}
+				lastY, hasY = y, true
+			}
+		case "ET":
+			space()
+		}
+		operands = nil
+	}
+	return text.String()
+}
+
+type pdfTokenKind int
+
+const (
+	pdfEOF pdfTokenKind = iota
+	pdfNumber
+	pdfString
+	pdfName
+	pdfArray
+	pdfDict
+	pdfOperator
+)
+
+type pdfToken struct {
+	kind   pdfTokenKind
+	value  string
+	number float64
+	// hex holds the bytes of strings, both literal and hexadecimal
+	hex   []byte
+	array []pdfToken
+}
+
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFWhitespace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\f' || b == 0
+}
+
+func isPDFDelimiter(b byte) bool {
+	return strings.IndexByte("()<>[]{}/%", b) >= 0
+}
+
+// next returns the next token, with arrays and dictionaries read whole.
+func (l *pdfLexer) next() pdfToken {
+	for l.pos < len(l.data) {
+		b := l.data[l.pos]
+		switch {
+		case isPDFWhitespace(b):
+			l.pos++
+		case b == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		case b == '(':
+			l.pos++
+			return pdfToken{kind: pdfString, hex: l.literalString()}
+		case b == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+			l.pos += 2
+			return l.collect(pdfDict, ">>")
+		case b == '<':
+			l.pos++
+			end := bytes.IndexByte(l.data[l.pos:], '>')
+			if end < 0 {
+				end = len(l.data) - l.pos
+			}
+			digits := string(l.data[l.pos : l.pos+end])
+			l.pos += end + 1
+			decoded, _ := pdfHexBytes(digits)
+			return pdfToken{kind: pdfString, hex: decoded}
+		case b == '[':
+			l.pos++
+			return l.collect(pdfArray, "]")
+		case b == ']' || b == '>':
+			// Closers are handled by collect, stray ones are skipped
+			l.pos++
+			if b == '>' && l.pos < len(l.data) && l.data[l.pos] == '>' {
+				l.pos++
+				return pdfToken{kind: pdfOperator, value: ">>"}
+			}
+			if b == ']' {
+				return pdfToken{kind: pdfOperator, value: "]"}
+			}
+		case b == '/':
+			l.pos++
+			return pdfToken{kind: pdfName, value: l.word()}
+		default:
+			word := l.word()
+			if word == "" {
+				l.pos++
+				continue
+			}
+			if number, err := strconv.ParseFloat(word, 64); err == nil {
+				return pdfToken{kind: pdfNumber, number: number, value: word}
+			}
+			if word == "ID" {
+				l.skipInlineImage()
+			}
+			return pdfToken{kind: pdfOperator, value: word}
+		}
+	}
+	return pdfToken{kind: pdfEOF}
+}
+
+// collect reads tokens until the closer of an array or dictionary.
+func (l *pdfLexer) collect(kind pdfTokenKind, closer string) pdfToken {
+	token := pdfToken{kind: kind}
+	for {
+		element := l.next()
+		if element.kind == pdfEOF || (element.kind == pdfOperator && element.value == closer) {
+			return token
+		}
+		token.array = append(token.array, element)
+	}
+}
+
+func (l *pdfLexer) word() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFWhitespace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+func (l *pdfLexer) literalString() []byte {
+	var out []byte
+	depth := 1
+	for l.pos < len(l.data) {
+		b := l.data[l.pos]
+		l.pos++
+		switch b {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return out
+			}
+			escaped := l.data[l.pos]
+			l.pos++
+			switch escaped {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r':
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			case '\n':
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					value := int(escaped - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					out = append(out, byte(value))
+				} else {
+					out = append(out, escaped)
+				}
+			}
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// skipInlineImage jumps over the binary data of an inline image.
+func (l *pdfLexer) skipInlineImage() {
+	for l.pos+2 < len(l.data) {
+		if l.data[l.pos] == 'E' && l.data[l.pos+1] == 'I' && isPDFWhitespace(l.data[l.pos-1]) &&
+			(l.pos+2 == len(l.data) || isPDFWhitespace(l.data[l.pos+2])) {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.data)
+}
+
+func pdfHexBytes(digits string) ([]byte, error) {
+	digits = strings.Join(strings.Fields(digits), "")
+	if len(digits)%2 == 1 {
+		digits += "0"
+	}
+	out := make([]byte, 0, len(digits)/2)
+	for i := 0; i+1 < len(digits); i += 2 {
+		value, err := strconv.ParseUint(digits[i:i+2], 16, 8)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, byte(value))
+	}
+	return out, nil
+}
+
+func pdfHexValue(digits string) (uint32, error) {
+	data, err := pdfHexBytes(digits)
+	return pdfBytesValue(data), err
+}
+
+// pdfBytesValue reads a big-endian character code.
+func pdfBytesValue(data []byte) uint32 {
+	var value uint32
+	for _, b := range data {
+		value = value<<8 | uint32(b)
+	}
+	return value
+}
+
+// pdfUTF16 decodes the UTF-16BE destination of a CMap entry.
+func pdfUTF16(digits string) string {
+	data, _ := pdfHexBytes(digits)
+	return pdfUTF16Bytes(data)
+}
+
+func pdfUTF16Bytes(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+func pdfDictRef(dict, key string) (int, bool) {
+	match := regexp.MustCompile(`/` + key + `\s+(\d+)\s+\d+\s+R\b`).FindStringSubmatch(dict)
+	if match == nil {
+		return 0, false
+	}
+	id, err := strconv.Atoi(match[1])
+	return id, err == nil
+}
+
+func pdfDictInt(dict, key string) int {
+	match := regexp.MustCompile(`/` + key + `\s+(\d+)(?:\s|/|>)`).FindStringSubmatch(dict)
+	if match == nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(match[1])
+	return value
+}
+
+func pdfDictArray(dict, key string) string {
+	match := regexp.MustCompile(`/` + key + `\s*\[([^\]]*)\]`).FindStringSubmatch(dict)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// pdfDictInline returns the body of a nested dictionary value, matching
+// nested brackets.
+func pdfDictInline(dict, key string) string {
+	loc := regexp.MustCompile(`/` + key + `\s*<<`).FindStringIndex(dict)
+	if loc == nil {
+		return ""
+	}
+	depth := 1
+	for i := loc[1]; i+1 < len(dict); i++ {
+		switch dict[i : i+2] {
+		case "<<":
+			depth++
+			i++
+		case ">>":
+			depth--
+			if depth == 0 {
+				return dict[loc[1]:i]
+			}
+			i++
+		}
+	}
+	return dict[loc[1]:]
+}
+
+func pdfRefs(value string) []int {
+	var ids []int
+	for _, match := range pdfReference.FindAllStringSubmatch(value, -1) {
+		if id, err := strconv.Atoi(match[1]); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func pdfSection(data, begin, end string) string {
+	sections := pdfSections(data, begin, end)
+	if len(sections) == 0 {
+		return ""
+	}
+	return sections[0]
+}
+
+func pdfSections(data, begin, end string) []string {
+	var sections []string
+	for {
+		start := strings.Index(data, begin)
+		if start < 0 {
+			return sections
+		}
+		data = data[start+len(begin):]
+		stop := strings.Index(data, end)
+		if stop < 0 {
+			return append(sections, data)
+		}
+		sections = append(sections, data[:stop])
+		data = data[stop+len(end):]
+	}
+}
+
+// collapseBlankLines trims lines and keeps at most one empty line in a row.
+func collapseBlankLines(text string) string {
+	var out strings.Builder
+	blank := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		out.WriteString(line + "\n")
+	}
+	return strings.TrimSpace(out.String())
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxPersonaNameLength         = 100
+	maxPersonaDescriptionLength  = 500
+	maxPersonaSystemPromptLength = 20000
+)
+
+// Persona is a reusable system prompt with a preferred model and generation
+// parameters. It belongs either to a user or to a workspace.
+type Persona struct {
+	ID           int              `json:"id"`
+	Name         string           `json:"name"`
+	Description  string           `json:"description"`
+	SystemPrompt string           `json:"systemPrompt"`
+	DefaultModel *string          `json:"defaultModel"`
+	Params       GenerationParams `json:"params"`
+	UserID       *string          `json:"userId"`
+	WorkspaceID  *int             `json:"workspaceId"`
+	CreatedBy    *string          `json:"createdBy"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+}
+
+// personaColumns lists the personas columns scanned by scanPersona.
+const personaColumns = "id, name, description, system_prompt, default_model, params, user_id, workspace_id, created_by, created_at, updated_at"
+
+func scanPersona(row rowScanner) (*Persona, error) {
+	var persona Persona
+	var params []byte
+	err := row.Scan(
+		&persona.ID, &persona.Name, &persona.Description, &persona.SystemPrompt, &persona.DefaultModel, &params,
+		&persona.UserID, &persona.WorkspaceID, &persona.CreatedBy, &persona.CreatedAt, &persona.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if params != nil {
+		if err := json.Unmarshal(params, &persona.Params); err != nil {
+			return nil, err
+		}
+	}
+	return &persona, nil
+}
+
+type PersonaRequest struct {
+	Name         *string           `json:"name"`
+	Description  *string           `json:"description"`
+	SystemPrompt *string           `json:"systemPrompt"`
+	DefaultModel *string           `json:"defaultModel"`
+	Params       *GenerationParams `json:"params"`
+	// WorkspaceID is only read when creating a persona
+	WorkspaceID *int `json:"workspaceId"`
+}
+
+type PersonaService struct {
+	db     *sql.DB
+	chats  *ChatService
+	models *ModelCatalog
+}
+
+func NewPersonaService(db *sql.DB, chats *ChatService, models *ModelCatalog) *PersonaService {
+	return &PersonaService{db: db, chats: chats, models: models}
+}
+
+// List the user's personal personas, or those of a workspace when workspaceId is given
+func (ps *PersonaService) GetPersonas(c *gin.Context) {
+	user := currentUser(c)
+
+	query := `SELECT ` + personaColumns + ` FROM personas WHERE user_id = ? ORDER BY name ASC`
+	args := []interface{}{user.ID}
+	if value := c.Query("workspaceId"); value != "" {
+		workspaceID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		if !ps.chats.requireWorkspaceRole(c, workspaceID, WorkspaceViewer) {
+			return
+		}
+		query = `SELECT ` + personaColumns + ` FROM personas WHERE workspace_id = ? ORDER BY name ASC`
+		args = []interface{}{workspaceID}
+	}
+
+	rows, err := ps.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch personas"})
+		return
+	}
+	defer rows.Close()
+
+	personas := []Persona{}
+	for rows.Next() {
+		persona, err := scanPersona(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan persona"})
+			return
+		}
+		personas = append(personas, *persona)
+	}
+
+	c.JSON(http.StatusOK, personas)
+}
+
+// Create a persona for the current user or a workspace
+func (ps *PersonaService) CreatePersona(c *gin.Context) {
+	user := currentUser(c)
+
+	var req PersonaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+	if !ps.validatePersonaRequest(c, &req) {
+		return
+	}
+
+	persona := Persona{
+		Name:      *req.Name,
+		CreatedBy: &user.ID,
+	}
+	if req.DefaultModel != nil && *req.DefaultModel != "" {
+		persona.DefaultModel = req.DefaultModel
+	}
+	if req.Description != nil {
+		persona.Description = *req.Description
+	}
+	if req.SystemPrompt != nil {
+		persona.SystemPrompt = *req.SystemPrompt
+	}
+	if req.Params != nil {
+		persona.Params = *req.Params
+	}
+	if req.WorkspaceID != nil {
+		if !ps.chats.requireWorkspaceRole(c, *req.WorkspaceID, WorkspaceEditor) {
+			return
+		}
+		persona.WorkspaceID = req.WorkspaceID
+	} else {
+		persona.UserID = &user.ID
+	}
+
+	params, err := json.Marshal(persona.Params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create persona"})
+		return
+	}
+
+	now := time.Now()
+	result, err := ps.db.Exec(`
+		INSERT INTO personas (name, description, system_prompt, default_model, params, user_id, workspace_id, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, persona.Name, persona.Description, persona.SystemPrompt, persona.DefaultModel, string(params),
+		persona.UserID, persona.WorkspaceID, persona.CreatedBy, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create persona"})
+		return
+	}
+
+	personaID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get persona ID"})
+		return
+	}
+	persona.ID = int(personaID)
+	persona.CreatedAt = now
+	persona.UpdatedAt = now
+
+	c.JSON(http.StatusCreated, persona)
+}
+
+// Get a single persona
+func (ps *PersonaService) GetPersona(c *gin.Context) {
+	persona, ok := ps.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, persona)
+}
+
+// Update a persona
+func (ps *PersonaService) UpdatePersona(c *gin.Context) {
+	persona, ok := ps.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	var req PersonaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !ps.validatePersonaRequest(c, &req) {
+		return
+	}
+
+	// Build dynamic update query
+	updateFields := []string{}
+	args := []interface{}{}
+
+	if req.Name != nil {
+		updateFields = append(updateFields, "name = ?")
+		args = append(args, *req.Name)
+	}
+	if req.Description != nil {
+		updateFields = append(updateFields, "description = ?")
+		args = append(args, *req.Description)
+	}
+	if req.SystemPrompt != nil {
+		updateFields = append(updateFields, "system_prompt = ?")
+		args = append(args, *req.SystemPrompt)
+	}
+	if req.DefaultModel != nil {
+		// An empty model clears the persona's default
+		var model interface{}
+		if *req.DefaultModel != "" {
+			model = *req.DefaultModel
+		}
+		updateFields = append(updateFields, "default_model = ?")
+		args = append(args, model)
+	}
+	if req.Params != nil {
+		params, err := json.Marshal(req.Params)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update persona"})
+			return
+		}
+		updateFields = append(updateFields, "params = ?")
+		args = append(args, string(params))
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updateFields = append(updateFields, "updated_at = ?")
+	args = append(args, time.Now(), persona.ID)
+
+	query := `UPDATE personas SET ` + strings.Join(updateFields, ", ") + ` WHERE id = ?`
+	if _, err := ps.db.Exec(query, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update persona"})
+		return
+	}
+
+	updated, err := scanPersona(ps.db.QueryRow(`SELECT `+personaColumns+` FROM personas WHERE id = ?`, persona.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// Delete a persona, chats using it keep their messages but lose the persona
+func (ps *PersonaService) DeletePersona(c *gin.Context) {
+	persona, ok := ps.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if _, err := ps.db.Exec("DELETE FROM personas WHERE id = ?", persona.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete persona"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Persona deleted successfully"})
+}
+
+// validatePersonaRequest checks the fields that are set and trims the name,
+// writing the error response when something is invalid.
+func (ps *PersonaService) validatePersonaRequest(c *gin.Context, req *PersonaRequest) bool {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len([]rune(name)) > maxPersonaNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name must be between 1 and 100 characters"})
+			return false
+		}
+		req.Name = &name
+	}
+	if req.Description != nil && len([]rune(*req.Description)) > maxPersonaDescriptionLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Description must be at most 500 characters"})
+		return false
+	}
+	if req.SystemPrompt != nil && len([]rune(*req.SystemPrompt)) > maxPersonaSystemPromptLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "System prompt must be at most 20000 characters"})
+		return false
+	}
+	if req.DefaultModel != nil && *req.DefaultModel != "" && !ps.models.IsKnown(*req.DefaultModel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model"})
+		return false
+	}
+	if req.Params != nil {
+		if err := req.Params.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
+// authorize loads the persona named by the :id parameter and checks access.
+// Personal personas are only visible to their owner.
+func (ps *PersonaService) authorize(c *gin.Context, minRole string) (*Persona, bool) {
+	personaID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid persona ID"})
+		return nil, false
+	}
+
+	persona, err := scanPersona(ps.db.QueryRow(`SELECT `+personaColumns+` FROM personas WHERE id = ?`, personaID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persona"})
+		return nil, false
+	}
+
+	if persona.WorkspaceID == nil {
+		if persona.UserID == nil || *persona.UserID != currentUser(c).ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Persona not found"})
+			return nil, false
+		}
+		return persona, true
+	}
+
+	if !ps.chats.requireWorkspaceRole(c, *persona.WorkspaceID, minRole) {
+		return nil, false
+	}
+	return persona, true
+}
+
+// loadPersona returns a persona by ID, or nil when it no longer exists.
+func loadPersona(db *sql.DB, personaID int) (*Persona, error) {
+	persona, err := scanPersona(db.QueryRow(`SELECT `+personaColumns+` FROM personas WHERE id = ?`, personaID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return persona, err
+}
+
+// canUsePersona reports whether a user may attach a persona to a chat.
+// Workspace chats only take personas of the same workspace, so every member
+// sees the same behaviour. Personal chats take the user's own personas and
+// those of workspaces the user belongs to.
+func canUsePersona(db *sql.DB, persona *Persona, userID string, chatWorkspaceID *int) (bool, error) {
+	if chatWorkspaceID != nil {
+		return persona.WorkspaceID != nil && *persona.WorkspaceID == *chatWorkspaceID, nil
+	}
+	if persona.WorkspaceID == nil {
+		return persona.UserID != nil && *persona.UserID == userID, nil
+	}
+
+	_, err := workspaceRole(db, *persona.WorkspaceID, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxTemplateNameLength    = 100
+	maxTemplateContentLength = 20000
+	maxTemplateVariables     = 30
+	maxRenderedValueLength   = 20000
+	// messages.content is a TEXT column
+	maxRenderedContentBytes = 65535
+)
+
+var (
+	// templatePlaceholderPattern matches {{name}}, allowing spaces inside the braces
+	templatePlaceholderPattern  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+	templateVariableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	templateVariableTypes       = []string{"string", "text", "number", "boolean", "enum"}
+)
+
+// TemplateVariable defines a {{placeholder}} of a template.
+type TemplateVariable struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	// Options lists the allowed values of an enum variable
+	Options []string `json:"options,omitempty"`
+}
+
+type PromptTemplate struct {
+	ID          int                `json:"id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Content     string             `json:"content"`
+	Variables   []TemplateVariable `json:"variables"`
+	UserID      *string            `json:"userId"`
+	WorkspaceID *int               `json:"workspaceId"`
+	CreatedBy   *string            `json:"createdBy"`
+	UsageCount  int                `json:"usageCount"`
+	LastUsedAt  *time.Time         `json:"lastUsedAt"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt"`
+}
+
+// promptTemplateColumns lists the prompt_templates columns scanned by scanPromptTemplate.
+const promptTemplateColumns = "id, name, description, content, variables, user_id, workspace_id, created_by, usage_count, last_used_at, created_at, updated_at"
+
+func scanPromptTemplate(row rowScanner) (*PromptTemplate, error) {
+	var template PromptTemplate
+	var variables []byte
+	err := row.Scan(
+		&template.ID, &template.Name, &template.Description, &template.Content, &variables, &template.UserID, &template.WorkspaceID,
+		&template.CreatedBy, &template.UsageCount, &template.LastUsedAt, &template.CreatedAt, &template.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	template.Variables = []TemplateVariable{}
+	if variables != nil {
+		if err := json.Unmarshal(variables, &template.Variables); err != nil {
+			return nil, err
+		}
+	}
+	return &template, nil
+}
+
+type PromptTemplateRequest struct {
+	Name        *string             `json:"name"`
+	Description *string             `json:"description"`
+	Content     *string             `json:"content"`
+	Variables   *[]TemplateVariable `json:"variables"`
+	// WorkspaceID is only read when creating a template
+	WorkspaceID *int `json:"workspaceId"`
+}
+
+type RenderTemplateRequest struct {
+	ChatID int                    `json:"chatId"`
+	Values map[string]interface{} `json:"values"`
+	// DryRun only returns the rendered content without creating a message
+	DryRun bool `json:"dryRun"`
+}
+
+type PromptTemplateService struct {
+	db    *sql.DB
+	chats *ChatService
+}
+
+func NewPromptTemplateService(db *sql.DB, chats *ChatService) *PromptTemplateService {
+	return &PromptTemplateService{db: db, chats: chats}
+}
+
+// List the user's personal templates, or those of a workspace when workspaceId is given
+func (ts *PromptTemplateService) GetTemplates(c *gin.Context) {
+	query := `SELECT ` + promptTemplateColumns + ` FROM prompt_templates WHERE user_id = ? ORDER BY usage_count DESC, name ASC`
+	args := []interface{}{currentUser(c).ID}
+	if value := c.Query("workspaceId"); value != "" {
+		workspaceID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+			return
+		}
+		if !ts.chats.requireWorkspaceRole(c, workspaceID, WorkspaceViewer) {
+			return
+		}
+		query = `SELECT ` + promptTemplateColumns + ` FROM prompt_templates WHERE workspace_id = ? ORDER BY usage_count DESC, name ASC`
+		args = []interface{}{workspaceID}
+	}
+
+	rows, err := ts.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch templates"})
+		return
+	}
+	defer rows.Close()
+
+	templates := []PromptTemplate{}
+	for rows.Next() {
+		template, err := scanPromptTemplate(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan template"})
+			return
+		}
+		templates = append(templates, *template)
+	}
+
+	c.JSON(http.StatusOK, templates)
+}
+
+// Create a template for the current user or a workspace
+func (ts *PromptTemplateService) CreateTemplate(c *gin.Context) {
+	user := currentUser(c)
+
+	var req PromptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if req.Name == nil || req.Content == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name and content are required"})
+		return
+	}
+	if req.Variables == nil {
+		req.Variables = &[]TemplateVariable{}
+	}
+	if err := validateTemplateRequest(&req, *req.Content, *req.Variables); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	template := PromptTemplate{
+		Name:      *req.Name,
+		Content:   *req.Content,
+		Variables: *req.Variables,
+		CreatedBy: &user.ID,
+	}
+	if req.Description != nil {
+		template.Description = *req.Description
+	}
+	if req.WorkspaceID != nil {
+		if !ts.chats.requireWorkspaceRole(c, *req.WorkspaceID, WorkspaceEditor) {
+			return
+		}
+		template.WorkspaceID = req.WorkspaceID
+	} else {
+		template.UserID = &user.ID
+	}
+
+	variables, err := json.Marshal(template.Variables)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create template"})
+		return
+	}
+
+	now := time.Now()
+	result, err := ts.db.Exec(`
+		INSERT INTO prompt_templates (name, description, content, variables, user_id, workspace_id, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, template.Name, template.Description, template.Content, string(variables), template.UserID, template.WorkspaceID, template.CreatedBy, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create template"})
+		return
+	}
+
+	templateID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get template ID"})
+		return
+	}
+	template.ID = int(templateID)
+	template.CreatedAt = now
+	template.UpdatedAt = now
+
+	c.JSON(http.StatusCreated, template)
+}
+
+// Get a single template
+func (ts *PromptTemplateService) GetTemplate(c *gin.Context) {
+	template, ok := ts.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
+
+// Update a template
+func (ts *PromptTemplateService) UpdateTemplate(c *gin.Context) {
+	template, ok := ts.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	var req PromptTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Placeholders are checked against the variables as they will be stored
+	content := template.Content
+	if req.Content != nil {
+		content = *req.Content
+	}
+	variables := template.Variables
+	if req.Variables != nil {
+		variables = *req.Variables
+	}
+	if err := validateTemplateRequest(&req, content, variables); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Build dynamic update query
+	updateFields := []string{}
+	args := []interface{}{}
+
+	if req.Name != nil {
+		updateFields = append(updateFields, "name = ?")
+		args = append(args, *req.Name)
+	}
+	if req.Description != nil {
+		updateFields = append(updateFields, "description = ?")
+		args = append(args, *req.Description)
+	}
+	if req.Content != nil {
+		updateFields = append(updateFields, "content = ?")
+		args = append(args, *req.Content)
+	}
+	if req.Variables != nil {
+		data, err := json.Marshal(*req.Variables)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update template"})
+			return
+		}
+		updateFields = append(updateFields, "variables = ?")
+		args = append(args, string(data))
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	updateFields = append(updateFields, "updated_at = ?")
+	args = append(args, time.Now(), template.ID)
+
+	query := `UPDATE prompt_templates SET ` + strings.Join(updateFields, ", ") + ` WHERE id = ?`
+	if _, err := ts.db.Exec(query, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update template"})
+		return
+	}
+
+	updated, err := scanPromptTemplate(ts.db.QueryRow(`SELECT `+promptTemplateColumns+` FROM prompt_templates WHERE id = ?`, template.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// Delete a template
+func (ts *PromptTemplateService) DeleteTemplate(c *gin.Context) {
+	template, ok := ts.authorize(c, WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if _, err := ts.db.Exec("DELETE FROM prompt_templates WHERE id = ?", template.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete template"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Template deleted successfully"})
+}
+
+// Fill in a template's variables and post the result as a user message in a chat
+func (ts *PromptTemplateService) RenderTemplate(c *gin.Context) {
+	template, ok := ts.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	var req RenderTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	content, err := renderTemplate(template, req.Values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.DryRun {
+		c.JSON(http.StatusOK, gin.H{"content": content})
+		return
+	}
+
+	if req.ChatID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat ID is required"})
+		return
+	}
+	if _, ok := ts.chats.authorizeChat(c, req.ChatID, WorkspaceEditor); !ok {
+		return
+	}
+
+	message := &Message{ChatID: req.ChatID, Content: content, Role: "user"}
+	if err := insertMessage(ts.db, message); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create message"})
+		return
+	}
+
+	now := time.Now()
+	if _, err := ts.db.Exec(
+		"UPDATE prompt_templates SET usage_count = usage_count + 1, last_used_at = ? WHERE id = ?", now, template.ID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record template usage"})
+		return
+	}
+	if _, err := ts.db.Exec("UPDATE chats SET updated_at = ? WHERE id = ?", now, req.ChatID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update chat"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"content": content, "message": message})
+}
+
+// authorize loads the template named by the :id parameter and checks access.
+// Personal templates are only visible to their owner.
+func (ts *PromptTemplateService) authorize(c *gin.Context, minRole string) (*PromptTemplate, bool) {
+	templateID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid template ID"})
+		return nil, false
+	}
+
+	template, err := scanPromptTemplate(ts.db.QueryRow(`SELECT `+promptTemplateColumns+` FROM prompt_templates WHERE id = ?`, templateID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch template"})
+		return nil, false
+	}
+
+	if template.WorkspaceID == nil {
+		if template.UserID == nil || *template.UserID != currentUser(c).ID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return nil, false
+		}
+		return template, true
+	}
+
+	if !ts.chats.requireWorkspaceRole(c, *template.WorkspaceID, minRole) {
+		return nil, false
+	}
+	return template, true
+}
+
+// validateTemplateRequest checks the request fields and that every
+// placeholder in content has a variable definition.
+func validateTemplateRequest(req *PromptTemplateRequest, content string, variables []TemplateVariable) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len([]rune(name)) > maxTemplateNameLength {
+			return fmt.Errorf("name must be between 1 and %d characters", maxTemplateNameLength)
+		}
+		req.Name = &name
+	}
+	if req.Description != nil && len([]rune(*req.Description)) > 500 {
+		return fmt.Errorf("description must be at most 500 characters")
+	}
+	if strings.TrimSpace(content) == "" || len([]rune(content)) > maxTemplateContentLength {
+		return fmt.Errorf("content must be between 1 and %d characters", maxTemplateContentLength)
+	}
+	if len(variables) > maxTemplateVariables {
+		return fmt.Errorf("a template can have at most %d variables", maxTemplateVariables)
+	}
+
+	defined := make(map[string]bool, len(variables))
+	for i := range variables {
+		variable := &variables[i]
+		if !templateVariableNamePattern.MatchString(variable.Name) {
+			return fmt.Errorf("invalid variable name %q", variable.Name)
+		}
+		if defined[variable.Name] {
+			return fmt.Errorf("variable %s is defined twice", variable.Name)
+		}
+		defined[variable.Name] = true
+
+		if variable.Type == "" {
+			variable.Type = "string"
+		}
+		if !slices.Contains(templateVariableTypes, variable.Type) {
+			return fmt.Errorf("variable %s has an invalid type", variable.Name)
+		}
+		if variable.Type == "enum" && len(variable.Options) == 0 {
+			return fmt.Errorf("variable %s needs options", variable.Name)
+		}
+		if variable.Default != nil {
+			if _, err := formatTemplateValue(*variable, variable.Default); err != nil {
+				return fmt.Errorf("default of %s: %v", variable.Name, err)
+			}
+		}
+	}
+
+	for _, match := range templatePlaceholderPattern.FindAllStringSubmatch(content, -1) {
+		if !defined[match[1]] {
+			return fmt.Errorf("placeholder {{%s}} has no variable definition", match[1])
+		}
+	}
+	return nil
+}
+
+// renderTemplate replaces every placeholder with its value, falling back to
+// the variable's default.
+func renderTemplate(template *PromptTemplate, values map[string]interface{}) (string, error) {
+	rendered := make(map[string]string, len(template.Variables))
+	for _, variable := range template.Variables {
+		value, ok := values[variable.Name]
+		if !ok || value == nil {
+			value = variable.Default
+		}
+		if value == nil {
+			if variable.Required {
+				return "", fmt.Errorf("variable %s is required", variable.Name)
+			}
+			rendered[variable.Name] = ""
+			continue
+		}
+
+		formatted, err := formatTemplateValue(variable, value)
+		if err != nil {
+			return "", fmt.Errorf("variable %s: %v", variable.Name, err)
+		}
+		if variable.Required && strings.TrimSpace(formatted) == "" {
+			return "", fmt.Errorf("variable %s is required", variable.Name)
+		}
+		rendered[variable.Name] = formatted
+	}
+
+	for name := range values {
+		if _, ok := rendered[name]; !ok {
+			return "", fmt.Errorf("unknown variable %s", name)
+		}
+	}
+
+	content := templatePlaceholderPattern.ReplaceAllStringFunc(template.Content, func(placeholder string) string {
+		name := templatePlaceholderPattern.FindStringSubmatch(placeholder)[1]
+		return rendered[name]
+	})
+	if len(content) > maxRenderedContentBytes {
+		return "", fmt.Errorf("rendered template must be at most %d bytes", maxRenderedContentBytes)
+	}
+	return content, nil
+}
+
+// formatTemplateValue checks a JSON value against the variable type and
+// returns its text form.
+func formatTemplateValue(variable TemplateVariable, value interface{}) (string, error) {
+	switch variable.Type {
+	case "number":
+		number, ok := value.(float64)
+		if !ok || math.IsNaN(number) || math.IsInf(number, 0) {
+			return "", fmt.Errorf("must be a number")
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	case "boolean":
+		boolean, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("must be a boolean")
+		}
+		return strconv.FormatBool(boolean), nil
+	case "enum":
+		text, ok := value.(string)
+		if !ok || !slices.Contains(variable.Options, text) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(variable.Options, ", "))
+		}
+		return text, nil
+	default:
+		text, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("must be a string")
+		}
+		if variable.Type == "string" && strings.ContainsAny(text, "\r\n") {
+			return "", fmt.Errorf("must be a single line")
+		}
+		if len([]rune(text)) > maxRenderedValueLength {
+			return "", fmt.Errorf("must be at most %d characters", maxRenderedValueLength)
+		}
+		return text, nil
+	}
+}
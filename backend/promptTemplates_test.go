@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	template := &PromptTemplate{
+		Content: "Translate {{text}} into {{language}}.",
+		Variables: []TemplateVariable{
+			{Name: "text", Type: "text", Required: true},
+			{Name: "language", Type: "enum", Options: []string{"French", "German"}, Default: "French"},
+		},
+	}
+
+	content, err := renderTemplate(template, map[string]interface{}{"text": "good morning"})
+	if err != nil || content != "Translate good morning into French." {
+		t.Fatalf("renderTemplate = %q, %v", content, err)
+	}
+
+	if _, err := renderTemplate(template, map[string]interface{}{}); err == nil || err.Error() != "variable text is required" {
+		t.Errorf("missing required variable error = %v", err)
+	}
+	if _, err := renderTemplate(template, map[string]interface{}{"text": "hi", "tone": "formal"}); err == nil || err.Error() != "unknown variable tone" {
+		t.Errorf("unknown variable error = %v", err)
+	}
+}
+
+func TestRenderTemplateLimitsContentLength(t *testing.T) {
+	template := &PromptTemplate{
+		Content: "{{a}}{{b}}{{c}}{{d}}",
+		Variables: []TemplateVariable{
+			{Name: "a", Type: "text"}, {Name: "b", Type: "text"}, {Name: "c", Type: "text"}, {Name: "d", Type: "text"},
+		},
+	}
+	value := strings.Repeat("x", maxRenderedValueLength)
+
+	// Each value is within its own limit, together they don't fit a message
+	values := map[string]interface{}{"a": value, "b": value, "c": value, "d": value}
+	if _, err := renderTemplate(template, values); err == nil {
+		t.Fatal("renderTemplate accepted content longer than a message")
+	}
+
+	delete(values, "d")
+	content, err := renderTemplate(template, values)
+	if err != nil || len(content) != 3*maxRenderedValueLength {
+		t.Fatalf("renderTemplate = %d bytes, %v, want %d bytes", len(content), err, 3*maxRenderedValueLength)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ProviderOpenRouter = "openrouter"
+	ProviderOpenAI     = "openai"
+)
+
+// Provider is an OpenAI-compatible API endpoint.
+type Provider struct {
+	Name        string
+	BaseURL     string
+	InstanceKey string
+	// ValidatePath is requested with a key to check that it is accepted
+	ValidatePath string
+}
+
+type ProviderClient struct {
+	httpClient *http.Client
+	providers  map[string]*Provider
+}
+
+type ProviderMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Parts replace Content with multimodal content when set
+	Parts []ContentPart `json:"-"`
+	// ToolCalls are requested by assistant messages, ToolCallID names the
+	// call a "tool" message answers
+	ToolCalls  []ProviderToolCall `json:"-"`
+	ToolCallID string             `json:"-"`
+}
+
+// ContentPart is a piece of a multimodal message, "text" or "image_url".
+type ContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *ImageURLPart `json:"image_url,omitempty"`
+}
+
+type ImageURLPart struct {
+	// URL is a data URL, so providers never need access to our storage
+	URL string `json:"url"`
+}
+
+// ProviderToolCall is a function call requested by the model. Arguments is
+// the JSON text the model produced, which isn't guaranteed to be valid.
+type ProviderToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// ProviderTool offers a function to the model.
+type ProviderTool struct {
+	Type     string         `json:"type"`
+	Function ToolDefinition `json:"function"`
+}
+
+// MarshalJSON sends Content as a plain string unless the message has parts,
+// which not every provider accepts for text-only messages.
+func (m ProviderMessage) MarshalJSON() ([]byte, error) {
+	type toolFields struct {
+		ToolCalls  []ProviderToolCall `json:"tool_calls,omitempty"`
+		ToolCallID string             `json:"tool_call_id,omitempty"`
+	}
+	if len(m.Parts) == 0 {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+			toolFields
+		}{m.Role, m.Content, toolFields{m.ToolCalls, m.ToolCallID}})
+	}
+	return json.Marshal(struct {
+		Role    string        `json:"role"`
+		Content []ContentPart `json:"content"`
+	}{m.Role, m.Parts})
+}
+
+type ReasoningConfig struct {
+	Effort  string `json:"effort"`
+	Exclude bool   `json:"exclude"`
+}
+
+type CompletionRequest struct {
+	Model     string            `json:"model"`
+	Messages  []ProviderMessage `json:"messages"`
+	Stream    bool              `json:"stream"`
+	Reasoning *ReasoningConfig  `json:"reasoning,omitempty"`
+	Tools     []ProviderTool    `json:"tools,omitempty"`
+
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+
+	// OpenRouter reports usage and cost when asked through Usage, plain
+	// OpenAI-compatible APIs through StreamOptions
+	Usage         *UsageConfig   `json:"usage,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type UsageConfig struct {
+	Include bool `json:"include"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// TokenUsage is the usage block sent with the final chunk of a stream.
+type TokenUsage struct {
+	PromptTokens            int      `json:"prompt_tokens"`
+	CompletionTokens        int      `json:"completion_tokens"`
+	TotalTokens             int      `json:"total_tokens"`
+	Cost                    *float64 `json:"cost"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+}
+
+// StreamDelta is one incremental piece of a streamed completion.
+type StreamDelta struct {
+	Content   string `json:"content,omitempty"`
+	Reasoning string `json:"reasoning,omitempty"`
+}
+
+// CompletionResult is the accumulated outcome of a completion.
+type CompletionResult struct {
+	Content      string
+	Reasoning    string
+	FinishReason string
+	// Model is the model that actually answered, which can differ from the
+	// requested one when the provider routes or falls back
+	Model     string
+	Usage     *TokenUsage
+	ToolCalls []ProviderToolCall
+}
+
+// ProviderModel is an entry of a provider's models listing. OpenRouter fills
+// in all fields, plain OpenAI-compatible APIs usually only the ID.
+type ProviderModel struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	ContextLength int    `json:"context_length"`
+	Pricing       struct {
+		Prompt     string `json:"prompt"`
+		Completion string `json:"completion"`
+		Image      string `json:"image"`
+		Request    string `json:"request"`
+	} `json:"pricing"`
+	Architecture struct {
+		InputModalities  []string `json:"input_modalities"`
+		OutputModalities []string `json:"output_modalities"`
+	} `json:"architecture"`
+	TopProvider struct {
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	} `json:"top_provider"`
+	SupportedParameters []string `json:"supported_parameters"`
+}
+
+// ProviderError is returned when the provider answers with an error status.
+type ProviderError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("provider returned %d: %s", e.StatusCode, e.Message)
+}
+
+func NewProviderClient() *ProviderClient {
+	return &ProviderClient{
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+		providers: map[string]*Provider{
+			ProviderOpenRouter: {
+				Name:         ProviderOpenRouter,
+				BaseURL:      strings.TrimSuffix(getEnv("OPENROUTER_BASE_URL", "https://openrouter.ai/api/v1"), "/"),
+				InstanceKey:  getEnv("OPENROUTER_API_KEY", ""),
+				ValidatePath: "/key",
+			},
+			ProviderOpenAI: {
+				Name:         ProviderOpenAI,
+				BaseURL:      strings.TrimSuffix(getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"), "/"),
+				InstanceKey:  getEnv("OPENAI_API_KEY", ""),
+				ValidatePath: "/models",
+			},
+		},
+	}
+}
+
+func (pc *ProviderClient) Provider(name string) (*Provider, bool) {
+	provider, ok := pc.providers[name]
+	return provider, ok
+}
+
+// ValidateKey makes a cheap authenticated request to check an API key.
+func (pc *ProviderClient) ValidateKey(ctx context.Context, providerName, apiKey string) error {
+	provider, ok := pc.Provider(providerName)
+	if !ok {
+		return fmt.Errorf("unknown provider %s", providerName)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.BaseURL+provider.ValidatePath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readProviderError(resp)
+	}
+	return nil
+}
+
+// ListModels fetches the models a provider offers. The instance key is sent
+// when configured, OpenRouter also answers without one.
+func (pc *ProviderClient) ListModels(ctx context.Context, providerName string) ([]ProviderModel, error) {
+	provider, ok := pc.Provider(providerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", providerName)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.BaseURL+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	if provider.InstanceKey != "" {
+		req.Header.Set("Authorization", "Bearer "+provider.InstanceKey)
+	}
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readProviderError(resp)
+	}
+
+	var listing struct {
+		Data []ProviderModel `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, err
+	}
+	return listing.Data, nil
+}
+
+// StreamChat runs a streaming chat completion and calls onDelta for every
+// content or reasoning chunk. The accumulated result is returned once the
+// provider finishes the stream.
+func (pc *ProviderClient) StreamChat(ctx context.Context, providerName, apiKey string, completion CompletionRequest, onDelta func(StreamDelta) error) (*CompletionResult, error) {
+	provider, ok := pc.Provider(providerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", providerName)
+	}
+
+	completion.Stream = true
+	if providerName == ProviderOpenRouter {
+		completion.Usage = &UsageConfig{Include: true}
+	} else {
+		completion.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	body, err := json.Marshal(completion)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readProviderError(resp)
+	}
+
+	result := &CompletionResult{Model: completion.Model}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data: ") {
+			// Blank lines and ": keep-alive" comments
+			continue
+		}
+
+		data := strings.TrimPrefix(line, "data: ")
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Model   string      `json:"model"`
+			Usage   *TokenUsage `json:"usage"`
+			Choices []struct {
+				Delta struct {
+					StreamDelta
+					ToolCalls []struct {
+						Index    int    `json:"index"`
+						ID       string `json:"id"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Error *struct {
+				Message string `json:"message"`
+				Code    int    `json:"code"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+
+		if chunk.Error != nil {
+			return result, &ProviderError{StatusCode: chunk.Error.Code, Message: chunk.Error.Message}
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			result.FinishReason = *choice.FinishReason
+		}
+
+		// Tool calls arrive in pieces, keyed by their index
+		for _, delta := range choice.Delta.ToolCalls {
+			if delta.Index < 0 || delta.Index > len(result.ToolCalls) {
+				continue
+			}
+			if delta.Index == len(result.ToolCalls) {
+				result.ToolCalls = append(result.ToolCalls, ProviderToolCall{Type: "function"})
+			}
+			call := &result.ToolCalls[delta.Index]
+			if delta.ID != "" {
+				call.ID = delta.ID
+			}
+			call.Function.Name += delta.Function.Name
+			call.Function.Arguments += delta.Function.Arguments
+		}
+
+		if choice.Delta.Content == "" && choice.Delta.Reasoning == "" {
+			continue
+		}
+
+		result.Content += choice.Delta.Content
+		result.Reasoning += choice.Delta.Reasoning
+		if err := onDelta(choice.Delta.StreamDelta); err != nil {
+			return result, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// CreateEmbeddings embeds texts with a provider's embeddings endpoint. The
+// vectors are returned in the order of the inputs.
+func (pc *ProviderClient) CreateEmbeddings(ctx context.Context, providerName, apiKey, model string, inputs []string) ([][]float32, error) {
+	provider, ok := pc.Provider(providerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", providerName)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"model": model, "input": inputs})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.BaseURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := pc.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readProviderError(resp)
+	}
+
+	var embeddings struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&embeddings); err != nil {
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(inputs))
+	for _, item := range embeddings.Data {
+		if item.Index < 0 || item.Index >= len(vectors) {
+			return nil, fmt.Errorf("embedding index %d out of range", item.Index)
+		}
+		vectors[item.Index] = item.Embedding
+	}
+	for i, vector := range vectors {
+		if len(vector) == 0 {
+			return nil, fmt.Errorf("missing embedding for input %d", i)
+		}
+	}
+	return vectors, nil
+}
+
+func readProviderError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error.Message != "" {
+		message = parsed.Error.Message
+	}
+
+	return &ProviderError{StatusCode: resp.StatusCode, Message: message}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errNoAPIKey = errors.New("no API key available for provider")
+
+type ProviderKeyService struct {
+	db        *sql.DB
+	box       *SecretBox
+	providers *ProviderClient
+}
+
+// ProviderKey describes a stored key without ever exposing it.
+type ProviderKey struct {
+	Provider        string     `json:"provider"`
+	KeyHint         string     `json:"keyHint"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+	LastValidatedAt *time.Time `json:"lastValidatedAt"`
+}
+
+type SaveProviderKeyRequest struct {
+	Provider string `json:"provider"`
+	APIKey   string `json:"apiKey"`
+}
+
+func NewProviderKeyService(db *sql.DB, box *SecretBox, providers *ProviderClient) *ProviderKeyService {
+	return &ProviderKeyService{db: db, box: box, providers: providers}
+}
+
+// List the provider keys stored for the current user
+func (ps *ProviderKeyService) GetProviderKeys(c *gin.Context) {
+	rows, err := ps.db.Query(`
+		SELECT provider, key_hint, created_at, updated_at, last_validated_at
+		FROM provider_keys
+		WHERE user_id = ?
+		ORDER BY provider ASC
+	`, currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch provider keys"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []ProviderKey{}
+	for rows.Next() {
+		var key ProviderKey
+		if err := rows.Scan(&key.Provider, &key.KeyHint, &key.CreatedAt, &key.UpdatedAt, &key.LastValidatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan provider key"})
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// Test a provider key and store it encrypted for the current user
+func (ps *ProviderKeyService) SaveProviderKey(c *gin.Context) {
+	user := currentUser(c)
+
+	if !ps.box.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Key storage is not configured on this instance"})
+		return
+	}
+
+	var req SaveProviderKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Provider = strings.ToLower(strings.TrimSpace(req.Provider))
+	req.APIKey = strings.TrimSpace(req.APIKey)
+
+	if _, ok := ps.providers.Provider(req.Provider); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported provider"})
+		return
+	}
+	if req.APIKey == "" || len(req.APIKey) > 512 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API key is required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+	if err := ps.providers.ValidateKey(ctx, req.Provider, req.APIKey); err != nil {
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) && (providerErr.StatusCode == http.StatusUnauthorized || providerErr.StatusCode == http.StatusForbidden) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The provider rejected this API key"})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Could not reach the provider to verify the key"})
+		}
+		return
+	}
+
+	sealed, err := ps.box.Seal([]byte(req.APIKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt key"})
+		return
+	}
+
+	now := time.Now()
+	hint := keyHint(req.APIKey)
+	_, err = ps.db.Exec(`
+		INSERT INTO provider_keys (user_id, provider, ciphertext, nonce, wrapped_key, key_nonce, master_key_id, key_hint, created_at, updated_at, last_validated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		ciphertext = VALUES(ciphertext), nonce = VALUES(nonce), wrapped_key = VALUES(wrapped_key),
+		key_nonce = VALUES(key_nonce), master_key_id = VALUES(master_key_id), key_hint = VALUES(key_hint),
+		updated_at = VALUES(updated_at), last_validated_at = VALUES(last_validated_at)
+	`, user.ID, req.Provider, sealed.Ciphertext, sealed.Nonce, sealed.WrappedKey, sealed.KeyNonce, sealed.MasterKeyID, hint, now, now, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ProviderKey{
+		Provider:        req.Provider,
+		KeyHint:         hint,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		LastValidatedAt: &now,
+	})
+}
+
+// Delete the current user's key for a provider
+func (ps *ProviderKeyService) DeleteProviderKey(c *gin.Context) {
+	result, err := ps.db.Exec("DELETE FROM provider_keys WHERE user_id = ? AND provider = ?", currentUser(c).ID, c.Param("provider"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete key"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Provider key deleted successfully"})
+}
+
+// resolveAPIKey returns the user's own key for a provider, falling back to
+// the instance key. The returned source is "user" or "instance".
+func (ps *ProviderKeyService) resolveAPIKey(userID, providerName string) (string, string, error) {
+	provider, ok := ps.providers.Provider(providerName)
+	if !ok {
+		return "", "", errNoAPIKey
+	}
+
+	if ps.box.Enabled() {
+		var sealed SealedSecret
+		err := ps.db.QueryRow(`
+			SELECT ciphertext, nonce, wrapped_key, key_nonce, master_key_id
+			FROM provider_keys
+			WHERE user_id = ? AND provider = ?
+		`, userID, providerName).Scan(&sealed.Ciphertext, &sealed.Nonce, &sealed.WrappedKey, &sealed.KeyNonce, &sealed.MasterKeyID)
+
+		switch {
+		case err == nil:
+			plaintext, err := ps.box.Open(&sealed)
+			if err == nil {
+				return string(plaintext), "user", nil
+			}
+			// Fall through to the instance key rather than failing the request
+			log.Printf("Failed to decrypt %s key for user %s: %v", providerName, userID, err)
+		case err != sql.ErrNoRows:
+			return "", "", err
+		}
+	}
+
+	if provider.InstanceKey != "" {
+		return provider.InstanceKey, "instance", nil
+	}
+	return "", "", errNoAPIKey
+}
+
+// keyHint keeps the last four characters so users can tell keys apart.
+func keyHint(apiKey string) string {
+	if len(apiKey) <= 4 {
+		return "****"
+	}
+	return "..." + apiKey[len(apiKey)-4:]
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	minuteWindow = time.Minute
+	dayWindow    = time.Hour * 24
+)
+
+// CounterStore keeps fixed-window counters. The in-memory store serves a
+// single process; a shared implementation (e.g. Redis INCRBY + EXPIRE) can
+// replace it when running several backends.
+type CounterStore interface {
+	// Add increments the counter for key in the window containing now and
+	// returns the new value together with the end of the window.
+	Add(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Time, error)
+	// Get returns the current value without changing it.
+	Get(ctx context.Context, key string, window time.Duration) (int64, time.Time, error)
+}
+
+// Limits are the quotas applied to one subject. Zero disables a limit.
+type Limits struct {
+	RequestsPerMinute int64
+	TokensPerDay      int64
+	MessagesPerDay    int64
+}
+
+type RateLimiter struct {
+	store CounterStore
+	user  Limits
+	ip    Limits
+}
+
+func NewRateLimiter(store CounterStore) *RateLimiter {
+	return &RateLimiter{
+		store: store,
+		user: Limits{
+			RequestsPerMinute: getEnvInt64("RATE_LIMIT_USER_RPM", 30),
+			TokensPerDay:      getEnvInt64("QUOTA_USER_TOKENS_PER_DAY", 0),
+			MessagesPerDay:    getEnvInt64("QUOTA_USER_MESSAGES_PER_DAY", 0),
+		},
+		ip: Limits{
+			RequestsPerMinute: getEnvInt64("RATE_LIMIT_IP_RPM", 60),
+			TokensPerDay:      getEnvInt64("QUOTA_IP_TOKENS_PER_DAY", 0),
+			MessagesPerDay:    getEnvInt64("QUOTA_IP_MESSAGES_PER_DAY", 0),
+		},
+	}
+}
+
+// Requests enforces the requests-per-minute limits. Must run after RequireAuth.
+func (rl *RateLimiter) Requests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rl.exceeded(c, "rpm", 1, minuteWindow, rl.user.RequestsPerMinute, rl.ip.RequestsPerMinute, "Too many requests") {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Messages enforces the messages-per-day quota, counting one message per request.
+func (rl *RateLimiter) Messages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rl.exceeded(c, "messages", 1, dayWindow, rl.user.MessagesPerDay, rl.ip.MessagesPerDay, "Daily message limit reached") {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Tokens rejects requests once the daily token quota is used up. Tokens are
+// only known after a completion, so they are added with RecordTokens.
+func (rl *RateLimiter) Tokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rl.exceeded(c, "tokens", 0, dayWindow, rl.user.TokensPerDay, rl.ip.TokensPerDay, "Daily token limit reached") {
+			return
+		}
+		c.Next()
+	}
+}
+
+// RecordTokens adds tokens spent by a completion to the daily counters.
+func (rl *RateLimiter) RecordTokens(c *gin.Context, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	if rl.user.TokensPerDay > 0 {
+		if _, _, err := rl.store.Add(ctx, "tokens:user:"+currentUser(c).ID, tokens, dayWindow); err != nil {
+			log.Printf("Failed to record token usage: %v", err)
+		}
+	}
+	if rl.ip.TokensPerDay > 0 {
+		if _, _, err := rl.store.Add(ctx, "tokens:ip:"+c.ClientIP(), tokens, dayWindow); err != nil {
+			log.Printf("Failed to record token usage: %v", err)
+		}
+	}
+}
+
+// exceeded adds n to the user and IP counters and responds with 429 when
+// either one is over its limit. With n == 0 the counters are only checked.
+func (rl *RateLimiter) exceeded(c *gin.Context, name string, n int64, window time.Duration, userLimit, ipLimit int64, message string) bool {
+	subjects := []struct {
+		key   string
+		limit int64
+	}{
+		{name + ":user:" + currentUser(c).ID, userLimit},
+		{name + ":ip:" + c.ClientIP(), ipLimit},
+	}
+
+	for _, subject := range subjects {
+		if subject.limit <= 0 {
+			continue
+		}
+
+		var value int64
+		var resetAt time.Time
+		var err error
+		if n > 0 {
+			value, resetAt, err = rl.store.Add(c.Request.Context(), subject.key, n, window)
+		} else {
+			value, resetAt, err = rl.store.Get(c.Request.Context(), subject.key, window)
+			// Checking needs room for at least one more token
+			value++
+		}
+		if err != nil {
+			// Fail open, a broken counter store shouldn't take the API down
+			log.Printf("Rate limiter store error: %v", err)
+			continue
+		}
+
+		if value > subject.limit {
+			retryAfter := int64(math.Ceil(time.Until(resetAt).Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message, "retryAfter": retryAfter})
+			return true
+		}
+	}
+
+	return false
+}
+
+// MemoryCounterStore is a CounterStore for a single process.
+type MemoryCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]*windowCounter
+}
+
+type windowCounter struct {
+	value   int64
+	resetAt time.Time
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	store := &MemoryCounterStore{counters: make(map[string]*windowCounter)}
+	runPeriodically("rate limit cleanup", 10*time.Minute, func() error {
+		store.cleanup()
+		return nil
+	})
+	return store
+}
+
+func (s *MemoryCounterStore) Add(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.counter(key, window)
+	counter.value += n
+	return counter.value, counter.resetAt, nil
+}
+
+func (s *MemoryCounterStore) Get(ctx context.Context, key string, window time.Duration) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.counter(key, window)
+	return counter.value, counter.resetAt, nil
+}
+
+// counter returns the live counter for key, starting a new window when the
+// previous one has ended. Windows are aligned so daily quotas reset at
+// midnight UTC.
+func (s *MemoryCounterStore) counter(key string, window time.Duration) *windowCounter {
+	now := time.Now()
+	counter, ok := s.counters[key]
+	if !ok || !now.Before(counter.resetAt) {
+		counter = &windowCounter{resetAt: now.Truncate(window).Add(window)}
+		s.counters[key] = counter
+	}
+	return counter
+}
+
+func (s *MemoryCounterStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, counter := range s.counters {
+		if !now.Before(counter.resetAt) {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// estimateTokens roughly approximates a token count at four characters per token.
+func estimateTokens(text string) int64 {
+	return int64(len([]rune(text))+3) / 4
+}
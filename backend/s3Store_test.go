@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var sigV4Authorization = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=test-key/(\d{8})/eu-central-1/s3/aws4_request, SignedHeaders=((?:content-type;)?host;x-amz-content-sha256;x-amz-date), Signature=[0-9a-f]{64}$`)
+
+// fakeS3 is a path-style bucket that checks every request is signed.
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string]string
+	paths   []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.Method+" "+r.URL.EscapedPath())
+
+	match := sigV4Authorization.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match == nil {
+		f.t.Errorf("%s %s: malformed Authorization header %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if amzDate := r.Header.Get("X-Amz-Date"); !strings.HasPrefix(amzDate, match[1]+"T") {
+		f.t.Errorf("X-Amz-Date %q doesn't match the credential date %s", amzDate, match[1])
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != unsignedPayload {
+		f.t.Errorf("X-Amz-Content-Sha256 = %q, want %s", r.Header.Get("X-Amz-Content-Sha256"), unsignedPayload)
+	}
+	if hasContentType := strings.HasPrefix(match[2], "content-type;"); hasContentType != (r.Header.Get("Content-Type") != "") {
+		f.t.Errorf("SignedHeaders %s doesn't match Content-Type %q", match[2], r.Header.Get("Content-Type"))
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = string(body)
+	case http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		io.WriteString(w, body)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Store(t *testing.T) (*S3BlobStore, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{t: t, objects: map[string]string{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &S3BlobStore{
+		endpoint:  endpoint,
+		region:    "eu-central-1",
+		bucket:    "bucket",
+		accessKey: "test-key",
+		secretKey: "test-secret",
+		pathStyle: true,
+		client:    server.Client(),
+	}, fake
+}
+
+func TestS3BlobStore(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestS3Store(t)
+
+	if err := store.Put(ctx, "user-1/file-1", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	blob, err := store.Get(ctx, "user-1/file-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Get = %q, %v, want hello", data, err)
+	}
+
+	if err := store.Delete(ctx, "user-1/file-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, "user-1/file-1"); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("Get after Delete error = %v, want errBlobNotFound", err)
+	}
+
+	want := []string{
+		"PUT /bucket/user-1/file-1",
+		"GET /bucket/user-1/file-1",
+		"DELETE /bucket/user-1/file-1",
+		"GET /bucket/user-1/file-1",
+	}
+	if strings.Join(fake.paths, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests = %q, want %q", fake.paths, want)
+	}
+}
+
+func TestS3BlobStoreRejectsInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+	store, fake := newTestS3Store(t)
+
+	for _, key := range []string{"", "../secret", "/etc/passwd", "a//b", "a/", "A/b", "a/../b", ".hidden"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an error", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, errBlobNotFound) {
+			t.Errorf("Get(%q) error = %v, want an invalid key error", key, err)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded, want an error", key)
+		}
+	}
+	if len(fake.paths) != 0 {
+		t.Errorf("invalid keys reached the server: %q", fake.paths)
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	endpoint, _ := url.Parse("https://s3.example.com/prefix/")
+	store := &S3BlobStore{endpoint: endpoint, bucket: "bucket", pathStyle: true}
+	if got := store.objectURL("user-1/file-1").String(); got != "https://s3.example.com/prefix/bucket/user-1/file-1" {
+		t.Errorf("path-style URL = %s", got)
+	}
+
+	store.pathStyle = false
+	if got := store.objectURL("user-1/file-1").String(); got != "https://bucket.s3.example.com/prefix/user-1/file-1" {
+		t.Errorf("virtual-hosted URL = %s", got)
+	}
+}
+
+func TestS3SignIsDeterministic(t *testing.T) {
+	store, _ := newTestS3Store(t)
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	sign := func(secret string) string {
+		req, _ := http.NewRequest(http.MethodGet, store.objectURL("user-1/file-1").String(), nil)
+		s := *store
+		s.secretKey = secret
+		s.sign(req, now)
+		if req.Header.Get("X-Amz-Date") != "20240501T123000Z" {
+			t.Errorf("X-Amz-Date = %s", req.Header.Get("X-Amz-Date"))
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	first := sign("test-secret")
+	if !sigV4Authorization.MatchString(first) || !strings.Contains(first, "/20240501/") {
+		t.Fatalf("Authorization = %s", first)
+	}
+	if sign("test-secret") != first {
+		t.Error("signing the same request twice gave different signatures")
+	}
+	if sign("other-secret") == first {
+		t.Error("signature doesn't depend on the secret key")
+	}
+}
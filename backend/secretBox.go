@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	errNoMasterKey       = errors.New("no master key configured")
+	errMasterKeyMismatch = errors.New("secret was sealed with a different master key")
+)
+
+// SecretBox implements envelope encryption: every secret gets its own data
+// key, and only the data key is encrypted with the master key. Rotating the
+// master key therefore only requires re-wrapping the data keys, which
+// rewrapSecrets does while the previous keys are still configured.
+type SecretBox struct {
+	masterKey []byte
+	keyID     string
+	// previousKeys open secrets sealed before a rotation, by key ID
+	previousKeys map[string][]byte
+}
+
+// SealedSecret is the stored form of an encrypted secret.
+type SealedSecret struct {
+	Ciphertext  []byte
+	Nonce       []byte
+	WrappedKey  []byte
+	KeyNonce    []byte
+	MasterKeyID string
+}
+
+// NewSecretBox loads the master key from MASTER_KEY (base64) or from the file
+// named by MASTER_KEY_FILE, and replaced master keys from the comma
+// separated PREVIOUS_MASTER_KEYS. Without a master key, a box is returned
+// that refuses to seal or open secrets.
+func NewSecretBox() (*SecretBox, error) {
+	encoded := os.Getenv("MASTER_KEY")
+	if encoded == "" {
+		if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read master key file: %w", err)
+			}
+			encoded = strings.TrimSpace(string(data))
+		}
+	}
+	if encoded == "" {
+		return &SecretBox{}, nil
+	}
+
+	key, keyID, err := parseMasterKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key: %w", err)
+	}
+	box := &SecretBox{masterKey: key, keyID: keyID, previousKeys: map[string][]byte{}}
+	for _, encoded := range getEnvList("PREVIOUS_MASTER_KEYS") {
+		key, keyID, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("previous master key: %w", err)
+		}
+		if keyID != box.keyID {
+			box.previousKeys[keyID] = key
+		}
+	}
+	return box, nil
+}
+
+func parseMasterKey(encoded string) ([]byte, string, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, "", fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	sum := sha256.Sum256(key)
+	return key, hex.EncodeToString(sum[:4]), nil
+}
+
+func (b *SecretBox) Enabled() bool {
+	return b.masterKey != nil
+}
+
+func (b *SecretBox) Seal(plaintext []byte) (*SealedSecret, error) {
+	if !b.Enabled() {
+		return nil, errNoMasterKey
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, nonce, err := aesGCMSeal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, keyNonce, err := aesGCMSeal(b.masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SealedSecret{
+		Ciphertext:  ciphertext,
+		Nonce:       nonce,
+		WrappedKey:  wrappedKey,
+		KeyNonce:    keyNonce,
+		MasterKeyID: b.keyID,
+	}, nil
+}
+
+func (b *SecretBox) Open(secret *SealedSecret) ([]byte, error) {
+	if !b.Enabled() {
+		return nil, errNoMasterKey
+	}
+	dataKey, err := b.openDataKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return aesGCMOpen(dataKey, secret.Nonce, secret.Ciphertext)
+}
+
+// Rewrap wraps the data key of a secret sealed with a previous master key
+// with the current one. The ciphertext stays the same. Secrets already
+// wrapped with the current key are returned unchanged.
+func (b *SecretBox) Rewrap(secret *SealedSecret) (*SealedSecret, error) {
+	if !b.Enabled() {
+		return nil, errNoMasterKey
+	}
+	if secret.MasterKeyID == b.keyID {
+		return secret, nil
+	}
+
+	dataKey, err := b.openDataKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, keyNonce, err := aesGCMSeal(b.masterKey, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := *secret
+	rewrapped.WrappedKey = wrappedKey
+	rewrapped.KeyNonce = keyNonce
+	rewrapped.MasterKeyID = b.keyID
+	return &rewrapped, nil
+}
+
+// openDataKey unwraps the data key with the master key the secret names.
+func (b *SecretBox) openDataKey(secret *SealedSecret) ([]byte, error) {
+	masterKey := b.masterKey
+	if secret.MasterKeyID != b.keyID {
+		var ok bool
+		if masterKey, ok = b.previousKeys[secret.MasterKeyID]; !ok {
+			return nil, errMasterKeyMismatch
+		}
+	}
+	return aesGCMOpen(masterKey, secret.KeyNonce, secret.WrappedKey)
+}
+
+func aesGCMSeal(key, plaintext []byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return gcm.Seal(nil, nonce, plaintext, nil), nonce, nil
+}
+
+func aesGCMOpen(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
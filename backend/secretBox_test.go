@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func newTestMasterKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestSecretBoxRotation(t *testing.T) {
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+
+	t.Setenv("MASTER_KEY", oldKey)
+	oldBox, err := NewSecretBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := oldBox.Seal([]byte("sk-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("MASTER_KEY", newKey)
+	t.Setenv("PREVIOUS_MASTER_KEYS", oldKey)
+	box, err := NewSecretBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := box.Open(sealed); err != nil || string(plaintext) != "sk-secret" {
+		t.Fatalf("Open with a previous key = %q, %v", plaintext, err)
+	}
+
+	rewrapped, err := box.Rewrap(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.MasterKeyID != box.keyID || !bytes.Equal(rewrapped.Ciphertext, sealed.Ciphertext) {
+		t.Errorf("Rewrap = %+v, want the same ciphertext under key %s", rewrapped, box.keyID)
+	}
+
+	// After the rotation the previous key is no longer needed
+	t.Setenv("PREVIOUS_MASTER_KEYS", "")
+	box, err = NewSecretBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := box.Open(rewrapped); err != nil || string(plaintext) != "sk-secret" {
+		t.Errorf("Open after Rewrap = %q, %v", plaintext, err)
+	}
+	if _, err := box.Open(sealed); !errors.Is(err, errMasterKeyMismatch) {
+		t.Errorf("Open with a dropped key error = %v, want errMasterKeyMismatch", err)
+	}
+}
+
+func TestSecretBoxWithoutMasterKey(t *testing.T) {
+	t.Setenv("MASTER_KEY", "")
+	t.Setenv("MASTER_KEY_FILE", "")
+	box, err := NewSecretBox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := box.Seal([]byte("x")); !errors.Is(err, errNoMasterKey) {
+		t.Errorf("Seal error = %v, want errNoMasterKey", err)
+	}
+}
+
+func TestSecretBoxRejectsInvalidPreviousKeys(t *testing.T) {
+	t.Setenv("MASTER_KEY", newTestMasterKey(t))
+	t.Setenv("PREVIOUS_MASTER_KEYS", "not base64!")
+	if _, err := NewSecretBox(); err == nil {
+		t.Error("NewSecretBox accepted an invalid previous key")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SignupOpen     = "open"
+	SignupDomains  = "domains"
+	SignupInvite   = "invite"
+	SignupWaitlist = "waitlist"
+
+	waitlistPending  = "pending"
+	waitlistApproved = "approved"
+	waitlistRejected = "rejected"
+)
+
+var (
+	errSignupDomain   = errors.New("email domain is not allowed to sign up")
+	errInviteRequired = errors.New("a valid invite code is required to sign up")
+	errWaitlisted     = errors.New("sign up is waiting for admin approval")
+)
+
+// SignupPolicy decides whether a first-time Google login may create an account.
+type SignupPolicy struct {
+	Mode           string
+	AllowedDomains map[string]bool
+}
+
+type InviteCode struct {
+	Code      string     `json:"code"`
+	CreatedBy *string    `json:"createdBy"`
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+type WaitlistEntry struct {
+	ID          int        `json:"id"`
+	Email       string     `json:"email"`
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	ReviewedBy  *string    `json:"reviewedBy"`
+	ReviewedAt  *time.Time `json:"reviewedAt"`
+}
+
+type CreateInviteRequest struct {
+	MaxUses       int `json:"maxUses"`
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+func NewSignupPolicy() *SignupPolicy {
+	mode := strings.ToLower(getEnv("SIGNUP_MODE", SignupOpen))
+	switch mode {
+	case SignupOpen, SignupDomains, SignupInvite, SignupWaitlist:
+	default:
+		log.Printf("Unknown SIGNUP_MODE %q, falling back to %s", mode, SignupInvite)
+		mode = SignupInvite
+	}
+
+	domains := make(map[string]bool)
+	for _, domain := range getEnvList("SIGNUP_ALLOWED_DOMAINS") {
+		domains[strings.ToLower(strings.TrimPrefix(domain, "@"))] = true
+	}
+
+	return &SignupPolicy{Mode: mode, AllowedDomains: domains}
+}
+
+// authorize checks whether a new account may be created inside tx,
+// consuming one use of the invite code when it is what grants access.
+func (p *SignupPolicy) authorize(tx *sql.Tx, googleUser GoogleUserInfo, inviteCode string) error {
+	switch p.Mode {
+	case SignupOpen:
+		return nil
+
+	case SignupDomains:
+		email := strings.ToLower(googleUser.Email)
+		domain := email[strings.LastIndex(email, "@")+1:]
+		if !p.AllowedDomains[domain] {
+			return errSignupDomain
+		}
+		return nil
+
+	case SignupInvite:
+		ok, err := consumeInviteCode(tx, inviteCode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInviteRequired
+		}
+		return nil
+
+	default:
+		// Waitlist: an invite code skips the queue, otherwise an admin must approve
+		ok, err := consumeInviteCode(tx, inviteCode)
+		if err != nil || ok {
+			return err
+		}
+
+		var status string
+		err = tx.QueryRow("SELECT status FROM waitlist WHERE email = ?", googleUser.Email).Scan(&status)
+		if err == sql.ErrNoRows || (err == nil && status != waitlistApproved) {
+			return errWaitlisted
+		}
+		return err
+	}
+}
+
+// joinWaitlist records a sign-up request, keeping any earlier decision.
+func (p *SignupPolicy) joinWaitlist(db *sql.DB, googleUser GoogleUserInfo) error {
+	_, err := db.Exec(
+		"INSERT IGNORE INTO waitlist (email, name, status, requested_at) VALUES (?, ?, ?, ?)",
+		googleUser.Email, googleUser.Name, waitlistPending, time.Now(),
+	)
+	return err
+}
+
+// consumeInviteCode uses up one redemption of a valid invite code.
+func consumeInviteCode(tx *sql.Tx, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	result, err := tx.Exec(`
+		UPDATE invite_codes SET uses = uses + 1
+		WHERE code = ? AND revoked_at IS NULL AND uses < max_uses AND (expires_at IS NULL OR expires_at > NOW())
+	`, code)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func generateInviteCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// Describe the sign-up mode so the login page can ask for an invite code
+func (a *AuthService) GetSignupPolicy(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"mode": a.signupPolicy.Mode})
+}
+
+// Create an invite code
+func (as *AdminService) CreateInvite(c *gin.Context) {
+	var req CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 || req.MaxUses > 10000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Max uses must be between 1 and 10000"})
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must not be negative"})
+		return
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invite code"})
+		return
+	}
+
+	admin := currentUser(c)
+	now := time.Now()
+	invite := InviteCode{
+		Code:      code,
+		CreatedBy: &admin.ID,
+		MaxUses:   req.MaxUses,
+		CreatedAt: now,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := now.Add(time.Hour * 24 * time.Duration(req.ExpiresInDays))
+		invite.ExpiresAt = &expiresAt
+	}
+
+	_, err = as.db.Exec(
+		"INSERT INTO invite_codes (code, created_by, max_uses, uses, expires_at, created_at) VALUES (?, ?, ?, 0, ?, ?)",
+		invite.Code, invite.CreatedBy, invite.MaxUses, invite.ExpiresAt, invite.CreatedAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite code"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// List all invite codes
+func (as *AdminService) ListInvites(c *gin.Context) {
+	rows, err := as.db.Query(`
+		SELECT code, created_by, max_uses, uses, expires_at, revoked_at, created_at
+		FROM invite_codes
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invite codes"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []InviteCode{}
+	for rows.Next() {
+		var invite InviteCode
+		err := rows.Scan(&invite.Code, &invite.CreatedBy, &invite.MaxUses, &invite.Uses, &invite.ExpiresAt, &invite.RevokedAt, &invite.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan invite code"})
+			return
+		}
+		invites = append(invites, invite)
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// Revoke an invite code so it can no longer be redeemed
+func (as *AdminService) RevokeInvite(c *gin.Context) {
+	result, err := as.db.Exec("UPDATE invite_codes SET revoked_at = ? WHERE code = ? AND revoked_at IS NULL", time.Now(), c.Param("code"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite code"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite code not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite code revoked successfully"})
+}
+
+// List waitlist entries, pending ones by default
+func (as *AdminService) ListWaitlist(c *gin.Context) {
+	status := c.DefaultQuery("status", waitlistPending)
+
+	rows, err := as.db.Query(`
+		SELECT id, email, name, status, requested_at, reviewed_by, reviewed_at
+		FROM waitlist
+		WHERE status = ?
+		ORDER BY requested_at ASC
+	`, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waitlist"})
+		return
+	}
+	defer rows.Close()
+
+	entries := []WaitlistEntry{}
+	for rows.Next() {
+		var entry WaitlistEntry
+		err := rows.Scan(&entry.ID, &entry.Email, &entry.Name, &entry.Status, &entry.RequestedAt, &entry.ReviewedBy, &entry.ReviewedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan waitlist entry"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// Approve a waitlist entry; the user can sign in afterwards
+func (as *AdminService) ApproveWaitlistEntry(c *gin.Context) {
+	as.reviewWaitlistEntry(c, waitlistApproved)
+}
+
+// Reject a waitlist entry
+func (as *AdminService) RejectWaitlistEntry(c *gin.Context) {
+	as.reviewWaitlistEntry(c, waitlistRejected)
+}
+
+func (as *AdminService) reviewWaitlistEntry(c *gin.Context, status string) {
+	entryID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid waitlist entry ID"})
+		return
+	}
+
+	result, err := as.db.Exec(
+		"UPDATE waitlist SET status = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?",
+		status, currentUser(c).ID, time.Now(), entryID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update waitlist entry"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Waitlist entry not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Waitlist entry " + status})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// chunkText splits a document into chunks of about chunkTokens tokens for
+// embedding. Chunks end at paragraph and sentence boundaries where possible
+// and start with the last overlapTokens of the previous chunk, so a passage
+// cut in two can still be found as a whole.
+func chunkText(text string, chunkTokens, overlapTokens int) []string {
+	tokenizer := defaultTokenizerFamily
+
+	var segments []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if tokenizer.countTokens(paragraph) <= chunkTokens {
+			segments = append(segments, paragraph)
+			continue
+		}
+		for _, sentence := range splitSentences(paragraph) {
+			segments = append(segments, splitToTokens(sentence, chunkTokens, tokenizer)...)
+		}
+	}
+
+	var chunks []string
+	var current []string
+	currentTokens := 0
+	for _, segment := range segments {
+		tokens := tokenizer.countTokens(segment)
+		if currentTokens+tokens > chunkTokens && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, "\n\n"))
+
+			// Carry the tail of the chunk over into the next one
+			var overlap []string
+			overlapUsed := 0
+			for i := len(current) - 1; i >= 0; i-- {
+				segmentTokens := tokenizer.countTokens(current[i])
+				if overlapUsed+segmentTokens > overlapTokens || overlapUsed+segmentTokens+tokens > chunkTokens {
+					break
+				}
+				overlap = append([]string{current[i]}, overlap...)
+				overlapUsed += segmentTokens
+			}
+			current, currentTokens = overlap, overlapUsed
+		}
+		current = append(current, segment)
+		currentTokens += tokens
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, "\n\n"))
+	}
+	return chunks
+}
+
+// splitSentences cuts after sentence punctuation followed by a space.
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+	for i := 0; i < len(runes)-1; i++ {
+		if strings.ContainsRune(".!?。！？", runes[i]) && unicode.IsSpace(runes[i+1]) {
+			sentences = append(sentences, strings.TrimSpace(string(runes[start:i+1])))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(string(runes[start:])); rest != "" {
+		sentences = append(sentences, rest)
+	}
+	return sentences
+}
+
+// splitToTokens hard-splits text longer than limit tokens, preferring to
+// cut at whitespace.
+func splitToTokens(text string, limit int, tokenizer tokenizerFamily) []string {
+	var pieces []string
+	for tokenizer.countTokens(text) > limit {
+		runes := []rune(text)
+		cut := min(len(runes), max(1, int(float64(limit)*tokenizer.charsPerToken)))
+		for cut > 1 && tokenizer.countTokens(string(runes[:cut])) > limit {
+			cut = cut * 9 / 10
+		}
+		if space := strings.LastIndexFunc(string(runes[:cut]), unicode.IsSpace); space > 0 {
+			cut = len([]rune(string(runes[:cut])[:space]))
+		}
+		pieces = append(pieces, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	if text != "" {
+		pieces = append(pieces, text)
+	}
+	return pieces
+}
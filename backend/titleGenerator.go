@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	TitleSourceDefault   = "default"
+	TitleSourceGenerated = "generated"
+	TitleSourceUser      = "user"
+
+	defaultChatTitle   = "New Chat"
+	maxChatTitleLength = 50
+	titlePrompt        = "Generate a short, descriptive title (max 6 words) for a conversation that starts with the following exchange. Only return the title, nothing else."
+)
+
+// TitleService names chats in the background after their first exchange.
+type TitleService struct {
+	db        *sql.DB
+	jobs      *JobQueue
+	providers *ProviderClient
+	keys      *ProviderKeyService
+	events    *EventHub
+	// model is empty when titles should always come from the first message
+	model string
+}
+
+func NewTitleService(db *sql.DB, jobs *JobQueue, providers *ProviderClient, keys *ProviderKeyService, events *EventHub) *TitleService {
+	model := getEnv("TITLE_MODEL", "mistralai/mistral-7b-instruct:free")
+	if model == "none" {
+		model = ""
+	}
+	return &TitleService{db: db, jobs: jobs, providers: providers, keys: keys, events: events, model: model}
+}
+
+// scheduleTitle queues title generation once a chat without a chosen title
+// has its first complete exchange.
+func (ts *TitleService) scheduleTitle(chatID int, userID string) {
+	var titleSource string
+	var answered int
+	err := ts.db.QueryRow(`
+		SELECT ch.title_source,
+		(SELECT COUNT(*) FROM messages m WHERE m.chat_id = ch.id AND m.role = 'assistant' AND m.isStreaming = FALSE AND m.content <> '')
+		FROM chats ch WHERE ch.id = ?
+	`, chatID).Scan(&titleSource, &answered)
+	if err != nil {
+		log.Printf("Failed to check title of chat %d: %v", chatID, err)
+		return
+	}
+	if titleSource != TitleSourceDefault || answered != 1 {
+		return
+	}
+
+	if !ts.jobs.Enqueue("chat title", func() error { return ts.generateTitle(chatID, userID) }) {
+		log.Printf("Job queue full, skipping title for chat %d", chatID)
+	}
+}
+
+// generateTitle asks the title model for a title, falling back to the start
+// of the first user message, then stores and announces it.
+func (ts *TitleService) generateTitle(chatID int, userID string) error {
+	messages, err := queryChatMessages(ts.db, chatID)
+	if err != nil {
+		return err
+	}
+
+	var firstUser, firstAssistant string
+	for _, message := range messages {
+		if message.Role == "user" && firstUser == "" {
+			firstUser = message.Content
+		}
+		if message.Role == "assistant" && firstAssistant == "" && !message.IsStreaming {
+			firstAssistant = message.Content
+		}
+	}
+	if firstUser == "" {
+		return nil
+	}
+
+	title := ""
+	if ts.model != "" {
+		title, err = ts.requestTitle(userID, firstUser, firstAssistant)
+		if err != nil {
+			log.Printf("Title model failed for chat %d, using fallback: %v", chatID, err)
+		}
+	}
+	if title == "" {
+		title = fallbackTitle(firstUser)
+	}
+
+	// The source check keeps a rename that happened meanwhile
+	result, err := ts.db.Exec(
+		"UPDATE chats SET title = ?, title_source = ? WHERE id = ? AND title_source = ?",
+		title, TitleSourceGenerated, chatID, TitleSourceDefault,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	chat, err := scanChat(ts.db.QueryRow(`SELECT `+chatColumns+` FROM chats WHERE id = ?`, chatID))
+	if err != nil {
+		return err
+	}
+	ts.events.PublishChat(chat, Event{Type: EventChatUpdated, Data: chat})
+	return nil
+}
+
+func (ts *TitleService) requestTitle(userID, userMessage, assistantMessage string) (string, error) {
+	apiKey, _, err := ts.keys.resolveAPIKey(userID, ProviderOpenRouter)
+	if err != nil {
+		return "", err
+	}
+
+	exchange := "User: " + truncateRunes(userMessage, 2000)
+	if assistantMessage != "" {
+		exchange += "\n\nAssistant: " + truncateRunes(assistantMessage, 2000)
+	}
+
+	maxTokens := 30
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := ts.providers.StreamChat(ctx, ProviderOpenRouter, apiKey, CompletionRequest{
+		Model: ts.model,
+		Messages: []ProviderMessage{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: exchange},
+		},
+		MaxTokens: &maxTokens,
+	}, func(StreamDelta) error { return nil })
+	if err != nil {
+		return "", err
+	}
+
+	return cleanTitle(result.Content), nil
+}
+
+// cleanTitle keeps the first line of a model answer without quotes or a
+// "Title:" prefix. Answers that are too long are rejected.
+func cleanTitle(answer string) string {
+	title := strings.TrimSpace(answer)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = title[:i]
+	}
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(strings.TrimSpace(title), `"'*#`+"`")
+	title = strings.TrimSpace(title)
+
+	if title == "" || len([]rune(title)) > maxChatTitleLength {
+		return ""
+	}
+	return title
+}
+
+// fallbackTitle uses the start of the first message, cut at a word boundary.
+func fallbackTitle(message string) string {
+	words := strings.FieldsFunc(message, unicode.IsSpace)
+	if len(words) == 0 {
+		return defaultChatTitle
+	}
+
+	title := ""
+	for _, word := range words {
+		next := strings.TrimSpace(title + " " + word)
+		if len([]rune(next)) > maxChatTitleLength-3 {
+			break
+		}
+		title = next
+	}
+	if title == "" {
+		return truncateRunes(words[0], maxChatTitleLength-3) + "..."
+	}
+	if len([]rune(title)) < len([]rune(strings.Join(words, " "))) {
+		title += "..."
+	}
+	return title
+}
+
+func truncateRunes(value string, max int) string {
+	runes := []rune(value)
+	if len(runes) <= max {
+		return value
+	}
+	return string(runes[:max])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// tokenizerFamily approximates the tokenizer of a group of models. Exact
+// counts need the model's own vocabulary, these ratios are calibrated to
+// stay slightly above the real count for English text and code.
+type tokenizerFamily struct {
+	charsPerToken float64
+	// messageOverhead covers the role and separator tokens of a chat message
+	messageOverhead int
+}
+
+var tokenizerFamilies = map[string]tokenizerFamily{
+	"openai":     {charsPerToken: 3.8, messageOverhead: 4},
+	"anthropic":  {charsPerToken: 3.4, messageOverhead: 5},
+	"google":     {charsPerToken: 3.8, messageOverhead: 4},
+	"meta-llama": {charsPerToken: 3.6, messageOverhead: 5},
+	"mistralai":  {charsPerToken: 3.2, messageOverhead: 4},
+	"deepseek":   {charsPerToken: 3.4, messageOverhead: 4},
+	"qwen":       {charsPerToken: 3.4, messageOverhead: 4},
+}
+
+// defaultTokenizerFamily is used for models of unknown families and errs on
+// the side of counting too many tokens.
+var defaultTokenizerFamily = tokenizerFamily{charsPerToken: 3.2, messageOverhead: 5}
+
+// modelTokenizer picks the tokenizer family from the provider prefix of a
+// model ID such as "openai/gpt-4o".
+func modelTokenizer(model string) tokenizerFamily {
+	prefix, _, found := strings.Cut(model, "/")
+	if !found {
+		return defaultTokenizerFamily
+	}
+	if family, ok := tokenizerFamilies[prefix]; ok {
+		return family
+	}
+	return defaultTokenizerFamily
+}
+
+// countTokens estimates the tokens of a text for a model. Ideographic and
+// syllabic scripts are counted as one token per character, since tokenizers
+// rarely merge them.
+func (f tokenizerFamily) countTokens(text string) int {
+	var wide, other int
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hangul, unicode.Hiragana, unicode.Katakana, unicode.Thai) {
+			wide++
+		} else {
+			other++
+		}
+	}
+	return wide + int(math.Ceil(float64(other)/f.charsPerToken))
+}
+
+// imagePartTokens is charged per image, about what a detailed image costs
+// with the common vision models.
+const imagePartTokens = 1000
+
+// countMessageTokens estimates the tokens a message takes up in a prompt.
+func (f tokenizerFamily) countMessageTokens(message ProviderMessage) int {
+	if len(message.Parts) == 0 {
+		return f.messageOverhead + f.countTokens(message.Content)
+	}
+
+	tokens := f.messageOverhead
+	for _, part := range message.Parts {
+		if part.Type == "image_url" {
+			tokens += imagePartTokens
+		} else {
+			tokens += f.countTokens(part.Text)
+		}
+	}
+	return tokens
+}
+
+// countStoredMessageTokens estimates the tokens of a stored message before
+// its attachments are loaded.
+func (f tokenizerFamily) countStoredMessageTokens(message Message) int {
+	return f.messageOverhead + f.countTokens(message.Content) + imageCount(message)*imagePartTokens
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxToolRounds limits how often the model may call tools before it has
+	// to answer
+	maxToolRounds = 8
+	// maxToolResultRunes caps what a tool returns to the model
+	maxToolResultRunes = 20000
+	toolCallTimeout    = 60 * time.Second
+)
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ToolDefinition describes a tool to the model. Parameters is a JSON schema
+// of the arguments object.
+type ToolDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// Tool is a function the model can call during a completion.
+type Tool interface {
+	Definition() ToolDefinition
+	// Call runs the tool with arguments that match the schema. The returned
+	// text is given to the model, errors are reported to it as failures.
+	Call(ctx context.Context, tc *ToolContext, arguments json.RawMessage) (string, error)
+}
+
+// ToolContext is the completion a tool is called in.
+type ToolContext struct {
+	UserID string
+	ChatID int
+
+	citations []Citation
+}
+
+// Cite records a source on the assistant message and returns the number
+// the model should cite it with. A URL cited before keeps its number.
+func (tc *ToolContext) Cite(citation Citation) int {
+	if citation.URL != "" {
+		for _, existing := range tc.citations {
+			if existing.Source == citation.Source && existing.URL == citation.URL {
+				return existing.Index
+			}
+		}
+	}
+	citation.Index = len(tc.citations) + 1
+	tc.citations = append(tc.citations, citation)
+	return citation.Index
+}
+
+// ToolSource provides tools only some users can call, such as those of
+// servers a user connected.
+type ToolSource interface {
+	UserTools(ctx context.Context, userID string) []Tool
+}
+
+// ToolRegistry holds the tools chats can enable. Tools may be added at any
+// time, for example when an external server connects.
+type ToolRegistry struct {
+	mu      sync.RWMutex
+	tools   map[string]Tool
+	sources []ToolSource
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{tools: make(map[string]Tool)}
+}
+
+// Register adds a tool, replacing a tool of the same name.
+func (tr *ToolRegistry) Register(tool Tool) error {
+	name := tool.Definition().Name
+	if !toolNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid tool name %q", name)
+	}
+	tr.mu.Lock()
+	tr.tools[name] = tool
+	tr.mu.Unlock()
+	return nil
+}
+
+func (tr *ToolRegistry) Unregister(name string) {
+	tr.mu.Lock()
+	delete(tr.tools, name)
+	tr.mu.Unlock()
+}
+
+// AddSource adds tools that are looked up per user. Registered tools take
+// precedence over source tools of the same name.
+func (tr *ToolRegistry) AddSource(source ToolSource) {
+	tr.mu.Lock()
+	tr.sources = append(tr.sources, source)
+	tr.mu.Unlock()
+}
+
+// userTools returns every tool the user can call, keyed by name.
+func (tr *ToolRegistry) userTools(ctx context.Context, userID string) map[string]Tool {
+	tr.mu.RLock()
+	tools := make(map[string]Tool, len(tr.tools))
+	for name, tool := range tr.tools {
+		tools[name] = tool
+	}
+	sources := slices.Clone(tr.sources)
+	tr.mu.RUnlock()
+
+	for _, source := range sources {
+		for _, tool := range source.UserTools(ctx, userID) {
+			name := tool.Definition().Name
+			if _, exists := tools[name]; !exists && toolNamePattern.MatchString(name) {
+				tools[name] = tool
+			}
+		}
+	}
+	return tools
+}
+
+func (tr *ToolRegistry) Lookup(ctx context.Context, userID, name string) (Tool, bool) {
+	tr.mu.RLock()
+	tool, ok := tr.tools[name]
+	tr.mu.RUnlock()
+	if ok {
+		return tool, true
+	}
+	tool, ok = tr.userTools(ctx, userID)[name]
+	return tool, ok
+}
+
+// Definitions returns the definitions of the named tools the user can call,
+// in name order. Nil names return all of them.
+func (tr *ToolRegistry) Definitions(ctx context.Context, userID string, names []string) []ToolDefinition {
+	definitions := []ToolDefinition{}
+	for name, tool := range tr.userTools(ctx, userID) {
+		if names == nil || slices.Contains(names, name) {
+			definitions = append(definitions, tool.Definition())
+		}
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// List the tools chats can enable
+func (tr *ToolRegistry) GetTools(c *gin.Context) {
+	c.JSON(http.StatusOK, tr.Definitions(c.Request.Context(), currentUser(c).ID, nil))
+}
+
+// validateToolNames checks that every name belongs to a tool the user can
+// call.
+func (tr *ToolRegistry) validateToolNames(ctx context.Context, userID string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	tools := tr.userTools(ctx, userID)
+	for _, name := range names {
+		if _, ok := tools[name]; !ok {
+			return fmt.Errorf("unknown tool %s", name)
+		}
+	}
+	return nil
+}
+
+// providerTools converts definitions for a completion request.
+func providerTools(definitions []ToolDefinition) []ProviderTool {
+	tools := make([]ProviderTool, len(definitions))
+	for i, definition := range definitions {
+		tools[i] = ProviderTool{Type: "function", Function: definition}
+	}
+	return tools
+}
+
+// ToolCall is a tool call made while generating an assistant message,
+// stored with its result in the chat history.
+type ToolCall struct {
+	ID        int             `json:"id"`
+	MessageID int             `json:"messageId"`
+	CallID    string          `json:"callId"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+	Result    string          `json:"result"`
+	IsError   bool            `json:"isError"`
+	// Round counts the model requests before the call, starting at 0
+	Round      int       `json:"round"`
+	DurationMs int       `json:"durationMs"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// toolCallColumns lists the tool_calls columns scanned by scanToolCall.
+const toolCallColumns = "id, message_id, call_id, name, arguments, result, is_error, round, duration_ms, created_at"
+
+func scanToolCall(row rowScanner) (*ToolCall, error) {
+	var call ToolCall
+	var arguments string
+	err := row.Scan(
+		&call.ID, &call.MessageID, &call.CallID, &call.Name, &arguments, &call.Result, &call.IsError,
+		&call.Round, &call.DurationMs, &call.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	call.Arguments = json.RawMessage(arguments)
+	return &call, nil
+}
+
+// runToolCall executes one call requested by the model. Failures, including
+// unknown tools and invalid arguments, become error results the model can
+// react to.
+func (tr *ToolRegistry) runToolCall(ctx context.Context, tc *ToolContext, enabled []string, request ProviderToolCall) ToolCall {
+	call := ToolCall{CallID: request.ID, Name: request.Function.Name, CreatedAt: time.Now()}
+
+	arguments := json.RawMessage(request.Function.Arguments)
+	if strings.TrimSpace(request.Function.Arguments) == "" {
+		arguments = json.RawMessage("{}")
+	}
+	// Invalid JSON is stored as a string so the record stays valid JSON
+	if json.Valid(arguments) {
+		call.Arguments = arguments
+	} else {
+		call.Arguments, _ = json.Marshal(request.Function.Arguments)
+	}
+
+	result, err := func() (string, error) {
+		tool, ok := tr.Lookup(ctx, tc.UserID, request.Function.Name)
+		if !ok || !slices.Contains(enabled, request.Function.Name) {
+			return "", fmt.Errorf("tool %s is not available", request.Function.Name)
+		}
+		if !json.Valid(arguments) {
+			return "", errors.New("arguments are not valid JSON")
+		}
+		if err := validateToolArguments(tool.Definition().Parameters, arguments); err != nil {
+			return "", err
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, toolCallTimeout)
+		defer cancel()
+		return tool.Call(ctx, tc, arguments)
+	}()
+
+	call.DurationMs = int(time.Since(call.CreatedAt).Milliseconds())
+	if err != nil {
+		call.IsError = true
+		result = "Error: " + err.Error()
+	}
+	call.Result = truncateRunes(result, maxToolResultRunes)
+	return call
+}
+
+// validateToolArguments checks arguments against the parts of JSON schema
+// tools use: types, required properties, enums and array items.
+func validateToolArguments(schema, arguments json.RawMessage) error {
+	var schemaValue, value interface{}
+	if err := json.Unmarshal(schema, &schemaValue); err != nil {
+		return fmt.Errorf("tool has an invalid schema: %w", err)
+	}
+	if err := json.Unmarshal(arguments, &value); err != nil {
+		return err
+	}
+	return validateSchemaValue(schemaValue, value, "arguments")
+}
+
+func validateSchemaValue(schema, value interface{}, path string) error {
+	rules, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if enum, ok := rules["enum"].([]interface{}); ok {
+		encoded, _ := json.Marshal(value)
+		found := false
+		for _, option := range enum {
+			if optionEncoded, _ := json.Marshal(option); string(optionEncoded) == string(encoded) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", path, enum)
+		}
+	}
+
+	switch rules["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		if required, ok := rules["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := object[key]; !present {
+						return fmt.Errorf("%s.%s is required", path, key)
+					}
+				}
+			}
+		}
+		properties, _ := rules["properties"].(map[string]interface{})
+		for key, property := range object {
+			if propertySchema, ok := properties[key]; ok {
+				if err := validateSchemaValue(propertySchema, property, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		for i, item := range array {
+			if err := validateSchemaValue(rules["items"], item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	}
+	return nil
+}
+
+// insertToolCall stores a finished tool call of an assistant message.
+func insertToolCall(db *sql.DB, messageID int, call *ToolCall) error {
+	result, err := db.Exec(`
+		INSERT INTO tool_calls (message_id, call_id, name, arguments, result, is_error, round, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, messageID, call.CallID, call.Name, string(call.Arguments), call.Result, call.IsError, call.Round, call.DurationMs, call.CreatedAt)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	call.ID = int(id)
+	call.MessageID = messageID
+	return nil
+}
+
+// queryChatToolCalls loads the tool calls of a chat's messages, keyed by
+// message ID.
+func queryChatToolCalls(db *sql.DB, chatID int) (map[int][]ToolCall, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.message_id, t.call_id, t.name, t.arguments, t.result, t.is_error, t.round, t.duration_ms, t.created_at
+		FROM tool_calls t JOIN messages m ON t.message_id = m.id
+		WHERE m.chat_id = ?
+		ORDER BY t.id ASC
+	`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calls := map[int][]ToolCall{}
+	for rows.Next() {
+		call, err := scanToolCall(rows)
+		if err != nil {
+			return nil, err
+		}
+		calls[call.MessageID] = append(calls[call.MessageID], *call)
+	}
+	return calls, rows.Err()
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	totpPeriod           = 30
+	totpDigits           = 6
+	totpSkew             = 1 // accepted steps before and after the current one
+	recoveryCodeCount    = 10
+	maxSecondFactorTries = 5
+	// Every failure past maxSecondFactorTries doubles the lockout
+	secondFactorLockout    = time.Minute
+	maxSecondFactorLockout = time.Hour
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errNoTOTPSecret = errors.New("no totp secret")
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// Start 2FA enrollment by generating a new secret for the current user
+func (a *AuthService) EnrollTwoFactor(c *gin.Context) {
+	user := currentUser(c)
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	if err := a.storeTOTPSecret(user.ID, secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUri": totpURI(secret, user.Email),
+	})
+}
+
+// Confirm enrollment with a code from the authenticator app
+func (a *AuthService) EnableTwoFactor(c *gin.Context) {
+	user := currentUser(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	ok, err := a.verifyTOTP(user.ID, req.Code)
+	if errors.Is(err, errNoTOTPSecret) || err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor enrollment has not been started"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// 2FA is only enabled together with its recovery codes
+	tx, err := a.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = TRUE WHERE id = ?", user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	codes, err := insertRecoveryCodes(tx, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// Disable 2FA after checking a current code or recovery code
+func (a *AuthService) DisableTwoFactor(c *gin.Context) {
+	user := currentUser(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ok, retryAfter, err := a.checkSecondFactor(user.ID, req.Code, a.verifySecondFactor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if retryAfter > 0 {
+		secondFactorLocked(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_ciphertext = NULL, totp_nonce = NULL,
+			totp_wrapped_key = NULL, totp_key_nonce = NULL, totp_master_key_id = NULL, totp_last_step = 0
+		WHERE id = ?
+	`, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete recovery codes"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// Replace all recovery codes, invalidating the previous set
+func (a *AuthService) RegenerateRecoveryCodes(c *gin.Context) {
+	user := currentUser(c)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ok, retryAfter, err := a.checkSecondFactor(user.ID, req.Code, a.verifyTOTP)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if retryAfter > 0 {
+		secondFactorLocked(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := a.replaceRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// Exchange a pending session and a valid code for a full session
+func (a *AuthService) VerifyTwoFactor(c *gin.Context) {
+	frontendURL := os.Getenv("FRONTEND_URL")
+
+	sessionID, err := c.Cookie("session_id")
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+		return
+	}
+
+	pending, err := a.getPendingSession(sessionID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "No pending two-factor session"})
+		return
+	}
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+		return
+	}
+
+	// Failures count against the user, so new logins don't reset them
+	ok, retryAfter, err := a.checkSecondFactor(pending.UserID, req.Code, a.verifySecondFactor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if retryAfter > 0 {
+		secondFactorLocked(c, retryAfter)
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// Rotate the session ID so the restricted one can't be reused
+	session, err := a.createSession(pending.UserID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	if _, err := a.db.Exec("DELETE FROM sessions WHERE id = ?", sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+		return
+	}
+
+	c.SetCookie("session_id", session.ID, int(sessionDuration/time.Second), "/", frontendURL, false, true)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// checkSecondFactor runs verify unless the user is locked out after too
+// many failed codes, in which case the seconds until the next try are
+// returned. A valid code clears the failures.
+func (a *AuthService) checkSecondFactor(userID, code string, verify func(userID, code string) (bool, error)) (bool, int64, error) {
+	var retryAfter int64
+	err := a.db.QueryRow(
+		"SELECT GREATEST(COALESCE(TIMESTAMPDIFF(SECOND, NOW(), second_factor_locked_until), 0), 0) FROM users WHERE id = ?",
+		userID,
+	).Scan(&retryAfter)
+	if err != nil {
+		return false, 0, err
+	}
+	if retryAfter > 0 {
+		return false, retryAfter, nil
+	}
+
+	ok, err := verify(userID, code)
+	if err != nil {
+		return false, 0, err
+	}
+	if !ok {
+		return false, 0, a.recordSecondFactorFailure(userID)
+	}
+
+	_, err = a.db.Exec("UPDATE users SET second_factor_failures = 0, second_factor_locked_until = NULL WHERE id = ?", userID)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, 0, nil
+}
+
+// recordSecondFactorFailure counts a failed code and locks the user out
+// once maxSecondFactorTries is reached.
+func (a *AuthService) recordSecondFactorFailure(userID string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	if err := tx.QueryRow("SELECT second_factor_failures FROM users WHERE id = ? FOR UPDATE", userID).Scan(&failures); err != nil {
+		return err
+	}
+	failures++
+
+	if failures < maxSecondFactorTries {
+		_, err = tx.Exec("UPDATE users SET second_factor_failures = ? WHERE id = ?", failures, userID)
+	} else {
+		lockout := min(secondFactorLockout<<min(failures-maxSecondFactorTries, 10), maxSecondFactorLockout)
+		_, err = tx.Exec(
+			"UPDATE users SET second_factor_failures = ?, second_factor_locked_until = DATE_ADD(NOW(), INTERVAL ? SECOND) WHERE id = ?",
+			failures, int64(lockout/time.Second), userID,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func secondFactorLocked(c *gin.Context, retryAfter int64) {
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid codes, try again later", "retryAfter": retryAfter})
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func (a *AuthService) verifySecondFactor(userID, code string) (bool, error) {
+	ok, err := a.verifyTOTP(userID, code)
+	if err != nil || ok {
+		return ok, err
+	}
+	return a.useRecoveryCode(userID, code)
+}
+
+// verifyTOTP checks a code against the user's secret and remembers the
+// accepted time step so the same code can't be replayed.
+func (a *AuthService) verifyTOTP(userID, code string) (bool, error) {
+	secret, lastStep, err := a.loadTOTPSecret(userID)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := acceptTOTP(secret, strings.TrimSpace(code), lastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	// Only one request can claim the step
+	result, err := a.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// storeTOTPSecret saves a new secret, sealed when a master key is
+// configured. Without one it's kept in totp_secret, which rewrapSecrets
+// seals once a key is added.
+func (a *AuthService) storeTOTPSecret(userID, secret string) error {
+	if !a.box.Enabled() {
+		_, err := a.db.Exec(`
+			UPDATE users SET totp_secret = ?, totp_ciphertext = NULL, totp_nonce = NULL, totp_wrapped_key = NULL,
+				totp_key_nonce = NULL, totp_master_key_id = NULL, totp_last_step = 0
+			WHERE id = ?
+		`, secret, userID)
+		return err
+	}
+
+	sealed, err := a.box.Seal([]byte(secret))
+	if err != nil {
+		return err
+	}
+	args := append(sealedColumns(sealed), userID)
+	_, err = a.db.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_ciphertext = ?, totp_nonce = ?, totp_wrapped_key = ?,
+			totp_key_nonce = ?, totp_master_key_id = ?, totp_last_step = 0
+		WHERE id = ?
+	`, args...)
+	return err
+}
+
+// loadTOTPSecret returns the user's secret and the last accepted time step.
+func (a *AuthService) loadTOTPSecret(userID string) (string, int64, error) {
+	var plaintext sql.NullString
+	var sealed SealedSecret
+	var masterKeyID sql.NullString
+	var lastStep int64
+	err := a.db.QueryRow(`
+		SELECT totp_secret, totp_ciphertext, totp_nonce, totp_wrapped_key, totp_key_nonce, totp_master_key_id, totp_last_step
+		FROM users WHERE id = ?
+	`, userID).Scan(&plaintext, &sealed.Ciphertext, &sealed.Nonce, &sealed.WrappedKey, &sealed.KeyNonce, &masterKeyID, &lastStep)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch {
+	case masterKeyID.Valid:
+		sealed.MasterKeyID = masterKeyID.String
+		secret, err := a.box.Open(&sealed)
+		if err != nil {
+			return "", 0, fmt.Errorf("open totp secret of user %s: %w", userID, err)
+		}
+		return string(secret), lastStep, nil
+	case plaintext.Valid:
+		return plaintext.String, lastStep, nil
+	}
+	return "", 0, fmt.Errorf("user %s: %w", userID, errNoTOTPSecret)
+}
+
+func (a *AuthService) useRecoveryCode(userID, code string) (bool, error) {
+	result, err := a.db.Exec(
+		"UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// replaceRecoveryCodes stores a fresh set of hashed recovery codes and
+// returns the plaintext codes, which are never shown again.
+func (a *AuthService) replaceRecoveryCodes(userID string) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := insertRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// insertRecoveryCodes replaces the user's recovery codes within tx.
+func insertRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+func totpURI(secret, email string) string {
+	issuer := getEnv("TOTP_ISSUER", "SafasChat")
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the RFC 6238 code for a time step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP returns the matching time step if the code is valid within
+// the allowed clock skew.
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// acceptTOTP validates a code like validateTOTP and rejects steps up to
+// lastStep, the step of the last accepted code.
+func acceptTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	step, ok := validateTOTP(secret, code, now)
+	if !ok || step <= lastStep {
+		return 0, false
+	}
+	return step, true
+}
+
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(buf))
+	return code[:8] + "-" + code[8:], nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238 Appendix B, "12345678901234567890".
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// The appendix lists 8 digit codes, the last 6 digits are the 6 digit code
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	key := []byte("12345678901234567890")
+	for _, tt := range tests {
+		want := tt.code[len(tt.code)-totpDigits:]
+		if got := totpCode(key, tt.unix/totpPeriod); got != want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+
+		step, ok := validateTOTP(rfc6238Secret, want, time.Unix(tt.unix, 0))
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("validateTOTP at %d = %d, %v, want step %d", tt.unix, step, ok, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code := totpCode(key, current+offset)
+		step, ok := validateTOTP(rfc6238Secret, code, now)
+		wantOK := offset >= -totpSkew && offset <= totpSkew
+		if ok != wantOK {
+			t.Errorf("code of step offset %d accepted = %v, want %v", offset, ok, wantOK)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code of step offset %d matched step %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := validateTOTP(rfc6238Secret, code, now); ok {
+			t.Errorf("validateTOTP accepted malformed code %q", code)
+		}
+	}
+	if _, ok := validateTOTP("not base32!", totpCode(key, current), now); ok {
+		t.Error("validateTOTP accepted a code for an undecodable secret")
+	}
+}
+
+func TestAcceptTOTPRejectsReplay(t *testing.T) {
+	key := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	code := totpCode(key, current)
+
+	step, ok := acceptTOTP(rfc6238Secret, code, 0, now)
+	if !ok || step != current {
+		t.Fatalf("first use = %d, %v, want step %d", step, ok, current)
+	}
+
+	// The stored step blocks the same code for the rest of its window
+	for _, later := range []time.Time{now, now.Add(totpPeriod * time.Second)} {
+		if _, ok := acceptTOTP(rfc6238Secret, code, step, later); ok {
+			t.Errorf("replayed code accepted at %v", later)
+		}
+	}
+
+	// So are older codes still inside the skew window
+	if _, ok := acceptTOTP(rfc6238Secret, totpCode(key, current-1), step, now); ok {
+		t.Error("code of an earlier step accepted after a later one")
+	}
+
+	// The next step's code is still accepted
+	if next, ok := acceptTOTP(rfc6238Secret, totpCode(key, current+1), step, now); !ok || next != current+1 {
+		t.Errorf("next step's code = %d, %v, want step %d", next, ok, current+1)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	usageDateLayout   = "2006-01-02"
+	defaultUsageRange = 30 * 24 * time.Hour
+	maxUsageRange     = 366 * 24 * time.Hour
+)
+
+var errInvalidUsageRange = errors.New("invalid usage date range")
+
+type UsageService struct {
+	db *sql.DB
+}
+
+// UsageRow is the usage of one group: a day, a model, a chat or a user.
+type UsageRow struct {
+	Key              string  `json:"key"`
+	Label            string  `json:"label,omitempty"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int64   `json:"promptTokens"`
+	CompletionTokens int64   `json:"completionTokens"`
+	ReasoningTokens  int64   `json:"reasoningTokens"`
+	Cost             float64 `json:"cost"`
+}
+
+type UsageReport struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	GroupBy string     `json:"groupBy"`
+	Totals  UsageRow   `json:"totals"`
+	Rows    []UsageRow `json:"rows"`
+}
+
+// usageGroup describes how a groupBy value maps onto SQL.
+type usageGroup struct {
+	key   string
+	label string
+	join  string
+	order string
+}
+
+var usageGroups = map[string]usageGroup{
+	"day": {
+		key:   "DATE_FORMAT(m.created_at, '%Y-%m-%d')",
+		label: "''",
+		order: "1 ASC",
+	},
+	"model": {
+		key:   "m.model",
+		label: "''",
+		order: "SUM(COALESCE(m.cost, 0)) DESC, 1 ASC",
+	},
+	"chat": {
+		key:   "CAST(m.chat_id AS CHAR)",
+		label: "COALESCE(MAX(ch.title), '')",
+		join:  "LEFT JOIN chats ch ON ch.id = m.chat_id",
+		order: "SUM(COALESCE(m.cost, 0)) DESC, 1 ASC",
+	},
+	"user": {
+		key:   "COALESCE(m.user_id, '')",
+		label: "COALESCE(MAX(u.email), '')",
+		join:  "LEFT JOIN users u ON u.id = m.user_id",
+		order: "SUM(COALESCE(m.cost, 0)) DESC, 1 ASC",
+	},
+}
+
+func NewUsageService(db *sql.DB) *UsageService {
+	return &UsageService{db: db}
+}
+
+// Get token usage and cost for the current user
+func (us *UsageService) GetUsage(c *gin.Context) {
+	if c.Query("groupBy") == "user" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid groupBy"})
+		return
+	}
+	us.respondWithUsage(c, currentUser(c).ID)
+}
+
+// Get token usage and cost across all users, optionally for a single user
+func (us *UsageService) GetAllUsage(c *gin.Context) {
+	us.respondWithUsage(c, c.Query("userId"))
+}
+
+// respondWithUsage parses the from, to and groupBy query parameters and
+// writes the aggregated report. An empty userID covers every user.
+func (us *UsageService) respondWithUsage(c *gin.Context, userID string) {
+	groupBy := c.DefaultQuery("groupBy", "day")
+	group, ok := usageGroups[groupBy]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid groupBy"})
+		return
+	}
+
+	from, to, err := parseUsageRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range, use YYYY-MM-DD and at most one year"})
+		return
+	}
+
+	report, err := us.queryUsage(group, userID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+	report.From = from.Format(usageDateLayout)
+	report.To = to.Format(usageDateLayout)
+	report.GroupBy = groupBy
+
+	c.JSON(http.StatusOK, report)
+}
+
+// queryUsage aggregates assistant messages with recorded usage between from
+// and to, both inclusive days.
+func (us *UsageService) queryUsage(group usageGroup, userID string, from, to time.Time) (*UsageReport, error) {
+	conditions := []string{"m.role = 'assistant'", "m.model IS NOT NULL", "m.created_at >= ?", "m.created_at < ?"}
+	args := []interface{}{from, to.AddDate(0, 0, 1)}
+	if userID != "" {
+		conditions = append(conditions, "m.user_id = ?")
+		args = append(args, userID)
+	}
+
+	query := `
+		SELECT ` + group.key + `, ` + group.label + `, COUNT(*),
+		COALESCE(SUM(m.prompt_tokens), 0), COALESCE(SUM(m.completion_tokens), 0),
+		COALESCE(SUM(m.reasoning_tokens), 0), COALESCE(SUM(m.cost), 0)
+		FROM messages m ` + group.join + `
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		GROUP BY 1
+		ORDER BY ` + group.order
+
+	rows, err := us.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &UsageReport{Rows: []UsageRow{}}
+	for rows.Next() {
+		var row UsageRow
+		if err := rows.Scan(&row.Key, &row.Label, &row.Requests, &row.PromptTokens, &row.CompletionTokens, &row.ReasoningTokens, &row.Cost); err != nil {
+			return nil, err
+		}
+
+		report.Totals.Requests += row.Requests
+		report.Totals.PromptTokens += row.PromptTokens
+		report.Totals.CompletionTokens += row.CompletionTokens
+		report.Totals.ReasoningTokens += row.ReasoningTokens
+		report.Totals.Cost += row.Cost
+		report.Rows = append(report.Rows, row)
+	}
+	return report, rows.Err()
+}
+
+// parseUsageRange reads a YYYY-MM-DD range, defaulting to the last 30 days.
+func parseUsageRange(fromParam, toParam string) (time.Time, time.Time, error) {
+	year, month, day := time.Now().Date()
+	to := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+	if toParam != "" {
+		parsed, err := time.ParseInLocation(usageDateLayout, toParam, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, errInvalidUsageRange
+		}
+		to = parsed
+	}
+
+	from := to.Add(-defaultUsageRange)
+	if fromParam != "" {
+		parsed, err := time.ParseInLocation(usageDateLayout, fromParam, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, errInvalidUsageRange
+		}
+		from = parsed
+	}
+
+	if from.After(to) || to.Sub(from) > maxUsageRange {
+		return time.Time{}, time.Time{}, errInvalidUsageRange
+	}
+	return from, to, nil
+}
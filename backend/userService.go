@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDisplayNameLength = 100
+	maxPreferencesSize   = 8 * 1024
+	maxAvatarUploadSize  = 5 << 20 // 5 MB
+	avatarSize           = 256
+)
+
+var avatarFilePattern = regexp.MustCompile(`^[a-f0-9-]+\.png$`)
+
+type UserService struct {
+	db        *sql.DB
+	jobs      *JobQueue
+	store     BlobStore
+	avatarDir string
+	exportDir string
+
+	deletionGracePeriod time.Duration
+}
+
+type UpdateProfileRequest struct {
+	DisplayName   *string          `json:"displayName,omitempty"`
+	Preferences   *json.RawMessage `json:"preferences,omitempty"`
+	CustomProfile *bool            `json:"customProfile,omitempty"`
+}
+
+func NewUserService(db *sql.DB, jobs *JobQueue, store BlobStore) *UserService {
+	return &UserService{
+		db:                  db,
+		jobs:                jobs,
+		store:               store,
+		avatarDir:           getEnv("AVATAR_DIR", "uploads/avatars"),
+		exportDir:           getEnv("EXPORT_DIR", "uploads/exports"),
+		deletionGracePeriod: deletionGracePeriod(),
+	}
+}
+
+// Get the authenticated user's profile
+func (us *UserService) GetProfile(c *gin.Context) {
+	c.JSON(http.StatusOK, currentUser(c))
+}
+
+// Update the authenticated user's display name and preferences
+func (us *UserService) UpdateProfile(c *gin.Context) {
+	user := currentUser(c)
+
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Build dynamic update query
+	updateFields := []string{}
+	args := []interface{}{}
+	customProfile := req.CustomProfile
+
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if displayName == "" || len([]rune(displayName)) > maxDisplayNameLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Display name must be between 1 and 100 characters"})
+			return
+		}
+		updateFields = append(updateFields, "display_name = ?")
+		args = append(args, displayName)
+
+		// A manual change marks the profile as customized unless stated otherwise
+		if customProfile == nil {
+			custom := true
+			customProfile = &custom
+		}
+	}
+	if req.Preferences != nil {
+		if len(*req.Preferences) > maxPreferencesSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Preferences are too large"})
+			return
+		}
+		var preferences map[string]interface{}
+		if err := json.Unmarshal(*req.Preferences, &preferences); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Preferences must be a JSON object"})
+			return
+		}
+		updateFields = append(updateFields, "preferences = ?")
+		args = append(args, string(*req.Preferences))
+	}
+	if customProfile != nil {
+		updateFields = append(updateFields, "custom_profile = ?")
+		args = append(args, *customProfile)
+
+		// Resuming Google sync restores the Google values right away
+		if !*customProfile {
+			updateFields = append(updateFields, "display_name = name", "avatar = image")
+		}
+	}
+
+	if len(updateFields) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	args = append(args, user.ID)
+	query := `UPDATE users SET ` + strings.Join(updateFields, ", ") + ` WHERE id = ?`
+	if _, err := us.db.Exec(query, args...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+
+	updated, err := scanUser(us.db.QueryRow(`SELECT `+userColumns+` FROM users u WHERE u.id = ?`, user.ID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profile"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// Upload a new avatar, stored as a square PNG
+func (us *UserService) UploadAvatar(c *gin.Context) {
+	user := currentUser(c)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarUploadSize+1024)
+	file, header, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar file is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxAvatarUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar must be 5 MB or smaller"})
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarUploadSize+1))
+	if err != nil || len(data) > maxAvatarUploadSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar must be 5 MB or smaller"})
+		return
+	}
+
+	img, _, err := decodeImage(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a PNG, JPEG or GIF image"})
+		return
+	}
+
+	encoded, err := encodePNG(fitWithin(cropSquare(img), avatarSize, avatarSize))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process avatar"})
+		return
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+	filename := user.ID + "-" + hex.EncodeToString(suffix) + ".png"
+
+	if err := os.MkdirAll(us.avatarDir, 0o755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+	if err := os.WriteFile(filepath.Join(us.avatarDir, filename), encoded, 0o644); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store avatar"})
+		return
+	}
+
+	avatarURL := os.Getenv("BACKEND_URL") + "/api/avatars/" + filename
+	if _, err := us.db.Exec("UPDATE users SET avatar = ?, custom_profile = TRUE WHERE id = ?", avatarURL, user.ID); err != nil {
+		os.Remove(filepath.Join(us.avatarDir, filename))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update avatar"})
+		return
+	}
+
+	// Remove the previously uploaded avatar, if any
+	us.removeAvatarFile(user.Avatar)
+
+	c.JSON(http.StatusOK, gin.H{"avatar": avatarURL})
+}
+
+// Serve an uploaded avatar
+func (us *UserService) GetAvatar(c *gin.Context) {
+	filename := c.Param("file")
+	if !avatarFilePattern.MatchString(filename) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+		return
+	}
+
+	path := filepath.Join(us.avatarDir, filename)
+	if _, err := os.Stat(path); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.File(path)
+}
+
+// removeAvatarFile deletes a locally stored avatar referenced by url.
+func (us *UserService) removeAvatarFile(url *string) {
+	if url == nil {
+		return
+	}
+	prefix := os.Getenv("BACKEND_URL") + "/api/avatars/"
+	if !strings.HasPrefix(*url, prefix) {
+		return
+	}
+	filename := strings.TrimPrefix(*url, prefix)
+	if avatarFilePattern.MatchString(filename) {
+		os.Remove(filepath.Join(us.avatarDir, filename))
+	}
+}
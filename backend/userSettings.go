@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// settingsSchemaVersion is bumped whenever a stored setting changes meaning.
+// Adding a key doesn't need a bump, missing keys fall back to their default.
+const settingsSchemaVersion = 1
+
+const (
+	SettingDefaultModel        = "defaultModel"
+	SettingReasoningEffort     = "reasoningEffort"
+	SettingTheme               = "theme"
+	SettingLanguage            = "language"
+	SettingDefaultSystemPrompt = "defaultSystemPrompt"
+	SettingSendOnEnter         = "sendOnEnter"
+	SettingContextStrategy     = "contextStrategy"
+	SettingMemoryEnabled       = "memoryEnabled"
+	SettingMemoryExtraction    = "memoryExtraction"
+)
+
+var languageTagPattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// settingDefinition describes the type and allowed values of a setting.
+type settingDefinition struct {
+	kind      string // "string", "enum" or "bool"
+	options   []string
+	maxLength int
+	pattern   *regexp.Regexp
+	// nullable settings default to null, meaning "not chosen"
+	defaultValue interface{}
+}
+
+var settingsSchema = map[string]settingDefinition{
+	SettingDefaultModel:        {kind: "string", maxLength: 255},
+	SettingReasoningEffort:     {kind: "enum", options: reasoningEfforts, defaultValue: "medium"},
+	SettingTheme:               {kind: "enum", options: []string{"system", "light", "dark"}, defaultValue: "system"},
+	SettingLanguage:            {kind: "string", maxLength: 35, pattern: languageTagPattern, defaultValue: "en"},
+	SettingDefaultSystemPrompt: {kind: "string", maxLength: 8000},
+	SettingSendOnEnter:         {kind: "bool", defaultValue: true},
+	SettingContextStrategy:     {kind: "enum", options: contextStrategies, defaultValue: ContextKeepPinned},
+	SettingMemoryEnabled:       {kind: "bool", defaultValue: true},
+	SettingMemoryExtraction:    {kind: "bool", defaultValue: false},
+}
+
+// settingsMigrations upgrade stored settings from the version they are keyed
+// by to the next one.
+var settingsMigrations = map[int]func(map[string]interface{}){}
+
+// UserSettings are the stored settings of a user merged with the defaults.
+type UserSettings struct {
+	Settings      map[string]interface{} `json:"settings"`
+	SchemaVersion int                    `json:"schemaVersion"`
+	// Version increases with every update, send it as If-Match to avoid
+	// overwriting changes made on another device
+	Version   int        `json:"version"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+type SettingsService struct {
+	db     *sql.DB
+	models *ModelCatalog
+	policy *ModelPolicyService
+}
+
+func NewSettingsService(db *sql.DB, models *ModelCatalog, policy *ModelPolicyService) *SettingsService {
+	return &SettingsService{db: db, models: models, policy: policy}
+}
+
+// Get the current user's settings
+func (ss *SettingsService) GetSettings(c *gin.Context) {
+	settings, err := loadUserSettings(ss.db, currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Update some of the current user's settings, null resets a setting to its default
+func (ss *SettingsService) UpdateSettings(c *gin.Context) {
+	user := currentUser(c)
+
+	var changes map[string]interface{}
+	if err := c.ShouldBindJSON(&changes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must be a JSON object"})
+		return
+	}
+	if len(changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	for key, value := range changes {
+		if value == nil {
+			if _, ok := settingsSchema[key]; !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown setting %s", key)})
+				return
+			}
+			continue
+		}
+		normalized, err := validateSetting(key, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		changes[key] = normalized
+	}
+
+	if model, ok := changes[SettingDefaultModel].(string); ok {
+		if !ss.models.IsKnown(model) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model"})
+			return
+		}
+		if !ss.policy.authorizeModel(c, model, nil) {
+			return
+		}
+	}
+
+	expectedVersion := -1
+	if ifMatch := strings.Trim(c.GetHeader("If-Match"), `"`); ifMatch != "" {
+		version, err := strconv.Atoi(ifMatch)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+			return
+		}
+		expectedVersion = version
+	}
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+	defer tx.Rollback()
+
+	stored, version, err := readStoredSettings(tx.QueryRow(
+		"SELECT settings, schema_version, version FROM user_settings WHERE user_id = ? FOR UPDATE", user.ID,
+	))
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+	if expectedVersion >= 0 && expectedVersion != version {
+		c.JSON(http.StatusConflict, gin.H{"error": "Settings were changed elsewhere, reload and try again", "version": version})
+		return
+	}
+
+	for key, value := range changes {
+		if value == nil {
+			delete(stored, key)
+		} else {
+			stored[key] = value
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		INSERT INTO user_settings (user_id, settings, schema_version, version, updated_at)
+		VALUES (?, ?, ?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+		settings = VALUES(settings), schema_version = VALUES(schema_version), version = version + 1, updated_at = VALUES(updated_at)
+	`, user.ID, string(data), settingsSchemaVersion, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, UserSettings{
+		Settings:      withSettingDefaults(stored),
+		SchemaVersion: settingsSchemaVersion,
+		Version:       version + 1,
+		UpdatedAt:     &now,
+	})
+}
+
+// loadUserSettings returns a user's settings with defaults filled in. Users
+// who never saved anything get version 0.
+func loadUserSettings(db *sql.DB, userID string) (*UserSettings, error) {
+	settings := &UserSettings{SchemaVersion: settingsSchemaVersion}
+
+	var updatedAt time.Time
+	var data []byte
+	var schemaVersion int
+	err := db.QueryRow(
+		"SELECT settings, schema_version, version, updated_at FROM user_settings WHERE user_id = ?", userID,
+	).Scan(&data, &schemaVersion, &settings.Version, &updatedAt)
+
+	stored := map[string]interface{}{}
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		migrateSettings(stored, schemaVersion)
+		settings.UpdatedAt = &updatedAt
+	}
+
+	settings.Settings = withSettingDefaults(stored)
+	return settings, nil
+}
+
+// String returns a string setting, or "" when it is unset.
+func (s *UserSettings) String(key string) string {
+	value, _ := s.Settings[key].(string)
+	return value
+}
+
+// Bool returns a boolean setting, or false when it is unset.
+func (s *UserSettings) Bool(key string) bool {
+	value, _ := s.Settings[key].(bool)
+	return value
+}
+
+// readStoredSettings scans the stored settings, upgraded to the current
+// schema, and their version. A missing row yields empty settings.
+func readStoredSettings(row *sql.Row) (map[string]interface{}, int, error) {
+	stored := map[string]interface{}{}
+	var data []byte
+	var schemaVersion, version int
+	if err := row.Scan(&data, &schemaVersion, &version); err != nil {
+		return stored, 0, err
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return map[string]interface{}{}, version, err
+	}
+	migrateSettings(stored, schemaVersion)
+	return stored, version, nil
+}
+
+func migrateSettings(stored map[string]interface{}, fromVersion int) {
+	for version := fromVersion; version < settingsSchemaVersion; version++ {
+		if migrate, ok := settingsMigrations[version]; ok {
+			migrate(stored)
+		}
+	}
+}
+
+// withSettingDefaults returns every known setting, taking stored values over
+// defaults and dropping keys that are no longer part of the schema.
+func withSettingDefaults(stored map[string]interface{}) map[string]interface{} {
+	settings := make(map[string]interface{}, len(settingsSchema))
+	for key, definition := range settingsSchema {
+		if value, ok := stored[key]; ok {
+			settings[key] = value
+		} else {
+			settings[key] = definition.defaultValue
+		}
+	}
+	return settings
+}
+
+// validateSetting checks a value against the schema and returns it normalized.
+func validateSetting(key string, value interface{}) (interface{}, error) {
+	definition, ok := settingsSchema[key]
+	if !ok {
+		return nil, fmt.Errorf("Unknown setting %s", key)
+	}
+
+	switch definition.kind {
+	case "bool":
+		boolValue, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a boolean", key)
+		}
+		return boolValue, nil
+	case "enum":
+		stringValue, ok := value.(string)
+		if !ok || !slices.Contains(definition.options, stringValue) {
+			return nil, fmt.Errorf("%s must be one of %s", key, strings.Join(definition.options, ", "))
+		}
+		return stringValue, nil
+	default:
+		stringValue, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", key)
+		}
+		stringValue = strings.TrimSpace(stringValue)
+		if definition.maxLength > 0 && len([]rune(stringValue)) > definition.maxLength {
+			return nil, fmt.Errorf("%s must be at most %d characters", key, definition.maxLength)
+		}
+		if definition.pattern != nil && !definition.pattern.MatchString(stringValue) {
+			return nil, fmt.Errorf("%s has an invalid format", key)
+		}
+		return stringValue, nil
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+)
+
+// VectorMatch is a chunk found by a vector search, with its cosine
+// similarity to the query.
+type VectorMatch struct {
+	ChunkID int64
+	Score   float64
+}
+
+// VectorIndex finds the chunks of a knowledge base closest to a query
+// vector. The knowledge_chunks table stays the source of truth, indexes only
+// speed up the search.
+type VectorIndex interface {
+	Search(ctx context.Context, knowledgeBaseID int, query []float32, k int) ([]VectorMatch, error)
+	// Forget drops whatever is cached for a knowledge base
+	Forget(knowledgeBaseID int)
+}
+
+// NewVectorIndex picks the index from VECTOR_INDEX: "memory" searches
+// vectors cached in the process, "mariadb" lets MariaDB 11.7 or newer
+// compute the distances.
+func NewVectorIndex(db *sql.DB) VectorIndex {
+	switch backend := getEnv("VECTOR_INDEX", "memory"); backend {
+	case "memory":
+		return &MemoryVectorIndex{db: db, bases: make(map[int]*indexedKnowledgeBase)}
+	case "mariadb":
+		return &MariaDBVectorIndex{db: db}
+	default:
+		log.Fatalf("Unknown VECTOR_INDEX %q", backend)
+		return nil
+	}
+}
+
+// MemoryVectorIndex compares the query with every chunk of a knowledge base.
+// Vectors are loaded on first search and reloaded when the version of the
+// knowledge base changes, so several backend instances stay consistent.
+type MemoryVectorIndex struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	bases map[int]*indexedKnowledgeBase
+}
+
+type indexedKnowledgeBase struct {
+	version  int
+	chunkIDs []int64
+	vectors  [][]float32
+}
+
+func (mi *MemoryVectorIndex) Search(ctx context.Context, knowledgeBaseID int, query []float32, k int) ([]VectorMatch, error) {
+	base, err := mi.load(ctx, knowledgeBaseID)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]VectorMatch, len(base.chunkIDs))
+	for i, vector := range base.vectors {
+		matches[i] = VectorMatch{ChunkID: base.chunkIDs[i], Score: dotProduct(query, vector)}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches[:min(k, len(matches))], nil
+}
+
+func (mi *MemoryVectorIndex) load(ctx context.Context, knowledgeBaseID int) (*indexedKnowledgeBase, error) {
+	var version int
+	if err := mi.db.QueryRowContext(ctx, "SELECT version FROM knowledge_bases WHERE id = ?", knowledgeBaseID).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	mi.mu.Lock()
+	base, ok := mi.bases[knowledgeBaseID]
+	mi.mu.Unlock()
+	if ok && base.version == version {
+		return base, nil
+	}
+
+	rows, err := mi.db.QueryContext(ctx, "SELECT id, embedding FROM knowledge_chunks WHERE knowledge_base_id = ?", knowledgeBaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	base = &indexedKnowledgeBase{version: version}
+	for rows.Next() {
+		var id int64
+		var embedding []byte
+		if err := rows.Scan(&id, &embedding); err != nil {
+			return nil, err
+		}
+		base.chunkIDs = append(base.chunkIDs, id)
+		base.vectors = append(base.vectors, decodeVector(embedding))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	mi.mu.Lock()
+	mi.bases[knowledgeBaseID] = base
+	mi.mu.Unlock()
+	return base, nil
+}
+
+func (mi *MemoryVectorIndex) Forget(knowledgeBaseID int) {
+	mi.mu.Lock()
+	delete(mi.bases, knowledgeBaseID)
+	mi.mu.Unlock()
+}
+
+// MariaDBVectorIndex searches in the database. Embeddings are stored in the
+// binary layout of MariaDB's VECTOR type, which its distance functions read.
+type MariaDBVectorIndex struct {
+	db *sql.DB
+}
+
+func (mi *MariaDBVectorIndex) Search(ctx context.Context, knowledgeBaseID int, query []float32, k int) ([]VectorMatch, error) {
+	rows, err := mi.db.QueryContext(ctx, `
+		SELECT id, VEC_DISTANCE_COSINE(embedding, ?) AS distance
+		FROM knowledge_chunks
+		WHERE knowledge_base_id = ? AND LENGTH(embedding) = ?
+		ORDER BY distance ASC
+		LIMIT ?
+	`, encodeVector(query), knowledgeBaseID, 4*len(query), k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matches := []VectorMatch{}
+	for rows.Next() {
+		var match VectorMatch
+		var distance float64
+		if err := rows.Scan(&match.ChunkID, &distance); err != nil {
+			return nil, err
+		}
+		match.Score = 1 - distance
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+func (mi *MariaDBVectorIndex) Forget(int) {}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// visionImageTypes are the image types providers accept as input.
+var visionImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+var errImageUnsupported = errors.New("image can't be prepared for the model")
+
+// VisionService turns image attachments into content parts for models that
+// accept images. Downscaled copies are kept in the blob store, so history
+// images aren't resized on every completion.
+type VisionService struct {
+	store        BlobStore
+	maxDimension int
+	maxBytes     int64
+}
+
+func NewVisionService(store BlobStore) *VisionService {
+	return &VisionService{
+		store:        store,
+		maxDimension: int(getEnvInt64("VISION_MAX_DIMENSION", 2048)),
+		maxBytes:     getEnvInt64("VISION_MAX_BYTES", 4<<20),
+	}
+}
+
+func isImageAttachment(attachment Attachment) bool {
+	return slices.Contains(visionImageTypes, attachment.ContentType)
+}
+
+// imageCount counts the image attachments of a message.
+func imageCount(message Message) int {
+	count := 0
+	for _, attachment := range message.Attachments {
+		if isImageAttachment(attachment) {
+			count++
+		}
+	}
+	return count
+}
+
+// messageParts returns the text and images of a message as content parts,
+// or nil when it has no images.
+func (vs *VisionService) messageParts(ctx context.Context, message Message) ([]ContentPart, error) {
+	if imageCount(message) == 0 {
+		return nil, nil
+	}
+
+	parts := []ContentPart{}
+	if message.Content != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: message.Content})
+	}
+	for _, attachment := range message.Attachments {
+		if !isImageAttachment(attachment) {
+			continue
+		}
+		url, err := vs.imageDataURL(ctx, attachment)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURLPart{URL: url}})
+	}
+	return parts, nil
+}
+
+// imageDataURL loads the prepared copy of an image, creating it on first use.
+func (vs *VisionService) imageDataURL(ctx context.Context, attachment Attachment) (string, error) {
+	key := "vision/" + attachment.ID
+
+	data, err := vs.readBlob(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		original, err := vs.readBlob(ctx, attachment.storageKey)
+		if err != nil {
+			return "", err
+		}
+		if data, err = vs.prepareImage(original, attachment.ContentType); err != nil {
+			return "", err
+		}
+		// The copy is only a cache, a failed write just means resizing again
+		if err := vs.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), http.DetectContentType(data)); err != nil {
+			log.Printf("Failed to cache prepared image %s: %v", attachment.ID, err)
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(data)
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (vs *VisionService) readBlob(ctx context.Context, key string) ([]byte, error) {
+	blob, err := vs.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(blob)
+}
+
+// prepareImage downscales images larger than the configured dimensions or
+// size. Images that already fit are sent unchanged.
+func (vs *VisionService) prepareImage(data []byte, contentType string) ([]byte, error) {
+	fits := int64(len(data)) <= vs.maxBytes
+	// WebP can't be decoded without extra dependencies, so it can't be resized
+	if contentType == "image/webp" {
+		if !fits {
+			return nil, errImageUnsupported
+		}
+		return data, nil
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if fits && config.Width <= vs.maxDimension && config.Height <= vs.maxDimension {
+		return data, nil
+	}
+
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	img = fitWithin(img, vs.maxDimension, vs.maxDimension)
+
+	// Keep PNG for screenshots and graphics, photos compress far better as JPEG
+	if format != "jpeg" {
+		if encoded, err := encodePNG(img); err == nil && int64(len(encoded)) <= vs.maxBytes {
+			return encoded, nil
+		}
+	}
+	encoded, err := encodeJPEG(img, 85)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(encoded)) > vs.maxBytes {
+		return nil, errImageUnsupported
+	}
+	return encoded, nil
+}
+
+// imagePlaceholder stands in for images when a model can't see them.
+func imagePlaceholder(message Message) string {
+	var names []string
+	for _, attachment := range message.Attachments {
+		if isImageAttachment(attachment) {
+			names = append(names, attachment.Filename)
+		}
+	}
+	placeholder := "[Image not shown to this model: " + strings.Join(names, ", ") + "]"
+	if message.Content == "" {
+		return placeholder
+	}
+	return message.Content + "\n\n" + placeholder
+}
+
+// requireVisionSupport rejects sending images to a model the catalog
+// describes as text-only. Responds and returns false in that case.
+func requireVisionSupport(c *gin.Context, db *sql.DB, models *ModelCatalog, model, userID string, attachmentIDs []string) bool {
+	if len(attachmentIDs) == 0 {
+		return true
+	}
+	catalogModel, ok := models.Lookup(model)
+	if !ok || catalogModel.SupportsVision {
+		return true
+	}
+
+	args := []interface{}{userID}
+	for _, id := range attachmentIDs {
+		args = append(args, id)
+	}
+	placeholders := make([]string, len(visionImageTypes))
+	for i, contentType := range visionImageTypes {
+		placeholders[i] = "?"
+		args = append(args, contentType)
+	}
+
+	var images int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM attachments WHERE user_id = ? AND message_id IS NULL AND id IN (?`+
+			strings.Repeat(", ?", len(attachmentIDs)-1)+`) AND content_type IN (`+strings.Join(placeholders, ", ")+`)`,
+		args...,
+	).Scan(&images)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachments"})
+		return false
+	}
+	if images > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": model + " does not support images"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxSearchResults     = 10
+	searchSnippetLength  = 500
+	searchRequestTimeout = 20 * time.Second
+)
+
+// SearchResult is a web page found by a search backend.
+type SearchResult struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Snippet     string `json:"snippet"`
+	PublishedAt string `json:"publishedAt,omitempty"`
+}
+
+// SearchBackend runs web searches for the web_search tool.
+type SearchBackend interface {
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+}
+
+// NewSearchBackend picks the backend from WEB_SEARCH_BACKEND: "searxng",
+// "brave", "tavily" or "fake", which answers from a fixtures file. Without
+// a backend nil is returned and the tool isn't offered.
+func NewSearchBackend() (SearchBackend, error) {
+	client := &http.Client{Timeout: searchRequestTimeout}
+
+	switch backend := getEnv("WEB_SEARCH_BACKEND", ""); backend {
+	case "":
+		return nil, nil
+	case "searxng":
+		baseURL := strings.TrimSuffix(getEnv("SEARXNG_URL", ""), "/")
+		if baseURL == "" {
+			return nil, errors.New("SEARXNG_URL is required for the searxng backend")
+		}
+		return &SearxNGBackend{client: client, baseURL: baseURL}, nil
+	case "brave":
+		apiKey := getEnv("BRAVE_SEARCH_API_KEY", "")
+		if apiKey == "" {
+			return nil, errors.New("BRAVE_SEARCH_API_KEY is required for the brave backend")
+		}
+		return &BraveSearchBackend{
+			client:  client,
+			baseURL: strings.TrimSuffix(getEnv("BRAVE_SEARCH_URL", "https://api.search.brave.com/res/v1"), "/"),
+			apiKey:  apiKey,
+		}, nil
+	case "tavily":
+		apiKey := getEnv("TAVILY_API_KEY", "")
+		if apiKey == "" {
+			return nil, errors.New("TAVILY_API_KEY is required for the tavily backend")
+		}
+		return &TavilySearchBackend{
+			client:  client,
+			baseURL: strings.TrimSuffix(getEnv("TAVILY_URL", "https://api.tavily.com"), "/"),
+			apiKey:  apiKey,
+		}, nil
+	case "fake":
+		return NewFakeSearchBackend(getEnv("WEB_SEARCH_FIXTURES", ""))
+	default:
+		return nil, fmt.Errorf("unknown WEB_SEARCH_BACKEND %q", backend)
+	}
+}
+
+// searchJSON sends a search request and decodes the JSON answer.
+func searchJSON(client *http.Client, req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("search backend answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxFetchBytes)).Decode(out)
+}
+
+// plainSnippet drops the highlighting markup some backends put in snippets.
+func plainSnippet(snippet string) string {
+	return truncateRunes(strings.TrimSpace(html.UnescapeString(htmlTags.ReplaceAllString(snippet, ""))), searchSnippetLength)
+}
+
+// SearxNGBackend queries a SearxNG instance, which must have the JSON
+// format enabled.
+type SearxNGBackend struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (b *SearxNGBackend) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	params := url.Values{"q": {query}, "format": {"json"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Results []struct {
+			Title         string `json:"title"`
+			URL           string `json:"url"`
+			Content       string `json:"content"`
+			PublishedDate string `json:"publishedDate"`
+		} `json:"results"`
+	}
+	if err := searchJSON(b.client, req, &response); err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, result := range response.Results {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, SearchResult{
+			Title:       result.Title,
+			URL:         result.URL,
+			Snippet:     plainSnippet(result.Content),
+			PublishedAt: result.PublishedDate,
+		})
+	}
+	return results, nil
+}
+
+// BraveSearchBackend uses the Brave Search API.
+type BraveSearchBackend struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+func (b *BraveSearchBackend) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	params := url.Values{"q": {query}, "count": {strconv.Itoa(limit)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+"/web/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Subscription-Token", b.apiKey)
+
+	var response struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+				Age         string `json:"age"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	if err := searchJSON(b.client, req, &response); err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, result := range response.Web.Results {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, SearchResult{
+			Title:       plainSnippet(result.Title),
+			URL:         result.URL,
+			Snippet:     plainSnippet(result.Description),
+			PublishedAt: result.Age,
+		})
+	}
+	return results, nil
+}
+
+// TavilySearchBackend uses the Tavily search API.
+type TavilySearchBackend struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+func (b *TavilySearchBackend) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "max_results": limit, "search_depth": "basic"})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.baseURL+"/search", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+b.apiKey)
+
+	var response struct {
+		Results []struct {
+			Title         string `json:"title"`
+			URL           string `json:"url"`
+			Content       string `json:"content"`
+			PublishedDate string `json:"published_date"`
+		} `json:"results"`
+	}
+	if err := searchJSON(b.client, req, &response); err != nil {
+		return nil, err
+	}
+
+	results := []SearchResult{}
+	for _, result := range response.Results {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, SearchResult{
+			Title:       result.Title,
+			URL:         result.URL,
+			Snippet:     plainSnippet(result.Content),
+			PublishedAt: result.PublishedDate,
+		})
+	}
+	return results, nil
+}
+
+// FakeSearchBackend answers from fixtures, for development and tests
+// without network access. The fixtures file maps queries to results, with
+// "*" answering every other query.
+type FakeSearchBackend struct {
+	fixtures map[string][]SearchResult
+}
+
+func NewFakeSearchBackend(path string) (*FakeSearchBackend, error) {
+	backend := &FakeSearchBackend{fixtures: map[string][]SearchResult{}}
+	if path == "" {
+		return backend, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read search fixtures: %w", err)
+	}
+	var fixtures map[string][]SearchResult
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("parse search fixtures: %w", err)
+	}
+	for query, results := range fixtures {
+		backend.fixtures[normalizeSearchQuery(query)] = results
+	}
+	return backend, nil
+}
+
+func normalizeSearchQuery(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+func (b *FakeSearchBackend) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	results, ok := b.fixtures[normalizeSearchQuery(query)]
+	if !ok {
+		results = b.fixtures["*"]
+	}
+	return append([]SearchResult{}, results[:min(limit, len(results))]...), nil
+}
+
+// WebSearchTool searches the web and cites every result it returns, so the
+// answer keeps its sources.
+type WebSearchTool struct {
+	backend SearchBackend
+	results int
+}
+
+func NewWebSearchTool(backend SearchBackend) *WebSearchTool {
+	results := int(getEnvInt64("WEB_SEARCH_RESULTS", 5))
+	return &WebSearchTool{backend: backend, results: max(1, min(results, maxSearchResults))}
+}
+
+func (t *WebSearchTool) Definition() ToolDefinition {
+	return ToolDefinition{
+		Name:        "web_search",
+		Description: "Search the web for current information. Returns numbered results with their URLs.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {"type": "string", "description": "The search query"},
+				"count": {"type": "integer", "description": "Number of results, 1 to 10"}
+			},
+			"required": ["query"]
+		}`),
+	}
+}
+
+func (t *WebSearchTool) Call(ctx context.Context, tc *ToolContext, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+		Count int    `json:"count"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+	args.Query = strings.TrimSpace(args.Query)
+	if args.Query == "" {
+		return "", errors.New("query is required")
+	}
+	limit := t.results
+	if args.Count > 0 {
+		limit = min(args.Count, maxSearchResults)
+	}
+
+	results, err := t.backend.Search(ctx, truncateRunes(args.Query, 400), limit)
+	if err != nil {
+		return "", err
+	}
+	if len(results) == 0 {
+		return fmt.Sprintf("No results for %q.", args.Query), nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Results for %q. Cite the results you use with their number in square brackets, like [1].\n", args.Query)
+	for _, result := range results {
+		if result.URL == "" {
+			continue
+		}
+		index := tc.Cite(Citation{Source: CitationWeb, Title: result.Title, URL: result.URL, Snippet: result.Snippet})
+		fmt.Fprintf(&sb, "\n[%d] %s\nURL: %s\n", index, result.Title, result.URL)
+		if result.PublishedAt != "" {
+			fmt.Fprintf(&sb, "Published: %s\n", result.PublishedAt)
+		}
+		if result.Snippet != "" {
+			sb.WriteString(result.Snippet + "\n")
+		}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFakeSearchBackend(t *testing.T) {
+	backend, err := NewFakeSearchBackend("testdata/search_fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		limit     int
+		wantFirst string
+		wantCount int
+	}{
+		{"normalized match", "go generics", 10, "https://go.dev/doc/tutorial/generics", 3},
+		{"limit", "  GO   generics ", 1, "https://go.dev/doc/tutorial/generics", 1},
+		{"fallback", "anything else", 5, "https://go.dev/", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := backend.Search(context.Background(), tt.query, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != tt.wantCount || results[0].URL != tt.wantFirst {
+				t.Errorf("Search = %+v, want %d results starting with %s", results, tt.wantCount, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestFakeSearchBackendWithoutFixtures(t *testing.T) {
+	backend, err := NewFakeSearchBackend("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := backend.Search(context.Background(), "go", 5)
+	if err != nil || len(results) != 0 {
+		t.Errorf("Search = %v, %v, want no results", results, err)
+	}
+	if _, err := NewFakeSearchBackend("testdata/missing.json"); err == nil {
+		t.Error("NewFakeSearchBackend succeeded without the fixtures file")
+	}
+}
+
+func TestWebSearchToolCitations(t *testing.T) {
+	backend, err := NewFakeSearchBackend("testdata/search_fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := NewWebSearchTool(backend)
+
+	// A citation from earlier in the turn keeps its number
+	tc := &ToolContext{}
+	tc.Cite(Citation{Source: "knowledge", Title: "Handbook"})
+
+	output, err := tool.Call(context.Background(), tc, json.RawMessage(`{"query": "Go generics"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"[2] Tutorial: Getting started with generics\nURL: https://go.dev/doc/tutorial/generics\nPublished: 2022-03-15\n",
+		"[3] An Introduction To Generics\nURL: https://go.dev/blog/intro-generics\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("output %q doesn't contain %q", output, want)
+		}
+	}
+	if strings.Contains(output, "No URL") {
+		t.Errorf("output %q lists a result without URL", output)
+	}
+
+	if len(tc.citations) != 3 {
+		t.Fatalf("got %d citations, want 3", len(tc.citations))
+	}
+	citation := tc.citations[1]
+	if citation.Index != 2 || citation.Source != CitationWeb || citation.URL != "https://go.dev/doc/tutorial/generics" || citation.Snippet == "" {
+		t.Errorf("citation = %+v", citation)
+	}
+
+	// Searching again cites the same pages with the same numbers
+	output, err = tool.Call(context.Background(), tc, json.RawMessage(`{"query": "go generics", "count": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "[2] Tutorial") || len(tc.citations) != 3 {
+		t.Errorf("repeated search gave %q with %d citations", output, len(tc.citations))
+	}
+}
+
+func TestWebSearchToolArguments(t *testing.T) {
+	backend, err := NewFakeSearchBackend("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := NewWebSearchTool(backend)
+
+	if _, err := tool.Call(context.Background(), &ToolContext{}, json.RawMessage(`{"query": "  "}`)); err == nil {
+		t.Error("Call succeeded without a query")
+	}
+	output, err := tool.Call(context.Background(), &ToolContext{}, json.RawMessage(`{"query": "nothing"}`))
+	if err != nil || output != `No results for "nothing".` {
+		t.Errorf("Call = %q, %v", output, err)
+	}
+}
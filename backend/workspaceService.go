@@ -0,0 +1,686 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	WorkspaceOwner  = "owner"
+	WorkspaceEditor = "editor"
+	WorkspaceViewer = "viewer"
+
+	invitationDuration = time.Hour * 24 * 14
+)
+
+var workspaceRoleRank = map[string]int{
+	WorkspaceViewer: 1,
+	WorkspaceEditor: 2,
+	WorkspaceOwner:  3,
+}
+
+type WorkspaceService struct {
+	db *sql.DB
+}
+
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy *string   `json:"createdBy"`
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type WorkspaceMember struct {
+	WorkspaceID int       `json:"workspaceId"`
+	UserID      string    `json:"userId"`
+	Email       string    `json:"email"`
+	DisplayName *string   `json:"displayName"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type WorkspaceInvitation struct {
+	ID            int        `json:"id"`
+	WorkspaceID   int        `json:"workspaceId"`
+	WorkspaceName string     `json:"workspaceName,omitempty"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	InvitedBy     *string    `json:"invitedBy"`
+	Token         string     `json:"token,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	AcceptedAt    *time.Time `json:"acceptedAt"`
+}
+
+type CreateInvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+func NewWorkspaceService(db *sql.DB) *WorkspaceService {
+	return &WorkspaceService{db: db}
+}
+
+// workspaceRole returns the user's membership role, or sql.ErrNoRows when
+// the user is not a member.
+func workspaceRole(db *sql.DB, workspaceID int, userID string) (string, error) {
+	var role string
+	err := db.QueryRow(
+		"SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?",
+		workspaceID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// hasWorkspaceRole reports whether role grants at least the permissions of minRole.
+func hasWorkspaceRole(role, minRole string) bool {
+	return workspaceRoleRank[role] >= workspaceRoleRank[minRole]
+}
+
+func isWorkspaceRole(role string) bool {
+	_, ok := workspaceRoleRank[role]
+	return ok
+}
+
+// Create a workspace owned by the current user
+func (ws *WorkspaceService) CreateWorkspace(c *gin.Context) {
+	user := currentUser(c)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	tx, err := ws.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(
+		"INSERT INTO workspaces (name, created_by, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		req.Name, user.ID, now, now,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+		return
+	}
+
+	workspaceID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get workspace ID"})
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		workspaceID, user.ID, WorkspaceOwner, now,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add workspace owner"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, Workspace{
+		ID:        int(workspaceID),
+		Name:      req.Name,
+		CreatedBy: &user.ID,
+		Role:      WorkspaceOwner,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+}
+
+// List the workspaces the current user is a member of
+func (ws *WorkspaceService) GetWorkspaces(c *gin.Context) {
+	rows, err := ws.db.Query(`
+		SELECT w.id, w.name, w.created_by, m.role, w.created_at, w.updated_at
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ?
+		ORDER BY w.name ASC
+	`, currentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspaces"})
+		return
+	}
+	defer rows.Close()
+
+	workspaces := []Workspace{}
+	for rows.Next() {
+		var workspace Workspace
+		err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.CreatedBy, &workspace.Role, &workspace.CreatedAt, &workspace.UpdatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan workspace"})
+			return
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	c.JSON(http.StatusOK, workspaces)
+}
+
+// Get a workspace the current user belongs to
+func (ws *WorkspaceService) GetWorkspace(c *gin.Context) {
+	workspaceID, role, ok := ws.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	workspace := Workspace{ID: workspaceID, Role: role}
+	err := ws.db.QueryRow(
+		"SELECT name, created_by, created_at, updated_at FROM workspaces WHERE id = ?",
+		workspaceID,
+	).Scan(&workspace.Name, &workspace.CreatedBy, &workspace.CreatedAt, &workspace.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, workspace)
+}
+
+// Rename a workspace
+func (ws *WorkspaceService) UpdateWorkspace(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	_, err := ws.db.Exec("UPDATE workspaces SET name = ?, updated_at = ? WHERE id = ?", req.Name, time.Now(), workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace updated successfully"})
+}
+
+// Delete a workspace together with its chats
+func (ws *WorkspaceService) DeleteWorkspace(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	if err := deleteWorkspace(ws.db, workspaceID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace deleted successfully"})
+}
+
+// deleteWorkspace removes a workspace and everything that belongs to it.
+func deleteWorkspace(db *sql.DB, workspaceID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"DELETE m FROM messages m JOIN chats ch ON m.chat_id = ch.id WHERE ch.workspace_id = ?",
+		"DELETE FROM chats WHERE workspace_id = ?",
+		"DELETE FROM workspace_invitations WHERE workspace_id = ?",
+		"DELETE FROM workspace_members WHERE workspace_id = ?",
+		"DELETE FROM model_policies WHERE workspace_id = ?",
+		"DELETE FROM personas WHERE workspace_id = ?",
+		"DELETE FROM prompt_templates WHERE workspace_id = ?",
+		"DELETE FROM knowledge_bases WHERE workspace_id = ?",
+		"DELETE FROM workspaces WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, workspaceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// List the members of a workspace
+func (ws *WorkspaceService) GetMembers(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	rows, err := ws.db.Query(`
+		SELECT m.workspace_id, m.user_id, u.email, u.display_name, m.role, m.created_at
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ?
+		ORDER BY m.created_at ASC
+	`, workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer rows.Close()
+
+	members := []WorkspaceMember{}
+	for rows.Next() {
+		var member WorkspaceMember
+		err := rows.Scan(&member.WorkspaceID, &member.UserID, &member.Email, &member.DisplayName, &member.Role, &member.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan member"})
+			return
+		}
+		members = append(members, member)
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// Change a member's role
+func (ws *WorkspaceService) UpdateMember(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+	memberID := c.Param("userId")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !isWorkspaceRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	current, err := workspaceRole(ws.db, workspaceID, memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch member"})
+		return
+	}
+
+	if current == WorkspaceOwner && req.Role != WorkspaceOwner && !ws.hasOtherOwner(workspaceID, memberID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A workspace needs at least one owner"})
+		return
+	}
+
+	_, err = ws.db.Exec(
+		"UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?",
+		req.Role, workspaceID, memberID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully"})
+}
+
+// Remove a member; any member may remove themselves to leave the workspace
+func (ws *WorkspaceService) RemoveMember(c *gin.Context) {
+	memberID := c.Param("userId")
+	minRole := WorkspaceOwner
+	if memberID == currentUser(c).ID {
+		minRole = WorkspaceViewer
+	}
+
+	workspaceID, _, ok := ws.authorize(c, minRole)
+	if !ok {
+		return
+	}
+
+	current, err := workspaceRole(ws.db, workspaceID, memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch member"})
+		return
+	}
+
+	if current == WorkspaceOwner && !ws.hasOtherOwner(workspaceID, memberID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A workspace needs at least one owner"})
+		return
+	}
+
+	_, err = ws.db.Exec("DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?", workspaceID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+// Invite someone to a workspace by email
+func (ws *WorkspaceService) CreateInvitation(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	var req CreateInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if !strings.Contains(req.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid email is required"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = WorkspaceViewer
+	}
+	if !isWorkspaceRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	var isMember bool
+	err := ws.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM workspace_members m JOIN users u ON u.id = m.user_id
+			WHERE m.workspace_id = ? AND u.email = ?
+		)
+	`, workspaceID, req.Email).Scan(&isMember)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check membership"})
+		return
+	}
+	if isMember {
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+
+	token, err := generateInvitationToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invitation"})
+		return
+	}
+
+	user := currentUser(c)
+	now := time.Now()
+	invitation := WorkspaceInvitation{
+		WorkspaceID: workspaceID,
+		Email:       req.Email,
+		Role:        req.Role,
+		InvitedBy:   &user.ID,
+		Token:       token,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(invitationDuration),
+	}
+
+	result, err := ws.db.Exec(`
+		INSERT INTO workspace_invitations (workspace_id, email, role, token, invited_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, invitation.WorkspaceID, invitation.Email, invitation.Role, invitation.Token, invitation.InvitedBy, invitation.CreatedAt, invitation.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+
+	invitationID, err := result.LastInsertId()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invitation ID"})
+		return
+	}
+	invitation.ID = int(invitationID)
+
+	c.JSON(http.StatusCreated, invitation)
+}
+
+// List open invitations of a workspace
+func (ws *WorkspaceService) GetInvitations(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	invitations, err := ws.queryInvitations(`
+		SELECT i.id, i.workspace_id, w.name, i.email, i.role, i.invited_by, i.token, i.created_at, i.expires_at, i.accepted_at
+		FROM workspace_invitations i
+		JOIN workspaces w ON w.id = i.workspace_id
+		WHERE i.workspace_id = ? AND i.accepted_at IS NULL AND i.expires_at > NOW()
+		ORDER BY i.created_at DESC
+	`, workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// Revoke an open invitation
+func (ws *WorkspaceService) RevokeInvitation(c *gin.Context) {
+	workspaceID, _, ok := ws.authorize(c, WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	invitationID, err := strconv.Atoi(c.Param("invitationId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	result, err := ws.db.Exec(
+		"DELETE FROM workspace_invitations WHERE id = ? AND workspace_id = ? AND accepted_at IS NULL",
+		invitationID, workspaceID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked successfully"})
+}
+
+// List pending invitations addressed to the current user's email
+func (ws *WorkspaceService) GetMyInvitations(c *gin.Context) {
+	invitations, err := ws.queryInvitations(`
+		SELECT i.id, i.workspace_id, w.name, i.email, i.role, i.invited_by, '', i.created_at, i.expires_at, i.accepted_at
+		FROM workspace_invitations i
+		JOIN workspaces w ON w.id = i.workspace_id
+		WHERE i.email = ? AND i.accepted_at IS NULL AND i.expires_at > NOW()
+		ORDER BY i.created_at DESC
+	`, strings.ToLower(currentUser(c).Email))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// Accept an invitation addressed to the current user's email. The invitation
+// can be referenced by its ID or by the token shared with the invitee.
+func (ws *WorkspaceService) AcceptInvitation(c *gin.Context) {
+	user := currentUser(c)
+
+	var invitation WorkspaceInvitation
+	query := `SELECT id, workspace_id, email, role FROM workspace_invitations WHERE accepted_at IS NULL AND expires_at > NOW() AND `
+	ref := c.Param("invitationId")
+	if invitationID, err := strconv.Atoi(ref); err == nil {
+		query += `id = ?`
+		err = ws.db.QueryRow(query, invitationID).Scan(&invitation.ID, &invitation.WorkspaceID, &invitation.Email, &invitation.Role)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitation"})
+			return
+		}
+	} else {
+		query += `token = ?`
+		err = ws.db.QueryRow(query, ref).Scan(&invitation.ID, &invitation.WorkspaceID, &invitation.Email, &invitation.Role)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitation"})
+			return
+		}
+	}
+
+	if invitation.ID == 0 || !strings.EqualFold(invitation.Email, user.Email) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	tx, err := ws.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"INSERT IGNORE INTO workspace_members (workspace_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		invitation.WorkspaceID, user.ID, invitation.Role, now,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join workspace"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE workspace_invitations SET accepted_at = ? WHERE id = ?", now, invitation.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"workspaceId": invitation.WorkspaceID, "role": invitation.Role})
+}
+
+// Decline an invitation addressed to the current user's email
+func (ws *WorkspaceService) DeclineInvitation(c *gin.Context) {
+	invitationID, err := strconv.Atoi(c.Param("invitationId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+
+	result, err := ws.db.Exec(
+		"DELETE FROM workspace_invitations WHERE id = ? AND email = ? AND accepted_at IS NULL",
+		invitationID, strings.ToLower(currentUser(c).Email),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decline invitation"})
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation declined"})
+}
+
+// authorize parses the :id workspace parameter and checks the current user's
+// role. Responds and returns false when access is denied.
+func (ws *WorkspaceService) authorize(c *gin.Context, minRole string) (int, string, bool) {
+	workspaceID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+		return 0, "", false
+	}
+
+	role, err := workspaceRole(ws.db, workspaceID, currentUser(c).ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return 0, "", false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace membership"})
+		return 0, "", false
+	}
+	if !hasWorkspaceRole(role, minRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient workspace permissions"})
+		return 0, "", false
+	}
+
+	return workspaceID, role, true
+}
+
+func (ws *WorkspaceService) hasOtherOwner(workspaceID int, userID string) bool {
+	var count int
+	ws.db.QueryRow(
+		"SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND role = ? AND user_id <> ?",
+		workspaceID, WorkspaceOwner, userID,
+	).Scan(&count)
+	return count > 0
+}
+
+func (ws *WorkspaceService) queryInvitations(query string, args ...interface{}) ([]WorkspaceInvitation, error) {
+	rows, err := ws.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []WorkspaceInvitation{}
+	for rows.Next() {
+		var invitation WorkspaceInvitation
+		err := rows.Scan(
+			&invitation.ID, &invitation.WorkspaceID, &invitation.WorkspaceName, &invitation.Email, &invitation.Role,
+			&invitation.InvitedBy, &invitation.Token, &invitation.CreatedAt, &invitation.ExpiresAt, &invitation.AcceptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+func generateInvitationToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
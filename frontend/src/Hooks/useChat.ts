@@ -117,53 +117,6 @@ export const useChat = () => {
         return chatId
     }, [loadChats, user])
 
-    // Generate title using Mistral API
-    const generateTitle = useCallback(async (userMessage: string, apiKey: string): Promise<string> => {
-        try {
-            const response = await fetch('https://openrouter.ai/api/v1/chat/completions', {
-                method: 'POST',
-                headers: {
-                    'Authorization': `Bearer ${apiKey}`,
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({
-                    model: 'mistralai/mistral-7b-instruct:free',
-                    messages: [
-                        {
-                            role: 'system',
-                            content: 'Generate a short, descriptive title (max 6 words) for a conversation that starts with the following user message. Only return the title, nothing else.'
-                        },
-                        {
-                            role: 'user',
-                            content: userMessage
-                        }
-                    ],
-                    max_tokens: 20,
-                    temperature: 0.7
-                })
-            })
-
-            if (!response.ok) {
-                throw new Error(`HTTP error! status: ${response.status}`)
-            }
-
-            const data = await response.json()
-            const title = data.choices?.[0]?.message?.content?.trim()
-            
-            // Clean up the title and ensure it's reasonable
-            if (title && title.length > 0 && title.length <= 50) {
-                return title.replace(/["']/g, '').trim()
-            }
-            
-            // Fallback to first few words of user message
-            return userMessage.split(' ').slice(0, 4).join(' ') + (userMessage.split(' ').length > 4 ? '...' : '')
-        } catch (error) {
-            console.error('Error generating title:', error)
-            // Fallback to first few words of user message
-            return userMessage.split(' ').slice(0, 4).join(' ') + (userMessage.split(' ').length > 4 ? '...' : '')
-        }
-    }, [])
-
     // Sync local data to backend
     const syncToBackend = useCallback(async (chatId: number) => {
         if (!user) return
@@ -220,14 +173,6 @@ export const useChat = () => {
     const sendMessage = useCallback(async (content: string, apiKey: string, model: string) => {
         if (!currentChatId || isStreaming) return
     
-        // Check if this is the first message in the chat
-        const existingMessages = await db.messages
-            .where('chatId')
-            .equals(currentChatId)
-            .count()
-        
-        const isFirstMessage = existingMessages === 0
-    
         const userMessage: Message = {
             chatId: currentChatId,
             content,
@@ -240,19 +185,7 @@ export const useChat = () => {
         const userMessageWithId = { ...userMessage, id: userMessageId }
         setMessages(prev => [...prev, userMessageWithId])
     
-        // Generate title if this is the first message
-        if (isFirstMessage) {
-            try {
-                const newTitle = await generateTitle(content, apiKey)
-                await db.chats.update(currentChatId, { 
-                    title: newTitle,
-                    updatedAt: new Date()
-                })
-                await loadChats() // Refresh chats to show new title
-            } catch (error) {
-                console.error('Error updating title:', error)
-            }
-        }
+        // The backend titles the chat after its first completion
     
         // Create assistant message placeholder
         const assistantMessage: Message = {
@@ -369,7 +302,7 @@ export const useChat = () => {
                 setIsStreaming(false)
             }
         })
-    }, [currentChatId, isStreaming, streamingService, loadChats, generateTitle, syncToBackend])
+    }, [currentChatId, isStreaming, streamingService, loadChats, syncToBackend])
 
     // Select chat
     const selectChat = useCallback(async (chatId: number) => {